@@ -0,0 +1,90 @@
+// Команда rotate-key перешифровывает хранилище сервера новым мастер-ключом.
+// Запускается при остановленном сервере:
+//
+//	MASTER_KEY_FILE=old.key rotate-key -new-key-file new.key [-generate]
+//
+// Текущий ключ берется из MASTER_KEY_FILE или MASTER_KEY; без них данные
+// считаются незашифрованными и шифруются впервые. После ротации журнал
+// сжимается в снимок, чтобы на диске не осталось записей под старым ключом.
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+
+	"secure-messenger/internal/server"
+)
+
+func main() {
+	dataDir := flag.String("data", getDataDir(), "каталог данных сервера")
+	newKeyFile := flag.String("new-key-file", "", "файл нового мастер-ключа (base64)")
+	generate := flag.Bool("generate", false, "создать новый ключ и записать его в -new-key-file")
+	flag.Parse()
+
+	if *newKeyFile == "" {
+		log.Fatal("❌ Не указан -new-key-file")
+	}
+	if *generate {
+		if err := writeNewKey(*newKeyFile); err != nil {
+			log.Fatal("❌ Ошибка создания ключа:", err)
+		}
+		log.Printf("🔑 Новый мастер-ключ записан в %s", *newKeyFile)
+	}
+
+	oldKey, err := server.MasterKeyFromEnv()
+	if err != nil {
+		log.Fatal("❌ Ошибка загрузки текущего ключа:", err)
+	}
+	newKey, err := server.LoadMasterKey(*newKeyFile)
+	if err != nil {
+		log.Fatal("❌ Ошибка загрузки нового ключа:", err)
+	}
+	if oldKey != nil && oldKey.ID() == newKey.ID() {
+		log.Fatal("❌ Новый ключ совпадает с текущим")
+	}
+
+	store, err := server.OpenFileStore(*dataDir)
+	if err != nil {
+		log.Fatal("❌ Ошибка открытия хранилища:", err)
+	}
+	defer store.Close()
+
+	n, err := server.RotateMasterKey(store, oldKey, newKey)
+	if err != nil {
+		log.Fatalf("❌ Ошибка ротации после %d записей: %v", n, err)
+	}
+	if err := store.Compact(); err != nil {
+		log.Fatal("❌ Ошибка сжатия журнала:", err)
+	}
+	log.Printf("✅ Перешифровано записей: %d, мастер-ключ %s", n, newKey.ID())
+}
+
+// writeNewKey создает файл со случайным мастер-ключом; существующий файл
+// не перезаписывается, чтобы случайно не потерять ключ
+func writeNewKey(path string) error {
+	key, err := server.GenerateMasterKey()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return errors.New("файл ключа уже существует")
+		}
+		return err
+	}
+	if _, err := f.WriteString(key + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func getDataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "./data"
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
+	"secure-messenger/internal/common"
 	"secure-messenger/internal/server"
 )
 
@@ -15,13 +20,65 @@ var userManager *server.UserManager
 var wsServer *server.WebSocketServer
 
 func main() {
-	// Инициализация менеджера пользователей и WebSocket сервера
-	userManager = server.NewUserManager()
+	// Инициализация хранилища, менеджера пользователей и WebSocket сервера
+	store, err := openStore()
+	if err != nil {
+		log.Fatal("❌ Ошибка открытия хранилища:", err)
+	}
+	userManager, err = server.NewUserManagerWithStore(store)
+	if err != nil {
+		log.Fatal("❌ Ошибка загрузки данных:", err)
+	}
 	wsServer = server.NewWebSocketServer(userManager)
+	if err := wsServer.SetHeartbeat(getDuration("WS_PING_INTERVAL", server.DefaultPingInterval),
+		getDuration("WS_PONG_WAIT", server.DefaultPongWait)); err != nil {
+		log.Fatal("❌ Неверные параметры heartbeat:", err)
+	}
+	if err := userManager.SetEditWindow(getDuration("EDIT_WINDOW", server.DefaultEditWindow)); err != nil {
+		log.Fatal("❌ Неверное окно редактирования:", err)
+	}
+	reapInterval := getDuration("EXPIRY_REAP_INTERVAL", server.DefaultReapInterval)
+	if reapInterval <= 0 {
+		log.Fatal("❌ Неверный интервал удаления исчезающих сообщений")
+	}
+
+	// Вложения: содержимое на диске, ограничения из MAX_ATTACHMENT_SIZE
+	// и ATTACHMENT_QUOTA (байты)
+	blobs, err := openBlobStore()
+	if err != nil {
+		log.Fatal("❌ Ошибка открытия хранилища вложений:", err)
+	}
+	userManager.SetBlobStore(blobs)
+	if err := userManager.SetAttachmentLimits(getBytes("MAX_ATTACHMENT_SIZE", server.DefaultMaxAttachmentSize),
+		getBytes("ATTACHMENT_QUOTA", server.DefaultAttachmentQuota)); err != nil {
+		log.Fatal("❌ Неверные ограничения вложений:", err)
+	}
+
+	// Резервные копии ключей: не более BACKUP_FETCH_LIMIT скачиваний
+	// за BACKUP_FETCH_WINDOW
+	if err := userManager.SetBackupFetchLimit(getInt("BACKUP_FETCH_LIMIT", server.DefaultBackupFetchLimit),
+		getDuration("BACKUP_FETCH_WINDOW", server.DefaultBackupFetchWindow)); err != nil {
+		log.Fatal("❌ Неверный лимит скачивания резервных копий:", err)
+	}
+	// Наборы предключей: не более PREKEY_FETCH_LIMIT наборов одного
+	// пользователя одному запрашивающему за PREKEY_FETCH_WINDOW
+	if err := userManager.SetPrekeyFetchLimit(getInt("PREKEY_FETCH_LIMIT", server.DefaultPrekeyFetchLimit),
+		getDuration("PREKEY_FETCH_WINDOW", server.DefaultPrekeyFetchWindow)); err != nil {
+		log.Fatal("❌ Неверный лимит выдачи предключей:", err)
+	}
+
+	// Параметры Argon2id для хэширования паролей
+	hasher, err := common.NewPasswordHasher(getPasswordParams())
+	if err != nil {
+		log.Fatal("❌ Неверные параметры хэширования паролей:", err)
+	}
+	userManager.SetPasswordHasher(hasher)
 
-	// Создаем демо-пользователя
-	userManager.RegisterUser("demo", "demo123")
-	userManager.RegisterUser("test", "test123")
+	// Создаем демо-пользователей только в пустом хранилище
+	if len(userManager.GetAllUsers()) == 0 {
+		userManager.RegisterUser("demo", "demo123")
+		userManager.RegisterUser("test", "test123")
+	}
 
 	// Настройка обработки статических файлов
 	fs := http.FileServer(http.Dir("./web/static"))
@@ -39,15 +96,28 @@ func main() {
 	http.HandleFunc("/api/login", handleLoginAPI)
 	http.HandleFunc("/api/validate", handleValidateSession)
 	http.HandleFunc("/api/users", handleGetUsers)
+	http.HandleFunc("/api/rooms", handleGetRooms)
+	http.HandleFunc("/api/settings", handleSettings)
+	http.HandleFunc("/api/prekeys", handlePrekeys)
+	http.HandleFunc("/api/prekeys/bundle", handlePrekeyBundle)
+	http.HandleFunc("/api/key-backup", handleKeyBackup)
+	http.HandleFunc("/api/key-backup/download", handleKeyBackupDownload)
 
 	// WebSocket эндпоинт
 	http.HandleFunc("/ws", wsServer.HandleWebSocket)
 
 	// API для истории сообщений
 	http.HandleFunc("/api/history", handleHistory)
+	http.HandleFunc("/api/thread", handleThread)
+	http.HandleFunc("/api/mentions", handleMentions)
 
-	// Запускаем периодическую очистку сессий
+	// Вложения: загрузка частями и скачивание
+	http.HandleFunc("/api/uploads", handleUploads)
+	http.HandleFunc("/api/attachments", handleAttachments)
+
+	// Запускаем периодическую очистку сессий и исчезающих сообщений
 	go cleanupSessions()
+	go reapExpiredMessages(reapInterval)
 
 	// Настройка порта и хоста для Render
 	port := getPort()
@@ -58,7 +128,7 @@ func main() {
 	log.Printf("🔗 WebSocket: ws://%s:%s/ws", getPublicHost(), port)
 
 	// Запуск сервера
-	err := http.ListenAndServe(fmt.Sprintf("%s:%s", host, port), nil)
+	err = http.ListenAndServe(fmt.Sprintf("%s:%s", host, port), nil)
 	if err != nil {
 		log.Fatal("❌ Ошибка запуска сервера:", err)
 	}
@@ -90,16 +160,115 @@ func getPublicHost() string {
 	return "localhost"
 }
 
+// openStore открывает хранилище на диске в DATA_DIR (по умолчанию ./data).
+// STORAGE=memory отключает сохранение данных между перезапусками. Если задан
+// мастер-ключ (MASTER_KEY_FILE или MASTER_KEY), записи шифруются на диске.
+func openStore() (server.Store, error) {
+	if os.Getenv("STORAGE") == "memory" {
+		return server.NewMemoryStore(), nil
+	}
+
+	masterKey, err := server.MasterKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	store, err := server.OpenFileStore(getDataDir())
+	if err != nil {
+		return nil, err
+	}
+	if masterKey == nil {
+		log.Println("⚠️  Мастер-ключ не задан, данные хранятся без шифрования")
+		return store, nil
+	}
+	log.Printf("🔐 Шифрование данных на диске, мастер-ключ %s", masterKey.ID())
+	return server.NewEncryptedStore(store, masterKey), nil
+}
+
+// openBlobStore открывает хранилище вложений в DATA_DIR/blobs; при
+// STORAGE=memory вложения живут во временном каталоге до перезапуска
+func openBlobStore() (*server.BlobStore, error) {
+	if os.Getenv("STORAGE") == "memory" {
+		dir, err := os.MkdirTemp("", "secure-messenger-blobs")
+		if err != nil {
+			return nil, err
+		}
+		return server.OpenBlobStore(dir)
+	}
+	return server.OpenBlobStore(filepath.Join(getDataDir(), "blobs"))
+}
+
+func getDataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "./data"
+}
+
+// getPasswordParams читает параметры Argon2id из окружения:
+// ARGON2_TIME, ARGON2_MEMORY (КиБ) и ARGON2_THREADS
+func getPasswordParams() common.PasswordParams {
+	params := common.DefaultPasswordParams
+
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_TIME"), 10, 32); err == nil {
+		params.Time = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY"), 10, 32); err == nil {
+		params.Memory = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_THREADS"), 10, 8); err == nil {
+		params.Threads = uint8(v)
+	}
+	return params
+}
+
+// getDuration читает длительность из окружения (например, "30s")
+func getDuration(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return d
+	}
+	return fallback
+}
+
+// getBytes читает размер в байтах из переменной окружения
+func getBytes(name string, fallback int64) int64 {
+	if v, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// getInt читает целое число из переменной окружения
+func getInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return fallback
+}
+
 func cleanupSessions() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		userManager.CleanupSessions()
+		userManager.CleanupUploads()
+		userManager.CleanupFetchLimits()
 		log.Println("🧹 Выполнена очистка просроченных сессий")
 	}
 }
 
+// reapExpiredMessages удаляет истекшие исчезающие сообщения с интервалом interval
+func reapExpiredMessages(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if n := wsServer.ReapExpiredMessages(); n > 0 {
+			log.Printf("⏳ Удалено исчезающих сообщений: %d", n)
+		}
+	}
+}
+
 func serveIndex(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
@@ -119,7 +288,7 @@ func serveRegister(w http.ResponseWriter, r *http.Request) {
 func serveChat(w http.ResponseWriter, r *http.Request) {
 	// Проверка сессии через куки или заголовок
 	sessionToken := getSessionToken(r)
-	username, valid := userManager.ValidateSession(sessionToken)
+	_, valid := userManager.ValidateSession(sessionToken)
 
 	if !valid {
 		// Редирект на страницу входа
@@ -128,7 +297,7 @@ func serveChat(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Обновляем время сессии
-	userManager.UpdateSession(username)
+	userManager.UpdateSession(sessionToken)
 
 	// Устанавливаем куку с токеном
 	setSessionCookie(w, sessionToken)
@@ -173,6 +342,7 @@ func handleRegisterAPI(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	wsServer.NotifySenderKeyRotation("")
 
 	// Создание сессии
 	sessionToken := userManager.CreateSession(req.Username)
@@ -243,7 +413,7 @@ func handleValidateSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if valid {
-		userManager.UpdateSession(username)
+		userManager.UpdateSession(sessionToken)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -262,6 +432,365 @@ func handleGetUsers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
+func handleGetRooms(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	rooms := userManager.GetRooms(username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// handleSettings GET возвращает настройки приватности, POST сохраняет их
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var settings common.PrivacySettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Неверный формат запроса", http.StatusBadRequest)
+			return
+		}
+		if err := userManager.SetPrivacySettings(username, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := userManager.GetPrivacySettings(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// handleMentions GET возвращает страницу входящих упоминаний
+// (?before=<ID>&limit=N), POST отмечает упоминания прочитанными:
+// {"ids": [...]}, пустой список - все
+func handleMentions(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			IDs []string `json:"ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Неверный формат запроса", http.StatusBadRequest)
+			return
+		}
+		userManager.MarkMentionsRead(username, req.IDs)
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	limit := 0
+	if value := params.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Неверный параметр limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := userManager.Mentions(username, params.Get("before"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleUploads управляет загрузкой вложения частями:
+// POST начинает загрузку (common.UploadRequest), GET ?id= возвращает
+// принятый объем для продолжения, PUT ?id=&offset= дописывает часть,
+// DELETE ?id= отменяет загрузку
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	var (
+		status common.UploadStatus
+		err    error
+	)
+	switch r.Method {
+	case "POST":
+		var req common.UploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Неверный формат запроса", http.StatusBadRequest)
+			return
+		}
+		status, err = userManager.StartUpload(username, req)
+	case "GET":
+		status, err = userManager.UploadStatus(username, id)
+	case "PUT":
+		offset, parseErr := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if parseErr != nil {
+			http.Error(w, "Неверный параметр offset", http.StatusBadRequest)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, server.MaxUploadChunkSize)
+		status, err = userManager.WriteUpload(username, id, offset, body)
+	case "DELETE":
+		if err := userManager.CancelUpload(username, id); err != nil {
+			http.Error(w, err.Error(), attachmentErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		// Вместе с ошибкой клиент получает смещение для продолжения
+		w.WriteHeader(attachmentErrorStatus(err))
+		json.NewEncoder(w).Encode(struct {
+			common.UploadStatus
+			Error string `json:"error"`
+		}{status, err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleAttachments GET ?id= отдает зашифрованное содержимое вложения
+// участникам диалога, DELETE ?id= удаляет вложение владельца
+func handleAttachments(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	switch r.Method {
+	case "GET":
+		attachment, f, err := userManager.OpenAttachment(username, id)
+		if err != nil {
+			http.Error(w, err.Error(), attachmentErrorStatus(err))
+			return
+		}
+		defer f.Close()
+
+		// Содержимое зашифровано, настоящий тип известен только клиенту
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("ETag", `"`+attachment.Hash+`"`)
+		http.ServeContent(w, r, "", time.Time{}, f)
+	case "DELETE":
+		if err := userManager.DeleteAttachment(username, id); err != nil {
+			http.Error(w, err.Error(), attachmentErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+	}
+}
+
+func attachmentErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, server.ErrAttachmentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, server.ErrQuotaExceeded), errors.Is(err, server.ErrAttachmentTooLarge),
+		errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, server.ErrUploadOffset), errors.Is(err, server.ErrUploadBusy):
+		return http.StatusConflict
+	case errors.Is(err, server.ErrAttachmentsDisabled):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// handlePrekeys GET возвращает размер собственного пула предключей и признак
+// публикации, POST публикует ключи
+func handlePrekeys(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	var count int
+	published := true
+	switch r.Method {
+	case "GET":
+		count, published = userManager.PrekeyCount(username)
+	case "POST":
+		var upload common.PrekeyUpload
+		if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+			http.Error(w, "Неверный формат запроса", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if count, err = wsServer.PublishPrekeys(username, upload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := map[string]interface{}{
+		"count":          count,
+		"published":      published,
+		"low_water_mark": server.PrekeyLowWaterMark,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleKeyBackup GET возвращает версии резервной копии ключей без
+// шифротекста, POST сохраняет новую версию (common.KeyBackup)
+func handleKeyBackup(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(userManager.KeyBackupVersions(username))
+	case "POST":
+		// base64 увеличивает размер на треть, плюс поля KDF
+		r.Body = http.MaxBytesReader(w, r.Body, server.MaxKeyBackupSize*4/3+4096)
+		var backup common.KeyBackup
+		if err := json.NewDecoder(r.Body).Decode(&backup); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Слишком большая резервная копия", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Неверный формат запроса", http.StatusBadRequest)
+			return
+		}
+		stored, err := userManager.StoreKeyBackup(username, backup)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(stored)
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleKeyBackupDownload GET ?version=N возвращает резервную копию
+// с шифротекстом, без version - последнюю. Скачивания ограничены.
+func handleKeyBackupDownload(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Неверный параметр version", http.StatusBadRequest)
+			return
+		}
+		version = n
+	}
+
+	backup, err := userManager.FetchKeyBackup(username, version)
+	if err != nil {
+		var limited *server.BackupRateLimitError
+		switch {
+		case errors.As(err, &limited):
+			w.Header().Set("Retry-After", strconv.Itoa(int(limited.RetryAfter.Seconds())+1))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		case errors.Is(err, server.ErrBackupNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(backup)
+}
+
+func handlePrekeyBundle(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	requester, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	bundle, err := wsServer.FetchPrekeyBundle(requester, r.URL.Query().Get("username"))
+	if err != nil {
+		var limited *server.PrekeyRateLimitError
+		if errors.As(err, &limited) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(limited.RetryAfter.Seconds())+1))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bundle)
+}
+
 func handleHistory(w http.ResponseWriter, r *http.Request) {
 	sessionToken := getSessionToken(r)
 	username, valid := userManager.ValidateSession(sessionToken)
@@ -270,15 +799,80 @@ func handleHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	history := userManager.GetUserHistory(username)
+	query, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := userManager.QueryHistory(username, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleThread возвращает страницу ответов ветки: /api/thread?id=<корень>
+// с теми же параметрами листания, что и /api/history
+func handleThread(w http.ResponseWriter, r *http.Request) {
+	sessionToken := getSessionToken(r)
+	username, valid := userManager.ValidateSession(sessionToken)
+	if !valid {
+		http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	query, err := parseHistoryQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := userManager.QueryThread(username, params.Get("id"), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(history)
+	json.NewEncoder(w).Encode(page)
+}
+
+func parseHistoryQuery(params url.Values) (common.HistoryQuery, error) {
+	query := common.HistoryQuery{
+		Peer:   params.Get("peer"),
+		Room:   params.Get("room"),
+		Before: params.Get("before"),
+		After:  params.Get("after"),
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return query, errors.New("Неверный параметр limit")
+		}
+		query.Limit = limit
+	}
+	for name, target := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, errors.New("Неверный параметр " + name)
+			}
+			*target = t
+		}
+	}
+	return query, nil
 }
 
 func handleLogout(w http.ResponseWriter, r *http.Request) {
 	sessionToken := getSessionToken(r)
 	if sessionToken != "" {
 		userManager.Logout(sessionToken)
+		wsServer.DisconnectSession(sessionToken)
 	}
 
 	// Удаляем куку
@@ -6,8 +6,10 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"io"
-	"strings"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 // GenerateSessionToken генерирует безопасный токен сессии
@@ -19,7 +21,10 @@ func GenerateSessionToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(tokenBytes), nil
 }
 
-// HashPassword создает хэш пароля с солью
+// HashPassword создает хэш пароля с солью (один раунд SHA-256).
+//
+// Deprecated: оставлена только для проверки устаревших хэшей,
+// новые пароли хэшируются PasswordHasher (Argon2id).
 func HashPassword(password, salt string) string {
 	hash := sha256.New()
 	hash.Write([]byte(password))
@@ -36,32 +41,63 @@ func GenerateSalt() (string, error) {
 	return base64.StdEncoding.EncodeToString(saltBytes), nil
 }
 
-// EncryptMessage шифрует сообщение
-func EncryptMessage(text, key string) (string, string, error) {
-	// Создаем ключ из хэша
-	keyHash := sha256.Sum256([]byte(key))
-	aesKey := keyHash[:]
+// DeriveKey выводит 32-байтный ключ из секрета через HKDF-SHA256. Разные
+// info дают независимые ключи из одного секрета. Секрет должен быть
+// случайным: для паролей нужен PasswordHasher.
+func DeriveKey(secret []byte, info string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
 
-	// Создаем AES cipher
-	block, err := aes.NewCipher(aesKey)
+// SealAESGCM шифрует данные AES-256-GCM со случайным nonce
+func SealAESGCM(key, plaintext, associatedData []byte) (nonce, ciphertext []byte, err error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		return "", "", err
+		return nil, nil, err
 	}
 
-	// Создаем GCM
-	gcm, err := cipher.NewGCM(block)
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, associatedData), nil
+}
+
+// OpenAESGCM расшифровывает и проверяет данные, зашифрованные SealAESGCM
+func OpenAESGCM(key, nonce, ciphertext, associatedData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("недопустимый nonce")
 	}
+	return gcm.Open(nil, nonce, ciphertext, associatedData)
+}
 
-	// Генерируем nonce
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", "", err
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptMessage шифрует сообщение.
+//
+// Deprecated: нет версии формата, ID ключа и associated data; используйте
+// пакет envelope.
+func EncryptMessage(text, key string) (string, string, error) {
+	// Создаем ключ из хэша
+	keyHash := sha256.Sum256([]byte(key))
 
-	// Шифруем сообщение
-	ciphertext := gcm.Seal(nil, nonce, []byte(text), nil)
+	nonce, ciphertext, err := SealAESGCM(keyHash[:], []byte(text), nil)
+	if err != nil {
+		return "", "", err
+	}
 
 	// Кодируем в base64
 	encryptedText := base64.StdEncoding.EncodeToString(ciphertext)
@@ -70,11 +106,12 @@ func EncryptMessage(text, key string) (string, string, error) {
 	return encryptedText, nonceStr, nil
 }
 
-// DecryptMessage расшифровывает сообщение
+// DecryptMessage расшифровывает сообщение, зашифрованное EncryptMessage.
+//
+// Deprecated: используйте пакет envelope.
 func DecryptMessage(encryptedText, nonceStr, key string) (string, error) {
 	// Создаем ключ из хэша
 	keyHash := sha256.Sum256([]byte(key))
-	aesKey := keyHash[:]
 
 	// Декодируем из base64
 	ciphertext, err := base64.StdEncoding.DecodeString(encryptedText)
@@ -87,20 +124,7 @@ func DecryptMessage(encryptedText, nonceStr, key string) (string, error) {
 		return "", err
 	}
 
-	// Создаем AES cipher
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return "", err
-	}
-
-	// Создаем GCM
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-
-	// Расшифровываем сообщение
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := OpenAESGCM(keyHash[:], nonce, ciphertext, nil)
 	if err != nil {
 		return "", err
 	}
@@ -108,48 +132,6 @@ func DecryptMessage(encryptedText, nonceStr, key string) (string, error) {
 	return string(plaintext), nil
 }
 
-// SimpleEncrypt простая функция шифрования для демонстрации
-func SimpleEncrypt(text, recipient string) (encrypted, iv, tag string) {
-	// Кодируем сообщение в base64
-	encoded := base64.StdEncoding.EncodeToString([]byte(text))
-
-	// Генерируем IV
-	ivBytes := make([]byte, 12)
-	rand.Read(ivBytes)
-
-	// Форматируем результат
-	encrypted = "🔐 " + encoded + " [для: " + recipient + "]"
-	iv = base64.StdEncoding.EncodeToString(ivBytes)
-	tag = "demo_tag_" + recipient
-
-	return encrypted, iv, tag
-}
-
-// SimpleDecrypt простая функция расшифрования для демонстрации
-func SimpleDecrypt(encrypted, iv, tag, recipient string) (string, error) {
-	// Проверяем, зашифровано ли сообщение
-	if !strings.HasPrefix(encrypted, "🔐 ") {
-		return encrypted, nil
-	}
-
-	// Извлекаем закодированный текст
-	content := strings.TrimPrefix(encrypted, "🔐 ")
-	parts := strings.Split(content, " [для: ")
-	if len(parts) < 2 {
-		return content, nil
-	}
-
-	encodedText := parts[0]
-
-	// Декодируем из base64
-	decoded, err := base64.StdEncoding.DecodeString(encodedText)
-	if err != nil {
-		return encodedText, nil
-	}
-
-	return string(decoded), nil
-}
-
 // GenerateMessageID генерирует уникальный ID для сообщения
 func GenerateMessageID() (string, error) {
 	idBytes := make([]byte, 16)
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Параметры сквозного шифрования. Те же значения используются в web/static/chat.js,
+// поэтому любое изменение должно быть синхронизировано с браузерной реализацией.
+const (
+	E2EKeySize   = 32
+	E2ENonceSize = 12
+	E2ETagSize   = 16
+	e2eInfo      = "secure-messenger/e2e/v1"
+)
+
+var (
+	ErrInvalidPublicKey = errors.New("недопустимый публичный ключ")
+	ErrDecryptFailed    = errors.New("не удалось расшифровать сообщение")
+)
+
+// GenerateE2EKeyPair генерирует пару ключей X25519
+func GenerateE2EKeyPair() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodePublicKey кодирует публичный ключ X25519 в base64 для UserInfo.PublicKey
+func EncodePublicKey(pub *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub.Bytes())
+}
+
+// ParsePublicKey разбирает публичный ключ X25519 из base64
+func ParsePublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != 32 {
+		return nil, ErrInvalidPublicKey
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	return pub, nil
+}
+
+// DeriveConversationKey вычисляет ключ диалога двух пользователей:
+// HKDF-SHA256 от общего секрета X25519 с пустой солью и info,
+// привязанным к отсортированной паре имен.
+func DeriveConversationKey(priv *ecdh.PrivateKey, peer *ecdh.PublicKey, user1, user2 string) ([]byte, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	key := make([]byte, E2EKeySize)
+	r := hkdf.New(sha256.New, shared, nil, []byte(conversationInfo(user1, user2)))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// E2EEncrypt шифрует текст ключом диалога с помощью AES-256-GCM.
+// Возвращает шифротекст, IV и тег аутентификации в base64,
+// готовые для полей Message.Content, Message.IV и Message.AuthTag.
+func E2EEncrypt(key []byte, plaintext, sender, recipient string) (content, iv, tag string, err error) {
+	nonce := make([]byte, E2ENonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", "", err
+	}
+	return e2eSeal(key, nonce, plaintext, sender, recipient)
+}
+
+// e2eSeal шифрует с заданным nonce; E2EEncrypt передает случайный
+func e2eSeal(key, nonce []byte, plaintext, sender, recipient string) (content, iv, tag string, err error) {
+	gcm, err := newE2EGCM(key)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	sealed := gcm.Seal(nil, nonce, []byte(plaintext), e2eAdditionalData(sender, recipient))
+	ciphertext, authTag := sealed[:len(sealed)-E2ETagSize], sealed[len(sealed)-E2ETagSize:]
+
+	return base64.StdEncoding.EncodeToString(ciphertext),
+		base64.StdEncoding.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(authTag),
+		nil
+}
+
+// E2EDecrypt расшифровывает сообщение, зашифрованное E2EEncrypt или браузерным клиентом
+func E2EDecrypt(key []byte, content, iv, tag, sender, recipient string) (string, error) {
+	gcm, err := newE2EGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return "", ErrDecryptFailed
+	}
+	nonce, err := base64.StdEncoding.DecodeString(iv)
+	if err != nil || len(nonce) != E2ENonceSize {
+		return "", ErrDecryptFailed
+	}
+	authTag, err := base64.StdEncoding.DecodeString(tag)
+	if err != nil || len(authTag) != E2ETagSize {
+		return "", ErrDecryptFailed
+	}
+
+	sealed := append(ciphertext, authTag...)
+	plaintext, err := gcm.Open(nil, nonce, sealed, e2eAdditionalData(sender, recipient))
+	if err != nil {
+		return "", ErrDecryptFailed
+	}
+	return string(plaintext), nil
+}
+
+func newE2EGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != E2EKeySize {
+		return nil, errors.New("неверная длина ключа")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func conversationInfo(user1, user2 string) string {
+	if user2 < user1 {
+		user1, user2 = user2, user1
+	}
+	return e2eInfo + "|" + user1 + "|" + user2
+}
+
+// e2eAdditionalData связывает шифротекст с направлением сообщения,
+// чтобы сервер не мог выдать сообщение A->B за сообщение B->A
+func e2eAdditionalData(sender, recipient string) []byte {
+	return []byte(sender + "->" + recipient)
+}
@@ -0,0 +1,133 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Фиксированные векторы сквозного шифрования. web/static/chat.js
+// (getConversationKey, encryptMessage с IV c0..cb) выдает те же значения;
+// общий секрет и ключ HKDF сверены также с Node.js crypto.
+var e2eVector = struct {
+	alicePrivate, bobPrivate []byte
+	alicePublic, bobPublic   string
+	shared, key              string
+	info                     string
+	nonce                    []byte
+	plaintext                string
+	content, iv, tag         string
+}{
+	alicePrivate: sequence(0x01, 32),
+	bobPrivate:   sequence(0x41, 32),
+	alicePublic:  "B6N8vBQgk8i3VdwbEOhstCY3StFqqFPtC9/AsrhtHHw=",
+	bobPublic:    "ZLEBsdC+WocEvQePmJUAH8A+jp+VIvGI3RKNmEbUhGY=",
+	shared:       "26c2c17fdb82161cb21ad16e721315355b64d1763119b10bfc962530dc7cc163",
+	key:          "ccbeaf34ba3d5ba95ef0381f12903a6ec1191dbbefb77e379339b85aff9f5b83",
+	info:         "secure-messenger/e2e/v1|alice|bob",
+	nonce:        sequence(0xc0, E2ENonceSize),
+	plaintext:    "Привет, Bob!",
+	content:      "U3FJ3fZ1JJjuhHE+KGLtFIWN",
+	iv:           "wMHCw8TFxsfIycrL",
+	tag:          "da61Ylx3Dik4+Ego1rzrKg==",
+}
+
+func sequence(start byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+func vectorKeys(t *testing.T) (alice, bob *ecdh.PrivateKey) {
+	t.Helper()
+	alice, err := ecdh.X25519().NewPrivateKey(e2eVector.alicePrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = ecdh.X25519().NewPrivateKey(e2eVector.bobPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func TestE2EVectorKeys(t *testing.T) {
+	alice, bob := vectorKeys(t)
+	if got := EncodePublicKey(alice.PublicKey()); got != e2eVector.alicePublic {
+		t.Fatalf("публичный ключ alice %s", got)
+	}
+	if got := EncodePublicKey(bob.PublicKey()); got != e2eVector.bobPublic {
+		t.Fatalf("публичный ключ bob %s", got)
+	}
+	shared, _ := alice.ECDH(bob.PublicKey())
+	if got := hex.EncodeToString(shared); got != e2eVector.shared {
+		t.Fatalf("общий секрет %s", got)
+	}
+
+	// info не зависит от порядка имен; ключ одинаков у обеих сторон
+	if got := conversationInfo("bob", "alice"); got != e2eVector.info {
+		t.Fatalf("info %q", got)
+	}
+	bobPublic, err := ParsePublicKey(e2eVector.bobPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePublic, _ := ParsePublicKey(e2eVector.alicePublic)
+	fromAlice, err := DeriveConversationKey(alice, bobPublic, "alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBob, _ := DeriveConversationKey(bob, alicePublic, "alice", "bob")
+	if got := hex.EncodeToString(fromAlice); got != e2eVector.key || !bytes.Equal(fromAlice, fromBob) {
+		t.Fatalf("ключ диалога %s", got)
+	}
+}
+
+func TestE2EVectorCiphertext(t *testing.T) {
+	key, _ := hex.DecodeString(e2eVector.key)
+
+	// Раскладка: шифротекст без тега, отдельно 12-байтный IV и 16-байтный тег
+	content, iv, tag, err := e2eSeal(key, e2eVector.nonce, e2eVector.plaintext, "alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != e2eVector.content || iv != e2eVector.iv || tag != e2eVector.tag {
+		t.Fatalf("e2eSeal = %s %s %s", content, iv, tag)
+	}
+
+	plaintext, err := E2EDecrypt(key, e2eVector.content, e2eVector.iv, e2eVector.tag, "alice", "bob")
+	if err != nil || plaintext != e2eVector.plaintext {
+		t.Fatalf("E2EDecrypt = %q, %v", plaintext, err)
+	}
+	// Направление входит в associated data
+	if _, err := E2EDecrypt(key, e2eVector.content, e2eVector.iv, e2eVector.tag, "bob", "alice"); !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("обратное направление: %v", err)
+	}
+}
+
+func TestE2ERoundTrip(t *testing.T) {
+	key, _ := hex.DecodeString(e2eVector.key)
+	content, iv, tag, err := E2EEncrypt(key, "hello", "alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iv == e2eVector.iv {
+		t.Fatal("E2EEncrypt использует фиксированный IV")
+	}
+	if got, err := E2EDecrypt(key, content, iv, tag, "alice", "bob"); err != nil || got != "hello" {
+		t.Fatalf("E2EDecrypt = %q, %v", got, err)
+	}
+	for _, bad := range []struct{ content, iv, tag string }{
+		{content, iv[:8], tag},
+		{content, iv, tag[:8]},
+		{"!", iv, tag},
+	} {
+		if _, err := E2EDecrypt(key, bad.content, bad.iv, bad.tag, "alice", "bob"); !errors.Is(err, ErrDecryptFailed) {
+			t.Fatalf("поврежденное сообщение: %v", err)
+		}
+	}
+}
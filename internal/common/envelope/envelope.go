@@ -0,0 +1,237 @@
+// Package envelope реализует версионированный AEAD-конверт: двоичный формат
+// с заголовком (версия, алгоритм, ID ключа, nonce), привязкой к отправителю,
+// получателю и ID сообщения и выбором ключа по ID из связки ключей.
+// Поддерживаются AES-256-GCM и XChaCha20-Poly1305.
+//
+// Формат (версия 1):
+//
+//	версия (1) | алгоритм (1) | длина ID ключа (1) | ID ключа | nonce | шифротекст с тегом
+//
+// Длина nonce определяется алгоритмом: 12 байт для AES-256-GCM и 24 байта
+// для XChaCha20-Poly1305. Весь заголовок входит в associated data, поэтому
+// подмена алгоритма или ID ключа обнаруживается при расшифровке.
+//
+// Пакет - библиотека: сервер и клиент его пока не используют. Сообщения
+// шифруются по-прежнему (internal/common/e2e.go, ratchet, senderkey), а
+// хранилище - EncryptedStore со своим форматом. ID ключа конверта не
+// связан с common.Message.KeyID: там это ID цепочки sender key.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"secure-messenger/internal/common"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Version текущая версия формата конверта
+const Version byte = 1
+
+// KeySize длина ключа для обоих алгоритмов
+const KeySize = 32
+
+// maxKeyIDLen ограничение длины ID ключа: длина хранится в одном байте
+const maxKeyIDLen = 255
+
+// Algorithm алгоритм AEAD конверта
+type Algorithm byte
+
+const (
+	AES256GCM         Algorithm = 1
+	XChaCha20Poly1305 Algorithm = 2
+)
+
+var (
+	ErrUnsupportedVersion   = errors.New("envelope: неподдерживаемая версия")
+	ErrUnsupportedAlgorithm = errors.New("envelope: неподдерживаемый алгоритм")
+	ErrMalformed            = errors.New("envelope: поврежденный конверт")
+	ErrInvalidKey           = errors.New("envelope: недопустимый ключ")
+	ErrDecrypt              = errors.New("envelope: не удалось расшифровать")
+)
+
+// String возвращает название алгоритма
+func (a Algorithm) String() string {
+	switch a {
+	case AES256GCM:
+		return "AES-256-GCM"
+	case XChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	}
+	return "unknown"
+}
+
+// nonceSize возвращает длину nonce алгоритма или 0 для неизвестного
+func (a Algorithm) nonceSize() int {
+	switch a {
+	case AES256GCM:
+		return 12
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NonceSizeX
+	}
+	return 0
+}
+
+// Key ключ конверта
+type Key struct {
+	ID        string
+	Algorithm Algorithm
+	Secret    []byte
+}
+
+// NewKey создает случайный ключ для алгоритма
+func NewKey(id string, alg Algorithm) (*Key, error) {
+	secret := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	key := &Key{ID: id, Algorithm: alg, Secret: secret}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (k *Key) validate() error {
+	if k == nil || k.ID == "" || len(k.ID) > maxKeyIDLen || len(k.Secret) != KeySize {
+		return ErrInvalidKey
+	}
+	if k.Algorithm.nonceSize() == 0 {
+		return ErrUnsupportedAlgorithm
+	}
+	return nil
+}
+
+func (k *Key) aead() (cipher.AEAD, error) {
+	switch k.Algorithm {
+	case AES256GCM:
+		block, err := aes.NewCipher(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(k.Secret)
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// AssociatedData данные, к которым привязан конверт: расшифровать его можно
+// только с теми же отправителем, получателем и ID сообщения
+type AssociatedData struct {
+	Sender    string
+	Recipient string
+	MessageID string
+}
+
+// MessageAD возвращает associated data для сообщения
+func MessageAD(msg common.Message) AssociatedData {
+	return AssociatedData{Sender: msg.Sender, Recipient: msg.Recipient, MessageID: msg.ID}
+}
+
+// bytes каноническое представление: каждое поле предваряется длиной
+// (uint32, big-endian)
+func (ad AssociatedData) bytes() []byte {
+	var buf []byte
+	for _, field := range []string{ad.Sender, ad.Recipient, ad.MessageID} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+// Header разобранный заголовок конверта
+type Header struct {
+	Version   byte
+	Algorithm Algorithm
+	KeyID     string
+	Nonce     []byte
+}
+
+// Seal шифрует данные ключом key со случайным nonce и возвращает конверт
+func Seal(key *Key, plaintext []byte, ad AssociatedData) ([]byte, error) {
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, key.Algorithm.nonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return seal(key, nonce, plaintext, ad)
+}
+
+func seal(key *Key, nonce, plaintext []byte, ad AssociatedData) ([]byte, error) {
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, 3+len(key.ID)+len(nonce))
+	header = append(header, Version, byte(key.Algorithm), byte(len(key.ID)))
+	header = append(header, key.ID...)
+	header = append(header, nonce...)
+
+	return aead.Seal(header, nonce, plaintext, append(header[:len(header):len(header)], ad.bytes()...)), nil
+}
+
+// Parse разбирает заголовок конверта без расшифровки. Возвращает заголовок,
+// его длину в байтах и ошибку для неподдерживаемого или обрезанного конверта.
+func Parse(envelope []byte) (Header, int, error) {
+	if len(envelope) < 3 {
+		return Header{}, 0, ErrMalformed
+	}
+	if envelope[0] != Version {
+		return Header{}, 0, ErrUnsupportedVersion
+	}
+	alg := Algorithm(envelope[1])
+	nonceSize := alg.nonceSize()
+	if nonceSize == 0 {
+		return Header{}, 0, ErrUnsupportedAlgorithm
+	}
+	idLen := int(envelope[2])
+	if idLen == 0 {
+		return Header{}, 0, ErrMalformed
+	}
+	end := 3 + idLen + nonceSize
+	// тег аутентификации обоих алгоритмов занимает 16 байт
+	if len(envelope) < end+16 {
+		return Header{}, 0, ErrMalformed
+	}
+	return Header{
+		Version:   envelope[0],
+		Algorithm: alg,
+		KeyID:     string(envelope[3 : 3+idLen]),
+		Nonce:     envelope[3+idLen : end],
+	}, end, nil
+}
+
+// Open расшифровывает конверт ключом, найденным в связке по ID из заголовка
+func Open(keys Keyring, envelope []byte, ad AssociatedData) ([]byte, error) {
+	header, n, err := Parse(envelope)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.Key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != header.Algorithm {
+		return nil, ErrDecrypt
+	}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, header.Nonce, envelope[n:], append(envelope[:n:n], ad.bytes()...))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
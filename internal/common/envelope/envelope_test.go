@@ -0,0 +1,243 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Векторы проверены независимой реализацией (Node.js crypto: aes-256-gcm
+// и chacha20-poly1305 с подключом HChaCha20)
+var knownAnswers = []struct {
+	name      string
+	key       *Key
+	nonce     []byte
+	plaintext string
+	ad        AssociatedData
+	envelope  string
+}{
+	{
+		name:      "AES-256-GCM",
+		key:       &Key{ID: "k1", Algorithm: AES256GCM, Secret: sequence(0x00, KeySize)},
+		nonce:     sequence(0xa0, 12),
+		plaintext: "secure-messenger",
+		ad:        AssociatedData{Sender: "alice", Recipient: "bob", MessageID: "m1"},
+		envelope: "0101026b31" + "a0a1a2a3a4a5a6a7a8a9aaab" +
+			"957d1f5837ae2fd20716f4b6691da5ac" + "4e9bd2ea31eb814ef811bd948fee803d",
+	},
+	{
+		name:      "XChaCha20-Poly1305",
+		key:       &Key{ID: "key-2024", Algorithm: XChaCha20Poly1305, Secret: sequence(0x80, KeySize)},
+		nonce:     sequence(0x40, 24),
+		plaintext: "hello",
+		ad:        AssociatedData{Sender: "alice", MessageID: "42"},
+		envelope: "0102086b65792d32303234" + "404142434445464748494a4b4c4d4e4f5051525354555657" +
+			"99691f9834" + "f8473beb61ac1f3cf0b45b29d1329a84",
+	},
+}
+
+func sequence(start byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+func TestKnownAnswers(t *testing.T) {
+	for _, tc := range knownAnswers {
+		t.Run(tc.name, func(t *testing.T) {
+			want, err := hex.DecodeString(tc.envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := seal(tc.key, tc.nonce, []byte(tc.plaintext), tc.ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("seal = %x, want %x", got, want)
+			}
+
+			header, n, err := Parse(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Version != Version || header.Algorithm != tc.key.Algorithm ||
+				header.KeyID != tc.key.ID || !bytes.Equal(header.Nonce, tc.nonce) {
+				t.Fatalf("Parse = %+v", header)
+			}
+			if n != 3+len(tc.key.ID)+len(tc.nonce) {
+				t.Fatalf("длина заголовка %d", n)
+			}
+
+			keys, err := NewMemoryKeyring(tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := keys.Open(want, tc.ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != tc.plaintext {
+				t.Fatalf("Open = %q, want %q", plaintext, tc.plaintext)
+			}
+		})
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	for _, tc := range knownAnswers {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, _ := NewMemoryKeyring(tc.key)
+			envelope, _ := hex.DecodeString(tc.envelope)
+
+			for i := range envelope {
+				tampered := bytes.Clone(envelope)
+				tampered[i] ^= 0x01
+				if _, err := keys.Open(tampered, tc.ad); err == nil {
+					t.Fatalf("изменение байта %d не обнаружено", i)
+				}
+			}
+			for n := 0; n < len(envelope); n++ {
+				if _, err := keys.Open(envelope[:n], tc.ad); err == nil {
+					t.Fatalf("обрезанный до %d байт конверт открылся", n)
+				}
+			}
+
+			for _, ad := range []AssociatedData{
+				{Sender: "mallory", Recipient: tc.ad.Recipient, MessageID: tc.ad.MessageID},
+				{Sender: tc.ad.Sender, Recipient: "mallory", MessageID: tc.ad.MessageID},
+				{Sender: tc.ad.Sender, Recipient: tc.ad.Recipient, MessageID: "other"},
+				// границы полей входят в associated data
+				{Sender: tc.ad.Sender[:1], Recipient: tc.ad.Sender[1:] + tc.ad.Recipient, MessageID: tc.ad.MessageID},
+			} {
+				if _, err := keys.Open(envelope, ad); !errors.Is(err, ErrDecrypt) {
+					t.Fatalf("Open с %+v: %v, want ErrDecrypt", ad, err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	aes := knownAnswers[0]
+	envelope, _ := hex.DecodeString(aes.envelope)
+
+	other, _ := NewMemoryKeyring(&Key{ID: "k2", Algorithm: AES256GCM, Secret: aes.key.Secret})
+	if _, err := other.Open(envelope, aes.ad); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("неизвестный ключ: %v", err)
+	}
+
+	// ключ с тем же ID, но другим алгоритмом не подходит
+	swapped, _ := NewMemoryKeyring(&Key{ID: "k1", Algorithm: XChaCha20Poly1305, Secret: aes.key.Secret})
+	if _, err := swapped.Open(envelope, aes.ad); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("другой алгоритм: %v", err)
+	}
+
+	bad := bytes.Clone(envelope)
+	bad[0] = 2
+	if _, _, err := Parse(bad); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("версия: %v", err)
+	}
+	bad = bytes.Clone(envelope)
+	bad[1] = 3
+	if _, _, err := Parse(bad); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("алгоритм: %v", err)
+	}
+	bad = bytes.Clone(envelope)
+	bad[2] = 0
+	if _, _, err := Parse(bad); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("пустой ID ключа: %v", err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old, err := NewKey("old", AES256GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := NewMemoryKeyring(old)
+	ad := AssociatedData{Sender: "alice", Recipient: "bob", MessageID: "1"}
+	sealedOld, err := keys.Seal([]byte("before"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, _ := NewKey("new", XChaCha20Poly1305)
+	if err := keys.Add(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.SetPrimary("new"); err != nil {
+		t.Fatal(err)
+	}
+	sealedNew, _ := keys.Seal([]byte("after"), ad)
+	if header, _, _ := Parse(sealedNew); header.KeyID != "new" {
+		t.Fatalf("новый конверт под ключом %q", header.KeyID)
+	}
+
+	for envelope, want := range map[string]string{string(sealedOld): "before", string(sealedNew): "after"} {
+		got, err := keys.Open([]byte(envelope), ad)
+		if err != nil || string(got) != want {
+			t.Fatalf("Open = %q, %v", got, err)
+		}
+	}
+
+	if err := keys.Remove("new"); err == nil {
+		t.Fatal("основной ключ удален")
+	}
+	if err := keys.Remove("old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Open(sealedOld, ad); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("удаленный ключ: %v", err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, tc := range knownAnswers {
+		envelope, _ := hex.DecodeString(tc.envelope)
+		f.Add(envelope)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{1, 1, 255})
+
+	f.Fuzz(func(t *testing.T, envelope []byte) {
+		header, n, err := Parse(envelope)
+		if err != nil {
+			return
+		}
+		if n > len(envelope)-16 {
+			t.Fatalf("заголовок %d байт не оставляет места для тега в %d", n, len(envelope))
+		}
+		if len(header.Nonce) != header.Algorithm.nonceSize() || header.KeyID == "" {
+			t.Fatalf("недопустимый заголовок %+v", header)
+		}
+	})
+}
+
+func FuzzOpen(f *testing.F) {
+	keys, _ := NewMemoryKeyring(knownAnswers[0].key, knownAnswers[1].key)
+	for _, tc := range knownAnswers {
+		envelope, _ := hex.DecodeString(tc.envelope)
+		f.Add(envelope, tc.ad.Sender, tc.ad.Recipient, tc.ad.MessageID)
+	}
+
+	f.Fuzz(func(t *testing.T, envelope []byte, sender, recipient, messageID string) {
+		ad := AssociatedData{Sender: sender, Recipient: recipient, MessageID: messageID}
+		plaintext, err := keys.Open(envelope, ad)
+		if err != nil {
+			return
+		}
+		// открыться могут только настоящие конверты с их associated data
+		for _, tc := range knownAnswers {
+			want, _ := hex.DecodeString(tc.envelope)
+			if bytes.Equal(envelope, want) && ad == tc.ad && string(plaintext) == tc.plaintext {
+				return
+			}
+		}
+		t.Fatalf("открылся посторонний конверт %x", envelope)
+	})
+}
@@ -0,0 +1,117 @@
+package envelope
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrUnknownKey = errors.New("envelope: неизвестный ID ключа")
+	ErrNoPrimary  = errors.New("envelope: не выбран основной ключ")
+)
+
+// Keyring связка ключей: находит ключ по ID из заголовка конверта
+type Keyring interface {
+	Key(id string) (*Key, error)
+}
+
+// MemoryKeyring связка ключей в памяти с основным ключом для шифрования.
+// Старые ключи остаются в связке, чтобы расшифровывать прежние конверты.
+// Безопасна для конкурентного использования.
+type MemoryKeyring struct {
+	mu      sync.RWMutex
+	keys    map[string]*Key
+	primary string
+}
+
+// NewMemoryKeyring создает связку; первый ключ становится основным
+func NewMemoryKeyring(keys ...*Key) (*MemoryKeyring, error) {
+	kr := &MemoryKeyring{keys: make(map[string]*Key)}
+	for _, key := range keys {
+		if err := kr.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// Add добавляет ключ в связку. Если основного ключа еще нет, им
+// становится добавленный.
+func (kr *MemoryKeyring) Add(key *Key) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, exists := kr.keys[key.ID]; exists {
+		return errors.New("envelope: ключ с таким ID уже есть")
+	}
+	kr.keys[key.ID] = key
+	if kr.primary == "" {
+		kr.primary = key.ID
+	}
+	return nil
+}
+
+// SetPrimary выбирает ключ, которым шифруются новые конверты
+func (kr *MemoryKeyring) SetPrimary(id string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, exists := kr.keys[id]; !exists {
+		return ErrUnknownKey
+	}
+	kr.primary = id
+	return nil
+}
+
+// Remove удаляет ключ из связки; основной ключ удалить нельзя
+func (kr *MemoryKeyring) Remove(id string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if id == kr.primary {
+		return errors.New("envelope: нельзя удалить основной ключ")
+	}
+	delete(kr.keys, id)
+	return nil
+}
+
+// Key возвращает ключ по ID
+func (kr *MemoryKeyring) Key(id string) (*Key, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	key, exists := kr.keys[id]
+	if !exists {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// Primary возвращает основной ключ
+func (kr *MemoryKeyring) Primary() (*Key, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	if kr.primary == "" {
+		return nil, ErrNoPrimary
+	}
+	return kr.keys[kr.primary], nil
+}
+
+// Seal шифрует данные основным ключом связки
+func (kr *MemoryKeyring) Seal(plaintext []byte, ad AssociatedData) ([]byte, error) {
+	key, err := kr.Primary()
+	if err != nil {
+		return nil, err
+	}
+	return Seal(key, plaintext, ad)
+}
+
+// Open расшифровывает конверт ключом связки
+func (kr *MemoryKeyring) Open(envelope []byte, ad AssociatedData) ([]byte, error) {
+	return Open(kr, envelope, ad)
+}
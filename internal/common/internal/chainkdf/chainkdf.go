@@ -0,0 +1,68 @@
+// Package chainkdf содержит общие для храповика личных сообщений и ключей
+// отправителей групп шаги симметричной цепочки: KDF_CK и шифрование
+// сообщения его ключом. web/static/chat.js повторяет их в chainStep и
+// groupCipher.
+package chainkdf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Step KDF_CK: HMAC-SHA256 с константами 0x01 (ключ сообщения) и 0x02
+// (следующий ключ цепочки)
+func Step(ck []byte) (next, mk []byte) {
+	m := hmac.New(sha256.New, ck)
+	m.Write([]byte{0x01})
+	mk = m.Sum(nil)
+
+	m = hmac.New(sha256.New, ck)
+	m.Write([]byte{0x02})
+	next = m.Sum(nil)
+	return next, mk
+}
+
+// AD дополняет associated data каноническим заголовком сообщения
+func AD(ad, header []byte) []byte {
+	return append(append([]byte(nil), ad...), header...)
+}
+
+// Seal шифрует сообщение ключом mk; info разделяет ключи разных протоколов
+func Seal(info string, mk, plaintext, ad []byte) ([]byte, error) {
+	gcm, nonce, err := messageCipher(info, mk)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, nonce, plaintext, ad), nil
+}
+
+// Open расшифровывает сообщение, зашифрованное Seal
+func Open(info string, mk, ciphertext, ad []byte) ([]byte, error) {
+	gcm, nonce, err := messageCipher(info, mk)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, ad)
+}
+
+// messageCipher выводит из ключа сообщения ключ AES-256-GCM и nonce
+func messageCipher(info string, mk []byte) (cipher.AEAD, []byte, error) {
+	out := make([]byte, 32+12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, mk, nil, []byte(info)), out); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(out[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, out[32:], nil
+}
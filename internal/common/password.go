@@ -0,0 +1,131 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2Prefix идентификатор схемы в хэше формата PHC:
+// $argon2id$v=19$m=<KiB>,t=<итерации>,p=<потоки>$<соль>$<хэш>.
+// Хэши без префикса считаются устаревшими (SHA-256 из HashPassword).
+const argon2Prefix = "$argon2id$"
+
+var ErrInvalidPasswordHash = errors.New("недопустимый формат хэша пароля")
+
+// PasswordParams параметры Argon2id
+type PasswordParams struct {
+	Time    uint32 // число итераций
+	Memory  uint32 // память в КиБ
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultPasswordParams параметры по умолчанию (рекомендация OWASP)
+var DefaultPasswordParams = PasswordParams{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 2,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// PasswordHasher хэширует и проверяет пароли с помощью Argon2id
+type PasswordHasher struct {
+	params PasswordParams
+}
+
+// NewPasswordHasher создает хэшер с заданными параметрами
+func NewPasswordHasher(params PasswordParams) (*PasswordHasher, error) {
+	if params.Time == 0 || params.Memory < 8*uint32(params.Threads) || params.Threads == 0 {
+		return nil, errors.New("недопустимые параметры Argon2id")
+	}
+	if params.SaltLen < 8 || params.KeyLen < 16 {
+		return nil, errors.New("слишком короткая соль или ключ Argon2id")
+	}
+	return &PasswordHasher{params: params}, nil
+}
+
+// Hash возвращает хэш пароля в формате PHC с закодированными параметрами
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLen)
+	return encodeArgon2(h.params, salt, key), nil
+}
+
+// Verify проверяет пароль за постоянное время. legacySalt используется только
+// для устаревших хэшей SHA-256. needsRehash сообщает, что хэш следует
+// пересчитать текущими параметрами.
+func (h *PasswordHasher) Verify(password, encoded, legacySalt string) (ok, needsRehash bool, err error) {
+	if !strings.HasPrefix(encoded, argon2Prefix) {
+		legacy := HashPassword(password, legacySalt)
+		return subtle.ConstantTimeCompare([]byte(legacy), []byte(encoded)) == 1, true, nil
+	}
+
+	params, salt, key, err := decodeArgon2(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false, nil
+	}
+
+	current := h.params
+	needsRehash = params.Time != current.Time || params.Memory != current.Memory ||
+		params.Threads != current.Threads || uint32(len(key)) != current.KeyLen ||
+		uint32(len(salt)) != current.SaltLen
+	return true, needsRehash, nil
+}
+
+func encodeArgon2(p PasswordParams, salt, key []byte) string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodeArgon2(encoded string) (PasswordParams, []byte, []byte, error) {
+	var p PasswordParams
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", соль, хэш
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+	if p.Time == 0 || p.Threads == 0 {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrInvalidPasswordHash
+	}
+
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
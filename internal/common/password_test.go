@@ -0,0 +1,123 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fastParams дешевые параметры, чтобы тесты не считали Argon2id секундами
+var fastParams = PasswordParams{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func newFastHasher(t *testing.T, params PasswordParams) *PasswordHasher {
+	t.Helper()
+	h, err := NewPasswordHasher(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	h := newFastHasher(t, fastParams)
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("формат хэша: %s", encoded)
+	}
+	if other, _ := h.Hash("correct horse"); other == encoded {
+		t.Fatal("одинаковые хэши: соль не случайна")
+	}
+
+	ok, needsRehash, err := h.Verify("correct horse", encoded, "")
+	if err != nil || !ok || needsRehash {
+		t.Fatalf("Verify = %v, %v, %v", ok, needsRehash, err)
+	}
+	if ok, _, err := h.Verify("wrong horse", encoded, ""); err != nil || ok {
+		t.Fatalf("неверный пароль: %v, %v", ok, err)
+	}
+}
+
+func TestPasswordLegacyHashNeedsRehash(t *testing.T) {
+	h := newFastHasher(t, fastParams)
+	legacy := HashPassword("secret", "salt")
+
+	ok, needsRehash, err := h.Verify("secret", legacy, "salt")
+	if err != nil || !ok || !needsRehash {
+		t.Fatalf("устаревший хэш: %v, %v, %v", ok, needsRehash, err)
+	}
+	if ok, _, _ := h.Verify("secret", legacy, "other"); ok {
+		t.Fatal("принята чужая соль")
+	}
+	if ok, _, _ := h.Verify("guess", legacy, "salt"); ok {
+		t.Fatal("принят неверный пароль")
+	}
+}
+
+func TestPasswordRehashAfterParamsChange(t *testing.T) {
+	old := newFastHasher(t, fastParams)
+	encoded, err := old.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := map[string]PasswordParams{
+		"time":    {Time: 2, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32},
+		"memory":  {Time: 1, Memory: 2048, Threads: 1, SaltLen: 16, KeyLen: 32},
+		"threads": {Time: 1, Memory: 1024, Threads: 2, SaltLen: 16, KeyLen: 32},
+		"salt":    {Time: 1, Memory: 1024, Threads: 1, SaltLen: 32, KeyLen: 32},
+		"key":     {Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 64},
+	}
+	for name, params := range changes {
+		// Старый хэш проверяется по своим параметрам, но требует пересчета
+		ok, needsRehash, err := newFastHasher(t, params).Verify("secret", encoded, "")
+		if err != nil || !ok || !needsRehash {
+			t.Errorf("%s: Verify = %v, %v, %v", name, ok, needsRehash, err)
+		}
+	}
+}
+
+func TestPasswordRejectsMalformedHash(t *testing.T) {
+	h := newFastHasher(t, fastParams)
+	valid, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, "$")
+	salt, key := parts[4], parts[5]
+
+	malformed := []string{
+		"$argon2id$",
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + key + "$extra",
+		"$argon2id$v=16$m=1024,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$t=1,m=1024,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "!$" + key,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$",
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + key + "==",
+	}
+	for _, encoded := range malformed {
+		ok, _, err := h.Verify("secret", encoded, "")
+		if ok || !errors.Is(err, ErrInvalidPasswordHash) {
+			t.Errorf("Verify(%q) = %v, %v", encoded, ok, err)
+		}
+	}
+}
+
+func TestNewPasswordHasherRejectsWeakParams(t *testing.T) {
+	for _, params := range []PasswordParams{
+		{Time: 0, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32},
+		{Time: 1, Memory: 4, Threads: 1, SaltLen: 16, KeyLen: 32},
+		{Time: 1, Memory: 1024, Threads: 0, SaltLen: 16, KeyLen: 32},
+		{Time: 1, Memory: 1024, Threads: 1, SaltLen: 4, KeyLen: 32},
+		{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 8},
+	} {
+		if _, err := NewPasswordHasher(params); err == nil {
+			t.Errorf("приняты параметры %+v", params)
+		}
+	}
+}
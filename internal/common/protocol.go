@@ -19,12 +19,63 @@ const (
 	MsgHistory    = "history"
 	MsgPing       = "ping"
 	MsgPong       = "pong"
+	MsgKeyUpdate  = "key_update"
+	MsgDelivered  = "delivered"
+	MsgRead       = "read"
+	MsgAck        = "ack"
+	MsgSync       = "sync"
+	MsgSyncDone   = "sync_done"
+	MsgEdit       = "edit"
+	MsgDelete     = "delete"
+	MsgReaction   = "reaction"
+	MsgThread     = "thread"
+	// MsgThreadReply уведомляет участников ветки о новом ответе
+	MsgThreadReply = "thread_reply"
+	// MsgMention уведомляет упомянутого пользователя
+	MsgMention = "mention"
+	// MsgExpiry меняет таймер исчезающих сообщений диалога, MsgExpired
+	// сообщает участникам об удалении истекших сообщений
+	MsgExpiry  = "expiry"
+	MsgExpired = "expired"
+	// MsgKeyChange предупреждает собеседников о смене ключа пользователя
+	MsgKeyChange = "key_change"
+	// MsgSenderKey пересылает получателю ключ цепочки отправителя в группе,
+	// зашифрованный личной сессией; MsgSenderKeyRotate сообщает участникам
+	// о смене состава группы, после которой ключи нужно обновить
+	MsgSenderKey       = "sender_key"
+	MsgSenderKeyRotate = "sender_key_rotate"
+
+	// Каталог предключей (X3DH)
+	MsgPrekeyUpload  = "prekey_upload"
+	MsgPrekeyRequest = "prekey_request"
+	MsgPrekeyBundle  = "prekey_bundle"
+	MsgPrekeyLow     = "prekey_low"
+
+	// Комнаты (групповые чаты)
+	MsgRoomCreate  = "room_create"
+	MsgRoomJoin    = "room_join"
+	MsgRoomLeave   = "room_leave"
+	MsgRoomInvite  = "room_invite"
+	MsgRoomKick    = "room_kick"
+	MsgRoomRole    = "room_role"
+	MsgRoomMessage = "room_message"
+	MsgRoomUpdate  = "room_update"
+)
+
+// Роли участников комнаты
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
 )
 
 // Message структура сообщения
 type Message struct {
 	Type         string     `json:"type"`
 	ID           string     `json:"id,omitempty"`
+	ClientID     string     `json:"client_id,omitempty"`
+	Conversation string     `json:"conversation,omitempty"`
+	Seq          uint64     `json:"seq,omitempty"`
 	Sender       string     `json:"sender,omitempty"`
 	Recipient    string     `json:"recipient,omitempty"`
 	Content      string     `json:"content,omitempty"`
@@ -37,15 +88,212 @@ type Message struct {
 	SessionToken string     `json:"session_token,omitempty"`
 	Username     string     `json:"username,omitempty"`
 	Password     string     `json:"password,omitempty"`
+	PublicKey    string     `json:"public_key,omitempty"`
+	// SigningKey публичный ключ Ed25519 пользователя (auth, key_update);
+	// Signature - подпись отправителя над MessageEnvelope, SignedAt - время
+	// подписи по часам отправителя
+	SigningKey string    `json:"signing_key,omitempty"`
+	Signature  string    `json:"signature,omitempty"`
+	SignedAt   time.Time `json:"signed_at,omitempty"`
+	// Заголовок Double Ratchet; сервер лишь пересылает его вместе с шифротекстом
+	RatchetKey  string `json:"ratchet_key,omitempty"`
+	PrevCounter uint32 `json:"prev_counter,omitempty"`
+	Counter     uint32 `json:"counter,omitempty"`
+	// Первое сообщение сессии несет параметры X3DH
+	X3DH    *X3DHHeader   `json:"x3dh,omitempty"`
+	Prekeys *PrekeyUpload `json:"prekeys,omitempty"`
+	Bundle  *PrekeyBundle `json:"bundle,omitempty"`
+	Count   int           `json:"count,omitempty"`
+	// Комнаты: имя комнаты, роль для room_role, приватность для room_create
+	Room     string    `json:"room,omitempty"`
+	Role     string    `json:"role,omitempty"`
+	Private  bool      `json:"private,omitempty"`
+	RoomInfo *RoomInfo `json:"room_info,omitempty"`
+	// Квитанции получателей (в истории отправителя)
+	Receipts map[string]Receipt `json:"receipts,omitempty"`
+	// Target ID сообщения, к которому относится правка или удаление;
+	// остальные поля описывают состояние правок сообщения в истории
+	Target  string        `json:"target,omitempty"`
+	Edited  bool          `json:"edited,omitempty"`
+	Edits   []MessageEdit `json:"edits,omitempty"`
+	Deleted bool          `json:"deleted,omitempty"`
+	// Реакции: Emoji и Remove в запросе, Reactions - итог по сообщению
+	// (эмодзи -> пользователи)
+	Emoji     string              `json:"emoji,omitempty"`
+	Remove    bool                `json:"remove,omitempty"`
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	// Ветки: ParentID - корневое сообщение ответа; у корня ReplyCount и
+	// LastReplyAt описывают ответы
+	ParentID    string    `json:"parent_id,omitempty"`
+	ReplyCount  int       `json:"reply_count,omitempty"`
+	LastReplyAt time.Time `json:"last_reply_at,omitempty"`
+	// Упомянутые пользователи. Для открытого текста сервер находит их сам,
+	// для зашифрованного принимает список отправителя.
+	Mentions []string `json:"mentions,omitempty"`
+	// Зашифрованные вложения, загруженные через /api/uploads
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Исчезающие сообщения: ExpiresIn - таймер диалога в секундах (0 -
+	// выключен), ExpiresAt - момент удаления сообщения, IDs - удаленные
+	// сообщения, Timers - таймеры диалогов пользователя в sync_done
+	ExpiresIn int64            `json:"expires_in,omitempty"`
+	ExpiresAt time.Time        `json:"expires_at,omitempty"`
+	IDs       []string         `json:"ids,omitempty"`
+	Timers    map[string]int64 `json:"timers,omitempty"`
+	// Эпоха состава группы, для которой выдан ключ отправителя (key_id и
+	// counter); Epochs - текущие эпохи групп пользователя в sync_done
+	Epoch  uint64            `json:"epoch,omitempty"`
+	Epochs map[string]uint64 `json:"epochs,omitempty"`
+	// Последние полученные порядковые номера по диалогам для синхронизации
+	Cursors map[string]uint64 `json:"cursors,omitempty"`
+	// Запрос страницы истории и ответ на него
+	Query *HistoryQuery `json:"query,omitempty"`
+	Page  *HistoryPage  `json:"page,omitempty"`
+}
+
+// ConversationID возвращает идентификатор диалога сообщения: "general" для
+// общего чата, "room:<имя>" для комнат и "dm:<user1>:<user2>" (имена по
+// возрастанию) для личной переписки
+func ConversationID(msgType, sender, recipient, room string) string {
+	switch {
+	case room != "":
+		return "room:" + room
+	case msgType == MsgPrivate:
+		if recipient < sender {
+			sender, recipient = recipient, sender
+		}
+		return "dm:" + sender + ":" + recipient
+	default:
+		return "general"
+	}
 }
 
 // UserInfo информация о пользователе
 type UserInfo struct {
-	Username  string    `json:"username"`
-	PublicKey string    `json:"public_key,omitempty"`
-	IsOnline  bool      `json:"is_online"`
-	LastSeen  time.Time `json:"last_seen,omitempty"`
-	JoinedAt  time.Time `json:"joined_at,omitempty"`
+	Username   string    `json:"username"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	SigningKey string    `json:"signing_key,omitempty"` // Ed25519, для проверки подписей сообщений
+	IsOnline   bool      `json:"is_online"`
+	LastSeen   time.Time `json:"last_seen,omitempty"`
+	JoinedAt   time.Time `json:"joined_at,omitempty"`
+}
+
+// MessageEdit предыдущая версия отредактированного сообщения с заголовком
+// шифрования и подписью, без которых ее нельзя расшифровать и проверить
+type MessageEdit struct {
+	Content     string    `json:"content"`
+	IV          string    `json:"iv,omitempty"`
+	AuthTag     string    `json:"auth_tag,omitempty"`
+	RatchetKey  string    `json:"ratchet_key,omitempty"`
+	PrevCounter uint32    `json:"prev_counter,omitempty"`
+	Counter     uint32    `json:"counter,omitempty"`
+	KeyID       string    `json:"key_id,omitempty"`
+	Epoch       uint64    `json:"epoch,omitempty"`
+	Signature   string    `json:"signature,omitempty"`
+	SignedAt    time.Time `json:"signed_at,omitempty"`
+	EditedAt    time.Time `json:"edited_at"`
+}
+
+// HistoryQuery запрос страницы истории. Peer выбирает личный диалог
+// ("all" - общий чат), Room - комнату; без них выдаются все диалоги
+// пользователя. Before/After - ID сообщений, ограничивающие страницу;
+// без After выдаются самые новые сообщения.
+type HistoryQuery struct {
+	Peer   string    `json:"peer,omitempty"`
+	Room   string    `json:"room,omitempty"`
+	Before string    `json:"before,omitempty"`
+	After  string    `json:"after,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	Until  time.Time `json:"until,omitempty"`
+	Limit  int       `json:"limit,omitempty"`
+}
+
+// HistoryPage страница истории в хронологическом порядке. HasMore
+// сообщает, что в направлении листания есть еще сообщения.
+type HistoryPage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
+	// Root корневое сообщение, если страница - ответы ветки
+	Root *Message `json:"root,omitempty"`
+}
+
+// Attachment метаданные зашифрованного вложения. Size, MimeType и Hash
+// (SHA-256 зашифрованного файла, hex) сервер берет из завершенной загрузки.
+// Key - ключ файла, зашифрованный клиентом для участников диалога; сервер
+// передает его как есть и расшифровать вложение не может.
+type Attachment struct {
+	ID       string `json:"id"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+	Hash     string `json:"hash"`
+	Key      string `json:"key,omitempty"`
+}
+
+// UploadRequest начинает загрузку вложения: размер, тип и SHA-256 (hex)
+// уже зашифрованного файла
+type UploadRequest struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+	Hash     string `json:"hash"`
+}
+
+// UploadStatus состояние загрузки: Offset - сколько байт уже принято,
+// с этого места загрузку можно продолжить. После последней части
+// заполняется Attachment.
+type UploadStatus struct {
+	ID         string      `json:"id"`
+	Size       int64       `json:"size"`
+	Offset     int64       `json:"offset"`
+	ChunkSize  int64       `json:"chunk_size"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
+
+// Mention запись во входящих упоминаниях пользователя
+type Mention struct {
+	Message Message `json:"message"`
+	Read    bool    `json:"read"`
+}
+
+// MentionsPage страница входящих упоминаний в хронологическом порядке;
+// Unread - число непрочитанных упоминаний всего
+type MentionsPage struct {
+	Mentions []Mention `json:"mentions"`
+	Unread   int       `json:"unread"`
+	HasMore  bool      `json:"has_more"`
+}
+
+// Receipt состояние доставки сообщения одному получателю;
+// нулевое время означает, что событие еще не произошло
+type Receipt struct {
+	DeliveredAt time.Time `json:"delivered_at"`
+	ReadAt      time.Time `json:"read_at"`
+}
+
+// KeyBackupKDF параметры Argon2id, которыми клиент вывел ключ резервной
+// копии из фразы восстановления
+type KeyBackupKDF struct {
+	Algorithm string `json:"algorithm"` // "argon2id"
+	Salt      string `json:"salt"`
+	Time      uint32 `json:"time"`
+	Memory    uint32 `json:"memory"` // КиБ
+	Threads   uint8  `json:"threads"`
+}
+
+// KeyBackup резервная копия ключей пользователя, зашифрованная на клиенте
+// AES-256-GCM ключом из фразы восстановления. Сервер хранит ее как есть
+// и расшифровать не может. В списке версий Ciphertext не передается.
+type KeyBackup struct {
+	Version    int          `json:"version"`
+	CreatedAt  time.Time    `json:"created_at"`
+	KDF        KeyBackupKDF `json:"kdf"`
+	Nonce      string       `json:"nonce"`
+	Ciphertext string       `json:"ciphertext,omitempty"`
+	Size       int          `json:"size"` // длина шифротекста в байтах
+}
+
+// PrivacySettings настройки приватности пользователя
+type PrivacySettings struct {
+	// ReadReceipts разрешает сообщать отправителям о прочтении
+	ReadReceipts bool `json:"read_receipts"`
 }
 
 // AuthRequest запрос аутентификации
@@ -82,3 +330,58 @@ type ChatMessage struct {
 	Timestamp time.Time `json:"timestamp"`
 	Read      bool      `json:"read"`
 }
+
+// Prekey одноразовый предключ X25519. KeyID должен быть ненулевым.
+type Prekey struct {
+	KeyID     uint32 `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// SignedPrekey подписанный предключ: подпись Ed25519 ключом SigningKey
+// над сырыми байтами публичного ключа
+type SignedPrekey struct {
+	KeyID     uint32 `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+// PrekeyUpload публикация ключей пользователя в каталоге
+type PrekeyUpload struct {
+	IdentityKey    string        `json:"identity_key,omitempty"`
+	SigningKey     string        `json:"signing_key,omitempty"`
+	SignedPrekey   *SignedPrekey `json:"signed_prekey,omitempty"`
+	OneTimePrekeys []Prekey      `json:"one_time_prekeys,omitempty"`
+}
+
+// PrekeyBundle набор ключей для асинхронной установки сессии
+type PrekeyBundle struct {
+	Username      string       `json:"username"`
+	IdentityKey   string       `json:"identity_key"`
+	SigningKey    string       `json:"signing_key"`
+	SignedPrekey  SignedPrekey `json:"signed_prekey"`
+	OneTimePrekey *Prekey      `json:"one_time_prekey,omitempty"`
+}
+
+// X3DHHeader параметры X3DH, которые инициатор передает в первом сообщении
+type X3DHHeader struct {
+	IdentityKey     string `json:"identity_key"`
+	EphemeralKey    string `json:"ephemeral_key"`
+	SignedPrekeyID  uint32 `json:"signed_prekey_id"`
+	OneTimePrekeyID uint32 `json:"one_time_prekey_id,omitempty"`
+}
+
+// RoomMember участник комнаты
+type RoomMember struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// RoomInfo информация о комнате
+type RoomInfo struct {
+	Name      string       `json:"name"`
+	Owner     string       `json:"owner"`
+	Private   bool         `json:"private"`
+	CreatedAt time.Time    `json:"created_at"`
+	Members   []RoomMember `json:"members"`
+}
@@ -0,0 +1,306 @@
+// Package ratchet реализует Double Ratchet (по спецификации Signal) для личных
+// сообщений. Сервер видит только заголовок (публичный ключ храповика и счетчики)
+// и шифротекст; состояние сессии хранится и сериализуется на стороне клиента.
+//
+// Пакет предназначен для клиентов на Go. Браузерный клиент (web/static/chat.js)
+// пока шифрует личные сообщения статическим ключом диалога из common: сервер
+// рассылает сообщение на все устройства пользователя, а клиент заново
+// расшифровывает историю при загрузке, тогда как сессии храповика привязаны
+// к одному устройству и ключи сообщений после расшифровки стираются.
+package ratchet
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"secure-messenger/internal/common"
+	"secure-messenger/internal/common/internal/chainkdf"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MaxSkip ограничивает число ключей, пропускаемых в одной цепочке
+	MaxSkip = 1000
+	// maxStoredSkipped ограничивает общее число сохраненных пропущенных ключей
+	maxStoredSkipped = 2000
+	// maxPreviousKeys сколько старых ключей храповика помнить для отбраковки повторов
+	maxPreviousKeys = 16
+
+	rootInfo    = "secure-messenger/ratchet/v1/root"
+	messageInfo = "secure-messenger/ratchet/v1/message"
+)
+
+var (
+	ErrTooManySkipped = errors.New("ratchet: слишком много пропущенных сообщений")
+	ErrReplay         = errors.New("ratchet: повторное сообщение")
+	ErrDecrypt        = errors.New("ratchet: не удалось расшифровать сообщение")
+	ErrNoSendingChain = errors.New("ratchet: цепочка отправки не инициализирована")
+	ErrInvalidHeader  = errors.New("ratchet: недопустимый заголовок")
+)
+
+// Header заголовок сообщения храповика
+type Header struct {
+	DH []byte // текущий публичный ключ храповика отправителя
+	PN uint32 // длина предыдущей цепочки отправки
+	N  uint32 // номер сообщения в текущей цепочке
+}
+
+// Bytes возвращает каноническое представление заголовка для associated data
+func (h Header) Bytes() []byte {
+	buf := make([]byte, 0, len(h.DH)+8)
+	buf = append(buf, h.DH...)
+	buf = binary.BigEndian.AppendUint32(buf, h.PN)
+	buf = binary.BigEndian.AppendUint32(buf, h.N)
+	return buf
+}
+
+// Apply записывает заголовок в поля common.Message
+func (h Header) Apply(msg *common.Message) {
+	msg.RatchetKey = base64.StdEncoding.EncodeToString(h.DH)
+	msg.PrevCounter = h.PN
+	msg.Counter = h.N
+}
+
+// HeaderFromMessage извлекает заголовок храповика из common.Message
+func HeaderFromMessage(msg common.Message) (Header, error) {
+	dh, err := base64.StdEncoding.DecodeString(msg.RatchetKey)
+	if err != nil || len(dh) != 32 {
+		return Header{}, ErrInvalidHeader
+	}
+	return Header{DH: dh, PN: msg.PrevCounter, N: msg.Counter}, nil
+}
+
+type skippedKey struct {
+	DH string
+	N  uint32
+}
+
+// Session состояние сессии Double Ratchet. Не безопасна для конкурентного использования.
+type Session struct {
+	dhs  *ecdh.PrivateKey
+	dhr  *ecdh.PublicKey
+	rk   []byte
+	cks  []byte
+	ckr  []byte
+	ns   uint32
+	nr   uint32
+	pn   uint32
+	skip map[skippedKey][]byte
+	// order порядок добавления пропущенных ключей для вытеснения старых
+	order []skippedKey
+	// previous недавние ключи храповика собеседника, цепочки которых уже закрыты
+	previous [][]byte
+}
+
+// InitSender создает сессию инициатора (Alice) по общему секрету и
+// публичному ключу храповика собеседника
+func InitSender(sharedSecret []byte, remote *ecdh.PublicKey) (*Session, error) {
+	dhs, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dhOut, err := dhs.ECDH(remote)
+	if err != nil {
+		return nil, err
+	}
+	rk, cks, err := kdfRoot(sharedSecret, dhOut)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		dhs:  dhs,
+		dhr:  remote,
+		rk:   rk,
+		cks:  cks,
+		skip: make(map[skippedKey][]byte),
+	}, nil
+}
+
+// InitReceiver создает сессию отвечающей стороны (Bob) по общему секрету и
+// собственной паре ключей храповика, публичная часть которой известна инициатору
+func InitReceiver(sharedSecret []byte, ratchetKey *ecdh.PrivateKey) *Session {
+	return &Session{
+		dhs:  ratchetKey,
+		rk:   append([]byte(nil), sharedSecret...),
+		skip: make(map[skippedKey][]byte),
+	}
+}
+
+// Encrypt шифрует сообщение и продвигает цепочку отправки
+func (s *Session) Encrypt(plaintext, associatedData []byte) (Header, []byte, error) {
+	if s.cks == nil {
+		return Header{}, nil, ErrNoSendingChain
+	}
+
+	var mk []byte
+	s.cks, mk = chainkdf.Step(s.cks)
+	h := Header{DH: s.dhs.PublicKey().Bytes(), PN: s.pn, N: s.ns}
+	s.ns++
+
+	ciphertext, err := chainkdf.Seal(messageInfo, mk, plaintext, chainkdf.AD(associatedData, h.Bytes()))
+	if err != nil {
+		return Header{}, nil, err
+	}
+	return h, ciphertext, nil
+}
+
+// Decrypt расшифровывает сообщение. Состояние меняется только при успешной
+// расшифровке, поэтому подделанные сообщения не портят сессию.
+func (s *Session) Decrypt(h Header, ciphertext, associatedData []byte) ([]byte, error) {
+	if len(h.DH) != 32 {
+		return nil, ErrInvalidHeader
+	}
+	ad := chainkdf.AD(associatedData, h.Bytes())
+
+	// Сообщение из ранее пропущенных
+	key := skippedKey{DH: string(h.DH), N: h.N}
+	if mk, ok := s.skip[key]; ok {
+		plaintext, err := chainkdf.Open(messageInfo, mk, ciphertext, ad)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		s.forgetSkipped(key)
+		return plaintext, nil
+	}
+
+	// Ключ уже использован: либо текущая цепочка, либо одна из закрытых
+	if s.dhr != nil && bytes.Equal(h.DH, s.dhr.Bytes()) && h.N < s.nr {
+		return nil, ErrReplay
+	}
+	for _, prev := range s.previous {
+		if bytes.Equal(prev, h.DH) {
+			return nil, ErrReplay
+		}
+	}
+
+	next := s.clone()
+	if next.dhr == nil || !bytes.Equal(h.DH, next.dhr.Bytes()) {
+		if err := next.skipMessageKeys(h.PN); err != nil {
+			return nil, err
+		}
+		if err := next.dhRatchet(h); err != nil {
+			return nil, err
+		}
+	}
+	if err := next.skipMessageKeys(h.N); err != nil {
+		return nil, err
+	}
+
+	var mk []byte
+	next.ckr, mk = chainkdf.Step(next.ckr)
+	next.nr++
+
+	plaintext, err := chainkdf.Open(messageInfo, mk, ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	*s = *next
+	return plaintext, nil
+}
+
+// SkippedCount возвращает количество сохраненных ключей пропущенных сообщений
+func (s *Session) SkippedCount() int {
+	return len(s.skip)
+}
+
+func (s *Session) skipMessageKeys(until uint32) error {
+	if s.ckr == nil {
+		return nil
+	}
+	if until < s.nr {
+		return nil
+	}
+	if until-s.nr > MaxSkip {
+		return ErrTooManySkipped
+	}
+	dh := string(s.dhr.Bytes())
+	for s.nr < until {
+		var mk []byte
+		s.ckr, mk = chainkdf.Step(s.ckr)
+		s.storeSkipped(skippedKey{DH: dh, N: s.nr}, mk)
+		s.nr++
+	}
+	return nil
+}
+
+func (s *Session) storeSkipped(key skippedKey, mk []byte) {
+	s.skip[key] = mk
+	s.order = append(s.order, key)
+	for len(s.order) > maxStoredSkipped {
+		delete(s.skip, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *Session) forgetSkipped(key skippedKey) {
+	delete(s.skip, key)
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *Session) dhRatchet(h Header) error {
+	remote, err := ecdh.X25519().NewPublicKey(h.DH)
+	if err != nil {
+		return ErrInvalidHeader
+	}
+
+	if s.dhr != nil {
+		s.previous = append(s.previous, s.dhr.Bytes())
+		if len(s.previous) > maxPreviousKeys {
+			s.previous = s.previous[1:]
+		}
+	}
+
+	s.pn = s.ns
+	s.ns = 0
+	s.nr = 0
+	s.dhr = remote
+
+	dhOut, err := s.dhs.ECDH(s.dhr)
+	if err != nil {
+		return ErrInvalidHeader
+	}
+	if s.rk, s.ckr, err = kdfRoot(s.rk, dhOut); err != nil {
+		return err
+	}
+
+	if s.dhs, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return err
+	}
+	if dhOut, err = s.dhs.ECDH(s.dhr); err != nil {
+		return ErrInvalidHeader
+	}
+	s.rk, s.cks, err = kdfRoot(s.rk, dhOut)
+	return err
+}
+
+func (s *Session) clone() *Session {
+	c := *s
+	c.skip = make(map[skippedKey][]byte, len(s.skip))
+	for k, v := range s.skip {
+		c.skip[k] = v
+	}
+	c.order = append([]skippedKey(nil), s.order...)
+	c.previous = append([][]byte(nil), s.previous...)
+	return &c
+}
+
+// kdfRoot KDF_RK: HKDF с корневым ключом в качестве соли
+func kdfRoot(rk, dhOut []byte) ([]byte, []byte, error) {
+	out := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dhOut, rk, []byte(rootInfo)), out); err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
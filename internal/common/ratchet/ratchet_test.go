@@ -0,0 +1,237 @@
+package ratchet
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var testAD = []byte("alice|bob")
+
+type sealed struct {
+	header     Header
+	ciphertext []byte
+	plaintext  string
+}
+
+// newPair создает сессии Alice (инициатор) и Bob по общему секрету
+func newPair(t *testing.T) (alice, bob *Session) {
+	t.Helper()
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err = InitSender(secret, bobKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, InitReceiver(secret, bobKey)
+}
+
+func send(t *testing.T, s *Session, n int, prefix string) []sealed {
+	t.Helper()
+	var out []sealed
+	for i := 0; i < n; i++ {
+		text := fmt.Sprintf("%s%d", prefix, i)
+		h, ct, err := s.Encrypt([]byte(text), testAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, sealed{h, ct, text})
+	}
+	return out
+}
+
+func receive(t *testing.T, s *Session, msg sealed) {
+	t.Helper()
+	plaintext, err := s.Decrypt(msg.header, msg.ciphertext, testAD)
+	if err != nil {
+		t.Fatalf("%s: %v", msg.plaintext, err)
+	}
+	if string(plaintext) != msg.plaintext {
+		t.Fatalf("получено %q, want %q", plaintext, msg.plaintext)
+	}
+}
+
+func TestConversation(t *testing.T) {
+	alice, bob := newPair(t)
+	if _, _, err := bob.Encrypt([]byte("x"), testAD); !errors.Is(err, ErrNoSendingChain) {
+		t.Fatalf("Bob до первого сообщения: %v", err)
+	}
+
+	for round := 0; round < 4; round++ {
+		for _, msg := range send(t, alice, 3, "a") {
+			receive(t, bob, msg)
+		}
+		for _, msg := range send(t, bob, 2, "b") {
+			receive(t, alice, msg)
+		}
+	}
+	if alice.SkippedCount() != 0 || bob.SkippedCount() != 0 {
+		t.Fatal("остались пропущенные ключи")
+	}
+}
+
+func TestOutOfOrderWithinChain(t *testing.T) {
+	alice, bob := newPair(t)
+	msgs := send(t, alice, 5, "a")
+
+	receive(t, bob, msgs[4])
+	if n := bob.SkippedCount(); n != 4 {
+		t.Fatalf("пропущено %d, want 4", n)
+	}
+	for _, i := range []int{0, 2, 1, 3} {
+		receive(t, bob, msgs[i])
+	}
+	if n := bob.SkippedCount(); n != 0 {
+		t.Fatalf("после доставки пропущено %d", n)
+	}
+}
+
+func TestOutOfOrderAcrossDHSteps(t *testing.T) {
+	alice, bob := newPair(t)
+
+	first := send(t, alice, 3, "a")
+	receive(t, bob, first[0])
+	reply := send(t, bob, 2, "b")
+	receive(t, alice, reply[1]) // шаг храповика у Alice, b0 пропущен
+
+	// Новая цепочка Alice приходит раньше хвоста старой: Bob делает шаг
+	// храповика и сохраняет ключи a1, a2 по PN заголовка
+	second := send(t, alice, 2, "c")
+	if second[0].header.PN != 3 {
+		t.Fatalf("PN = %d, want 3", second[0].header.PN)
+	}
+	receive(t, bob, second[1])
+	if n := bob.SkippedCount(); n != 3 { // a1, a2, c0
+		t.Fatalf("пропущено %d, want 3", n)
+	}
+
+	// Еще один шаг: Bob отвечает, Alice отвечает новой цепочкой
+	more := send(t, bob, 1, "d")
+	receive(t, alice, more[0])
+	third := send(t, alice, 1, "e")
+	receive(t, bob, third[0])
+
+	// Опоздавшие сообщения двух закрытых цепочек
+	receive(t, bob, first[2])
+	receive(t, bob, second[0])
+	receive(t, bob, first[1])
+	receive(t, alice, reply[0])
+	if bob.SkippedCount() != 0 || alice.SkippedCount() != 0 {
+		t.Fatal("остались пропущенные ключи")
+	}
+}
+
+func TestMaxSkip(t *testing.T) {
+	alice, bob := newPair(t)
+	msgs := send(t, alice, MaxSkip+2, "a")
+
+	// Пропуск больше MaxSkip отклоняется, состояние не меняется
+	last := msgs[MaxSkip+1]
+	if _, err := bob.Decrypt(last.header, last.ciphertext, testAD); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("пропуск %d: %v", MaxSkip+1, err)
+	}
+	if n := bob.SkippedCount(); n != 0 {
+		t.Fatalf("после отказа пропущено %d", n)
+	}
+
+	// Ровно MaxSkip допускается: первое сообщение задает цепочку, затем
+	// пропускаются сообщения 1..MaxSkip
+	receive(t, bob, msgs[0])
+	receive(t, bob, msgs[MaxSkip+1])
+	if n := bob.SkippedCount(); n != MaxSkip {
+		t.Fatalf("пропущено %d, want %d", n, MaxSkip)
+	}
+	receive(t, bob, msgs[MaxSkip/2])
+}
+
+func TestMaxSkipAcrossDHStep(t *testing.T) {
+	alice, bob := newPair(t)
+	old := send(t, alice, MaxSkip+2, "a")
+	receive(t, bob, old[0])
+	reply := send(t, bob, 1, "b")
+	receive(t, alice, reply[0])
+
+	// PN новой цепочки требует пропустить больше MaxSkip ключей старой
+	next := send(t, alice, 1, "c")
+	if _, err := bob.Decrypt(next[0].header, next[0].ciphertext, testAD); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("пропуск по PN: %v", err)
+	}
+	// Сессия осталась прежней: старая цепочка по-прежнему расшифровывается
+	receive(t, bob, old[1])
+}
+
+func TestReplayRejected(t *testing.T) {
+	alice, bob := newPair(t)
+	msgs := send(t, alice, 3, "a")
+
+	replay := func(msg sealed) {
+		t.Helper()
+		if _, err := bob.Decrypt(msg.header, msg.ciphertext, testAD); !errors.Is(err, ErrReplay) {
+			t.Fatalf("повтор %s: %v", msg.plaintext, err)
+		}
+	}
+
+	receive(t, bob, msgs[0])
+	replay(msgs[0])
+
+	// Пропущенное сообщение принимается один раз
+	receive(t, bob, msgs[2])
+	receive(t, bob, msgs[1])
+	replay(msgs[1])
+	replay(msgs[2])
+
+	// После шага храповика повтор из закрытой цепочки тоже отклоняется
+	reply := send(t, bob, 1, "b")
+	receive(t, alice, reply[0])
+	receive(t, bob, send(t, alice, 1, "c")[0])
+	replay(msgs[0])
+	replay(msgs[2])
+}
+
+func TestTamperedMessageKeepsState(t *testing.T) {
+	alice, bob := newPair(t)
+	msgs := send(t, alice, 2, "a")
+
+	forged := append([]byte(nil), msgs[1].ciphertext...)
+	forged[0] ^= 1
+	if _, err := bob.Decrypt(msgs[1].header, forged, testAD); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("подделка: %v", err)
+	}
+	if _, err := bob.Decrypt(msgs[0].header, msgs[0].ciphertext, []byte("other")); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("чужие associated data: %v", err)
+	}
+	if n := bob.SkippedCount(); n != 0 {
+		t.Fatalf("подделка изменила сессию: пропущено %d", n)
+	}
+	receive(t, bob, msgs[0])
+	receive(t, bob, msgs[1])
+}
+
+func TestSkippedKeysSurviveSerialization(t *testing.T) {
+	alice, bob := newPair(t)
+	msgs := send(t, alice, 3, "a")
+	receive(t, bob, msgs[2])
+
+	data, err := json.Marshal(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored Session
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, &restored, msgs[0])
+	receive(t, &restored, msgs[1])
+	if _, err := restored.Decrypt(msgs[2].header, msgs[2].ciphertext, testAD); !errors.Is(err, ErrReplay) {
+		t.Fatalf("повтор после восстановления: %v", err)
+	}
+}
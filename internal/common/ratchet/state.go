@@ -0,0 +1,86 @@
+package ratchet
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+)
+
+// sessionState сериализуемое представление Session для хранения на клиенте
+type sessionState struct {
+	DHs      []byte         `json:"dhs"`
+	DHr      []byte         `json:"dhr,omitempty"`
+	RK       []byte         `json:"rk"`
+	CKs      []byte         `json:"cks,omitempty"`
+	CKr      []byte         `json:"ckr,omitempty"`
+	Ns       uint32         `json:"ns"`
+	Nr       uint32         `json:"nr"`
+	PN       uint32         `json:"pn"`
+	Skipped  []skippedEntry `json:"skipped,omitempty"`
+	Previous [][]byte       `json:"previous,omitempty"`
+}
+
+type skippedEntry struct {
+	DH []byte `json:"dh"`
+	N  uint32 `json:"n"`
+	MK []byte `json:"mk"`
+}
+
+// MarshalJSON сериализует состояние сессии. Результат содержит секретные ключи
+// и должен храниться только на клиенте.
+func (s *Session) MarshalJSON() ([]byte, error) {
+	st := sessionState{
+		DHs:      s.dhs.Bytes(),
+		RK:       s.rk,
+		CKs:      s.cks,
+		CKr:      s.ckr,
+		Ns:       s.ns,
+		Nr:       s.nr,
+		PN:       s.pn,
+		Previous: s.previous,
+	}
+	if s.dhr != nil {
+		st.DHr = s.dhr.Bytes()
+	}
+	for _, k := range s.order {
+		st.Skipped = append(st.Skipped, skippedEntry{DH: []byte(k.DH), N: k.N, MK: s.skip[k]})
+	}
+	return json.Marshal(st)
+}
+
+// UnmarshalJSON восстанавливает состояние сессии
+func (s *Session) UnmarshalJSON(data []byte) error {
+	var st sessionState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+
+	dhs, err := ecdh.X25519().NewPrivateKey(st.DHs)
+	if err != nil {
+		return err
+	}
+	var dhr *ecdh.PublicKey
+	if len(st.DHr) > 0 {
+		if dhr, err = ecdh.X25519().NewPublicKey(st.DHr); err != nil {
+			return err
+		}
+	}
+
+	*s = Session{
+		dhs:      dhs,
+		dhr:      dhr,
+		rk:       st.RK,
+		cks:      st.CKs,
+		ckr:      st.CKr,
+		ns:       st.Ns,
+		nr:       st.Nr,
+		pn:       st.PN,
+		skip:     make(map[skippedKey][]byte, len(st.Skipped)),
+		previous: st.Previous,
+	}
+	for _, e := range st.Skipped {
+		key := skippedKey{DH: string(e.DH), N: e.N}
+		s.skip[key] = e.MK
+		s.order = append(s.order, key)
+	}
+	return nil
+}
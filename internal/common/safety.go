@@ -0,0 +1,104 @@
+package common
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Параметры номеров безопасности. Те же значения используются в
+// web/static/chat.js: номер, посчитанный браузером, должен совпадать
+// с посчитанным здесь (общие векторы - в safety_test.go).
+const (
+	// fingerprintVersion 1: отпечаток покрывает и ключ подписи Ed25519
+	fingerprintVersion    = 1
+	fingerprintIterations = 5200
+	// SafetyNumberLength число цифр в номере безопасности пары ключей
+	SafetyNumberLength = 60
+)
+
+// Identity ключи идентичности пользователя: X25519 для шифрования
+// и Ed25519 для подписей. SigningKey пуст у старых клиентов.
+type Identity struct {
+	Username   string
+	PublicKey  string
+	SigningKey string
+}
+
+// Fingerprint вычисляет отпечаток ключей идентичности пользователя: 30 цифр.
+// SHA-512 итерируется над версией, ключами (X25519, затем Ed25519) и именем,
+// затем каждые 5 байт дайджеста дают 5 цифр (число по модулю 100000).
+// Ключ подписи входит в отпечаток, иначе сервер мог бы незаметно подменить
+// его при неизменном номере безопасности.
+func Fingerprint(id Identity) (string, error) {
+	pub, err := ParsePublicKey(id.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	key := pub.Bytes()
+	if id.SigningKey != "" {
+		signing, err := ParseSigningKey(id.SigningKey)
+		if err != nil {
+			return "", err
+		}
+		key = append(key, signing...)
+	}
+
+	digest := make([]byte, 0, 2+len(key)+len(id.Username))
+	digest = binary.BigEndian.AppendUint16(digest, fingerprintVersion)
+	digest = append(append(digest, key...), id.Username...)
+	for i := 0; i < fingerprintIterations; i++ {
+		sum := sha512.Sum512(append(digest, key...))
+		digest = sum[:]
+	}
+
+	var b strings.Builder
+	for i := 0; i < 6; i++ {
+		var chunk uint64
+		for _, octet := range digest[i*5 : i*5+5] {
+			chunk = chunk<<8 | uint64(octet)
+		}
+		fmt.Fprintf(&b, "%05d", chunk%100000)
+	}
+	return b.String(), nil
+}
+
+// SafetyNumber вычисляет номер безопасности двух пользователей: отпечатки
+// их ключей по возрастанию. Обе стороны получают одинаковый номер; если
+// он совпадает при сверке вне мессенджера, сервер не подменял ключи.
+func SafetyNumber(a, b Identity) (string, error) {
+	first, err := Fingerprint(a)
+	if err != nil {
+		return "", err
+	}
+	second, err := Fingerprint(b)
+	if err != nil {
+		return "", err
+	}
+	if second < first {
+		first, second = second, first
+	}
+	return first + second, nil
+}
+
+// FormatSafetyNumber разбивает номер безопасности на группы по 5 цифр
+func FormatSafetyNumber(number string) string {
+	groups := make([]string, 0, len(number)/5+1)
+	for len(number) > 5 {
+		groups = append(groups, number[:5])
+		number = number[5:]
+	}
+	return strings.Join(append(groups, number), " ")
+}
+
+// NormalizeSafetyNumber убирает из введенного номера пробелы и прочие
+// разделители, оставляя только цифры
+func NormalizeSafetyNumber(number string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+}
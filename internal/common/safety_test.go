@@ -0,0 +1,99 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+)
+
+// Фиксированные векторы номеров безопасности. web/static/chat.js
+// (fingerprint, safetyNumber) для тех же ключей выдает те же цифры.
+// Ключи X25519 - из e2eVector, ключи Ed25519 - из seed 21..40 и 61..80.
+var safetyVector = struct {
+	aliceSigning, bobSigning        string
+	alice, bob, aliceWithoutSigning string
+	number                          string
+}{
+	aliceSigning:        "5/FioQvsVZr+oZXk3OhLaVaNXSywlj60RsBoXisX8vA=",
+	bobSigning:          "iC0Oo7KGTnpYfz5pjOpEWZmDEuZV4F+l6LURnYuqyM0=",
+	alice:               "093141860560183578240498839270",
+	bob:                 "458200771196355716357497257677",
+	aliceWithoutSigning: "187051804199655421948677805779",
+	number:              "093141860560183578240498839270458200771196355716357497257677",
+}
+
+func safetyIdentities() (alice, bob Identity) {
+	return Identity{Username: "alice", PublicKey: e2eVector.alicePublic, SigningKey: safetyVector.aliceSigning},
+		Identity{Username: "bob", PublicKey: e2eVector.bobPublic, SigningKey: safetyVector.bobSigning}
+}
+
+func TestSafetyNumberVectors(t *testing.T) {
+	signingKey := func(start byte) string {
+		return base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(sequence(start, 32)).Public().(ed25519.PublicKey))
+	}
+	if signingKey(0x21) != safetyVector.aliceSigning || signingKey(0x61) != safetyVector.bobSigning {
+		t.Fatal("ключи подписи векторов")
+	}
+
+	alice, bob := safetyIdentities()
+	for _, tt := range []struct {
+		id   Identity
+		want string
+	}{
+		{alice, safetyVector.alice},
+		{bob, safetyVector.bob},
+		{Identity{Username: "alice", PublicKey: e2eVector.alicePublic}, safetyVector.aliceWithoutSigning},
+	} {
+		got, err := Fingerprint(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Fingerprint(%s, подпись %q) = %s, want %s", tt.id.Username, tt.id.SigningKey, got, tt.want)
+		}
+	}
+
+	// Обе стороны получают один номер
+	for _, pair := range [][2]Identity{{alice, bob}, {bob, alice}} {
+		number, err := SafetyNumber(pair[0], pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if number != safetyVector.number || len(number) != SafetyNumberLength {
+			t.Fatalf("SafetyNumber(%s, %s) = %s", pair[0].Username, pair[1].Username, number)
+		}
+	}
+}
+
+func TestSafetyNumberCoversKeysAndName(t *testing.T) {
+	alice, bob := safetyIdentities()
+	number, _ := SafetyNumber(alice, bob)
+
+	substitutes := map[string]Identity{
+		"ключ подписи": {Username: "bob", PublicKey: e2eVector.bobPublic, SigningKey: safetyVector.aliceSigning},
+		"ключ X25519":  {Username: "bob", PublicKey: e2eVector.alicePublic, SigningKey: safetyVector.bobSigning},
+		"имя":          {Username: "bobby", PublicKey: e2eVector.bobPublic, SigningKey: safetyVector.bobSigning},
+	}
+	for name, substitute := range substitutes {
+		if other, _ := SafetyNumber(alice, substitute); other == number {
+			t.Errorf("подмена (%s) не меняет номер", name)
+		}
+	}
+
+	if _, err := Fingerprint(Identity{Username: "bob", PublicKey: "не ключ"}); err == nil {
+		t.Error("принят недопустимый ключ")
+	}
+	if _, err := Fingerprint(Identity{Username: "bob", PublicKey: e2eVector.bobPublic, SigningKey: "AAAA"}); err == nil {
+		t.Error("принят недопустимый ключ подписи")
+	}
+}
+
+func TestFormatSafetyNumber(t *testing.T) {
+	formatted := FormatSafetyNumber(safetyVector.number)
+	if formatted[:17] != "09314 18605 60183" || len(formatted) != SafetyNumberLength+11 {
+		t.Fatalf("FormatSafetyNumber = %q", formatted)
+	}
+	if got := NormalizeSafetyNumber(formatted + "\n"); got != safetyVector.number {
+		t.Fatalf("NormalizeSafetyNumber = %q", got)
+	}
+}
@@ -0,0 +1,271 @@
+// Package senderkey реализует Sender Keys для групповых диалогов (общего чата
+// и комнат). Каждый участник шифрует сообщение один раз своей цепочкой
+// ключей, а состояние цепочки раздает остальным участникам по личным
+// E2E-сессиям. Сервер видит только ID ключа, номер сообщения и шифротекст.
+package senderkey
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"secure-messenger/internal/common"
+	"secure-messenger/internal/common/internal/chainkdf"
+)
+
+const (
+	// MaxSkip ограничивает число ключей, пропускаемых в цепочке за раз
+	MaxSkip = 1000
+	// maxStoredSkipped ограничивает число сохраненных пропущенных ключей
+	maxStoredSkipped = 2000
+
+	messageInfo = "secure-messenger/senderkey/v1/message"
+)
+
+var (
+	ErrTooManySkipped = errors.New("senderkey: слишком много пропущенных сообщений")
+	ErrReplay         = errors.New("senderkey: повторное сообщение")
+	ErrDecrypt        = errors.New("senderkey: не удалось расшифровать сообщение")
+	ErrUnknownKey     = errors.New("senderkey: неизвестный ключ отправителя")
+	ErrInvalidKey     = errors.New("senderkey: недопустимое состояние цепочки")
+	ErrInvalidHeader  = errors.New("senderkey: недопустимый заголовок")
+)
+
+// Header заголовок группового сообщения
+type Header struct {
+	KeyID uint32 // ID цепочки отправителя
+	N     uint32 // номер сообщения в цепочке
+}
+
+// Bytes возвращает каноническое представление заголовка для associated data
+func (h Header) Bytes() []byte {
+	buf := make([]byte, 0, 8)
+	buf = binary.BigEndian.AppendUint32(buf, h.KeyID)
+	buf = binary.BigEndian.AppendUint32(buf, h.N)
+	return buf
+}
+
+// Apply записывает заголовок в поля common.Message
+func (h Header) Apply(msg *common.Message) {
+	msg.KeyID = strconv.FormatUint(uint64(h.KeyID), 10)
+	msg.Counter = h.N
+}
+
+// HeaderFromMessage извлекает заголовок из common.Message
+func HeaderFromMessage(msg common.Message) (Header, error) {
+	id, err := strconv.ParseUint(msg.KeyID, 10, 32)
+	if err != nil {
+		return Header{}, ErrInvalidHeader
+	}
+	return Header{KeyID: uint32(id), N: msg.Counter}, nil
+}
+
+// Distribution состояние цепочки, которое отправитель раздает участникам
+// группы. Передается только внутри личных зашифрованных сообщений.
+type Distribution struct {
+	Conversation string `json:"conversation"`
+	Epoch        uint64 `json:"epoch"`
+	KeyID        uint32 `json:"key_id"`
+	Iteration    uint32 `json:"iteration"`
+	ChainKey     []byte `json:"chain_key"`
+}
+
+// SenderKey собственная цепочка отправки участника в одной группе и эпохе
+// ее состава. Не безопасна для конкурентного использования.
+type SenderKey struct {
+	conversation string
+	epoch        uint64
+	keyID        uint32
+	ck           []byte
+	n            uint32
+}
+
+// New создает новую цепочку отправки со случайными ID и ключом
+func New(conversation string, epoch uint64) (*SenderKey, error) {
+	buf := make([]byte, 4+32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return &SenderKey{
+		conversation: conversation,
+		epoch:        epoch,
+		keyID:        binary.BigEndian.Uint32(buf),
+		ck:           buf[4:],
+	}, nil
+}
+
+// Conversation возвращает ID группового диалога цепочки
+func (k *SenderKey) Conversation() string {
+	return k.conversation
+}
+
+// Epoch возвращает эпоху состава группы, для которой создана цепочка
+func (k *SenderKey) Epoch() uint64 {
+	return k.epoch
+}
+
+// Distribution возвращает текущее состояние цепочки для рассылки участникам.
+// Получатель сможет расшифровать только сообщения, отправленные после этого.
+func (k *SenderKey) Distribution() Distribution {
+	return Distribution{
+		Conversation: k.conversation,
+		Epoch:        k.epoch,
+		KeyID:        k.keyID,
+		Iteration:    k.n,
+		ChainKey:     append([]byte(nil), k.ck...),
+	}
+}
+
+// Encrypt шифрует сообщение и продвигает цепочку
+func (k *SenderKey) Encrypt(plaintext, associatedData []byte) (Header, []byte, error) {
+	var mk []byte
+	h := Header{KeyID: k.keyID, N: k.n}
+	k.ck, mk = chainkdf.Step(k.ck)
+	k.n++
+
+	ciphertext, err := chainkdf.Seal(messageInfo, mk, plaintext, chainkdf.AD(associatedData, h.Bytes()))
+	if err != nil {
+		return Header{}, nil, err
+	}
+	return h, ciphertext, nil
+}
+
+// EncryptMessage шифрует текст группового сообщения и заполняет поля msg:
+// заголовок, эпоху, шифротекст и тег аутентификации
+func (k *SenderKey) EncryptMessage(msg *common.Message, plaintext, associatedData []byte) error {
+	h, ciphertext, err := k.Encrypt(plaintext, associatedData)
+	if err != nil {
+		return err
+	}
+	tag := len(ciphertext) - 16
+	h.Apply(msg)
+	msg.Epoch = k.epoch
+	msg.IV = ""
+	msg.Content = base64.StdEncoding.EncodeToString(ciphertext[:tag])
+	msg.AuthTag = base64.StdEncoding.EncodeToString(ciphertext[tag:])
+	return nil
+}
+
+// Receiver цепочка другого участника, полученная из его Distribution.
+// Не безопасна для конкурентного использования.
+type Receiver struct {
+	keyID uint32
+	ck    []byte
+	n     uint32
+	skip  map[uint32][]byte
+	// order порядок добавления пропущенных ключей для вытеснения старых
+	order []uint32
+}
+
+// NewReceiver создает цепочку получателя по состоянию отправителя
+func NewReceiver(d Distribution) (*Receiver, error) {
+	if len(d.ChainKey) != 32 {
+		return nil, ErrInvalidKey
+	}
+	return &Receiver{
+		keyID: d.KeyID,
+		ck:    append([]byte(nil), d.ChainKey...),
+		n:     d.Iteration,
+		skip:  make(map[uint32][]byte),
+	}, nil
+}
+
+// KeyID возвращает ID цепочки отправителя
+func (r *Receiver) KeyID() uint32 {
+	return r.keyID
+}
+
+// Decrypt расшифровывает сообщение. Состояние меняется только при успешной
+// расшифровке, поэтому подделанные сообщения не портят цепочку.
+func (r *Receiver) Decrypt(h Header, ciphertext, associatedData []byte) ([]byte, error) {
+	if h.KeyID != r.keyID {
+		return nil, ErrUnknownKey
+	}
+	ad := chainkdf.AD(associatedData, h.Bytes())
+
+	if mk, ok := r.skip[h.N]; ok {
+		plaintext, err := chainkdf.Open(messageInfo, mk, ciphertext, ad)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		r.forgetSkipped(h.N)
+		return plaintext, nil
+	}
+	if h.N < r.n {
+		return nil, ErrReplay
+	}
+	if h.N-r.n > MaxSkip {
+		return nil, ErrTooManySkipped
+	}
+
+	next := r.clone()
+	for next.n < h.N {
+		var mk []byte
+		next.ck, mk = chainkdf.Step(next.ck)
+		next.storeSkipped(next.n, mk)
+		next.n++
+	}
+	var mk []byte
+	next.ck, mk = chainkdf.Step(next.ck)
+	next.n++
+
+	plaintext, err := chainkdf.Open(messageInfo, mk, ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	*r = *next
+	return plaintext, nil
+}
+
+// DecryptMessage расшифровывает групповое сообщение, зашифрованное EncryptMessage
+func (r *Receiver) DecryptMessage(msg common.Message, associatedData []byte) ([]byte, error) {
+	h, err := HeaderFromMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	body, err := base64.StdEncoding.DecodeString(msg.Content)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	tag, err := base64.StdEncoding.DecodeString(msg.AuthTag)
+	if err != nil || len(tag) != 16 {
+		return nil, ErrDecrypt
+	}
+	return r.Decrypt(h, append(body, tag...), associatedData)
+}
+
+// SkippedCount возвращает количество сохраненных ключей пропущенных сообщений
+func (r *Receiver) SkippedCount() int {
+	return len(r.skip)
+}
+
+func (r *Receiver) storeSkipped(n uint32, mk []byte) {
+	r.skip[n] = mk
+	r.order = append(r.order, n)
+	for len(r.order) > maxStoredSkipped {
+		delete(r.skip, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+func (r *Receiver) forgetSkipped(n uint32) {
+	delete(r.skip, n)
+	for i, k := range r.order {
+		if k == n {
+			r.order = append(r.order[:i:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (r *Receiver) clone() *Receiver {
+	c := *r
+	c.skip = make(map[uint32][]byte, len(r.skip))
+	for k, v := range r.skip {
+		c.skip[k] = v
+	}
+	c.order = append([]uint32(nil), r.order...)
+	return &c
+}
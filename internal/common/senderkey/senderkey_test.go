@@ -0,0 +1,227 @@
+package senderkey
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+var testAD = []byte("alice->room:team")
+
+// Фиксированные векторы групповых сообщений. web/static/chat.js
+// (encryptGroup: chainStep, groupCipher, groupAD "<отправитель>-><диалог>")
+// с тем же состоянием цепочки выдает те же значения.
+var groupVectors = []struct {
+	plaintext    string
+	content, tag string
+	nextChainKey string
+}{
+	{"Привет, комната! 0", "0HIjGVdslH3DOPySqBBvFIvA3fOQyLht7/OnUMTw5g==", "YDyOoO3jq0o9YoGAkvEh0Q==", "d5dc1a03a1a284cf096b59a579eaf8336be2b255504692e5662c208f59862783"},
+	{"Привет, комната! 1", "V1SZBNmUHXZL6nuHHo8KZpF6Oftxdbp382yrea3WFw==", "+3RZpt72XD6NRgLCaBR6eg==", "48edf05471314d00041553ef6036514a39c905430bd9823a3ae522b1882a5516"},
+	{"Привет, комната! 2", "XhiTsWRrviga4W3KhLrqlHrnRhiYFBZRs7rE0E1nmQ==", "67En8QwZcJWW1n7lXc4/Gw==", "54c93427ff67bf25173a51427db19161c48b2b93f335d9f12f581ca26ff52ef5"},
+}
+
+// vectorKey цепочка векторов: ключ 10 11 .. 2f, key_id 0x01020304, эпоха 3
+func vectorKey() *SenderKey {
+	ck := make([]byte, 32)
+	for i := range ck {
+		ck[i] = 0x10 + byte(i)
+	}
+	return &SenderKey{conversation: "room:team", epoch: 3, keyID: 0x01020304, ck: ck}
+}
+
+type sealed struct {
+	header     Header
+	ciphertext []byte
+	plaintext  string
+}
+
+func send(t *testing.T, k *SenderKey, n int) []sealed {
+	t.Helper()
+	var out []sealed
+	for i := 0; i < n; i++ {
+		text := fmt.Sprintf("m%d", i)
+		h, ct, err := k.Encrypt([]byte(text), testAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, sealed{h, ct, text})
+	}
+	return out
+}
+
+func receive(t *testing.T, r *Receiver, msg sealed) {
+	t.Helper()
+	plaintext, err := r.Decrypt(msg.header, msg.ciphertext, testAD)
+	if err != nil {
+		t.Fatalf("%s: %v", msg.plaintext, err)
+	}
+	if string(plaintext) != msg.plaintext {
+		t.Fatalf("получено %q, want %q", plaintext, msg.plaintext)
+	}
+}
+
+func newReceiver(t *testing.T, k *SenderKey) *Receiver {
+	t.Helper()
+	r, err := NewReceiver(k.Distribution())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestGroupVectors(t *testing.T) {
+	k := vectorKey()
+	r := newReceiver(t, k)
+	for i, v := range groupVectors {
+		var msg common.Message
+		if err := k.EncryptMessage(&msg, []byte(v.plaintext), testAD); err != nil {
+			t.Fatal(err)
+		}
+		if msg.KeyID != "16909060" || msg.Counter != uint32(i) || msg.Epoch != 3 || msg.IV != "" {
+			t.Fatalf("заголовок %d: %q %d %d %q", i, msg.KeyID, msg.Counter, msg.Epoch, msg.IV)
+		}
+		if msg.Content != v.content || msg.AuthTag != v.tag {
+			t.Fatalf("шифротекст %d: %s %s", i, msg.Content, msg.AuthTag)
+		}
+		if got := hex.EncodeToString(k.ck); got != v.nextChainKey {
+			t.Fatalf("ключ цепочки после %d: %s", i, got)
+		}
+		plaintext, err := r.DecryptMessage(msg, testAD)
+		if err != nil || string(plaintext) != v.plaintext {
+			t.Fatalf("расшифровка %d: %q, %v", i, plaintext, err)
+		}
+	}
+}
+
+func TestChainAdvance(t *testing.T) {
+	k, err := New("general", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReceiver(t, k)
+	msgs := send(t, k, 5)
+	for i, msg := range msgs {
+		if msg.header.N != uint32(i) || msg.header.KeyID != r.KeyID() {
+			t.Fatalf("заголовок %d: %+v", i, msg.header)
+		}
+		receive(t, r, msg)
+	}
+	if _, err := r.Decrypt(msgs[2].header, msgs[2].ciphertext, testAD); !errors.Is(err, ErrReplay) {
+		t.Fatalf("повтор: %v", err)
+	}
+	if _, err := r.Decrypt(msgs[4].header, msgs[4].ciphertext, []byte("bob->general")); !errors.Is(err, ErrReplay) {
+		t.Fatalf("повтор с чужими данными: %v", err)
+	}
+	if r.SkippedCount() != 0 {
+		t.Fatalf("пропущенных ключей: %d", r.SkippedCount())
+	}
+}
+
+func TestSkippedKeys(t *testing.T) {
+	k, _ := New("general", 1)
+	r := newReceiver(t, k)
+	msgs := send(t, k, 6)
+
+	receive(t, r, msgs[4])
+	if r.SkippedCount() != 4 {
+		t.Fatalf("пропущенных ключей: %d, want 4", r.SkippedCount())
+	}
+	for _, i := range []int{1, 3, 0, 2} {
+		receive(t, r, msgs[i])
+	}
+	if r.SkippedCount() != 0 {
+		t.Fatalf("пропущенных ключей: %d", r.SkippedCount())
+	}
+	// Ключ пропущенного сообщения используется один раз
+	if _, err := r.Decrypt(msgs[1].header, msgs[1].ciphertext, testAD); !errors.Is(err, ErrReplay) {
+		t.Fatalf("повтор пропущенного: %v", err)
+	}
+	receive(t, r, msgs[5])
+
+	// Подделка не продвигает цепочку и не тратит пропущенные ключи
+	more := send(t, k, 3)
+	tampered := append([]byte(nil), more[2].ciphertext...)
+	tampered[0] ^= 1
+	if _, err := r.Decrypt(more[2].header, tampered, testAD); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("подделка: %v", err)
+	}
+	if r.SkippedCount() != 0 {
+		t.Fatalf("подделка сохранила ключи: %d", r.SkippedCount())
+	}
+	for _, msg := range more {
+		receive(t, r, msg)
+	}
+
+	far := Header{KeyID: k.keyID, N: k.n + MaxSkip + 1}
+	if _, err := r.Decrypt(far, more[0].ciphertext, testAD); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("слишком далекий номер: %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, _ := New("room:team", 1)
+	r := newReceiver(t, old)
+	receive(t, r, send(t, old, 1)[0])
+
+	// Смена состава: новая цепочка с другим ID, прежний получатель ее не знает
+	rotated, err := New("room:team", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.keyID == old.keyID {
+		t.Fatal("ID цепочки не сменился")
+	}
+	msg := send(t, rotated, 1)[0]
+	if _, err := r.Decrypt(msg.header, msg.ciphertext, testAD); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("старый получатель и новый ключ: %v", err)
+	}
+
+	// Новый участник получает состояние после уже отправленных сообщений
+	// и не читает их
+	late := newReceiver(t, rotated)
+	if _, err := late.Decrypt(msg.header, msg.ciphertext, testAD); !errors.Is(err, ErrReplay) {
+		t.Fatalf("сообщение до раздачи ключа: %v", err)
+	}
+	receive(t, late, send(t, rotated, 1)[0])
+	if d := rotated.Distribution(); d.Epoch != 2 || d.Iteration != 2 {
+		t.Fatalf("состояние цепочки: эпоха %d, номер %d", d.Epoch, d.Iteration)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	k, _ := New("general", 4)
+	r := newReceiver(t, k)
+	msgs := send(t, k, 3)
+	receive(t, r, msgs[2])
+
+	data, err := json.Marshal(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restoredKey SenderKey
+	if err := json.Unmarshal(data, &restoredKey); err != nil {
+		t.Fatal(err)
+	}
+	data, err = json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored Receiver
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+
+	receive(t, &restored, msgs[0])
+	receive(t, &restored, send(t, &restoredKey, 1)[0])
+	if restored.SkippedCount() != 1 {
+		t.Fatalf("пропущенных ключей после восстановления: %d", restored.SkippedCount())
+	}
+	if err := json.Unmarshal([]byte(`{"key_id":1,"ck":"AAAA"}`), &restored); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("короткий ключ цепочки: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package senderkey
+
+import "encoding/json"
+
+// senderState сериализуемое представление SenderKey для хранения на клиенте
+type senderState struct {
+	Conversation string `json:"conversation"`
+	Epoch        uint64 `json:"epoch"`
+	KeyID        uint32 `json:"key_id"`
+	CK           []byte `json:"ck"`
+	N            uint32 `json:"n"`
+}
+
+// receiverState сериализуемое представление Receiver
+type receiverState struct {
+	KeyID   uint32         `json:"key_id"`
+	CK      []byte         `json:"ck"`
+	N       uint32         `json:"n"`
+	Skipped []skippedEntry `json:"skipped,omitempty"`
+}
+
+type skippedEntry struct {
+	N  uint32 `json:"n"`
+	MK []byte `json:"mk"`
+}
+
+// MarshalJSON сериализует цепочку отправки. Результат содержит секретный
+// ключ и должен храниться только на клиенте.
+func (k *SenderKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(senderState{
+		Conversation: k.conversation,
+		Epoch:        k.epoch,
+		KeyID:        k.keyID,
+		CK:           k.ck,
+		N:            k.n,
+	})
+}
+
+// UnmarshalJSON восстанавливает цепочку отправки
+func (k *SenderKey) UnmarshalJSON(data []byte) error {
+	var st senderState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	if len(st.CK) != 32 {
+		return ErrInvalidKey
+	}
+	*k = SenderKey{
+		conversation: st.Conversation,
+		epoch:        st.Epoch,
+		keyID:        st.KeyID,
+		ck:           st.CK,
+		n:            st.N,
+	}
+	return nil
+}
+
+// MarshalJSON сериализует цепочку получателя
+func (r *Receiver) MarshalJSON() ([]byte, error) {
+	st := receiverState{KeyID: r.keyID, CK: r.ck, N: r.n}
+	for _, n := range r.order {
+		st.Skipped = append(st.Skipped, skippedEntry{N: n, MK: r.skip[n]})
+	}
+	return json.Marshal(st)
+}
+
+// UnmarshalJSON восстанавливает цепочку получателя
+func (r *Receiver) UnmarshalJSON(data []byte) error {
+	var st receiverState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	if len(st.CK) != 32 {
+		return ErrInvalidKey
+	}
+	*r = Receiver{
+		keyID: st.KeyID,
+		ck:    st.CK,
+		n:     st.N,
+		skip:  make(map[uint32][]byte, len(st.Skipped)),
+	}
+	for _, e := range st.Skipped {
+		r.skip[e.N] = e.MK
+		r.order = append(r.order, e.N)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// signatureDomain отделяет подписи сообщений от других подписей тем же
+// ключом Ed25519 (например, подписанных предключей)
+const signatureDomain = "secure-messenger/signature/v1"
+
+var (
+	ErrMessageUnsigned   = errors.New("сообщение не подписано")
+	ErrInvalidMessageSig = errors.New("недопустимая подпись сообщения")
+)
+
+// MessageEnvelope возвращает подписываемое представление сообщения:
+// отправитель, получатель, комната, время подписи (SignedAt в миллисекундах)
+// и SHA-256 шифротекста вместе с заголовками шифрования и вложениями.
+// Каждое поле предваряется длиной (uint32, big-endian). Вложения, если они
+// есть, добавляются к хэшу числом и полями ID, Hash, Key каждого. Те же
+// правила реализует web/static/chat.js. Время доставки сервер назначает
+// сам, поэтому подписывается время отправителя. Правка подписывается как
+// новая версия сообщения с его вложениями, без Target.
+func MessageEnvelope(msg Message) []byte {
+	fields := []string{
+		msg.Content,
+		msg.IV,
+		msg.AuthTag,
+		msg.RatchetKey,
+		strconv.FormatUint(uint64(msg.PrevCounter), 10),
+		strconv.FormatUint(uint64(msg.Counter), 10),
+		msg.KeyID,
+		strconv.FormatUint(msg.Epoch, 10),
+	}
+	if len(msg.Attachments) > 0 {
+		fields = append(fields, strconv.Itoa(len(msg.Attachments)))
+		for _, a := range msg.Attachments {
+			fields = append(fields, a.ID, a.Hash, a.Key)
+		}
+	}
+	hash := sha256.New()
+	for _, field := range fields {
+		hash.Write(lengthPrefixed(nil, []byte(field)))
+	}
+
+	var envelope []byte
+	for _, field := range [][]byte{
+		[]byte(signatureDomain),
+		[]byte(msg.Sender),
+		[]byte(msg.Recipient),
+		[]byte(msg.Room),
+		[]byte(strconv.FormatInt(msg.SignedAt.UnixMilli(), 10)),
+		hash.Sum(nil),
+	} {
+		envelope = lengthPrefixed(envelope, field)
+	}
+	return envelope
+}
+
+// SignMessage подписывает сообщение ключом Ed25519 отправителя. Поля
+// сообщения должны быть окончательными: отправитель, получатель (для
+// общего чата "all", для комнаты пустой) и шифротекст.
+func SignMessage(signer ed25519.PrivateKey, msg *Message) {
+	msg.SignedAt = time.Now().Truncate(time.Millisecond)
+	msg.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signer, MessageEnvelope(*msg)))
+}
+
+// VerifyMessage проверяет подпись сообщения ключом подписи отправителя
+func VerifyMessage(signingKey string, msg Message) error {
+	if msg.Signature == "" || msg.SignedAt.IsZero() {
+		return ErrMessageUnsigned
+	}
+	pub, err := ParseSigningKey(signingKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil || !ed25519.Verify(pub, MessageEnvelope(msg), sig) {
+		return ErrInvalidMessageSig
+	}
+	return nil
+}
+
+func lengthPrefixed(buf, field []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+	return append(buf, field...)
+}
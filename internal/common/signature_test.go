@@ -0,0 +1,152 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Фиксированные векторы подписи сообщений. web/static/chat.js
+// (messageEnvelope, signMessage) для тех же полей и ключа из seed 21..40
+// выдает те же байты и подписи.
+var signatureVector = struct {
+	envelope       string
+	direct, room   string
+	directSignedAt string
+	roomSignedAt   string
+}{
+	envelope: "0000001d7365637572652d6d657373656e6765722f7369676e61747572652f7631" +
+		"00000005616c69636500000003626f62000000000000000d31373630303030303030313233" +
+		"0000002047f8518cc70295a528ef608b689ef36696ae5244017e6d2901e9d5d3a607ae76",
+	direct:         "R6M7jtOvY7JluM2MAYsCbCiVR4jfA8XPtMP5UTtFmUYxeyvwWLin5Hzn9oooW7wvc6B6ARSXwqXgHOT2ZbnuAQ==",
+	room:           "BbDYkaXS88XjI7IsUQca6gcOpUYGkn7f1w9CcSsUPOjjWex3cBXXlU28frlYREHG8/m1jqzi8KW9oycWFysBDQ==",
+	directSignedAt: "2025-10-09T08:53:20.123Z",
+	roomSignedAt:   "2025-10-09T08:53:20.999Z",
+}
+
+func signedAt(t *testing.T, value string) time.Time {
+	t.Helper()
+	at, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return at
+}
+
+// vectorMessages возвращает личное сообщение с вложением и сообщение
+// комнаты из векторов, без подписи
+func vectorMessages(t *testing.T) (direct, room Message) {
+	direct = Message{
+		Sender: "alice", Recipient: "bob",
+		Content: "U3FJ3fZ1JJjuhHE+KGLtFIWN", IV: "wMHCw8TFxsfIycrL", AuthTag: "da61Ylx3Dik4+Ego1rzrKg==",
+		Counter:     3,
+		SignedAt:    signedAt(t, signatureVector.directSignedAt),
+		Attachments: []Attachment{{ID: "att1", Hash: "ab", Key: "a2V5"}},
+	}
+	room = Message{
+		Sender: "alice", Room: "team",
+		Content: "c", AuthTag: "t", KeyID: "16909060", Counter: 2, Epoch: 3,
+		SignedAt: signedAt(t, signatureVector.roomSignedAt),
+	}
+	return direct, room
+}
+
+func TestMessageSignatureVectors(t *testing.T) {
+	signer := ed25519.NewKeyFromSeed(sequence(0x21, 32))
+	direct, room := vectorMessages(t)
+
+	if got := hex.EncodeToString(MessageEnvelope(direct)); got != signatureVector.envelope {
+		t.Fatalf("MessageEnvelope = %s", got)
+	}
+	for _, tt := range []struct {
+		msg  Message
+		want string
+	}{
+		{direct, signatureVector.direct},
+		{room, signatureVector.room},
+	} {
+		got := base64.StdEncoding.EncodeToString(ed25519.Sign(signer, MessageEnvelope(tt.msg)))
+		if got != tt.want {
+			t.Errorf("подпись %s/%s = %s, want %s", tt.msg.Recipient, tt.msg.Room, got, tt.want)
+		}
+		tt.msg.Signature = tt.want
+		if err := VerifyMessage(safetyVector.aliceSigning, tt.msg); err != nil {
+			t.Errorf("VerifyMessage(%s/%s): %v", tt.msg.Recipient, tt.msg.Room, err)
+		}
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	signer := ed25519.NewKeyFromSeed(sequence(0x21, 32))
+	msg, _ := vectorMessages(t)
+	SignMessage(signer, &msg)
+	if msg.SignedAt.IsZero() || msg.SignedAt.Nanosecond()%int(time.Millisecond) != 0 {
+		t.Fatalf("SignedAt = %v", msg.SignedAt)
+	}
+	if err := VerifyMessage(safetyVector.aliceSigning, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyMessage(safetyVector.bobSigning, msg); !errors.Is(err, ErrInvalidMessageSig) {
+		t.Errorf("чужой ключ: %v", err)
+	}
+	if err := VerifyMessage("AAAA", msg); !errors.Is(err, ErrInvalidSigningKey) {
+		t.Errorf("недопустимый ключ: %v", err)
+	}
+	unsigned := msg
+	unsigned.Signature = ""
+	if err := VerifyMessage(safetyVector.aliceSigning, unsigned); !errors.Is(err, ErrMessageUnsigned) {
+		t.Errorf("без подписи: %v", err)
+	}
+	unsigned = msg
+	unsigned.SignedAt = time.Time{}
+	if err := VerifyMessage(safetyVector.aliceSigning, unsigned); !errors.Is(err, ErrMessageUnsigned) {
+		t.Errorf("без времени подписи: %v", err)
+	}
+}
+
+func TestSignatureCoversFields(t *testing.T) {
+	signer := ed25519.NewKeyFromSeed(sequence(0x21, 32))
+	original, _ := vectorMessages(t)
+	SignMessage(signer, &original)
+
+	tampers := map[string]func(*Message){
+		"отправитель":    func(m *Message) { m.Sender = "mallory" },
+		"получатель":     func(m *Message) { m.Recipient = "carol" },
+		"комната":        func(m *Message) { m.Recipient, m.Room = "", "bob" },
+		"время подписи":  func(m *Message) { m.SignedAt = m.SignedAt.Add(time.Millisecond) },
+		"шифротекст":     func(m *Message) { m.Content = "AAAA" + m.Content[4:] },
+		"iv":             func(m *Message) { m.IV = "AAAA" + m.IV[4:] },
+		"тег":            func(m *Message) { m.AuthTag = "AAAA" + m.AuthTag[4:] },
+		"ключ храповика": func(m *Message) { m.RatchetKey = "rk" },
+		"prev_counter":   func(m *Message) { m.PrevCounter = 1 },
+		"counter":        func(m *Message) { m.Counter++ },
+		"key_id":         func(m *Message) { m.KeyID = "1" },
+		"эпоха":          func(m *Message) { m.Epoch++ },
+		"ID вложения":    func(m *Message) { m.Attachments[0].ID = "att2" },
+		"хэш вложения":   func(m *Message) { m.Attachments[0].Hash = "cd" },
+		"ключ вложения":  func(m *Message) { m.Attachments[0].Key = "a2V6" },
+		"без вложения":   func(m *Message) { m.Attachments = nil },
+		"лишнее вложение": func(m *Message) {
+			m.Attachments = append(m.Attachments, Attachment{ID: "att2", Hash: "cd", Key: "a2V5"})
+		},
+	}
+	for name, tamper := range tampers {
+		msg := original
+		msg.Attachments = append([]Attachment(nil), original.Attachments...)
+		tamper(&msg)
+		if err := VerifyMessage(safetyVector.aliceSigning, msg); !errors.Is(err, ErrInvalidMessageSig) {
+			t.Errorf("подмена (%s): %v", name, err)
+		}
+	}
+
+	// Размер и тип вложения в подпись не входят
+	msg := original
+	msg.Attachments = []Attachment{{ID: "att1", Hash: "ab", Key: "a2V5", Size: 10, MimeType: "text/plain"}}
+	if err := VerifyMessage(safetyVector.aliceSigning, msg); err != nil {
+		t.Errorf("метаданные вложения: %v", err)
+	}
+}
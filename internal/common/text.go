@@ -0,0 +1,30 @@
+package common
+
+// ParseMentions находит в тексте упоминания вида @username и возвращает
+// имена без повторов в порядке появления. Символ @ внутри слова (например,
+// в адресе почты) упоминанием не считается.
+func ParseMentions(text string) []string {
+	isNameChar := func(ch byte) bool {
+		return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') ||
+			(ch >= '0' && ch <= '9') || ch == '_'
+	}
+
+	var mentions []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(text); i++ {
+		if text[i] != '@' || (i > 0 && isNameChar(text[i-1])) {
+			continue
+		}
+		end := i + 1
+		for end < len(text) && isNameChar(text[end]) {
+			end++
+		}
+		name := text[i+1 : end]
+		if ValidateUsername(name) && !seen[name] {
+			seen[name] = true
+			mentions = append(mentions, name)
+		}
+		i = end - 1
+	}
+	return mentions
+}
@@ -0,0 +1,24 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"привет @alice и @bob_2", []string{"alice", "bob_2"}},
+		{"@alice @alice, @bob", []string{"alice", "bob"}},
+		{"почта alice@example.com", nil},
+		{"@al слишком короткое, @", nil},
+		{"(@carol)", []string{"carol"}},
+	}
+	for _, tt := range tests {
+		if got := ParseMentions(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseMentions(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// ValidateRoomName проверяет валидность имени комнаты
+func ValidateRoomName(name string) bool {
+	if len(name) < 3 || len(name) > 32 {
+		return false
+	}
+
+	// Разрешаем буквы, цифры, подчеркивание и дефис
+	for _, ch := range name {
+		if !((ch >= 'a' && ch <= 'z') ||
+			(ch >= 'A' && ch <= 'Z') ||
+			(ch >= '0' && ch <= '9') ||
+			ch == '_' || ch == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateReaction проверяет реакцию: короткая последовательность символов
+// (эмодзи может состоять из нескольких кодовых точек) без пробелов и
+// управляющих символов. Из ASCII допустимы только цифры, '#' и '*',
+// встречающиеся в эмодзи-клавишах.
+func ValidateReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > 32 || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	for _, ch := range emoji {
+		if unicode.IsSpace(ch) || unicode.IsControl(ch) {
+			return false
+		}
+		if ch < utf8.RuneSelf && !(ch >= '0' && ch <= '9') && ch != '#' && ch != '*' {
+			return false
+		}
+	}
+	return utf8.RuneCountInString(emoji) <= 8
+}
@@ -0,0 +1,34 @@
+package common
+
+import "testing"
+
+func TestValidateRoomName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"team":       true,
+		"dev-ops_1":  true,
+		"ab":         false,
+		"with space": false,
+		"комната":    false,
+	} {
+		if got := ValidateRoomName(name); got != want {
+			t.Errorf("ValidateRoomName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestValidateReaction(t *testing.T) {
+	for emoji, want := range map[string]bool{
+		"👍":     true,
+		"👨‍👩‍👧": true,
+		"#️⃣":   true,
+		"":      false,
+		"ok":    false,
+		"👍 ":    false,
+		"\x00":  false,
+		"\xff":  false,
+	} {
+		if got := ValidateReaction(emoji); got != want {
+			t.Errorf("ValidateReaction(%q) = %v, want %v", emoji, got, want)
+		}
+	}
+}
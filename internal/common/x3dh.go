@@ -0,0 +1,181 @@
+package common
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const x3dhInfo = "secure-messenger/x3dh/v1"
+
+var (
+	ErrInvalidSigningKey   = errors.New("недопустимый ключ подписи")
+	ErrInvalidPrekeySig    = errors.New("недопустимая подпись предключа")
+	ErrInvalidPrekeyBundle = errors.New("недопустимый набор предключей")
+)
+
+// X3DHResult результат X3DH на стороне инициатора
+type X3DHResult struct {
+	// SharedKey общий секрет для ratchet.InitSender
+	SharedKey []byte
+	// AssociatedData IK_A || IK_B, добавляется к associated data каждого сообщения
+	AssociatedData []byte
+	// RatchetKey подписанный предключ собеседника, начальный ключ храповика
+	RatchetKey *ecdh.PublicKey
+	// Header передается в поле Message.X3DH первого сообщения
+	Header X3DHHeader
+}
+
+// ParseSigningKey разбирает публичный ключ Ed25519 из base64
+func ParseSigningKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, ErrInvalidSigningKey
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// SignPrekey подписывает предключ ключом Ed25519
+func SignPrekey(signer ed25519.PrivateKey, keyID uint32, prekey *ecdh.PublicKey) SignedPrekey {
+	return SignedPrekey{
+		KeyID:     keyID,
+		PublicKey: EncodePublicKey(prekey),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(signer, prekey.Bytes())),
+	}
+}
+
+// VerifySignedPrekey проверяет подпись предключа
+func VerifySignedPrekey(signingKey string, spk SignedPrekey) error {
+	pub, err := ParseSigningKey(signingKey)
+	if err != nil {
+		return err
+	}
+	prekey, err := ParsePublicKey(spk.PublicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(spk.Signature)
+	if err != nil || !ed25519.Verify(pub, prekey.Bytes(), sig) {
+		return ErrInvalidPrekeySig
+	}
+	return nil
+}
+
+// X3DHInitiate выполняет X3DH на стороне инициатора по набору предключей собеседника
+func X3DHInitiate(identity *ecdh.PrivateKey, bundle PrekeyBundle) (*X3DHResult, error) {
+	if err := VerifySignedPrekey(bundle.SigningKey, bundle.SignedPrekey); err != nil {
+		return nil, err
+	}
+	peerIdentity, err := ParsePublicKey(bundle.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	spk, err := ParsePublicKey(bundle.SignedPrekey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := []dhPair{
+		{identity, spk},
+		{ephemeral, peerIdentity},
+		{ephemeral, spk},
+	}
+	header := X3DHHeader{
+		IdentityKey:    EncodePublicKey(identity.PublicKey()),
+		EphemeralKey:   EncodePublicKey(ephemeral.PublicKey()),
+		SignedPrekeyID: bundle.SignedPrekey.KeyID,
+	}
+	if bundle.OneTimePrekey != nil {
+		opk, err := ParsePublicKey(bundle.OneTimePrekey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, dhPair{ephemeral, opk})
+		header.OneTimePrekeyID = bundle.OneTimePrekey.KeyID
+	}
+
+	sk, err := x3dhSecret(pairs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &X3DHResult{
+		SharedKey:      sk,
+		AssociatedData: x3dhAssociatedData(identity.PublicKey(), peerIdentity),
+		RatchetKey:     spk,
+		Header:         header,
+	}, nil
+}
+
+// X3DHRespond вычисляет общий секрет на стороне получателя первого сообщения.
+// oneTimePrekey должен быть nil, если header.OneTimePrekeyID равен нулю;
+// после вызова одноразовый предключ следует удалить.
+func X3DHRespond(identity, signedPrekey, oneTimePrekey *ecdh.PrivateKey, header X3DHHeader) ([]byte, []byte, error) {
+	peerIdentity, err := ParsePublicKey(header.IdentityKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := ParsePublicKey(header.EphemeralKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pairs := []dhPair{
+		{signedPrekey, peerIdentity},
+		{identity, ephemeral},
+		{signedPrekey, ephemeral},
+	}
+	if header.OneTimePrekeyID != 0 {
+		if oneTimePrekey == nil {
+			return nil, nil, ErrInvalidPrekeyBundle
+		}
+		pairs = append(pairs, dhPair{oneTimePrekey, ephemeral})
+	}
+
+	sk, err := x3dhSecret(pairs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sk, x3dhAssociatedData(peerIdentity, identity.PublicKey()), nil
+}
+
+type dhPair struct {
+	priv *ecdh.PrivateKey
+	pub  *ecdh.PublicKey
+}
+
+// x3dhSecret SK = HKDF(F || DH1 || DH2 || DH3 [|| DH4]), F = 32 байта 0xFF
+func x3dhSecret(pairs []dhPair) ([]byte, error) {
+	ikm := make([]byte, 32, 32*(len(pairs)+1))
+	for i := range ikm {
+		ikm[i] = 0xFF
+	}
+	for _, p := range pairs {
+		dh, err := p.priv.ECDH(p.pub)
+		if err != nil {
+			return nil, ErrInvalidPublicKey
+		}
+		ikm = append(ikm, dh...)
+	}
+
+	sk := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, nil, []byte(x3dhInfo)), sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+func x3dhAssociatedData(initiator, responder *ecdh.PublicKey) []byte {
+	return append(append([]byte(nil), initiator.Bytes()...), responder.Bytes()...)
+}
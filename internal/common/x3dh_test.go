@@ -0,0 +1,140 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// x3dhResponder ключи отвечающей стороны и опубликованный ею набор
+type x3dhResponder struct {
+	identity, signedPrekey, oneTimePrekey *ecdh.PrivateKey
+	bundle                                PrekeyBundle
+}
+
+func newX3DHKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newX3DHResponder(t *testing.T) x3dhResponder {
+	t.Helper()
+	signingPublic, signingPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := x3dhResponder{
+		identity:      newX3DHKey(t),
+		signedPrekey:  newX3DHKey(t),
+		oneTimePrekey: newX3DHKey(t),
+	}
+	r.bundle = PrekeyBundle{
+		Username:      "bob",
+		IdentityKey:   EncodePublicKey(r.identity.PublicKey()),
+		SigningKey:    base64.StdEncoding.EncodeToString(signingPublic),
+		SignedPrekey:  SignPrekey(signingPrivate, 7, r.signedPrekey.PublicKey()),
+		OneTimePrekey: &Prekey{KeyID: 42, PublicKey: EncodePublicKey(r.oneTimePrekey.PublicKey())},
+	}
+	return r
+}
+
+func TestX3DHAgreement(t *testing.T) {
+	for _, withOneTime := range []bool{true, false} {
+		bob := newX3DHResponder(t)
+		var oneTime *ecdh.PrivateKey
+		if withOneTime {
+			oneTime = bob.oneTimePrekey
+		} else {
+			bob.bundle.OneTimePrekey = nil
+		}
+		alice := newX3DHKey(t)
+
+		result, err := X3DHInitiate(alice, bob.bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := result.Header
+		wantOneTime := uint32(0)
+		if withOneTime {
+			wantOneTime = 42
+		}
+		if header.SignedPrekeyID != 7 || header.OneTimePrekeyID != wantOneTime ||
+			header.IdentityKey != EncodePublicKey(alice.PublicKey()) {
+			t.Fatalf("заголовок (одноразовый %v): %+v", withOneTime, header)
+		}
+		if !result.RatchetKey.Equal(bob.signedPrekey.PublicKey()) {
+			t.Fatal("начальный ключ храповика не подписанный предключ")
+		}
+
+		secret, ad, err := X3DHRespond(bob.identity, bob.signedPrekey, oneTime, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(secret) != 32 || !bytes.Equal(secret, result.SharedKey) {
+			t.Fatalf("общие секреты не совпали (одноразовый %v)", withOneTime)
+		}
+		if !bytes.Equal(ad, result.AssociatedData) ||
+			!bytes.Equal(ad, append(alice.PublicKey().Bytes(), bob.identity.PublicKey().Bytes()...)) {
+			t.Fatalf("associated data не совпали (одноразовый %v)", withOneTime)
+		}
+	}
+}
+
+func TestX3DHOneTimePrekeyMatters(t *testing.T) {
+	bob := newX3DHResponder(t)
+	result, err := X3DHInitiate(newX3DHKey(t), bob.bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Без одноразового предключа, на который ссылается заголовок, сессия
+	// не устанавливается
+	if _, _, err := X3DHRespond(bob.identity, bob.signedPrekey, nil, result.Header); !errors.Is(err, ErrInvalidPrekeyBundle) {
+		t.Fatalf("нет одноразового предключа: %v", err)
+	}
+	secret, _, err := X3DHRespond(bob.identity, bob.signedPrekey, newX3DHKey(t), result.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(secret, result.SharedKey) {
+		t.Fatal("секрет не зависит от одноразового предключа")
+	}
+}
+
+func TestX3DHRejectsBadSignedPrekey(t *testing.T) {
+	alice := newX3DHKey(t)
+
+	// Предключ подменен: подпись относится к другому ключу
+	bob := newX3DHResponder(t)
+	bob.bundle.SignedPrekey.PublicKey = EncodePublicKey(newX3DHKey(t).PublicKey())
+	if _, err := X3DHInitiate(alice, bob.bundle); !errors.Is(err, ErrInvalidPrekeySig) {
+		t.Fatalf("подмененный предключ: %v", err)
+	}
+
+	// Подпись чужим ключом
+	bob = newX3DHResponder(t)
+	_, mallory, _ := ed25519.GenerateKey(nil)
+	bob.bundle.SignedPrekey = SignPrekey(mallory, 7, bob.signedPrekey.PublicKey())
+	if _, err := X3DHInitiate(alice, bob.bundle); !errors.Is(err, ErrInvalidPrekeySig) {
+		t.Fatalf("подпись чужим ключом: %v", err)
+	}
+
+	bob = newX3DHResponder(t)
+	bob.bundle.SignedPrekey.Signature = "не base64"
+	if _, err := X3DHInitiate(alice, bob.bundle); !errors.Is(err, ErrInvalidPrekeySig) {
+		t.Fatalf("испорченная подпись: %v", err)
+	}
+
+	bob = newX3DHResponder(t)
+	bob.bundle.SigningKey = "AAAA"
+	if _, err := X3DHInitiate(alice, bob.bundle); !errors.Is(err, ErrInvalidSigningKey) {
+		t.Fatalf("недопустимый ключ подписи: %v", err)
+	}
+}
@@ -0,0 +1,455 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+const (
+	// DefaultMaxAttachmentSize наибольший размер одного вложения
+	DefaultMaxAttachmentSize = 25 << 20
+	// DefaultAttachmentQuota суммарный объем вложений и незавершенных
+	// загрузок одного пользователя
+	DefaultAttachmentQuota = 100 << 20
+	// UploadChunkSize рекомендуемый клиентам размер части загрузки
+	UploadChunkSize = 256 << 10
+	// MaxUploadChunkSize наибольшая часть, принимаемая за один запрос
+	MaxUploadChunkSize = 4 << 20
+	// MaxAttachmentsPerMessage ограничивает число вложений в сообщении
+	MaxAttachmentsPerMessage = 10
+
+	// uploadTTL сколько хранится незавершенная загрузка
+	uploadTTL = 24 * time.Hour
+)
+
+var (
+	ErrAttachmentsDisabled = errors.New("вложения не поддерживаются")
+	ErrAttachmentNotFound  = errors.New("вложение не найдено")
+	ErrAttachmentTooLarge  = errors.New("вложение слишком большое")
+	ErrQuotaExceeded       = errors.New("превышена квота на вложения")
+	ErrUploadOffset        = errors.New("неверное смещение части загрузки")
+	ErrUploadBusy          = errors.New("загрузка уже выполняется")
+)
+
+// attachmentRecord завершенное вложение. Conversations - диалоги, в
+// которые оно отправлено: их участники могут его скачать.
+type attachmentRecord struct {
+	ID            string    `json:"id"`
+	Owner         string    `json:"owner"`
+	Hash          string    `json:"hash"`
+	Size          int64     `json:"size"`
+	MimeType      string    `json:"mime_type"`
+	CreatedAt     time.Time `json:"created_at"`
+	Conversations []string  `json:"conversations,omitempty"`
+}
+
+func (rec *attachmentRecord) attachment() common.Attachment {
+	return common.Attachment{
+		ID:       rec.ID,
+		Size:     rec.Size,
+		MimeType: rec.MimeType,
+		Hash:     rec.Hash,
+	}
+}
+
+// uploadRecord незавершенная загрузка; принятые байты лежат в BlobStore
+type uploadRecord struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	MimeType  string    `json:"mime_type"`
+	CreatedAt time.Time `json:"created_at"`
+
+	busy bool // часть загрузки сейчас принимается
+}
+
+// SetBlobStore подключает хранилище содержимого вложений; без него
+// вложения отключены
+func (um *UserManager) SetBlobStore(blobs *BlobStore) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.blobs = blobs
+}
+
+// SetAttachmentLimits задает наибольший размер вложения и квоту пользователя
+func (um *UserManager) SetAttachmentLimits(maxSize, quota int64) error {
+	if maxSize <= 0 || quota < maxSize {
+		return errors.New("квота должна быть не меньше положительного размера вложения")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.maxAttachmentSize = maxSize
+	um.attachmentQuota = quota
+	return nil
+}
+
+// StartUpload начинает загрузку зашифрованного вложения, если оно
+// помещается в квоту пользователя
+func (um *UserManager) StartUpload(username string, req common.UploadRequest) (common.UploadStatus, error) {
+	if !validBlobHash(req.Hash) {
+		return common.UploadStatus{}, errors.New("хэш должен быть SHA-256 в hex")
+	}
+	if req.MimeType == "" {
+		req.MimeType = "application/octet-stream"
+	}
+	if len(req.MimeType) > 100 || !strings.Contains(req.MimeType, "/") {
+		return common.UploadStatus{}, errors.New("неверный MIME-тип")
+	}
+	id, err := common.GenerateMessageID()
+	if err != nil {
+		return common.UploadStatus{}, errors.New("ошибка генерации ID загрузки")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if um.blobs == nil {
+		return common.UploadStatus{}, ErrAttachmentsDisabled
+	}
+	if req.Size <= 0 || req.Size > um.maxAttachmentSize {
+		return common.UploadStatus{}, ErrAttachmentTooLarge
+	}
+	if um.attachmentUsage(username)+req.Size > um.attachmentQuota {
+		return common.UploadStatus{}, ErrQuotaExceeded
+	}
+
+	upload := &uploadRecord{
+		ID:        id,
+		Owner:     username,
+		Hash:      req.Hash,
+		Size:      req.Size,
+		MimeType:  req.MimeType,
+		CreatedAt: time.Now(),
+	}
+	um.uploads[id] = upload
+	um.persist(bucketUploads, id, upload)
+
+	return common.UploadStatus{ID: id, Size: upload.Size, ChunkSize: UploadChunkSize}, nil
+}
+
+// UploadStatus возвращает, сколько байт загрузки уже принято
+func (um *UserManager) UploadStatus(username, id string) (common.UploadStatus, error) {
+	um.mu.RLock()
+	upload, exists := um.uploads[id]
+	blobs := um.blobs
+	um.mu.RUnlock()
+	if blobs == nil {
+		return common.UploadStatus{}, ErrAttachmentsDisabled
+	}
+	if !exists || upload.Owner != username {
+		return common.UploadStatus{}, ErrAttachmentNotFound
+	}
+
+	offset, err := blobs.UploadSize(id)
+	if err != nil {
+		return common.UploadStatus{}, err
+	}
+	return common.UploadStatus{ID: id, Size: upload.Size, Offset: offset, ChunkSize: UploadChunkSize}, nil
+}
+
+// WriteUpload принимает часть загрузки начиная с offset. Часть должна
+// продолжать уже принятые данные; при ErrUploadOffset статус содержит
+// смещение, с которого нужно продолжить. После последней части
+// содержимое проверяется по хэшу и становится вложением.
+func (um *UserManager) WriteUpload(username, id string, offset int64, body io.Reader) (common.UploadStatus, error) {
+	um.mu.Lock()
+	upload, exists := um.uploads[id]
+	blobs := um.blobs
+	if blobs == nil {
+		um.mu.Unlock()
+		return common.UploadStatus{}, ErrAttachmentsDisabled
+	}
+	if !exists || upload.Owner != username {
+		um.mu.Unlock()
+		return common.UploadStatus{}, ErrAttachmentNotFound
+	}
+	if upload.busy {
+		um.mu.Unlock()
+		return common.UploadStatus{}, ErrUploadBusy
+	}
+	// Запись на диск идет без общей блокировки; параллельные части одной
+	// загрузки отклоняются
+	upload.busy = true
+	um.mu.Unlock()
+	defer func() {
+		um.mu.Lock()
+		upload.busy = false
+		um.mu.Unlock()
+	}()
+
+	status := common.UploadStatus{ID: id, Size: upload.Size, ChunkSize: UploadChunkSize}
+	current, err := blobs.UploadSize(id)
+	if err != nil {
+		return status, err
+	}
+	status.Offset = current
+	if offset != current {
+		return status, ErrUploadOffset
+	}
+
+	status.Offset, err = blobs.AppendUpload(id, offset, upload.Size, body)
+	if err != nil || status.Offset < upload.Size {
+		return status, err
+	}
+
+	attachmentID, err := common.GenerateMessageID()
+	if err != nil {
+		return status, errors.New("ошибка генерации ID вложения")
+	}
+	if err := blobs.VerifyUpload(id, upload.Hash); err != nil {
+		if errors.Is(err, errHashMismatch) {
+			// Содержимое уже удалено, загрузку нужно начать заново
+			um.mu.Lock()
+			delete(um.uploads, id)
+			um.removeFromStore(bucketUploads, id)
+			um.mu.Unlock()
+		}
+		return status, err
+	}
+
+	rec := &attachmentRecord{
+		ID:        attachmentID,
+		Owner:     upload.Owner,
+		Hash:      upload.Hash,
+		Size:      upload.Size,
+		MimeType:  upload.MimeType,
+		CreatedAt: time.Now(),
+	}
+
+	// Перенос в хранилище и запись вложения идут под блокировкой: иначе
+	// removeAttachment другого вложения с тем же содержимым может удалить
+	// файл между ними
+	um.mu.Lock()
+	if err := blobs.CommitUpload(id, upload.Hash); err != nil {
+		um.mu.Unlock()
+		return status, err
+	}
+	delete(um.uploads, id)
+	um.removeFromStore(bucketUploads, id)
+	um.attachments[rec.ID] = rec
+	um.persist(bucketAttachments, rec.ID, rec)
+	um.mu.Unlock()
+
+	attachment := rec.attachment()
+	status.Attachment = &attachment
+	return status, nil
+}
+
+// CancelUpload отменяет незавершенную загрузку и освобождает квоту
+func (um *UserManager) CancelUpload(username, id string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if um.blobs == nil {
+		return ErrAttachmentsDisabled
+	}
+	upload, exists := um.uploads[id]
+	if !exists || upload.Owner != username {
+		return ErrAttachmentNotFound
+	}
+	if upload.busy {
+		return ErrUploadBusy
+	}
+	delete(um.uploads, id)
+	um.removeFromStore(bucketUploads, id)
+	return um.blobs.DiscardUpload(id)
+}
+
+// OpenAttachment открывает содержимое вложения. Скачать вложение может
+// его владелец и участники диалогов, в которые оно отправлено.
+func (um *UserManager) OpenAttachment(username, id string) (common.Attachment, *os.File, error) {
+	um.mu.RLock()
+	rec, exists := um.attachments[id]
+	blobs := um.blobs
+	if blobs == nil {
+		um.mu.RUnlock()
+		return common.Attachment{}, nil, ErrAttachmentsDisabled
+	}
+	if !exists || !um.canAccessAttachment(rec, username) {
+		um.mu.RUnlock()
+		return common.Attachment{}, nil, ErrAttachmentNotFound
+	}
+	attachment := rec.attachment()
+	um.mu.RUnlock()
+
+	f, err := blobs.Open(attachment.Hash)
+	if err != nil {
+		return common.Attachment{}, nil, err
+	}
+	return attachment, f, nil
+}
+
+// DeleteAttachment удаляет вложение владельца; содержимое удаляется, когда
+// на него не ссылаются другие вложения
+func (um *UserManager) DeleteAttachment(username, id string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if um.blobs == nil {
+		return ErrAttachmentsDisabled
+	}
+	rec, exists := um.attachments[id]
+	if !exists || rec.Owner != username {
+		return ErrAttachmentNotFound
+	}
+	return um.removeAttachment(rec)
+}
+
+// removeAttachment удаляет запись вложения и его содержимое, если другие
+// записи на него не ссылаются; вызывается под um.mu
+func (um *UserManager) removeAttachment(rec *attachmentRecord) error {
+	delete(um.attachments, rec.ID)
+	um.removeFromStore(bucketAttachments, rec.ID)
+
+	for _, other := range um.attachments {
+		if other.Hash == rec.Hash {
+			return nil
+		}
+	}
+	return um.blobs.Delete(rec.Hash)
+}
+
+// CleanupUploads удаляет загрузки, не завершенные за uploadTTL
+func (um *UserManager) CleanupUploads() {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if um.blobs == nil {
+		return
+	}
+	for id, upload := range um.uploads {
+		if upload.busy || time.Since(upload.CreatedAt) < uploadTTL {
+			continue
+		}
+		delete(um.uploads, id)
+		um.removeFromStore(bucketUploads, id)
+		if err := um.blobs.DiscardUpload(id); err != nil {
+			log.Printf("Upload cleanup error (%s): %v", id, err)
+		}
+	}
+}
+
+// bindAttachments проверяет вложения сообщения и открывает к ним доступ
+// участникам диалога. Отправить можно свое вложение или уже доступное
+// отправителю; метаданные берутся из записи, ключ - из сообщения.
+// Вызывается под um.mu.
+func (um *UserManager) bindAttachments(msg common.Message, conversation string) ([]common.Attachment, error) {
+	if len(msg.Attachments) == 0 {
+		return nil, nil
+	}
+	if len(msg.Attachments) > MaxAttachmentsPerMessage {
+		return nil, errors.New("слишком много вложений в сообщении")
+	}
+
+	records := make([]*attachmentRecord, 0, len(msg.Attachments))
+	attachments := make([]common.Attachment, 0, len(msg.Attachments))
+	for _, requested := range msg.Attachments {
+		rec, exists := um.attachments[requested.ID]
+		if !exists || !um.canAccessAttachment(rec, msg.Sender) {
+			return nil, ErrAttachmentNotFound
+		}
+		// Хэш подписан отправителем и должен совпадать с сохраненным
+		if requested.Hash != "" && requested.Hash != rec.Hash {
+			return nil, errors.New("хэш вложения не совпадает")
+		}
+		records = append(records, rec)
+
+		attachment := rec.attachment()
+		attachment.Key = requested.Key
+		attachments = append(attachments, attachment)
+	}
+
+	for _, rec := range records {
+		i := sort.SearchStrings(rec.Conversations, conversation)
+		if i < len(rec.Conversations) && rec.Conversations[i] == conversation {
+			continue
+		}
+		rec.Conversations = append(rec.Conversations, "")
+		copy(rec.Conversations[i+1:], rec.Conversations[i:])
+		rec.Conversations[i] = conversation
+		um.persist(bucketAttachments, rec.ID, rec)
+	}
+	return attachments, nil
+}
+
+// releaseAttachments закрывает доступ к вложениям исчезнувшего сообщения
+// в его диалоге, если их не несут другие сообщения диалога. Вложение,
+// не оставшееся ни в одном диалоге, удаляется. Вызывается под um.mu
+// после удаления сообщения из индексов.
+func (um *UserManager) releaseAttachments(msg *MessageHistory) {
+	for _, attachment := range msg.Attachments {
+		rec, exists := um.attachments[attachment.ID]
+		if !exists || um.attachmentInConversation(attachment.ID, msg.Conversation) {
+			continue
+		}
+
+		i := sort.SearchStrings(rec.Conversations, msg.Conversation)
+		if i == len(rec.Conversations) || rec.Conversations[i] != msg.Conversation {
+			continue
+		}
+		if len(rec.Conversations) == 1 {
+			if um.blobs != nil {
+				if err := um.removeAttachment(rec); err != nil {
+					log.Printf("Attachment delete error (%s): %v", rec.ID, err)
+				}
+			}
+			continue
+		}
+		rec.Conversations = append(rec.Conversations[:i], rec.Conversations[i+1:]...)
+		um.persist(bucketAttachments, rec.ID, rec)
+	}
+}
+
+// attachmentInConversation проверяет, несет ли вложение какое-либо
+// сообщение диалога; вызывается под um.mu
+func (um *UserManager) attachmentInConversation(id, conversation string) bool {
+	for _, msg := range um.conversations[conversation] {
+		for _, attachment := range msg.Attachments {
+			if attachment.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canAccessAttachment вызывается под um.mu
+func (um *UserManager) canAccessAttachment(rec *attachmentRecord, username string) bool {
+	if rec.Owner == username {
+		return true
+	}
+	for _, conversation := range rec.Conversations {
+		if um.canSee(conversation, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentUsage возвращает объем вложений и загрузок пользователя;
+// вызывается под um.mu
+func (um *UserManager) attachmentUsage(username string) int64 {
+	var total int64
+	for _, rec := range um.attachments {
+		if rec.Owner == username {
+			total += rec.Size
+		}
+	}
+	for _, upload := range um.uploads {
+		if upload.Owner == username {
+			total += upload.Size
+		}
+	}
+	return total
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+// uploadAttachment загружает содержимое одной частью и возвращает вложение
+func uploadAttachment(um *UserManager, username string, content []byte) (common.Attachment, error) {
+	sum := sha256.Sum256(content)
+	status, err := um.StartUpload(username, common.UploadRequest{
+		Hash: hex.EncodeToString(sum[:]), Size: int64(len(content)), MimeType: "text/plain",
+	})
+	if err != nil {
+		return common.Attachment{}, err
+	}
+	status, err = um.WriteUpload(username, status.ID, 0, bytes.NewReader(content))
+	if err != nil {
+		return common.Attachment{}, err
+	}
+	return *status.Attachment, nil
+}
+
+func newAttachmentManager(t *testing.T) (*UserManager, *BlobStore) {
+	t.Helper()
+	um := newTestUserManager(t, "alice", "bob")
+	blobs, err := OpenBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.SetBlobStore(blobs)
+	return um, blobs
+}
+
+func TestSharedBlobOutlivesOneAttachment(t *testing.T) {
+	um, blobs := newAttachmentManager(t)
+	content := []byte("одинаковое содержимое")
+
+	first, err := uploadAttachment(um, "alice", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Содержимое уже есть: загрузка bob ссылается на тот же файл
+	second, err := uploadAttachment(um, "bob", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Hash != second.Hash || first.ID == second.ID {
+		t.Fatalf("вложения %+v и %+v", first, second)
+	}
+
+	if err := um.DeleteAttachment("alice", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, f, err := um.OpenAttachment("bob", second.ID)
+	if err != nil {
+		t.Fatalf("содержимое удалено вместе с чужим вложением: %v", err)
+	}
+	f.Close()
+
+	if err := um.DeleteAttachment("bob", second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := blobs.Open(second.Hash); err == nil {
+		f.Close()
+		t.Fatal("содержимое без ссылок не удалено")
+	}
+}
+
+// Запускать с -race: загрузка того же содержимого завершается одновременно
+// с удалением другого вложения
+func TestUploadCommitConcurrentDelete(t *testing.T) {
+	um, _ := newAttachmentManager(t)
+	content := []byte("одинаковое содержимое")
+
+	for round := 0; round < 50; round++ {
+		first, err := uploadAttachment(um, "alice", content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var second common.Attachment
+		var uploadErr, deleteErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			second, uploadErr = uploadAttachment(um, "bob", content)
+		}()
+		go func() {
+			defer wg.Done()
+			deleteErr = um.DeleteAttachment("alice", first.ID)
+		}()
+		wg.Wait()
+		if uploadErr != nil || deleteErr != nil {
+			t.Fatalf("раунд %d: загрузка %v, удаление %v", round, uploadErr, deleteErr)
+		}
+
+		_, f, err := um.OpenAttachment("bob", second.ID)
+		if err != nil {
+			t.Fatalf("раунд %d: содержимое вложения пропало: %v", round, err)
+		}
+		f.Close()
+		if err := um.DeleteAttachment("bob", second.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeleteMessageReleasesAttachment(t *testing.T) {
+	um, blobs := newAttachmentManager(t)
+	attachment, err := uploadAttachment(um, "alice", []byte("вложение"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := um.AddMessage(common.Message{
+		Type: common.MsgPrivate, Sender: "alice", Recipient: "bob", Content: "v1",
+		Attachments: []common.Attachment{{ID: attachment.ID, Hash: attachment.Hash}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Событие правки несет копию вложений
+	if _, err := um.EditMessage("alice", common.Message{Type: common.MsgEdit, Target: msg.ID, Content: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	_, f, err := um.OpenAttachment("bob", attachment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := um.DeleteMessage("alice", msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := um.OpenAttachment("bob", attachment.ID); err != ErrAttachmentNotFound {
+		t.Fatalf("вложение удаленного сообщения открывается: %v", err)
+	}
+	um.mu.RLock()
+	used := um.attachmentUsage("alice")
+	um.mu.RUnlock()
+	if used != 0 {
+		t.Fatalf("квота не освобождена: %d", used)
+	}
+	if f, err := blobs.Open(attachment.Hash); err == nil {
+		f.Close()
+		t.Fatal("содержимое вложения не удалено")
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	errChunkTooLarge = errors.New("часть выходит за объявленный размер файла")
+	errHashMismatch  = errors.New("хэш загруженного файла не совпадает с объявленным")
+)
+
+// BlobStore хранилище зашифрованных вложений на диске с адресацией по
+// содержимому: blobs/<первые 2 символа хэша>/<SHA-256 hex>. Незавершенные
+// загрузки лежат в uploads/<ID загрузки> и дописываются частями.
+// Сервер не видит содержимого: клиенты загружают уже зашифрованные данные.
+type BlobStore struct {
+	dir string
+}
+
+// OpenBlobStore открывает (или создает) хранилище вложений в каталоге dir
+func OpenBlobStore(dir string) (*BlobStore, error) {
+	for _, sub := range []string{"blobs", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &BlobStore{dir: dir}, nil
+}
+
+func (bs *BlobStore) uploadPath(id string) string {
+	return filepath.Join(bs.dir, "uploads", id)
+}
+
+func (bs *BlobStore) blobPath(hash string) string {
+	return filepath.Join(bs.dir, "blobs", hash[:2], hash)
+}
+
+// UploadSize возвращает, сколько байт загрузки уже записано на диск
+func (bs *BlobStore) UploadSize(id string) (int64, error) {
+	info, err := os.Stat(bs.uploadPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// AppendUpload дописывает часть загрузки начиная с offset, не выходя за
+// limit байт всего. Возвращает новый размер загрузки; при обрыве чтения
+// записанное сохраняется, и загрузку можно продолжить с этого места.
+// Если все данные уже приняты, пустая часть завершает загрузку.
+func (bs *BlobStore) AppendUpload(id string, offset, limit int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(bs.uploadPath(id), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Хвост от неудачной записи за offset отбрасывается
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(f, io.LimitReader(r, limit-offset))
+	size := offset + written
+	if err != nil {
+		return size, err
+	}
+	// Часть с данными сверх объявленного размера отклоняется целиком
+	var extra [1]byte
+	if n, _ := r.Read(extra[:]); n > 0 {
+		if err := f.Truncate(offset); err != nil {
+			return size, err
+		}
+		return offset, errChunkTooLarge
+	}
+	return size, f.Sync()
+}
+
+// VerifyUpload проверяет SHA-256 завершенной загрузки; при несовпадении
+// загрузка удаляется
+func (bs *BlobStore) VerifyUpload(id, hash string) error {
+	path := bs.uploadPath(id)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		os.Remove(path)
+		return errHashMismatch
+	}
+	return nil
+}
+
+// CommitUpload переносит проверенную загрузку в хранилище под ее хэшем.
+// Одинаковое содержимое хранится один раз, поэтому вызывающий должен
+// исключить параллельный Delete того же хэша, пока не сохранит ссылку
+// на содержимое.
+func (bs *BlobStore) CommitUpload(id, hash string) error {
+	path := bs.uploadPath(id)
+	target := bs.blobPath(hash)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(target); err == nil {
+		return os.Remove(path)
+	}
+	return os.Rename(path, target)
+}
+
+// DiscardUpload удаляет незавершенную загрузку
+func (bs *BlobStore) DiscardUpload(id string) error {
+	err := os.Remove(bs.uploadPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Open открывает содержимое по хэшу
+func (bs *BlobStore) Open(hash string) (*os.File, error) {
+	if !validBlobHash(hash) {
+		return nil, fmt.Errorf("неверный хэш вложения %q", hash)
+	}
+	return os.Open(bs.blobPath(hash))
+}
+
+// Delete удаляет содержимое по хэшу; отсутствие не является ошибкой
+func (bs *BlobStore) Delete(hash string) error {
+	if !validBlobHash(hash) {
+		return fmt.Errorf("неверный хэш вложения %q", hash)
+	}
+	err := os.Remove(bs.blobPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// validBlobHash проверяет, что хэш - SHA-256 в нижнем регистре hex;
+// он же используется как имя файла
+func validBlobHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, ch := range hash {
+		if !((ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"secure-messenger/internal/common"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait время на запись одного кадра
+	writeWait = 10 * time.Second
+	// sendBufferSize размер очереди исходящих сообщений клиента
+	sendBufferSize = 256
+)
+
+// Client WebSocket-соединение пользователя. gorilla/websocket не допускает
+// конкурентной записи, поэтому все исходящие сообщения проходят через
+// буферизованный канал send, который читает единственная горутина writePump.
+type Client struct {
+	username     string
+	sessionToken string
+	conn         *websocket.Conn
+	send         chan []byte
+	done         chan struct{}
+	closeOnce    sync.Once
+	clock        clock
+	pingInterval time.Duration
+	pongWait     time.Duration
+	lastRead     atomic.Int64 // время последнего входящего кадра, UnixNano
+}
+
+func newClient(conn *websocket.Conn, username, sessionToken string, clk clock, pingInterval, pongWait time.Duration) *Client {
+	c := &Client{
+		username:     username,
+		sessionToken: sessionToken,
+		conn:         conn,
+		send:         make(chan []byte, sendBufferSize),
+		done:         make(chan struct{}),
+		clock:        clk,
+		pingInterval: pingInterval,
+		pongWait:     pongWait,
+	}
+	c.touch()
+	return c
+}
+
+// touch отмечает входящий кадр: сообщение, ping или pong
+func (c *Client) touch() {
+	c.lastRead.Store(c.clock.Now().UnixNano())
+}
+
+// idle возвращает время с последнего входящего кадра
+func (c *Client) idle() time.Duration {
+	return c.clock.Now().Sub(time.Unix(0, c.lastRead.Load()))
+}
+
+// Send ставит сообщение в очередь без блокировки. Если очередь заполнена,
+// клиент считается медленным и отключается.
+func (c *Client) Send(data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return false
+	default:
+		log.Printf("⚠️ Slow client %s disconnected: send buffer full", c.username)
+		c.Close()
+		return false
+	}
+}
+
+// SendWait ставит сообщение в очередь, ожидая свободного места до writeWait.
+// Используется читающей горутиной самого клиента для больших пакетов
+// (например, истории), где временное заполнение буфера ожидаемо.
+func (c *Client) SendWait(data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return false
+	case <-timer.C:
+		log.Printf("⚠️ Slow client %s disconnected: send timeout", c.username)
+		c.Close()
+		return false
+	}
+}
+
+// SendJSON сериализует сообщение и ставит его в очередь
+func (c *Client) SendJSON(msg common.Message) bool {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("JSON marshal error:", err)
+		return false
+	}
+	return c.Send(data)
+}
+
+// SendJSONWait как SendJSON, но с ожиданием места в очереди
+func (c *Client) SendJSONWait(msg common.Message) bool {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("JSON marshal error:", err)
+		return false
+	}
+	return c.SendWait(data)
+}
+
+// SendError отправляет клиенту сообщение об ошибке
+func (c *Client) SendError(message string) {
+	c.SendJSON(common.Message{
+		Type:    common.MsgError,
+		Content: message,
+	})
+}
+
+// Close закрывает соединение; безопасно вызывать многократно
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// writePump единственный писатель в соединение; также периодически
+// отправляет протокольный ping, чтобы обнаруживать полуоткрытые соединения.
+// Соединение, от которого дольше pongWait не было ни одного кадра,
+// закрывается на ближайшем тике.
+func (c *Client) writePump() {
+	ticker := c.clock.NewTicker(c.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(c.clock.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C():
+			if c.idle() > c.pongWait {
+				log.Printf("⚠️ Client %s disconnected: no pong", c.username)
+				return
+			}
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, c.clock.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
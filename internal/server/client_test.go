@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"secure-messenger/internal/common"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair возвращает серверную и клиентскую стороны соединения
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(ts.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return <-accepted, peer
+}
+
+// Запускать с -race: Send, SendWait и Close из разных горутин
+func TestClientSendConcurrentClose(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		conn, peer := wsPair(t)
+		client := newClient(conn, "alice", "token", systemClock{}, time.Hour, 2*time.Hour)
+		go client.writePump()
+		drain(peer)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if i%4 == 0 {
+						client.SendWait([]byte(`{"type":"ping"}`))
+					} else {
+						client.Send([]byte(`{"type":"ping"}`))
+					}
+					if i == 0 && j == 50 {
+						client.Close()
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if client.Send([]byte("{}")) || client.SendWait([]byte("{}")) {
+			t.Fatal("закрытый клиент принял сообщение")
+		}
+	}
+}
+
+// Рассылка идет, пока устройства подключаются и отключаются; часть из них
+// сервер сам отключает как медленные, когда заполняется очередь
+func TestSendDuringUnregister(t *testing.T) {
+	s, ts := newTestServer(t, "alice", "bob")
+
+	stop := make(chan struct{})
+	var senders sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		senders.Add(1)
+		go func(i int) {
+			defer senders.Done()
+			msg := common.Message{Type: common.MsgTyping, Sender: "bob", Recipient: "alice"}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if i%2 == 0 {
+					s.sendToUser("alice", msg)
+				} else {
+					s.broadcastToAll(msg)
+				}
+				time.Sleep(10 * time.Microsecond)
+			}
+		}(i)
+	}
+
+	for round := 0; round < 3; round++ {
+		var conns []*websocket.Conn
+		for i := 0; i < 8; i++ {
+			conn := dialUser(t, s, ts, "alice")
+			// Приветствие (или отключение медленного клиента) приходит
+			// после регистрации устройства
+			if _, _, err := conn.ReadMessage(); err == nil {
+				drain(conn)
+			}
+			conns = append(conns, conn)
+		}
+
+		var closers sync.WaitGroup
+		for _, conn := range conns {
+			closers.Add(1)
+			go func(conn *websocket.Conn) {
+				defer closers.Done()
+				conn.Close()
+			}(conn)
+		}
+		closers.Wait()
+		waitFor(t, "отключение устройств", func() bool {
+			return len(s.snapshotClients("alice")) == 0 && len(s.userManager.GetOnlineUsers()) == 0
+		})
+	}
+	close(stop)
+	senders.Wait()
+}
@@ -0,0 +1,39 @@
+package server
+
+import "time"
+
+// clock источник времени WebSocket-сервера: пульс соединений, сроки
+// ожидания и время событий. В тестах подменяется управляемыми часами.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker периодический сигнал часов
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock системные часы
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
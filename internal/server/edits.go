@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+// DefaultEditWindow сколько времени после отправки сообщение можно
+// редактировать или удалить
+const DefaultEditWindow = 15 * time.Minute
+
+var (
+	ErrEditForbidden     = errors.New("можно изменять только свои сообщения")
+	ErrEditWindowExpired = errors.New("время на изменение сообщения истекло")
+)
+
+// SetEditWindow задает окно редактирования и удаления сообщений
+func (um *UserManager) SetEditWindow(window time.Duration) error {
+	if window <= 0 {
+		return errors.New("окно редактирования должно быть положительным")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.editWindow = window
+	return nil
+}
+
+// EditMessage заменяет содержимое сообщения, сохраняя прежнюю версию
+// в истории правок. В диалог записывается событие edit со своим порядковым
+// номером, чтобы правку получили и синхронизирующиеся позже клиенты.
+func (um *UserManager) EditMessage(username string, edit common.Message) (MessageHistory, error) {
+	id, err := common.GenerateMessageID()
+	if err != nil {
+		return MessageHistory{}, errors.New("ошибка генерации ID сообщения")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	target, err := um.editableMessage(username, edit.Target)
+	if err != nil {
+		return MessageHistory{}, err
+	}
+	if err := um.checkSenderKey(edit, target.Conversation); err != nil {
+		return MessageHistory{}, err
+	}
+	// Правка подписывается как новая версия сообщения с его адресатами
+	// и вложениями
+	edit.Sender, edit.Recipient, edit.Room = target.Sender, target.Recipient, target.Room
+	edit.Attachments = target.Attachments
+	if err := um.checkSignature(edit); err != nil {
+		return MessageHistory{}, err
+	}
+
+	now := time.Now()
+	target.Edits = append(target.Edits, common.MessageEdit{
+		Content:     target.Content,
+		IV:          target.IV,
+		AuthTag:     target.AuthTag,
+		RatchetKey:  target.RatchetKey,
+		PrevCounter: target.PrevCounter,
+		Counter:     target.Counter,
+		KeyID:       target.KeyID,
+		Epoch:       target.Epoch,
+		Signature:   target.Signature,
+		SignedAt:    target.SignedAt,
+		EditedAt:    now,
+	})
+	target.Content = edit.Content
+	target.IV = edit.IV
+	target.AuthTag = edit.AuthTag
+	target.RatchetKey = edit.RatchetKey
+	target.PrevCounter = edit.PrevCounter
+	target.Counter = edit.Counter
+	target.KeyID = edit.KeyID
+	target.Epoch = edit.Epoch
+	target.Signature = edit.Signature
+	target.SignedAt = edit.SignedAt
+	target.EditedAt = now
+	um.persist(bucketMessages, target.storeKey, target)
+	um.updateMailbox(target)
+	um.updateMentions(target)
+
+	return *um.appendMessage(id, target.Conversation, um.eventFor(common.MsgEdit, target)), nil
+}
+
+// DeleteMessage стирает содержимое сообщения вместе с историей правок;
+// в истории остается пустая запись с пометкой Deleted
+func (um *UserManager) DeleteMessage(username, targetID string) (MessageHistory, error) {
+	id, err := common.GenerateMessageID()
+	if err != nil {
+		return MessageHistory{}, errors.New("ошибка генерации ID сообщения")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	target, err := um.editableMessage(username, targetID)
+	if err != nil {
+		return MessageHistory{}, err
+	}
+
+	target.Content = ""
+	target.IV = ""
+	target.AuthTag = ""
+	target.RatchetKey = ""
+	target.PrevCounter = 0
+	target.Counter = 0
+	target.KeyID = ""
+	target.Epoch = 0
+	target.Signature = ""
+	target.SignedAt = time.Time{}
+	target.X3DH = nil
+	target.Edits = nil
+	released := *target
+	target.Attachments = nil
+	target.Deleted = true
+	um.persist(bucketMessages, target.storeKey, target)
+	um.takeFromMailbox(target.Recipient, target.ID)
+	um.updateMentions(target)
+
+	// События правок несут копии текста и вложений и тоже стираются
+	msgs := um.conversations[target.Conversation]
+	from := sort.Search(len(msgs), func(i int) bool { return msgs[i].order > target.order })
+	for _, event := range msgs[from:] {
+		if event.Type == common.MsgEdit && event.Target == target.ID {
+			event.Content, event.IV, event.AuthTag = "", "", ""
+			event.RatchetKey, event.PrevCounter, event.Counter = "", 0, 0
+			event.KeyID, event.Epoch = "", 0
+			event.Signature, event.SignedAt = "", time.Time{}
+			event.Attachments = nil
+			um.persist(bucketMessages, event.storeKey, event)
+		}
+	}
+	// Вложения отзываются, когда на них не осталось ссылок в диалоге
+	um.releaseAttachments(&released)
+
+	return *um.appendMessage(id, target.Conversation, um.eventFor(common.MsgDelete, target)), nil
+}
+
+// editableMessage находит сообщение, которое пользователь может изменить;
+// вызывается под um.mu
+func (um *UserManager) editableMessage(username, id string) (*MessageHistory, error) {
+	target, exists := um.messageIndex[id]
+	if !exists || target.Deleted {
+		return nil, ErrMessageNotFound
+	}
+	switch target.Type {
+	case common.MsgGeneral, common.MsgPrivate, common.MsgRoomMessage:
+	default:
+		return nil, ErrMessageNotFound
+	}
+	if target.Sender != username {
+		return nil, ErrEditForbidden
+	}
+	if time.Since(target.Timestamp) > um.editWindow {
+		return nil, ErrEditWindowExpired
+	}
+	return target, nil
+}
+
+// eventFor описывает событие над сообщением с теми же адресатами,
+// что и исходное сообщение
+func (um *UserManager) eventFor(eventType string, target *MessageHistory) common.Message {
+	return common.Message{
+		Type:        eventType,
+		Sender:      target.Sender,
+		Recipient:   target.Recipient,
+		Room:        target.Room,
+		Target:      target.ID,
+		Content:     target.Content,
+		IV:          target.IV,
+		AuthTag:     target.AuthTag,
+		RatchetKey:  target.RatchetKey,
+		PrevCounter: target.PrevCounter,
+		Counter:     target.Counter,
+		KeyID:       target.KeyID,
+		Epoch:       target.Epoch,
+		Signature:   target.Signature,
+		SignedAt:    target.SignedAt,
+		Attachments: target.Attachments,
+	}
+}
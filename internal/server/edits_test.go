@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+func TestEditKeepsPreviousVersionVerifiable(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey := base64.StdEncoding.EncodeToString(public)
+	store := NewMemoryStore()
+	store.Put(bucketUsers, "alice", []byte(`{"username":"alice","signing_key":"`+signingKey+`"}`))
+	store.Put(bucketUsers, "bob", []byte(`{"username":"bob"}`))
+	um, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := common.Message{
+		Type: common.MsgPrivate, Sender: "alice", Recipient: "bob",
+		Content: "v1", IV: "iv1", AuthTag: "tag1",
+		RatchetKey: "rk1", PrevCounter: 2, Counter: 5,
+	}
+	common.SignMessage(private, &original)
+	msg, err := um.AddMessage(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edit := common.Message{
+		Type: common.MsgEdit, Target: msg.ID, Sender: "alice", Recipient: "bob",
+		Content: "v2", IV: "iv2", AuthTag: "tag2",
+		RatchetKey: "rk2", PrevCounter: 5, Counter: 0,
+	}
+	common.SignMessage(private, &edit)
+	if _, err := um.EditMessage("alice", edit); err != nil {
+		t.Fatal(err)
+	}
+
+	um.mu.RLock()
+	edits := um.messageIndex[msg.ID].Edits
+	um.mu.RUnlock()
+	if len(edits) != 1 {
+		t.Fatalf("правок: %d", len(edits))
+	}
+	prev := edits[0]
+	// Прежняя версия собирается обратно в сообщение с исходной подписью
+	restored := common.Message{
+		Sender: "alice", Recipient: "bob",
+		Content: prev.Content, IV: prev.IV, AuthTag: prev.AuthTag,
+		RatchetKey: prev.RatchetKey, PrevCounter: prev.PrevCounter, Counter: prev.Counter,
+		KeyID: prev.KeyID, Epoch: prev.Epoch,
+		Signature: prev.Signature, SignedAt: prev.SignedAt,
+	}
+	if err := common.VerifyMessage(signingKey, restored); err != nil {
+		t.Fatalf("подпись прежней версии: %v", err)
+	}
+	if prev.RatchetKey != "rk1" || prev.PrevCounter != 2 || prev.Counter != 5 {
+		t.Fatalf("заголовок прежней версии: %+v", prev)
+	}
+}
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"secure-messenger/internal/common"
+)
+
+const (
+	// masterKeySize длина мастер-ключа в байтах
+	masterKeySize = 32
+	// masterKeyIDSize длина ID мастер-ключа в записи
+	masterKeyIDSize = 8
+	// dataKeySize длина ключа данных отдельной записи
+	dataKeySize = 32
+
+	kekInfo      = "secure-messenger/at-rest/v1/kek"
+	masterIDInfo = "secure-messenger/at-rest/v1/key-id"
+	indexInfo    = "secure-messenger/at-rest/v1/index"
+)
+
+// recordMagic отмечает зашифрованную запись; значения без него считаются
+// записанными до включения шифрования (JSON не может начинаться с 0x00).
+// Последний байт - версия: в версии 1 ключ записи хранился открытым, в
+// версии 2 на диске лежит HMAC ключа, а сам ключ зашифрован вместе со
+// значением.
+var (
+	recordMagic       = []byte{0x00, 'S', 'M', 0x02}
+	legacyRecordMagic = []byte{0x00, 'S', 'M', 0x01}
+)
+
+var (
+	ErrWrongMasterKey   = errors.New("запись зашифрована другим мастер-ключом")
+	ErrCorruptEnvelope  = errors.New("поврежденная зашифрованная запись")
+	ErrInvalidMasterKey = errors.New("мастер-ключ должен быть 32 байтами в base64")
+)
+
+// MasterKey мастер-ключ шифрования данных на диске. Сам ключ в записи не
+// используется: из него выводится ключ шифрования ключей (KEK), которым
+// зашифрованы ключи данных отдельных записей.
+type MasterKey struct {
+	id    []byte
+	kek   []byte
+	index []byte
+}
+
+// NewMasterKey создает мастер-ключ из 32 случайных байт
+func NewMasterKey(secret []byte) (*MasterKey, error) {
+	if len(secret) != masterKeySize {
+		return nil, ErrInvalidMasterKey
+	}
+	kek, err := common.DeriveKey(secret, kekInfo)
+	if err != nil {
+		return nil, err
+	}
+	id, err := common.DeriveKey(secret, masterIDInfo)
+	if err != nil {
+		return nil, err
+	}
+	index, err := common.DeriveKey(secret, indexInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &MasterKey{id: id[:masterKeyIDSize], kek: kek, index: index}, nil
+}
+
+// ParseMasterKey разбирает мастер-ключ в base64
+func ParseMasterKey(encoded string) (*MasterKey, error) {
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, ErrInvalidMasterKey
+	}
+	return NewMasterKey(secret)
+}
+
+// LoadMasterKey читает мастер-ключ в base64 из файла
+func LoadMasterKey(path string) (*MasterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMasterKey(string(data))
+}
+
+// MasterKeyFromEnv загружает мастер-ключ из файла MASTER_KEY_FILE или
+// переменной MASTER_KEY. Если ни одна не задана, возвращает nil:
+// данные хранятся без шифрования.
+func MasterKeyFromEnv() (*MasterKey, error) {
+	if path := os.Getenv("MASTER_KEY_FILE"); path != "" {
+		key, err := LoadMasterKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("MASTER_KEY_FILE: %w", err)
+		}
+		return key, nil
+	}
+	if encoded := os.Getenv("MASTER_KEY"); encoded != "" {
+		key, err := ParseMasterKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("MASTER_KEY: %w", err)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// GenerateMasterKey создает случайный мастер-ключ и возвращает его в base64
+func GenerateMasterKey() (string, error) {
+	secret := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// ID возвращает идентификатор мастер-ключа в hex для журналов
+func (mk *MasterKey) ID() string {
+	return fmt.Sprintf("%x", mk.id)
+}
+
+// storeKey возвращает ключ, под которым запись лежит на диске: HMAC-SHA256
+// раздела и ключа записи (hex). По нему нельзя узнать имена пользователей
+// и собеседников, но можно найти запись, зная исходный ключ.
+func (mk *MasterKey) storeKey(bucket, key string) string {
+	mac := hmac.New(sha256.New, mk.index)
+	mac.Write(recordAD(bucket, key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal шифрует ключ и значение записи новым ключом данных и возвращает
+// ключ записи на диске. Формат: метка, ID мастер-ключа, nonce и
+// зашифрованный KEK ключ данных, nonce и зашифрованные длина ключа (uvarint),
+// ключ и значение. Раздел и ключ на диске входят в associated data,
+// поэтому запись нельзя переставить под другой ключ.
+func (mk *MasterKey) seal(bucket, key string, value []byte) (string, []byte, error) {
+	dek := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", nil, err
+	}
+	storeKey := mk.storeKey(bucket, key)
+	ad := recordAD(bucket, storeKey)
+
+	plain := binary.AppendUvarint(nil, uint64(len(key)))
+	plain = append(plain, key...)
+	plain = append(plain, value...)
+
+	wrapNonce, wrapped, err := common.SealAESGCM(mk.kek, dek, ad)
+	if err != nil {
+		return "", nil, err
+	}
+	dataNonce, ciphertext, err := common.SealAESGCM(dek, plain, ad)
+	if err != nil {
+		return "", nil, err
+	}
+
+	out := make([]byte, 0, len(recordMagic)+masterKeyIDSize+len(wrapNonce)+len(wrapped)+len(dataNonce)+len(ciphertext))
+	out = append(out, recordMagic...)
+	out = append(out, mk.id...)
+	out = append(out, wrapNonce...)
+	out = append(out, wrapped...)
+	out = append(out, dataNonce...)
+	return storeKey, append(out, ciphertext...), nil
+}
+
+// open расшифровывает запись, лежащую на диске под ключом storeKey, и
+// возвращает исходный ключ и значение. Записи версии 1 хранятся под
+// открытым ключом, он и возвращается.
+func (mk *MasterKey) open(bucket, storeKey string, record []byte) (string, []byte, error) {
+	plain, err := mk.unwrap(record[len(recordMagic):], recordAD(bucket, storeKey))
+	if err != nil {
+		return "", nil, err
+	}
+	if bytes.HasPrefix(record, legacyRecordMagic) {
+		return storeKey, plain, nil
+	}
+
+	keyLen, n := binary.Uvarint(plain)
+	if n <= 0 || keyLen > uint64(len(plain)-n) {
+		return "", nil, ErrCorruptEnvelope
+	}
+	key := string(plain[n : n+int(keyLen)])
+	if !hmac.Equal([]byte(mk.storeKey(bucket, key)), []byte(storeKey)) {
+		return "", nil, ErrCorruptEnvelope
+	}
+	return key, plain[n+int(keyLen):], nil
+}
+
+// unwrap расшифровывает ключ данных и тело записи без метки
+func (mk *MasterKey) unwrap(body, ad []byte) ([]byte, error) {
+	const nonceSize, tagSize = 12, 16
+	if len(body) < masterKeyIDSize+2*nonceSize+dataKeySize+2*tagSize {
+		return nil, ErrCorruptEnvelope
+	}
+	if !bytes.Equal(body[:masterKeyIDSize], mk.id) {
+		return nil, ErrWrongMasterKey
+	}
+	body = body[masterKeyIDSize:]
+
+	wrapEnd := nonceSize + dataKeySize + tagSize
+	dek, err := common.OpenAESGCM(mk.kek, body[:nonceSize], body[nonceSize:wrapEnd], ad)
+	if err != nil {
+		return nil, ErrCorruptEnvelope
+	}
+	body = body[wrapEnd:]
+	plain, err := common.OpenAESGCM(dek, body[:nonceSize], body[nonceSize:], ad)
+	if err != nil {
+		return nil, ErrCorruptEnvelope
+	}
+	return plain, nil
+}
+
+// sealedWith сообщает, зашифрована ли запись этим мастер-ключом
+func (mk *MasterKey) sealedWith(record []byte) bool {
+	return isSealed(record) && bytes.HasPrefix(record[len(recordMagic):], mk.id)
+}
+
+func recordAD(bucket, key string) []byte {
+	return []byte(bucket + "\x00" + key)
+}
+
+func isSealed(value []byte) bool {
+	return bytes.HasPrefix(value, recordMagic) || bytes.HasPrefix(value, legacyRecordMagic)
+}
+
+// storedRecord запись раздела с исходным ключом
+type storedRecord struct {
+	key      string
+	storeKey string
+	value    []byte
+	// rank 0 - запись под HMAC текущего ключа, 1 - под HMAC другого,
+	// 2 - под открытым ключом
+	rank int
+}
+
+// readBucket читает раздел и расшифровывает записи ключом mk или, если
+// запись зашифрована не им, ключом prev. Записи без шифрования
+// возвращаются как есть. Результат отсортирован по исходным ключам, а
+// копии одного ключа - от актуальной к устаревшей.
+func readBucket(store Store, bucket string, mk, prev *MasterKey) ([]storedRecord, error) {
+	var records []storedRecord
+	err := store.ForEach(bucket, func(storeKey string, value []byte) error {
+		rec := storedRecord{key: storeKey, storeKey: storeKey, value: value, rank: 2}
+		if isSealed(value) {
+			opener := mk
+			if prev != nil && !mk.sealedWith(value) {
+				opener = prev
+			}
+			key, plain, err := opener.open(bucket, storeKey, value)
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", bucket, storeKey, err)
+			}
+			rec.key, rec.value = key, plain
+			if !bytes.HasPrefix(value, legacyRecordMagic) {
+				rec.rank = 1
+				if opener == mk {
+					rec.rank = 0
+				}
+			}
+		}
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].key != records[j].key {
+			return records[i].key < records[j].key
+		}
+		return records[i].rank < records[j].rank
+	})
+	return records, nil
+}
+
+// migrateBucket переносит записи раздела под HMAC ключа mk, удаляет
+// устаревшие копии и возвращает записи без копий и число перенесенных
+func migrateBucket(store Store, bucket string, mk *MasterKey, records []storedRecord) ([]storedRecord, int, error) {
+	migrated := 0
+	result := make([]storedRecord, 0, len(records))
+	for i, rec := range records {
+		if i > 0 && records[i-1].key == rec.key {
+			// Копия осталась от прерванного переноса
+			if err := store.Delete(bucket, rec.storeKey); err != nil {
+				return nil, migrated, err
+			}
+			continue
+		}
+		if rec.rank != 0 {
+			storeKey, sealed, err := mk.seal(bucket, rec.key, rec.value)
+			if err != nil {
+				return nil, migrated, err
+			}
+			if err := store.Put(bucket, storeKey, sealed); err != nil {
+				return nil, migrated, err
+			}
+			if err := store.Delete(bucket, rec.storeKey); err != nil {
+				return nil, migrated, err
+			}
+			migrated++
+		}
+		result = append(result, rec)
+	}
+	return result, migrated, nil
+}
+
+// EncryptedStore шифрует записи вложенного хранилища. Открытыми остаются
+// только названия разделов, число записей и их размеры: ключи записей
+// (имена пользователей, пары собеседников, номера версий) заменяются
+// HMAC, а сами ключи шифруются вместе со значениями. Записи, сохраненные
+// до включения шифрования или под открытым ключом, переносятся под HMAC
+// при первом чтении раздела или командой rotate-key; в журнале FileStore
+// старые ключи остаются до сжатия.
+type EncryptedStore struct {
+	inner Store
+	key   *MasterKey
+}
+
+// NewEncryptedStore оборачивает хранилище шифрованием мастер-ключом
+func NewEncryptedStore(inner Store, key *MasterKey) *EncryptedStore {
+	return &EncryptedStore{inner: inner, key: key}
+}
+
+func (es *EncryptedStore) Put(bucket, key string, value []byte) error {
+	storeKey, sealed, err := es.key.seal(bucket, key, value)
+	if err != nil {
+		return err
+	}
+	return es.inner.Put(bucket, storeKey, sealed)
+}
+
+func (es *EncryptedStore) Delete(bucket, key string) error {
+	return es.inner.Delete(bucket, es.key.storeKey(bucket, key))
+}
+
+// ForEach расшифровывает раздел целиком, чтобы обойти записи в порядке
+// исходных ключей: порядок HMAC с ним не связан
+func (es *EncryptedStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	records, err := readBucket(es.inner, bucket, es.key, nil)
+	if err != nil {
+		return err
+	}
+	records, _, err = migrateBucket(es.inner, bucket, es.key, records)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := fn(rec.key, rec.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *EncryptedStore) Close() error {
+	return es.inner.Close()
+}
+
+// RotateMasterKey перешифровывает все записи хранилища новым мастер-ключом
+// со свежими ключами данных и переносит их под HMAC нового ключа. old
+// равен nil, если данные еще не шифровались. Записи, уже зашифрованные
+// новым ключом, пропускаются, поэтому прерванную ротацию можно запустить
+// повторно. Возвращает число перешифрованных записей. Сервер во время
+// ротации должен быть остановлен.
+func RotateMasterKey(store Store, old, next *MasterKey) (int, error) {
+	rotated := 0
+	for _, bucket := range storeBuckets {
+		records, err := readBucket(store, bucket, next, old)
+		if err != nil {
+			return rotated, err
+		}
+		_, n, err := migrateBucket(store, bucket, next, records)
+		rotated += n
+		if err != nil {
+			return rotated, err
+		}
+	}
+	return rotated, nil
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+func testMasterKey(t *testing.T, fill byte) *MasterKey {
+	t.Helper()
+	mk, err := NewMasterKey(bytes.Repeat([]byte{fill}, masterKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mk
+}
+
+// sealLegacy шифрует запись в формате версии 1: ключ на диске открытый
+func sealLegacy(t *testing.T, mk *MasterKey, bucket, key string, value []byte) []byte {
+	t.Helper()
+	dek := bytes.Repeat([]byte{7}, dataKeySize)
+	ad := recordAD(bucket, key)
+	wrapNonce, wrapped, err := common.SealAESGCM(mk.kek, dek, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataNonce, ciphertext, err := common.SealAESGCM(dek, value, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append(append([]byte(nil), legacyRecordMagic...), mk.id...)
+	out = append(append(append(out, wrapNonce...), wrapped...), dataNonce...)
+	return append(out, ciphertext...)
+}
+
+// rawRecords возвращает записи раздела вложенного хранилища как есть
+func rawRecords(t *testing.T, store Store, bucket string) map[string][]byte {
+	t.Helper()
+	records := make(map[string][]byte)
+	err := store.ForEach(bucket, func(key string, value []byte) error {
+		records[key] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// readAll возвращает записи раздела в порядке обхода
+func readAll(t *testing.T, store Store, bucket string) ([]string, []string) {
+	t.Helper()
+	var keys, values []string
+	err := store.ForEach(bucket, func(key string, value []byte) error {
+		keys = append(keys, key)
+		values = append(values, string(value))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, values
+}
+
+func TestEncryptedStoreHidesKeys(t *testing.T) {
+	inner := NewMemoryStore()
+	es := NewEncryptedStore(inner, testMasterKey(t, 1))
+
+	keys := []string{"alice/0000000001", "alice/0000000002", "bob/0000000001", "carol/0000000001"}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := es.Put(bucketBackups, keys[i], []byte("value-"+keys[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	es.Put(bucketMailbox, "alice/bob", []byte(`{}`))
+
+	for _, bucket := range []string{bucketBackups, bucketMailbox} {
+		for key, value := range rawRecords(t, inner, bucket) {
+			for _, name := range []string{"alice", "bob", "carol"} {
+				if strings.Contains(key, name) || bytes.Contains(value, []byte(name)) {
+					t.Fatalf("%s: имя %s на диске в записи %q", bucket, name, key)
+				}
+			}
+		}
+	}
+
+	// Обход идет по исходным ключам, а не по HMAC
+	got, values := readAll(t, es, bucketBackups)
+	if !reflect.DeepEqual(got, keys) {
+		t.Fatalf("ключи: %v, ожидались %v", got, keys)
+	}
+	for i, key := range keys {
+		if values[i] != "value-"+key {
+			t.Fatalf("значение %s: %q", key, values[i])
+		}
+	}
+
+	if err := es.Delete(bucketBackups, "bob/0000000001"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readAll(t, es, bucketBackups); len(got) != 3 {
+		t.Fatalf("после удаления: %v", got)
+	}
+}
+
+func TestEncryptedStoreRejectsMovedRecord(t *testing.T) {
+	inner := NewMemoryStore()
+	mk := testMasterKey(t, 1)
+	es := NewEncryptedStore(inner, mk)
+	es.Put(bucketUsers, "alice", []byte(`{"username":"alice"}`))
+
+	// Запись alice, переложенная под ключ bob, не открывается
+	inner.Put(bucketUsers, mk.storeKey(bucketUsers, "bob"), rawRecords(t, inner, bucketUsers)[mk.storeKey(bucketUsers, "alice")])
+	inner.Delete(bucketUsers, mk.storeKey(bucketUsers, "alice"))
+	if err := es.ForEach(bucketUsers, func(string, []byte) error { return nil }); err == nil {
+		t.Fatal("переставленная запись прочитана")
+	}
+}
+
+func TestEncryptedStoreMigratesLegacyKeys(t *testing.T) {
+	inner := NewMemoryStore()
+	mk := testMasterKey(t, 1)
+	inner.Put(bucketMailbox, "alice/bob", []byte("plain"))
+	inner.Put(bucketMailbox, "alice/carol", sealLegacy(t, mk, bucketMailbox, "alice/carol", []byte("sealed")))
+	// Копия, оставшаяся от прерванного переноса: новее запись под HMAC
+	inner.Put(bucketMailbox, "bob/alice", []byte("stale"))
+	es := NewEncryptedStore(inner, mk)
+	es.Put(bucketMailbox, "bob/alice", []byte("fresh"))
+
+	keys, values := readAll(t, es, bucketMailbox)
+	if !reflect.DeepEqual(keys, []string{"alice/bob", "alice/carol", "bob/alice"}) ||
+		!reflect.DeepEqual(values, []string{"plain", "sealed", "fresh"}) {
+		t.Fatalf("записи: %v %v", keys, values)
+	}
+
+	raw := rawRecords(t, inner, bucketMailbox)
+	if len(raw) != 3 {
+		t.Fatalf("записей на диске: %d", len(raw))
+	}
+	for _, key := range keys {
+		if _, ok := raw[mk.storeKey(bucketMailbox, key)]; !ok {
+			t.Fatalf("%s не перенесена под HMAC", key)
+		}
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	inner := NewMemoryStore()
+	oldKey, newKey := testMasterKey(t, 1), testMasterKey(t, 2)
+	inner.Put(bucketUsers, "legacy", []byte(`{"username":"legacy"}`))
+	NewEncryptedStore(inner, oldKey).Put(bucketUsers, "alice", []byte(`{"username":"alice"}`))
+	inner.Put(bucketRooms, "team", sealLegacy(t, oldKey, bucketRooms, "team", []byte(`{"name":"team"}`)))
+
+	n, err := RotateMasterKey(inner, oldKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("перешифровано %d записей, ожидалось 3", n)
+	}
+	if n, err := RotateMasterKey(inner, oldKey, newKey); err != nil || n != 0 {
+		t.Fatalf("повторная ротация: %d, %v", n, err)
+	}
+
+	for _, bucket := range []string{bucketUsers, bucketRooms} {
+		for key, value := range rawRecords(t, inner, bucket) {
+			if !newKey.sealedWith(value) || !bytes.HasPrefix(value, recordMagic) {
+				t.Fatalf("%s/%s не перешифрована", bucket, key)
+			}
+		}
+	}
+	if keys, _ := readAll(t, NewEncryptedStore(inner, newKey), bucketUsers); !reflect.DeepEqual(keys, []string{"alice", "legacy"}) {
+		t.Fatalf("пользователи после ротации: %v", keys)
+	}
+	if err := NewEncryptedStore(inner, oldKey).ForEach(bucketUsers, func(string, []byte) error { return nil }); err == nil {
+		t.Fatal("записи открываются старым ключом")
+	}
+}
+
+func TestRotateMasterKeyResumes(t *testing.T) {
+	inner := NewMemoryStore()
+	oldKey, newKey := testMasterKey(t, 1), testMasterKey(t, 2)
+	NewEncryptedStore(inner, oldKey).Put(bucketUsers, "alice", []byte("old"))
+	// Ротация прервалась после записи под новым ключом, до удаления старой
+	NewEncryptedStore(inner, newKey).Put(bucketUsers, "alice", []byte("new"))
+
+	if _, err := RotateMasterKey(inner, oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	raw := rawRecords(t, inner, bucketUsers)
+	if len(raw) != 1 {
+		t.Fatalf("записей после ротации: %d", len(raw))
+	}
+	if _, values := readAll(t, NewEncryptedStore(inner, newKey), bucketUsers); !reflect.DeepEqual(values, []string{"new"}) {
+		t.Fatalf("значения: %v", values)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+const (
+	// MinExpiry и MaxExpiry ограничивают таймер исчезающих сообщений
+	MinExpiry = 5 * time.Second
+	MaxExpiry = 4 * 7 * 24 * time.Hour
+	// DefaultReapInterval период удаления истекших сообщений
+	DefaultReapInterval = 10 * time.Second
+)
+
+var (
+	ErrInvalidExpiry = errors.New("недопустимый срок жизни сообщений")
+	ErrExpiryGeneral = errors.New("в общем чате исчезающие сообщения недоступны")
+)
+
+// SetExpiry задает таймер исчезающих сообщений личного диалога с recipient
+// или комнаты room и возвращает ID диалога; ноль отключает таймер. Таймер
+// действует на сообщения, отправленные после его установки. В комнате его
+// меняют владелец и администраторы, в личном диалоге - любой собеседник.
+func (um *UserManager) SetExpiry(username, recipient, room string, ttl time.Duration) (string, error) {
+	if ttl != 0 && (ttl < MinExpiry || ttl > MaxExpiry) {
+		return "", ErrInvalidExpiry
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	msgType := common.MsgPrivate
+	switch {
+	case room != "":
+		r, exists := um.rooms[room]
+		if !exists {
+			return "", ErrRoomNotFound
+		}
+		role := r.role(username)
+		if role == "" {
+			return "", ErrNotRoomMember
+		}
+		if roleRank[role] < roleRank[common.RoleAdmin] {
+			return "", ErrRoomForbidden
+		}
+		msgType = common.MsgRoomMessage
+	case recipient == "" || recipient == "all":
+		return "", ErrExpiryGeneral
+	default:
+		if _, exists := um.users[recipient]; !exists || recipient == username {
+			return "", errors.New("пользователь не найден")
+		}
+	}
+
+	conversation := common.ConversationID(msgType, username, recipient, room)
+	if ttl == 0 {
+		delete(um.expiry, conversation)
+		um.removeFromStore(bucketExpiry, conversation)
+	} else {
+		um.expiry[conversation] = ttl
+		um.persist(bucketExpiry, conversation, ttl)
+	}
+	return conversation, nil
+}
+
+// ExpiryTimers возвращает таймеры (в секундах) доступных пользователю диалогов
+func (um *UserManager) ExpiryTimers(username string) map[string]int64 {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	timers := make(map[string]int64)
+	for conversation, ttl := range um.expiry {
+		if um.canSee(conversation, username) {
+			timers[conversation] = int64(ttl / time.Second)
+		}
+	}
+	return timers
+}
+
+// ReapExpired удаляет сообщения, срок жизни которых истек к моменту now,
+// из памяти, хранилища, почтовых ящиков и входящих упоминаний. Вместе с
+// сообщением удаляются события его правок. Возвращает удаленные записи.
+func (um *UserManager) ReapExpired(now time.Time) []MessageHistory {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	var expired []*MessageHistory
+	targets := make(map[string]bool)
+	for _, msg := range um.messages {
+		if !msg.ExpiresAt.IsZero() && !now.Before(msg.ExpiresAt) {
+			expired = append(expired, msg)
+			targets[msg.ID] = true
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	for _, msg := range um.messages {
+		if msg.Target != "" && targets[msg.Target] && !targets[msg.ID] {
+			expired = append(expired, msg)
+			targets[msg.ID] = true
+		}
+	}
+
+	removed := make([]MessageHistory, 0, len(expired))
+	for _, msg := range expired {
+		um.removeMessage(msg)
+		um.removeFromStore(bucketMessages, msg.storeKey)
+		if msg.Type == common.MsgPrivate {
+			um.takeFromMailbox(msg.Recipient, msg.ID)
+		}
+		um.dropMentions(msg)
+		um.releaseAttachments(msg)
+
+		if root, exists := um.messageIndex[msg.ParentID]; exists && root.ReplyCount > 0 {
+			root.ReplyCount--
+			um.persist(bucketMessages, root.storeKey, root)
+		}
+		removed = append(removed, *msg)
+	}
+	return removed
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+func TestReapExpiredRemovesEverywhere(t *testing.T) {
+	um, blobs := newAttachmentManager(t)
+	if _, err := um.CreateRoom("team", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.JoinRoom("team", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	// Сообщения до установки таймера не исчезают
+	root, err := um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: "bob", Room: "team", Content: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.AddMessage(common.Message{Type: common.MsgGeneral, Sender: "alice", Recipient: "all", Content: "@bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.SetExpiry("bob", "alice", "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.SetExpiry("alice", "", "team", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	attachment, err := uploadAttachment(um, "alice", []byte("исчезающее вложение"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm, err := um.AddMessage(common.Message{
+		Type: common.MsgPrivate, Sender: "alice", Recipient: "bob", Content: "v1",
+		Attachments: []common.Attachment{{ID: attachment.ID, Hash: attachment.Hash}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm.ExpiresAt.IsZero() {
+		t.Fatal("срок жизни не назначен")
+	}
+	if err := um.EnqueueMessage(dm.Message()); err != nil {
+		t.Fatal(err)
+	}
+	edit, err := um.EditMessage("alice", common.Message{Type: common.MsgEdit, Target: dm.ID, Content: "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: "alice", Room: "team", ParentID: root.ID, Content: "@bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := reply.ExpiresAt
+
+	if removed := um.ReapExpired(dm.ExpiresAt.Add(-time.Millisecond)); removed != nil {
+		t.Fatalf("удалено до срока: %d", len(removed))
+	}
+
+	removed := um.ReapExpired(expiresAt)
+	got := make(map[string]bool)
+	for _, msg := range removed {
+		got[msg.ID] = true
+	}
+	if len(removed) != 3 || !got[dm.ID] || !got[edit.ID] || !got[reply.ID] {
+		t.Fatalf("удалено: %v", got)
+	}
+
+	um.mu.RLock()
+	for id := range got {
+		if _, exists := um.messageIndex[id]; exists {
+			t.Errorf("%s остался в индексе", id)
+		}
+	}
+	dmLeft := len(um.conversations[dm.Conversation])
+	threadLeft := len(um.threads[root.ID])
+	replyCount := um.messageIndex[root.ID].ReplyCount
+	um.mu.RUnlock()
+	if dmLeft != 0 || threadLeft != 0 || replyCount != 0 {
+		t.Fatalf("в диалоге %d, в ветке %d, ответов у корня %d", dmLeft, threadLeft, replyCount)
+	}
+	if history := um.GetUserHistory("bob"); len(history) != 2 {
+		t.Fatalf("в истории bob осталось %d", len(history))
+	}
+	if pending := um.PendingMessages("bob"); len(pending) != 0 {
+		t.Fatalf("в почтовом ящике: %d", len(pending))
+	}
+	if page, _ := um.Mentions("bob", "", 0); len(page.Mentions) != 1 || page.Mentions[0].Message.Content != "@bob" || page.Mentions[0].Message.Room != "" {
+		t.Fatalf("упоминания bob: %+v", page.Mentions)
+	}
+
+	for bucket, want := range map[string]int{bucketMessages: 2, bucketMailbox: 0, bucketMentions: 1} {
+		if keys := storeKeys(t, um.store, bucket); len(keys) != want {
+			t.Errorf("%s: %d записей, want %d", bucket, len(keys), want)
+		}
+	}
+	if _, _, err := um.OpenAttachment("bob", attachment.ID); err != ErrAttachmentNotFound {
+		t.Fatalf("вложение исчезнувшего сообщения: %v", err)
+	}
+	if f, err := blobs.Open(attachment.Hash); err == nil {
+		f.Close()
+		t.Fatal("содержимое вложения не удалено")
+	}
+
+	if removed := um.ReapExpired(expiresAt.Add(time.Hour)); removed != nil {
+		t.Fatalf("повторное удаление: %d", len(removed))
+	}
+	restarted, err := NewUserManagerWithStore(um.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history := restarted.GetUserHistory("bob"); len(history) != 2 {
+		t.Fatalf("после перезапуска в истории bob %d", len(history))
+	}
+}
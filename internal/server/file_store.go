@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	logFileName      = "store.log"
+	snapshotFileName = "store.snapshot"
+
+	opPut    byte = 1
+	opDelete byte = 2
+
+	// recordHeaderSize длина (4 байта) + CRC32 (4 байта)
+	recordHeaderSize = 8
+	maxRecordSize    = 16 << 20
+
+	// defaultCompactSize размер журнала, после которого делается снимок
+	defaultCompactSize = 8 << 20
+)
+
+var errCorruptRecord = errors.New("поврежденная запись журнала")
+
+// FileStore встроенное хранилище на диске: журнал добавления (store.log)
+// и периодический снимок (store.snapshot). Все данные также держатся в памяти.
+//
+// Формат записи: длина payload (uint32 BE), CRC32 payload, payload.
+// Payload: операция (1 байт), раздел и ключ (uint16 длина + байты),
+// значение (uint32 длина + байты). При открытии журнал проигрывается
+// поверх снимка до первой неполной или поврежденной записи, после чего
+// хвост журнала отрезается.
+type FileStore struct {
+	mem         *MemoryStore
+	dir         string
+	logFile     *os.File
+	logSize     int64
+	compactSize int64
+	mu          sync.Mutex
+}
+
+// OpenFileStore открывает (или создает) хранилище в каталоге dir
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		mem:         NewMemoryStore(),
+		dir:         dir,
+		compactSize: defaultCompactSize,
+	}
+
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, fmt.Errorf("чтение снимка: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := fs.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("чтение журнала: %w", err)
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	fs.logFile = f
+	fs.logSize = size
+	return fs, nil
+}
+
+func (fs *FileStore) Put(bucket, key string, value []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.appendRecord(opPut, bucket, key, value); err != nil {
+		return err
+	}
+	return fs.mem.Put(bucket, key, value)
+}
+
+func (fs *FileStore) Delete(bucket, key string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.appendRecord(opDelete, bucket, key, nil); err != nil {
+		return err
+	}
+	return fs.mem.Delete(bucket, key)
+}
+
+func (fs *FileStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return fs.mem.ForEach(bucket, fn)
+}
+
+// Compact записывает снимок текущего состояния и очищает журнал
+func (fs *FileStore) Compact() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.compact()
+}
+
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.logFile == nil {
+		return nil
+	}
+	err := fs.logFile.Close()
+	fs.logFile = nil
+	return err
+}
+
+func (fs *FileStore) appendRecord(op byte, bucket, key string, value []byte) error {
+	if fs.logFile == nil {
+		return errors.New("хранилище закрыто")
+	}
+
+	record := encodeRecord(op, bucket, key, value)
+	if _, err := fs.logFile.Write(record); err != nil {
+		// Не оставляем в журнале частично записанную запись
+		fs.logFile.Truncate(fs.logSize)
+		fs.logFile.Seek(fs.logSize, io.SeekStart)
+		return err
+	}
+	if err := fs.logFile.Sync(); err != nil {
+		return err
+	}
+	fs.logSize += int64(len(record))
+
+	if fs.logSize >= fs.compactSize {
+		if err := fs.compact(); err != nil {
+			log.Printf("Store compaction error: %v", err)
+		}
+	}
+	return nil
+}
+
+// compact пишет снимок во временный файл и атомарно переименовывает его.
+// Если процесс упадет до очистки журнала, повторное проигрывание
+// идемпотентных записей поверх снимка даст то же состояние.
+func (fs *FileStore) compact() error {
+	tmpPath := filepath.Join(fs.dir, snapshotFileName+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	fs.mem.mu.RLock()
+	for bucket, records := range fs.mem.buckets {
+		for key, value := range records {
+			if _, err = w.Write(encodeRecord(opPut, bucket, key, value)); err != nil {
+				break
+			}
+		}
+	}
+	fs.mem.mu.RUnlock()
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(fs.dir, snapshotFileName)); err != nil {
+		return err
+	}
+	syncDir(fs.dir)
+
+	if err := fs.logFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := fs.logFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fs.logSize = 0
+	return fs.logFile.Sync()
+}
+
+func (fs *FileStore) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(fs.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Снимок пишется атомарно, поэтому любое повреждение в нем - ошибка
+	r := bufio.NewReader(f)
+	for {
+		op, bucket, key, value, _, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fs.apply(op, bucket, key, value)
+	}
+}
+
+// replay проигрывает журнал и возвращает смещение конца последней целой записи
+func (fs *FileStore) replay(f *os.File) (int64, error) {
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		op, bucket, key, value, n, err := readRecord(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			log.Printf("⚠️ Журнал хранилища поврежден на смещении %d, хвост отброшен", offset)
+			if err := f.Truncate(offset); err != nil {
+				return 0, err
+			}
+			return offset, f.Sync()
+		}
+		if err != nil {
+			return 0, err
+		}
+		fs.apply(op, bucket, key, value)
+		offset += int64(n)
+	}
+}
+
+func (fs *FileStore) apply(op byte, bucket, key string, value []byte) {
+	switch op {
+	case opPut:
+		fs.mem.Put(bucket, key, value)
+	case opDelete:
+		fs.mem.Delete(bucket, key)
+	}
+}
+
+func encodeRecord(op byte, bucket, key string, value []byte) []byte {
+	payload := make([]byte, 0, 1+2+len(bucket)+2+len(key)+4+len(value))
+	payload = append(payload, op)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(bucket)))
+	payload = append(payload, bucket...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(key)))
+	payload = append(payload, key...)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(value)))
+	payload = append(payload, value...)
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+// readRecord читает одну запись и возвращает ее полный размер в байтах
+func readRecord(r io.Reader) (op byte, bucket, key string, value []byte, n int, err error) {
+	var header [recordHeaderSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		err = errCorruptRecord
+		return
+	}
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		err = errCorruptRecord
+		return
+	}
+
+	n = recordHeaderSize + int(size)
+	var ok bool
+	if op, bucket, key, value, ok = decodePayload(payload); !ok {
+		err = errCorruptRecord
+	}
+	return
+}
+
+func decodePayload(p []byte) (op byte, bucket, key string, value []byte, ok bool) {
+	readString := func() (string, bool) {
+		if len(p) < 2 {
+			return "", false
+		}
+		l := int(binary.BigEndian.Uint16(p))
+		if len(p) < 2+l {
+			return "", false
+		}
+		s := string(p[2 : 2+l])
+		p = p[2+l:]
+		return s, true
+	}
+
+	if len(p) < 1 {
+		return
+	}
+	op, p = p[0], p[1:]
+	if bucket, ok = readString(); !ok {
+		return
+	}
+	if key, ok = readString(); !ok {
+		return
+	}
+	if len(p) < 4 || uint32(len(p)-4) != binary.BigEndian.Uint32(p) {
+		ok = false
+		return
+	}
+	value = p[4:]
+	return op, bucket, key, value, true
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
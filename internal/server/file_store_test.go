@@ -0,0 +1,154 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// dump возвращает содержимое бакета
+func dump(t *testing.T, store Store, bucket string) map[string]string {
+	t.Helper()
+	result := make(map[string]string)
+	err := store.ForEach(bucket, func(key string, value []byte) error {
+		result[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// writeLog создает хранилище с тремя записями и возвращает содержимое
+// журнала и смещения концов записей
+func writeLog(t *testing.T) ([]byte, []int64) {
+	t.Helper()
+	dir := t.TempDir()
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []int64
+	for _, op := range []func() error{
+		func() error { return fs.Put("users", "alice", []byte(`{"a":1}`)) },
+		func() error { return fs.Put("users", "bob", []byte(`{"b":2}`)) },
+		func() error { return fs.Delete("users", "alice") },
+	} {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, fs.logSize)
+	}
+	fs.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, logFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, ends
+}
+
+func TestFileStoreRecoversTruncatedLog(t *testing.T) {
+	data, ends := writeLog(t)
+	// Состояние после каждой целой записи
+	states := []map[string]string{
+		{},
+		{"alice": `{"a":1}`},
+		{"alice": `{"a":1}`, "bob": `{"b":2}`},
+		{"bob": `{"b":2}`},
+	}
+
+	start := int64(0)
+	for i, end := range ends {
+		// Обрыв внутри заголовка, на границе заголовка и внутри payload
+		for _, cut := range []int64{start + 1, start + recordHeaderSize - 1, start + recordHeaderSize, start + recordHeaderSize + 3, end - 1} {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, logFileName), data[:cut], 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			fs, err := OpenFileStore(dir)
+			if err != nil {
+				t.Fatalf("обрыв на %d: %v", cut, err)
+			}
+			if got := dump(t, fs, "users"); !reflect.DeepEqual(got, states[i]) {
+				t.Fatalf("обрыв на %d: %v, want %v", cut, got, states[i])
+			}
+			if fs.logSize != start {
+				t.Fatalf("обрыв на %d: журнал %d байт, want %d", cut, fs.logSize, start)
+			}
+
+			// После восстановления журнал продолжается с целой записи
+			if err := fs.Put("users", "carol", []byte("c")); err != nil {
+				t.Fatal(err)
+			}
+			fs.Close()
+			reopened, err := OpenFileStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"carol": "c"}
+			for k, v := range states[i] {
+				want[k] = v
+			}
+			if got := dump(t, reopened, "users"); !reflect.DeepEqual(got, want) {
+				t.Fatalf("обрыв на %d, после записи: %v, want %v", cut, got, want)
+			}
+			reopened.Close()
+		}
+		start = end
+	}
+}
+
+func TestFileStoreDropsCorruptTail(t *testing.T) {
+	data, ends := writeLog(t)
+	// Испорченный байт в payload второй записи: CRC не сходится,
+	// вторая и следующие записи отбрасываются
+	data[ends[0]+recordHeaderSize+2] ^= 0xff
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, logFileName), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if got := dump(t, fs, "users"); !reflect.DeepEqual(got, map[string]string{"alice": `{"a":1}`}) {
+		t.Fatalf("после порчи: %v", got)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, logFileName)); info.Size() != ends[0] {
+		t.Fatalf("журнал %d байт, want %d", info.Size(), ends[0])
+	}
+}
+
+func TestFileStoreSnapshotAndLog(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Put("users", "alice", []byte("1"))
+	fs.Put("sessions", "s", []byte("2"))
+	if err := fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Delete("sessions", "s")
+	fs.Put("users", "bob", []byte("3"))
+	fs.Close()
+
+	reopened, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := dump(t, reopened, "users"); !reflect.DeepEqual(got, map[string]string{"alice": "1", "bob": "3"}) {
+		t.Fatalf("users: %v", got)
+	}
+	if got := dump(t, reopened, "sessions"); len(got) != 0 {
+		t.Fatalf("sessions: %v", got)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"secure-messenger/internal/common"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestUserManager создает менеджер с пользователями без паролей:
+// записи кладутся прямо в хранилище, чтобы не считать Argon2id
+func newTestUserManager(t *testing.T, usernames ...string) *UserManager {
+	t.Helper()
+	store := NewMemoryStore()
+	for _, username := range usernames {
+		store.Put(bucketUsers, username, []byte(`{"username":"`+username+`"}`))
+	}
+	um, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return um
+}
+
+// newTestServer запускает WebSocketServer за httptest-сервером
+func newTestServer(t *testing.T, usernames ...string) (*WebSocketServer, *httptest.Server) {
+	t.Helper()
+	s := NewWebSocketServer(newTestUserManager(t, usernames...))
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// dialUser открывает соединение от имени пользователя и проходит
+// аутентификацию
+func dialUser(t *testing.T, s *WebSocketServer, ts *httptest.Server, username string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	token := s.userManager.CreateSession(username)
+	if err := conn.WriteJSON(common.Message{Type: common.MsgAuth, SessionToken: token}); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// drain читает соединение до ошибки; закрывает done по завершении
+func drain(conn *websocket.Conn) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// waitFor ждет выполнения условия до секунды
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("не дождались: %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readUntil читает соединение до сообщения типа msgType и возвращает его
+// вместе с пропущенными до него сообщениями
+func readUntil(t *testing.T, conn *websocket.Conn, msgType string) (common.Message, []common.Message) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var skipped []common.Message
+	for {
+		var msg common.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("ждали %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg, skipped
+		}
+		skipped = append(skipped, msg)
+	}
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+
+	"secure-messenger/internal/common"
+)
+
+const (
+	// DefaultHistoryLimit размер страницы истории по умолчанию
+	DefaultHistoryLimit = 50
+	// MaxHistoryLimit наибольший размер страницы истории
+	MaxHistoryLimit = 200
+)
+
+var ErrMessageNotFound = errors.New("сообщение не найдено")
+
+// Message возвращает запись истории в виде сообщения протокола
+func (m MessageHistory) Message() common.Message {
+	return common.Message{
+		Type:         m.Type,
+		ID:           m.ID,
+		Conversation: m.Conversation,
+		Seq:          m.Seq,
+		Sender:       m.Sender,
+		Recipient:    m.Recipient,
+		Content:      m.Content,
+		Timestamp:    m.Timestamp,
+		Room:         m.Room,
+		IV:           m.IV,
+		AuthTag:      m.AuthTag,
+		Target:       m.Target,
+
+		RatchetKey:  m.RatchetKey,
+		PrevCounter: m.PrevCounter,
+		Counter:     m.Counter,
+		X3DH:        m.X3DH,
+		KeyID:       m.KeyID,
+		Epoch:       m.Epoch,
+		Signature:   m.Signature,
+		SignedAt:    m.SignedAt,
+		Receipts:    m.Receipts,
+		Edited:      !m.EditedAt.IsZero(),
+		Edits:       m.Edits,
+		Deleted:     m.Deleted,
+		Reactions:   m.Reactions,
+		ParentID:    m.ParentID,
+		ReplyCount:  m.ReplyCount,
+		LastReplyAt: m.LastReplyAt,
+		Mentions:    m.Mentions,
+		Attachments: m.Attachments,
+		ExpiresAt:   m.ExpiresAt,
+	}
+}
+
+// indexMessage добавляет сообщение в кольцо истории и индексы; вызывается под um.mu
+func (um *UserManager) indexMessage(msg *MessageHistory) {
+	um.messages = append(um.messages, msg)
+	um.conversations[msg.Conversation] = append(um.conversations[msg.Conversation], msg)
+	um.messageIndex[msg.ID] = msg
+	if msg.ParentID != "" {
+		um.threads[msg.ParentID] = append(um.threads[msg.ParentID], msg)
+	}
+}
+
+// evictOldestMessage убирает самое старое сообщение из кольца и индексов.
+// Оно же самое старое в своем диалоге и в своей ветке; вызывается под um.mu.
+func (um *UserManager) evictOldestMessage() {
+	oldest := um.messages[0]
+	um.messages = um.messages[1:]
+
+	msgs := um.conversations[oldest.Conversation][1:]
+	if len(msgs) == 0 {
+		delete(um.conversations, oldest.Conversation)
+	} else {
+		um.conversations[oldest.Conversation] = msgs
+	}
+	delete(um.messageIndex, oldest.ID)
+
+	// Вместе с корнем ветка перестает быть доступной
+	delete(um.threads, oldest.ID)
+	if replies := um.threads[oldest.ParentID]; len(replies) > 0 && replies[0] == oldest {
+		if len(replies) == 1 {
+			delete(um.threads, oldest.ParentID)
+		} else {
+			um.threads[oldest.ParentID] = replies[1:]
+		}
+	}
+}
+
+// removeMessage убирает сообщение из любого места кольца и индексов;
+// вызывается под um.mu
+func (um *UserManager) removeMessage(msg *MessageHistory) {
+	um.messages = removeOrdered(um.messages, msg)
+	if msgs := removeOrdered(um.conversations[msg.Conversation], msg); len(msgs) == 0 {
+		delete(um.conversations, msg.Conversation)
+	} else {
+		um.conversations[msg.Conversation] = msgs
+	}
+	delete(um.messageIndex, msg.ID)
+
+	delete(um.threads, msg.ID)
+	if msg.ParentID != "" {
+		if replies := removeOrdered(um.threads[msg.ParentID], msg); len(replies) == 0 {
+			delete(um.threads, msg.ParentID)
+		} else {
+			um.threads[msg.ParentID] = replies
+		}
+	}
+}
+
+// removeOrdered удаляет сообщение из списка, упорядоченного по order
+func removeOrdered(msgs []*MessageHistory, msg *MessageHistory) []*MessageHistory {
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].order >= msg.order })
+	if i == len(msgs) || msgs[i] != msg {
+		return msgs
+	}
+	return append(msgs[:i], msgs[i+1:]...)
+}
+
+// canSee проверяет доступ пользователя к диалогу; вызывается под um.mu
+func (um *UserManager) canSee(conversation, username string) bool {
+	switch {
+	case conversation == "general":
+		return true
+	case strings.HasPrefix(conversation, "dm:"):
+		for _, participant := range strings.Split(strings.TrimPrefix(conversation, "dm:"), ":") {
+			if participant == username {
+				return true
+			}
+		}
+		return false
+	case strings.HasPrefix(conversation, "room:"):
+		// Сообщения комнат видны только текущим участникам
+		room, exists := um.rooms[strings.TrimPrefix(conversation, "room:")]
+		return exists && room.role(username) != ""
+	}
+	return false
+}
+
+// visibleConversations возвращает диалоги с сообщениями, доступные
+// пользователю; вызывается под um.mu
+func (um *UserManager) visibleConversations(username string) []string {
+	var conversations []string
+	for conversation := range um.conversations {
+		if um.canSee(conversation, username) {
+			conversations = append(conversations, conversation)
+		}
+	}
+	return conversations
+}
+
+// sortedHistory копирует записи в порядке их добавления
+func sortedHistory(msgs []*MessageHistory) []MessageHistory {
+	history := make([]MessageHistory, 0, len(msgs))
+	for _, msg := range msgs {
+		history = append(history, *msg)
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].order < history[j].order })
+	return history
+}
+
+// QueryHistory возвращает страницу истории пользователя. Границы страницы
+// находятся двоичным поиском в индексах диалогов, поэтому стоимость запроса
+// зависит от размера страницы и числа диалогов, а не от объема истории.
+func (um *UserManager) QueryHistory(username string, q common.HistoryQuery) (common.HistoryPage, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	var conversations []string
+	switch {
+	case q.Room != "":
+		conversation := common.ConversationID(common.MsgRoomMessage, "", "", q.Room)
+		if !um.canSee(conversation, username) {
+			return common.HistoryPage{}, ErrNotRoomMember
+		}
+		conversations = []string{conversation}
+	case q.Peer == "all":
+		conversations = []string{"general"}
+	case q.Peer != "":
+		conversations = []string{common.ConversationID(common.MsgPrivate, username, q.Peer, "")}
+	default:
+		conversations = um.visibleConversations(username)
+	}
+
+	lists := make([][]*MessageHistory, 0, len(conversations))
+	for _, conversation := range conversations {
+		lists = append(lists, um.conversations[conversation])
+	}
+	return um.historyPage(username, lists, q)
+}
+
+// historyPage выбирает страницу из упорядоченных списков сообщений по
+// курсорам, интервалу времени и лимиту запроса; вызывается под um.mu
+func (um *UserManager) historyPage(username string, lists [][]*MessageHistory, q common.HistoryQuery) (common.HistoryPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
+	// Курсоры задают открытый интервал (lower, upper) глобального порядка
+	lower, upper := uint64(0), uint64(math.MaxUint64)
+	if q.After != "" {
+		msg, exists := um.messageIndex[q.After]
+		if !exists || !um.canSee(msg.Conversation, username) {
+			return common.HistoryPage{}, ErrMessageNotFound
+		}
+		lower = msg.order
+	}
+	if q.Before != "" {
+		msg, exists := um.messageIndex[q.Before]
+		if !exists || !um.canSee(msg.Conversation, username) {
+			return common.HistoryPage{}, ErrMessageNotFound
+		}
+		upper = msg.order
+	}
+	forward := q.After != "" && q.Before == ""
+
+	var collected []*MessageHistory
+	hasMore := false
+	for _, msgs := range lists {
+		lo := sort.Search(len(msgs), func(i int) bool { return msgs[i].order > lower })
+		hi := sort.Search(len(msgs), func(i int) bool { return msgs[i].order >= upper })
+		if !q.Since.IsZero() {
+			lo = max(lo, sort.Search(len(msgs), func(i int) bool { return !msgs[i].Timestamp.Before(q.Since) }))
+		}
+		if !q.Until.IsZero() {
+			hi = min(hi, sort.Search(len(msgs), func(i int) bool { return msgs[i].Timestamp.After(q.Until) }))
+		}
+		if lo >= hi {
+			continue
+		}
+
+		// Из каждого списка достаточно limit сообщений у нужного края
+		if hi-lo > limit {
+			hasMore = true
+			if forward {
+				hi = lo + limit
+			} else {
+				lo = hi - limit
+			}
+		}
+		collected = append(collected, msgs[lo:hi]...)
+	}
+
+	history := sortedHistory(collected)
+	if len(history) > limit {
+		hasMore = true
+		if forward {
+			history = history[:limit]
+		} else {
+			history = history[len(history)-limit:]
+		}
+	}
+
+	page := common.HistoryPage{
+		Messages: make([]common.Message, 0, len(history)),
+		HasMore:  hasMore,
+	}
+	for _, msg := range history {
+		page.Messages = append(page.Messages, msg.Message())
+	}
+	return page, nil
+}
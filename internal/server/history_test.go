@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+// historyFixture создает диалог alice и bob из count сообщений с
+// содержимым "0", "1", ... и временем base + i минут, диалог bob и carol
+// и комнату team alice и bob. Возвращает ID сообщений диалога alice и bob.
+func historyFixture(t *testing.T, count int, base time.Time) (*UserManager, []string) {
+	t.Helper()
+	um := newTestUserManager(t, "alice", "bob", "carol")
+	ids := make([]string, count)
+	for i := range ids {
+		sender, recipient := "alice", "bob"
+		if i%2 == 1 {
+			sender, recipient = recipient, sender
+		}
+		msg, err := um.AddMessage(common.Message{Type: common.MsgPrivate, Sender: sender, Recipient: recipient, Content: strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = msg.ID
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := um.AddMessage(common.Message{Type: common.MsgPrivate, Sender: "carol", Recipient: "bob", Content: "carol"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := um.CreateRoom("team", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.JoinRoom("team", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: "alice", Room: "team", Content: "team"}); err != nil {
+		t.Fatal(err)
+	}
+
+	um.mu.Lock()
+	for i, msg := range um.conversations[common.ConversationID(common.MsgPrivate, "alice", "bob", "")] {
+		msg.Timestamp = base.Add(time.Duration(i) * time.Minute)
+	}
+	um.mu.Unlock()
+	return um, ids
+}
+
+// pageRange проверяет, что страница - сообщения диалога с from по to
+// включительно
+func pageRange(t *testing.T, page common.HistoryPage, from, to int, hasMore bool) {
+	t.Helper()
+	if len(page.Messages) != to-from+1 || page.HasMore != hasMore {
+		t.Fatalf("страница: %d сообщений, has_more %v; want %d..%d, has_more %v", len(page.Messages), page.HasMore, from, to, hasMore)
+	}
+	for i, msg := range page.Messages {
+		if msg.Content != strconv.Itoa(from+i) {
+			t.Fatalf("сообщение %d страницы: %q, want %d", i, msg.Content, from+i)
+		}
+	}
+}
+
+func TestQueryHistoryLimit(t *testing.T) {
+	total := MaxHistoryLimit + 50
+	um, _ := historyFixture(t, total, time.Unix(0, 0))
+	for _, tt := range []struct {
+		limit, want int
+	}{
+		{0, DefaultHistoryLimit},
+		{-5, DefaultHistoryLimit},
+		{10, 10},
+		{MaxHistoryLimit + 1, MaxHistoryLimit},
+	} {
+		page, err := um.QueryHistory("alice", common.HistoryQuery{Peer: "bob", Limit: tt.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pageRange(t, page, total-tt.want, total-1, true)
+	}
+}
+
+func TestQueryHistoryCursors(t *testing.T) {
+	um, ids := historyFixture(t, 120, time.Unix(0, 0))
+
+	// Назад от конца до начала без пропусков и повторов
+	page, err := um.QueryHistory("alice", common.HistoryQuery{Peer: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 70, 119, true)
+	page, err = um.QueryHistory("alice", common.HistoryQuery{Peer: "bob", Before: page.Messages[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 20, 69, true)
+	page, err = um.QueryHistory("alice", common.HistoryQuery{Peer: "bob", Before: page.Messages[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 0, 19, false)
+
+	// Вперед от курсора
+	page, err = um.QueryHistory("bob", common.HistoryQuery{Peer: "alice", After: ids[0], Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 1, 10, true)
+	page, err = um.QueryHistory("bob", common.HistoryQuery{Peer: "alice", After: ids[110]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 111, 119, false)
+
+	// Оба курсора задают открытый интервал
+	page, err = um.QueryHistory("alice", common.HistoryQuery{Peer: "bob", After: ids[10], Before: ids[20]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 11, 19, false)
+
+	if _, err := um.QueryHistory("alice", common.HistoryQuery{Peer: "bob", Before: "нет такого"}); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("неизвестный курсор: %v", err)
+	}
+}
+
+func TestQueryHistoryTimeRange(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	um, ids := historyFixture(t, 120, base)
+
+	// Until включает сообщения ровно на границе
+	page, err := um.QueryHistory("alice", common.HistoryQuery{
+		Peer: "bob", Since: base.Add(100 * time.Minute), Until: base.Add(109 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 100, 109, false)
+
+	page, err = um.QueryHistory("alice", common.HistoryQuery{Peer: "bob", Since: base.Add(115*time.Minute + time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 116, 119, false)
+
+	// Интервал времени сочетается с курсором
+	page, err = um.QueryHistory("alice", common.HistoryQuery{Peer: "bob", Until: base.Add(30 * time.Minute), Before: ids[25], Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 20, 24, true)
+}
+
+func TestQueryHistoryVisibility(t *testing.T) {
+	um, ids := historyFixture(t, 10, time.Unix(0, 0))
+
+	// Курсор на чужое сообщение не выдает ни его, ни соседей
+	for _, q := range []common.HistoryQuery{{Before: ids[5]}, {After: ids[5]}, {Peer: "bob", Before: ids[5]}} {
+		if _, err := um.QueryHistory("carol", q); !errors.Is(err, ErrMessageNotFound) {
+			t.Fatalf("курсор на чужое сообщение %+v: %v", q, err)
+		}
+	}
+	if _, err := um.QueryHistory("carol", common.HistoryQuery{Room: "team"}); !errors.Is(err, ErrNotRoomMember) {
+		t.Fatalf("комната без членства: %v", err)
+	}
+
+	page, err := um.QueryHistory("carol", common.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != 3 {
+		t.Fatalf("carol видит %d сообщений", len(page.Messages))
+	}
+	for _, msg := range page.Messages {
+		if msg.Conversation != "dm:bob:carol" {
+			t.Fatalf("carol видит чужое сообщение: %+v", msg)
+		}
+	}
+
+	page, err = um.QueryHistory("alice", common.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != 11 || page.Messages[10].Content != "team" {
+		t.Fatalf("alice видит %d сообщений", len(page.Messages))
+	}
+}
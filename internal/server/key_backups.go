@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+const (
+	// MaxKeyBackupSize максимальный размер шифротекста резервной копии
+	MaxKeyBackupSize = 1 << 20
+	// MaxKeyBackupVersions сколько последних версий хранится у пользователя
+	MaxKeyBackupVersions = 10
+
+	// DefaultBackupFetchLimit и DefaultBackupFetchWindow ограничивают
+	// скачивание резервных копий: перебор фразы восстановления возможен
+	// только офлайн по скачанной копии, поэтому копий выдается немного
+	DefaultBackupFetchLimit  = 5
+	DefaultBackupFetchWindow = time.Hour
+
+	// Допустимые параметры Argon2id. Нижняя граница - минимум OWASP,
+	// верхняя не дает загрузить копию, которую клиент не сможет открыть.
+	minBackupKDFTime   = 2
+	maxBackupKDFTime   = 10
+	minBackupKDFMemory = 19 * 1024
+	maxBackupKDFMemory = 1024 * 1024
+	maxBackupKDFThread = 16
+	minBackupSaltLen   = 16
+	backupNonceSize    = 12
+)
+
+var (
+	ErrBackupNotFound    = errors.New("резервная копия не найдена")
+	ErrInvalidBackup     = errors.New("недопустимая резервная копия")
+	ErrBackupRateLimited = errors.New("слишком много запросов резервной копии")
+)
+
+// BackupRateLimitError отказ в скачивании резервной копии; RetryAfter -
+// через сколько освободится следующая попытка
+type BackupRateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BackupRateLimitError) Error() string {
+	return ErrBackupRateLimited.Error()
+}
+
+func (e *BackupRateLimitError) Is(target error) bool {
+	return target == ErrBackupRateLimited
+}
+
+// SetBackupFetchLimit задает, сколько раз пользователь может скачать
+// резервную копию за окно window. Счетчики держатся в памяти.
+func (um *UserManager) SetBackupFetchLimit(limit int, window time.Duration) error {
+	if limit <= 0 || window <= 0 {
+		return errors.New("лимит скачивания резервных копий должен быть положительным")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.backupFetchLimit = limit
+	um.backupFetchWindow = window
+	return nil
+}
+
+// StoreKeyBackup сохраняет новую версию резервной копии ключей. Сервер
+// проверяет только формат и параметры KDF: содержимое зашифровано на
+// клиенте. Самые старые версии сверх MaxKeyBackupVersions удаляются.
+// Возвращает сохраненную версию без шифротекста.
+func (um *UserManager) StoreKeyBackup(username string, backup common.KeyBackup) (common.KeyBackup, error) {
+	size, err := validateKeyBackup(backup)
+	if err != nil {
+		return common.KeyBackup{}, err
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if _, exists := um.users[username]; !exists {
+		return common.KeyBackup{}, errors.New("пользователь не найден")
+	}
+
+	versions := um.backups[username]
+	backup.Version = 1
+	if len(versions) > 0 {
+		backup.Version = versions[len(versions)-1].Version + 1
+	}
+	backup.CreatedAt = time.Now()
+	backup.Size = size
+	versions = append(versions, backup)
+	um.persist(bucketBackups, backupKey(username, backup.Version), backup)
+
+	for len(versions) > MaxKeyBackupVersions {
+		um.removeFromStore(bucketBackups, backupKey(username, versions[0].Version))
+		versions = versions[1:]
+	}
+	um.backups[username] = versions
+
+	backup.Ciphertext = ""
+	return backup, nil
+}
+
+// KeyBackupVersions возвращает версии резервных копий пользователя от
+// новых к старым без шифротекста. Список не расходует лимит скачиваний.
+func (um *UserManager) KeyBackupVersions(username string) []common.KeyBackup {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	versions := um.backups[username]
+	result := make([]common.KeyBackup, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		backup := versions[i]
+		backup.Ciphertext = ""
+		result = append(result, backup)
+	}
+	return result
+}
+
+// FetchKeyBackup возвращает резервную копию с шифротекстом: версию version
+// или последнюю при version == 0. Каждое скачивание учитывается в лимите,
+// при превышении возвращается *BackupRateLimitError.
+func (um *UserManager) FetchKeyBackup(username string, version int) (common.KeyBackup, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	versions := um.backups[username]
+	if len(versions) == 0 {
+		return common.KeyBackup{}, ErrBackupNotFound
+	}
+	backup := versions[len(versions)-1]
+	if version != 0 {
+		found := false
+		for _, b := range versions {
+			if b.Version == version {
+				backup, found = b, true
+				break
+			}
+		}
+		if !found {
+			return common.KeyBackup{}, ErrBackupNotFound
+		}
+	}
+
+	fetches, retryAfter := takeSlot(um.backupFetches[username], time.Now(), um.backupFetchLimit, um.backupFetchWindow)
+	um.backupFetches[username] = fetches
+	if retryAfter > 0 {
+		return common.KeyBackup{}, &BackupRateLimitError{RetryAfter: retryAfter}
+	}
+	return backup, nil
+}
+
+// validateKeyBackup проверяет формат копии и возвращает длину шифротекста
+func validateKeyBackup(backup common.KeyBackup) (int, error) {
+	kdf := backup.KDF
+	if kdf.Algorithm != "argon2id" {
+		return 0, fmt.Errorf("%w: поддерживается только argon2id", ErrInvalidBackup)
+	}
+	if kdf.Time < minBackupKDFTime || kdf.Time > maxBackupKDFTime ||
+		kdf.Memory < minBackupKDFMemory || kdf.Memory > maxBackupKDFMemory ||
+		kdf.Threads == 0 || kdf.Threads > maxBackupKDFThread {
+		return 0, fmt.Errorf("%w: параметры Argon2id вне допустимых", ErrInvalidBackup)
+	}
+	if salt, err := base64.StdEncoding.DecodeString(kdf.Salt); err != nil || len(salt) < minBackupSaltLen {
+		return 0, fmt.Errorf("%w: соль", ErrInvalidBackup)
+	}
+	if nonce, err := base64.StdEncoding.DecodeString(backup.Nonce); err != nil || len(nonce) != backupNonceSize {
+		return 0, fmt.Errorf("%w: nonce", ErrInvalidBackup)
+	}
+	if base64.StdEncoding.DecodedLen(len(backup.Ciphertext)) > MaxKeyBackupSize+2 {
+		return 0, fmt.Errorf("%w: слишком большая копия", ErrInvalidBackup)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(backup.Ciphertext)
+	if err != nil || len(ciphertext) <= 16 || len(ciphertext) > MaxKeyBackupSize {
+		return 0, fmt.Errorf("%w: шифротекст", ErrInvalidBackup)
+	}
+	return len(ciphertext), nil
+}
+
+func backupKey(username string, version int) string {
+	return fmt.Sprintf("%s/%010d", username, version)
+}
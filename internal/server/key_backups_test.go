@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+// keyBackup возвращает копию с допустимыми параметрами и шифротекстом size
+// байт
+func keyBackup(size int) common.KeyBackup {
+	return common.KeyBackup{
+		KDF: common.KeyBackupKDF{
+			Algorithm: "argon2id",
+			Salt:      base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, minBackupSaltLen)),
+			Time:      3, Memory: 64 * 1024, Threads: 4,
+		},
+		Nonce:      base64.StdEncoding.EncodeToString(make([]byte, backupNonceSize)),
+		Ciphertext: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, size)),
+	}
+}
+
+func TestValidateKeyBackup(t *testing.T) {
+	if size, err := validateKeyBackup(keyBackup(32)); err != nil || size != 32 {
+		t.Fatalf("допустимая копия: %d, %v", size, err)
+	}
+	if _, err := validateKeyBackup(keyBackup(MaxKeyBackupSize)); err != nil {
+		t.Fatalf("копия предельного размера: %v", err)
+	}
+
+	invalid := map[string]func(*common.KeyBackup){
+		"алгоритм":       func(b *common.KeyBackup) { b.KDF.Algorithm = "scrypt" },
+		"мало итераций":  func(b *common.KeyBackup) { b.KDF.Time = minBackupKDFTime - 1 },
+		"много итераций": func(b *common.KeyBackup) { b.KDF.Time = maxBackupKDFTime + 1 },
+		"мало памяти":    func(b *common.KeyBackup) { b.KDF.Memory = minBackupKDFMemory - 1 },
+		"много памяти":   func(b *common.KeyBackup) { b.KDF.Memory = maxBackupKDFMemory + 1 },
+		"без потоков":    func(b *common.KeyBackup) { b.KDF.Threads = 0 },
+		"много потоков":  func(b *common.KeyBackup) { b.KDF.Threads = maxBackupKDFThread + 1 },
+		"короткая соль": func(b *common.KeyBackup) {
+			b.KDF.Salt = base64.StdEncoding.EncodeToString(make([]byte, minBackupSaltLen-1))
+		},
+		"соль не base64":    func(b *common.KeyBackup) { b.KDF.Salt = "не base64" },
+		"nonce":             func(b *common.KeyBackup) { b.Nonce = base64.StdEncoding.EncodeToString(make([]byte, 16)) },
+		"только тег":        func(b *common.KeyBackup) { b.Ciphertext = base64.StdEncoding.EncodeToString(make([]byte, 16)) },
+		"шифротекст":        func(b *common.KeyBackup) { b.Ciphertext = strings.Repeat("!", 64) },
+		"слишком большая":   func(b *common.KeyBackup) { *b = keyBackup(MaxKeyBackupSize + 1) },
+		"огромная строка":   func(b *common.KeyBackup) { b.Ciphertext = strings.Repeat("A", 2*MaxKeyBackupSize) },
+		"пустой шифротекст": func(b *common.KeyBackup) { b.Ciphertext = "" },
+	}
+	for name, mutate := range invalid {
+		backup := keyBackup(32)
+		mutate(&backup)
+		if _, err := validateKeyBackup(backup); !errors.Is(err, ErrInvalidBackup) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestKeyBackupVersionRotation(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(bucketUsers, "alice", []byte(`{"username":"alice"}`))
+	um, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.StoreKeyBackup("bob", keyBackup(32)); err == nil {
+		t.Fatal("копия неизвестного пользователя сохранена")
+	}
+
+	total := MaxKeyBackupVersions + 3
+	for i := 1; i <= total; i++ {
+		saved, err := um.StoreKeyBackup("alice", keyBackup(16+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Version != i || saved.Size != 16+i || saved.Ciphertext != "" {
+			t.Fatalf("версия %d: %+v", i, saved)
+		}
+	}
+
+	versions := um.KeyBackupVersions("alice")
+	if len(versions) != MaxKeyBackupVersions || versions[0].Version != total || versions[len(versions)-1].Version != total-MaxKeyBackupVersions+1 {
+		t.Fatalf("версии: %d, от %d до %d", len(versions), versions[0].Version, versions[len(versions)-1].Version)
+	}
+	if keys := storeKeys(t, store, bucketBackups); len(keys) != MaxKeyBackupVersions {
+		t.Fatalf("копий в хранилище: %d", len(keys))
+	}
+	if _, err := um.FetchKeyBackup("alice", 1); !errors.Is(err, ErrBackupNotFound) {
+		t.Fatalf("удаленная версия: %v", err)
+	}
+
+	// После перезапуска нумерация продолжается с последней версии
+	restarted, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := restarted.FetchKeyBackup("alice", 0)
+	if err != nil || latest.Version != total || latest.Ciphertext == "" {
+		t.Fatalf("последняя версия: %+v, %v", latest, err)
+	}
+	if saved, err := restarted.StoreKeyBackup("alice", keyBackup(32)); err != nil || saved.Version != total+1 {
+		t.Fatalf("версия после перезапуска: %d, %v", saved.Version, err)
+	}
+}
+
+func TestKeyBackupFetchLimit(t *testing.T) {
+	um := newTestUserManager(t, "alice")
+	if _, err := um.FetchKeyBackup("alice", 0); !errors.Is(err, ErrBackupNotFound) {
+		t.Fatalf("копии нет: %v", err)
+	}
+	if _, err := um.StoreKeyBackup("alice", keyBackup(32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.SetBackupFetchLimit(0, time.Hour); err == nil {
+		t.Fatal("принят нулевой лимит")
+	}
+	if err := um.SetBackupFetchLimit(2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Список версий лимит не расходует
+	for i := 0; i < 5; i++ {
+		um.KeyBackupVersions("alice")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := um.FetchKeyBackup("alice", 0); err != nil {
+			t.Fatalf("скачивание %d: %v", i, err)
+		}
+	}
+	_, err := um.FetchKeyBackup("alice", 1)
+	var limited *BackupRateLimitError
+	if !errors.As(err, &limited) || !errors.Is(err, ErrBackupRateLimited) {
+		t.Fatalf("третье скачивание: %v", err)
+	}
+	if limited.RetryAfter <= 0 || limited.RetryAfter > time.Hour {
+		t.Fatalf("RetryAfter = %v", limited.RetryAfter)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sort"
+	"strings"
+)
+
+// setPublicKey меняет ключ пользователя и сообщает, был ли заменен ранее
+// опубликованный ключ; вызывается под um.mu
+func (um *UserManager) setPublicKey(user *User, publicKey string) bool {
+	previous := user.PublicKey
+	user.PublicKey = publicKey
+	um.saveUser(user)
+	return previous != "" && previous != publicKey
+}
+
+// KeyChangeWatchers возвращает пользователей, которых нужно предупредить
+// о смене ключа username: всех, кто с ним переписывался лично. Кого
+// пользователь проверил, сервер не знает: эти отметки хранит клиент.
+// Счетчики диалогов переживают вытеснение истории, поэтому учитываются
+// и давние собеседники.
+func (um *UserManager) KeyChangeWatchers(username string) []string {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	for conversation := range um.sequences {
+		if !strings.HasPrefix(conversation, "dm:") {
+			continue
+		}
+		first, second, _ := strings.Cut(strings.TrimPrefix(conversation, "dm:"), ":")
+		switch username {
+		case first:
+			seen[second] = true
+		case second:
+			seen[first] = true
+		}
+	}
+	delete(seen, username)
+
+	watchers := make([]string, 0, len(seen))
+	for watcher := range seen {
+		if _, exists := um.users[watcher]; exists {
+			watchers = append(watchers, watcher)
+		}
+	}
+	sort.Strings(watchers)
+	return watchers
+}
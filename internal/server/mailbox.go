@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"secure-messenger/internal/common"
+)
+
+// maxMailboxSize ограничивает очередь одного получателя; при переполнении
+// вытесняются самые старые сообщения
+const maxMailboxSize = 1000
+
+// mailboxEntry неподтвержденное сообщение в почтовом ящике получателя
+type mailboxEntry struct {
+	Message common.Message `json:"message"`
+
+	storeKey string
+}
+
+// EnqueueMessage кладет личное сообщение в почтовый ящик получателя.
+// Сообщение остается там, пока получатель не подтвердит его доставку,
+// поэтому переживает и офлайн получателя, и вытеснение из общей истории.
+func (um *UserManager) EnqueueMessage(msg common.Message) error {
+	if msg.ID == "" {
+		return errors.New("сообщение без ID нельзя поставить в очередь")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if _, exists := um.users[msg.Recipient]; !exists {
+		return errors.New("пользователь не найден")
+	}
+	um.enqueue(msg)
+	return nil
+}
+
+// enqueue добавляет сообщение в конец почтового ящика получателя;
+// вызывается под um.mu
+func (um *UserManager) enqueue(msg common.Message) {
+	um.mailboxSeq++
+	entry := mailboxEntry{
+		Message:  msg,
+		storeKey: fmt.Sprintf("%s/%020d", msg.Recipient, um.mailboxSeq),
+	}
+	queue := append(um.mailboxes[msg.Recipient], entry)
+	um.persist(bucketMailbox, entry.storeKey, entry)
+
+	if len(queue) > maxMailboxSize {
+		dropped := queue[0]
+		um.removeFromStore(bucketMailbox, dropped.storeKey)
+		queue = queue[1:]
+		log.Printf("⚠️ Mailbox of %s is full, dropped message %s", msg.Recipient, dropped.Message.ID)
+	}
+	um.mailboxes[msg.Recipient] = queue
+}
+
+// PendingMessages возвращает неподтвержденные сообщения пользователя
+// в порядке поступления
+func (um *UserManager) PendingMessages(username string) []common.Message {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	queue := um.mailboxes[username]
+	messages := make([]common.Message, 0, len(queue))
+	for _, entry := range queue {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+// takeFromMailbox удаляет сообщение из почтового ящика после подтверждения
+// доставки; вызывается под um.mu
+func (um *UserManager) takeFromMailbox(username, id string) (mailboxEntry, bool) {
+	queue := um.mailboxes[username]
+	for i, entry := range queue {
+		if entry.Message.ID != id {
+			continue
+		}
+
+		um.removeFromStore(bucketMailbox, entry.storeKey)
+		queue = append(queue[:i], queue[i+1:]...)
+		if len(queue) == 0 {
+			delete(um.mailboxes, username)
+		} else {
+			um.mailboxes[username] = queue
+		}
+		return entry, true
+	}
+	return mailboxEntry{}, false
+}
+
+// updateMailbox заменяет содержимое еще не доставленного сообщения его
+// текущей версией; вызывается под um.mu
+func (um *UserManager) updateMailbox(msg *MessageHistory) {
+	queue := um.mailboxes[msg.Recipient]
+	for i := range queue {
+		if queue[i].Message.ID != msg.ID {
+			continue
+		}
+
+		queued := &queue[i].Message
+		queued.Content = msg.Content
+		queued.IV = msg.IV
+		queued.AuthTag = msg.AuthTag
+		queued.RatchetKey = msg.RatchetKey
+		queued.PrevCounter = msg.PrevCounter
+		queued.Counter = msg.Counter
+		queued.Signature = msg.Signature
+		queued.SignedAt = msg.SignedAt
+		queued.Edited = true
+		um.persist(bucketMailbox, queue[i].storeKey, queue[i])
+		return
+	}
+}
+
+// mailboxDepth возвращает общее число сообщений в очередях; вызывается под um.mu
+func (um *UserManager) mailboxDepth() int {
+	total := 0
+	for _, queue := range um.mailboxes {
+		total += len(queue)
+	}
+	return total
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+// Сообщение офлайн получателю ждет в почтовом ящике и досылается при
+// каждом подключении, пока получатель не пришлет квитанцию
+func TestMailboxRedeliversUntilReceipt(t *testing.T) {
+	s, ts := newTestServer(t, "alice", "bob")
+	store := s.userManager.store
+	alice := dialUser(t, s, ts, "alice")
+	readUntil(t, alice, common.MsgSyncDone)
+
+	if err := alice.WriteJSON(common.Message{Type: common.MsgPrivate, Recipient: "bob", Content: "привет", ClientID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	ack, _ := readUntil(t, alice, common.MsgAck)
+	pending := s.userManager.PendingMessages("bob")
+	if len(pending) != 1 || pending[0].ID != ack.ID || pending[0].Content != "привет" {
+		t.Fatalf("почтовый ящик bob: %+v", pending)
+	}
+	if keys := storeKeys(t, store, bucketMailbox); len(keys) != 1 {
+		t.Fatalf("записей ящика в хранилище: %d", len(keys))
+	}
+
+	// Без квитанции сообщение приходит снова при следующем подключении
+	for i := 0; i < 2; i++ {
+		bob := dialUser(t, s, ts, "bob")
+		readUntil(t, bob, common.MsgSyncDone)
+		msg, _ := readUntil(t, bob, common.MsgPrivate)
+		if msg.ID != ack.ID || msg.Sender != "alice" {
+			t.Fatalf("подключение %d: %+v", i, msg)
+		}
+		bob.Close()
+		waitFor(t, "отключение bob", func() bool { return len(s.snapshotClients("bob")) == 0 })
+	}
+
+	bob := dialUser(t, s, ts, "bob")
+	readUntil(t, bob, common.MsgPrivate)
+	if err := bob.WriteJSON(common.Message{Type: common.MsgDelivered, ID: ack.ID}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "очистка ящика", func() bool { return len(s.userManager.PendingMessages("bob")) == 0 })
+	if keys := storeKeys(t, store, bucketMailbox); len(keys) != 0 {
+		t.Fatalf("записей ящика в хранилище: %d", len(keys))
+	}
+	bob.Close()
+	waitFor(t, "отключение bob", func() bool { return len(s.snapshotClients("bob")) == 0 })
+
+	// Подтвержденное сообщение остается только в истории
+	bob = dialUser(t, s, ts, "bob")
+	readUntil(t, bob, common.MsgSyncDone)
+	if err := bob.WriteJSON(common.Message{Type: common.MsgPing}); err != nil {
+		t.Fatal(err)
+	}
+	if _, skipped := readUntil(t, bob, common.MsgPong); len(skipped) != 0 {
+		t.Fatalf("после подтверждения пришло: %+v", skipped)
+	}
+}
+
+func TestMailboxEvictsOldest(t *testing.T) {
+	um := newTestUserManager(t, "alice", "bob")
+	for i := 0; i < maxMailboxSize+2; i++ {
+		if err := um.EnqueueMessage(common.Message{ID: fmt.Sprintf("m%d", i), Sender: "alice", Recipient: "bob"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := um.PendingMessages("bob")
+	if len(pending) != maxMailboxSize || pending[0].ID != "m2" {
+		t.Fatalf("в ящике %d сообщений, первое %s", len(pending), pending[0].ID)
+	}
+	if keys := storeKeys(t, um.store, bucketMailbox); len(keys) != maxMailboxSize {
+		t.Fatalf("записей ящика в хранилище: %d", len(keys))
+	}
+	if err := um.EnqueueMessage(common.Message{Sender: "alice", Recipient: "bob"}); err == nil {
+		t.Fatal("сообщение без ID поставлено в очередь")
+	}
+	if err := um.EnqueueMessage(common.Message{ID: "x", Sender: "alice", Recipient: "carol"}); err == nil {
+		t.Fatal("сообщение неизвестному получателю поставлено в очередь")
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+
+	"secure-messenger/internal/common"
+)
+
+const (
+	// MaxMentionsPerMessage ограничивает число упоминаний в одном сообщении
+	MaxMentionsPerMessage = 20
+	// maxMentionInbox ограничивает входящие упоминания одного пользователя;
+	// при переполнении вытесняются самые старые
+	maxMentionInbox = 500
+)
+
+// mentionEntry упоминание во входящих пользователя
+type mentionEntry struct {
+	common.Mention
+
+	storeKey string
+}
+
+// resolveMentions определяет, кого упоминает сообщение. Открытый текст
+// разбирается на сервере; для зашифрованного используется список
+// отправителя. Остаются только существующие пользователи, которые видят
+// диалог; личные сообщения упоминаний не несут. Вызывается под um.mu.
+func (um *UserManager) resolveMentions(msg common.Message, conversation string) []string {
+	if msg.Type == common.MsgPrivate {
+		return nil
+	}
+
+	candidates := msg.Mentions
+	if msg.IV == "" && msg.AuthTag == "" {
+		candidates = common.ParseMentions(msg.Content)
+	}
+
+	var mentions []string
+	seen := make(map[string]bool)
+	for _, username := range candidates {
+		if len(mentions) == MaxMentionsPerMessage {
+			break
+		}
+		if seen[username] || username == msg.Sender {
+			continue
+		}
+		seen[username] = true
+		if _, exists := um.users[username]; exists && um.canSee(conversation, username) {
+			mentions = append(mentions, username)
+		}
+	}
+	return mentions
+}
+
+// recordMentions кладет сообщение во входящие упомянутых пользователей;
+// вызывается под um.mu
+func (um *UserManager) recordMentions(msg *MessageHistory) {
+	for _, username := range msg.Mentions {
+		um.mentionSeq++
+		entry := mentionEntry{
+			Mention:  common.Mention{Message: msg.Message()},
+			storeKey: fmt.Sprintf("%s/%020d", username, um.mentionSeq),
+		}
+		inbox := append(um.mentions[username], entry)
+		um.persist(bucketMentions, entry.storeKey, entry)
+
+		if len(inbox) > maxMentionInbox {
+			um.removeFromStore(bucketMentions, inbox[0].storeKey)
+			inbox = inbox[1:]
+		}
+		um.mentions[username] = inbox
+	}
+}
+
+// updateMentions заменяет копии сообщения во входящих упомянутых текущей
+// версией после правки или удаления; вызывается под um.mu
+func (um *UserManager) updateMentions(msg *MessageHistory) {
+	for _, username := range msg.Mentions {
+		inbox := um.mentions[username]
+		for i := len(inbox) - 1; i >= 0; i-- {
+			if inbox[i].Message.ID != msg.ID {
+				continue
+			}
+			inbox[i].Message = msg.Message()
+			um.persist(bucketMentions, inbox[i].storeKey, inbox[i])
+			break
+		}
+	}
+}
+
+// dropMentions убирает исчезнувшее сообщение из входящих упомянутых;
+// вызывается под um.mu
+func (um *UserManager) dropMentions(msg *MessageHistory) {
+	for _, username := range msg.Mentions {
+		inbox := um.mentions[username]
+		for i := len(inbox) - 1; i >= 0; i-- {
+			if inbox[i].Message.ID != msg.ID {
+				continue
+			}
+			um.removeFromStore(bucketMentions, inbox[i].storeKey)
+			inbox = append(inbox[:i], inbox[i+1:]...)
+			break
+		}
+		if len(inbox) == 0 {
+			delete(um.mentions, username)
+		} else {
+			um.mentions[username] = inbox
+		}
+	}
+}
+
+// Mentions возвращает страницу входящих упоминаний пользователя: самые
+// новые или, если задан before, предшествующие упоминанию с этим ID
+func (um *UserManager) Mentions(username, before string, limit int) (common.MentionsPage, error) {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	inbox := um.mentions[username]
+	end := len(inbox)
+	if before != "" {
+		end = -1
+		for i, entry := range inbox {
+			if entry.Message.ID == before {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return common.MentionsPage{}, ErrMessageNotFound
+		}
+	}
+	start := max(0, end-limit)
+
+	page := common.MentionsPage{
+		Mentions: make([]common.Mention, 0, end-start),
+		Unread:   um.unreadMentions(username),
+		HasMore:  start > 0,
+	}
+	for _, entry := range inbox[start:end] {
+		page.Mentions = append(page.Mentions, entry.Mention)
+	}
+	return page, nil
+}
+
+// MarkMentionsRead отмечает упоминания прочитанными (все, если ids пуст)
+// и возвращает число оставшихся непрочитанных
+func (um *UserManager) MarkMentionsRead(username string, ids []string) int {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	selected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	inbox := um.mentions[username]
+	for i := range inbox {
+		if inbox[i].Read || (len(ids) > 0 && !selected[inbox[i].Message.ID]) {
+			continue
+		}
+		inbox[i].Read = true
+		um.persist(bucketMentions, inbox[i].storeKey, inbox[i])
+	}
+	return um.unreadMentions(username)
+}
+
+// UnreadMentions возвращает число непрочитанных упоминаний пользователя
+func (um *UserManager) UnreadMentions(username string) int {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	return um.unreadMentions(username)
+}
+
+// unreadMentions вызывается под um.mu
+func (um *UserManager) unreadMentions(username string) int {
+	unread := 0
+	for _, entry := range um.mentions[username] {
+		if !entry.Read {
+			unread++
+		}
+	}
+	return unread
+}
+
+// mentionCount возвращает общее число записей во входящих; вызывается под um.mu
+func (um *UserManager) mentionCount() int {
+	total := 0
+	for _, inbox := range um.mentions {
+		total += len(inbox)
+	}
+	return total
+}
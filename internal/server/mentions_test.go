@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+func TestResolveMentions(t *testing.T) {
+	names := []string{"alice", "bob", "carol", "dave"}
+	for i := 0; i < MaxMentionsPerMessage+5; i++ {
+		names = append(names, fmt.Sprintf("user%02d", i))
+	}
+	um := newTestUserManager(t, names...)
+	if _, err := um.CreateRoom("team", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.JoinRoom("team", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		msg  common.Message
+		want []string
+	}{
+		{
+			"комната: посторонние, отправитель и неизвестные отбрасываются",
+			common.Message{Type: common.MsgRoomMessage, Room: "team", Content: "@bob @carol @alice @ghost @bob"},
+			[]string{"bob"},
+		},
+		{
+			"зашифрованное: список отправителя",
+			common.Message{Type: common.MsgRoomMessage, Room: "team", IV: "iv", Content: "@carol", Mentions: []string{"bob", "carol", "alice", "bob"}},
+			[]string{"bob"},
+		},
+		{
+			"общий чат виден всем",
+			common.Message{Type: common.MsgGeneral, Recipient: "all", Content: "@carol и @dave"},
+			[]string{"carol", "dave"},
+		},
+		{
+			"личное сообщение",
+			common.Message{Type: common.MsgPrivate, Recipient: "bob", Content: "@bob"},
+			nil,
+		},
+	} {
+		tt.msg.Sender = "alice"
+		msg, err := um.AddMessage(tt.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg.Mentions, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, msg.Mentions, tt.want)
+		}
+	}
+
+	// Число упоминаний в сообщении ограничено
+	msg, err := um.AddMessage(common.Message{Type: common.MsgGeneral, Sender: "alice", Recipient: "all", Content: "@" + strings.Join(names[4:], " @")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Mentions) != MaxMentionsPerMessage || msg.Mentions[0] != "user00" {
+		t.Fatalf("упоминаний: %d", len(msg.Mentions))
+	}
+	if unread := um.UnreadMentions("carol"); unread != 1 {
+		t.Fatalf("непрочитанных у carol: %d", unread)
+	}
+}
+
+func TestMentionInboxEvictsOldest(t *testing.T) {
+	um := newTestUserManager(t, "alice", "bob")
+	var first string
+	for i := 0; i < maxMentionInbox+3; i++ {
+		msg, err := um.AddMessage(common.Message{Type: common.MsgGeneral, Sender: "alice", Recipient: "all", Content: fmt.Sprintf("@bob %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 {
+			first = msg.ID
+		}
+	}
+	page, err := um.Mentions("bob", "", MaxHistoryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Unread != maxMentionInbox || !page.HasMore {
+		t.Fatalf("непрочитанных %d, has_more %v", page.Unread, page.HasMore)
+	}
+	um.mu.RLock()
+	inbox := um.mentions["bob"]
+	um.mu.RUnlock()
+	if len(inbox) != maxMentionInbox || inbox[0].Message.ID != first {
+		t.Fatalf("во входящих %d, первое %s", len(inbox), inbox[0].Message.ID)
+	}
+	if keys := storeKeys(t, um.store, bucketMentions); len(keys) != maxMentionInbox {
+		t.Fatalf("упоминаний в хранилище: %d", len(keys))
+	}
+}
+
+func TestMentionsPagingAndRead(t *testing.T) {
+	um := newTestUserManager(t, "alice", "bob")
+	ids := make([]string, 7)
+	for i := range ids {
+		msg, err := um.AddMessage(common.Message{Type: common.MsgGeneral, Sender: "alice", Recipient: "all", Content: fmt.Sprintf("@bob %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = msg.ID
+	}
+	pageIDs := func(page common.MentionsPage) []string {
+		var got []string
+		for _, m := range page.Mentions {
+			got = append(got, m.Message.ID)
+		}
+		return got
+	}
+
+	page, err := um.Mentions("bob", "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pageIDs(page), ids[4:]) || !page.HasMore || page.Unread != 7 {
+		t.Fatalf("первая страница: %d упоминаний, has_more %v, непрочитанных %d", len(page.Mentions), page.HasMore, page.Unread)
+	}
+	page, err = um.Mentions("bob", ids[4], 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pageIDs(page), ids[1:4]) || !page.HasMore {
+		t.Fatalf("вторая страница: %d упоминаний, has_more %v", len(page.Mentions), page.HasMore)
+	}
+	page, err = um.Mentions("bob", ids[1], 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pageIDs(page), ids[:1]) || page.HasMore {
+		t.Fatalf("последняя страница: %d упоминаний, has_more %v", len(page.Mentions), page.HasMore)
+	}
+	if _, err := um.Mentions("bob", "нет такого", 3); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("неизвестный курсор: %v", err)
+	}
+	if page, _ := um.Mentions("alice", "", 0); len(page.Mentions) != 0 || page.Unread != 0 {
+		t.Fatalf("упоминания отправителя: %+v", page)
+	}
+
+	if unread := um.MarkMentionsRead("bob", []string{ids[2], ids[5], "нет такого"}); unread != 5 {
+		t.Fatalf("после отметки двух: %d непрочитанных", unread)
+	}
+	page, _ = um.Mentions("bob", "", 0)
+	for i, m := range page.Mentions {
+		if m.Read != (i == 2 || i == 5) {
+			t.Fatalf("упоминание %d: прочитано %v", i, m.Read)
+		}
+	}
+	if unread := um.MarkMentionsRead("bob", nil); unread != 0 {
+		t.Fatalf("после отметки всех: %d непрочитанных", unread)
+	}
+
+	// Отметки сохраняются
+	restarted, err := NewUserManagerWithStore(um.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := restarted.Mentions("bob", "", 0); len(page.Mentions) != 7 || page.Unread != 0 {
+		t.Fatalf("после перезапуска: %d упоминаний, %d непрочитанных", len(page.Mentions), page.Unread)
+	}
+}
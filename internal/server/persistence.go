@@ -0,0 +1,371 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+// userRecord сохраняемая часть User (без состояния подключения)
+type userRecord struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Salt         string    `json:"salt,omitempty"`
+	LastSeen     time.Time `json:"last_seen"`
+	JoinedAt     time.Time `json:"joined_at"`
+	PublicKey    string    `json:"public_key,omitempty"`
+	SigningKey   string    `json:"signing_key,omitempty"`
+	// Отрицание, чтобы у старых записей уведомления о прочтении были включены
+	HideReadReceipts bool `json:"hide_read_receipts,omitempty"`
+}
+
+// sessionRecord сохраняемая сессия
+type sessionRecord struct {
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+}
+
+// persist сериализует значение и записывает его в хранилище.
+// Вызывается под um.mu; ошибки записи логируются, рабочая копия в памяти
+// остается источником истины до перезапуска.
+func (um *UserManager) persist(bucket, key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Store marshal error (%s/%s): %v", bucket, key, err)
+		return
+	}
+	if err := um.store.Put(bucket, key, data); err != nil {
+		log.Printf("Store write error (%s/%s): %v", bucket, key, err)
+	}
+}
+
+func (um *UserManager) removeFromStore(bucket, key string) {
+	if err := um.store.Delete(bucket, key); err != nil {
+		log.Printf("Store delete error (%s/%s): %v", bucket, key, err)
+	}
+}
+
+func (um *UserManager) saveUser(user *User) {
+	um.persist(bucketUsers, user.Username, userRecord{
+		Username:     user.Username,
+		PasswordHash: user.PasswordHash,
+		Salt:         user.Salt,
+		LastSeen:     user.LastSeen,
+		JoinedAt:     user.JoinedAt,
+		PublicKey:    user.PublicKey,
+		SigningKey:   user.SigningKey,
+
+		HideReadReceipts: user.HideReadReceipts,
+	})
+}
+
+// sessionKeyPrefix отличает ключи-хэши от открытых токенов, под которыми
+// сессии хранились раньше
+const sessionKeyPrefix = "sha256:"
+
+// hashToken возвращает SHA-256 токена сессии (hex): по нему сессия
+// хранится в памяти и на диске
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (um *UserManager) saveSession(session *Session) {
+	um.persist(bucketSessions, sessionKeyPrefix+session.TokenHash, sessionRecord{
+		Username: session.Username,
+		Expires:  session.Expires,
+	})
+}
+
+func (um *UserManager) deleteSession(tokenHash string) {
+	um.removeFromStore(bucketSessions, sessionKeyPrefix+tokenHash)
+}
+
+// load восстанавливает состояние из хранилища
+func (um *UserManager) load() error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	err := um.store.ForEach(bucketUsers, func(key string, value []byte) error {
+		var rec userRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return err
+		}
+		um.users[rec.Username] = &User{
+			Username:     rec.Username,
+			PasswordHash: rec.PasswordHash,
+			Salt:         rec.Salt,
+			LastSeen:     rec.LastSeen,
+			JoinedAt:     rec.JoinedAt,
+			PublicKey:    rec.PublicKey,
+			SigningKey:   rec.SigningKey,
+
+			HideReadReceipts: rec.HideReadReceipts,
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var stale []string
+	var migrated []*Session
+	err = um.store.ForEach(bucketSessions, func(key string, value []byte) error {
+		var rec sessionRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return err
+		}
+		// Старые записи лежат под открытым токеном и переносятся под хэш
+		id, hashed := strings.CutPrefix(key, sessionKeyPrefix)
+		if !hashed {
+			id = hashToken(key)
+		}
+		if _, exists := um.users[rec.Username]; !exists || now.After(rec.Expires) {
+			stale = append(stale, key)
+			return nil
+		}
+		session := &Session{
+			TokenHash: id,
+			Username:  rec.Username,
+			Expires:   rec.Expires,
+		}
+		um.sessions[id] = session
+		if !hashed {
+			stale = append(stale, key)
+			migrated = append(migrated, session)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		um.removeFromStore(bucketSessions, key)
+	}
+	for _, session := range migrated {
+		um.saveSession(session)
+	}
+
+	var loaded []*MessageHistory
+	err = um.store.ForEach(bucketMessages, func(key string, value []byte) error {
+		var msg MessageHistory
+		if err := json.Unmarshal(value, &msg); err != nil {
+			return err
+		}
+		msg.storeKey = key
+		order, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return fmt.Errorf("неверный ключ сообщения %q: %w", key, err)
+		}
+		msg.order = order
+		loaded = append(loaded, &msg)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for len(loaded) > um.messageLimit {
+		um.removeFromStore(bucketMessages, loaded[0].storeKey)
+		loaded = loaded[1:]
+	}
+	if n := len(loaded); n > 0 {
+		um.messageSeq = loaded[n-1].order
+	}
+
+	err = um.store.ForEach(bucketSequences, func(conversation string, value []byte) error {
+		var seq uint64
+		if err := json.Unmarshal(value, &seq); err != nil {
+			return err
+		}
+		um.sequences[conversation] = seq
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, msg := range loaded {
+		if msg.Seq > um.sequences[msg.Conversation] {
+			um.sequences[msg.Conversation] = msg.Seq
+		}
+	}
+	// Сообщения, сохраненные до появления порядковых номеров, получают
+	// ID и номера в исходном порядке
+	for _, msg := range loaded {
+		if msg.Seq == 0 {
+			if msg.ID == "" {
+				if msg.ID, err = common.GenerateMessageID(); err != nil {
+					return err
+				}
+			}
+			msg.Conversation = common.ConversationID(msg.Type, msg.Sender, msg.Recipient, msg.Room)
+			um.sequences[msg.Conversation]++
+			msg.Seq = um.sequences[msg.Conversation]
+			um.persist(bucketSequences, msg.Conversation, msg.Seq)
+			um.persist(bucketMessages, msg.storeKey, msg)
+		}
+		um.indexMessage(msg)
+	}
+
+	err = um.store.ForEach(bucketPrekeys, func(username string, value []byte) error {
+		var rec prekeyRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return err
+		}
+		um.prekeys[username] = &rec
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = um.store.ForEach(bucketRooms, func(name string, value []byte) error {
+		var room Room
+		if err := json.Unmarshal(value, &room); err != nil {
+			return err
+		}
+		if room.Invited == nil {
+			room.Invited = make(map[string]bool)
+		}
+		um.rooms[name] = &room
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Ключи вида "<получатель>/<номер>" обходятся по возрастанию,
+	// поэтому порядок сообщений в каждой очереди сохраняется
+	err = um.store.ForEach(bucketMailbox, func(key string, value []byte) error {
+		var entry mailboxEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return err
+		}
+		entry.storeKey = key
+
+		recipient, seqPart, found := strings.Cut(key, "/")
+		seq, err := strconv.ParseUint(seqPart, 10, 64)
+		if found && err == nil && seq > um.mailboxSeq {
+			um.mailboxSeq = seq
+		}
+		um.mailboxes[recipient] = append(um.mailboxes[recipient], entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = um.store.ForEach(bucketExpiry, func(conversation string, value []byte) error {
+		var ttl time.Duration
+		if err := json.Unmarshal(value, &ttl); err != nil {
+			return err
+		}
+		um.expiry[conversation] = ttl
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Сервер больше не хранит, кого проверил пользователь
+	var legacyVerified []string
+	err = um.store.ForEach(bucketLegacyVerified, func(key string, _ []byte) error {
+		legacyVerified = append(legacyVerified, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range legacyVerified {
+		um.removeFromStore(bucketLegacyVerified, key)
+	}
+
+	err = um.store.ForEach(bucketEpochs, func(conversation string, value []byte) error {
+		var epoch uint64
+		if err := json.Unmarshal(value, &epoch); err != nil {
+			return err
+		}
+		um.epochs[conversation] = epoch
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = um.store.ForEach(bucketBackups, func(key string, value []byte) error {
+		var backup common.KeyBackup
+		if err := json.Unmarshal(value, &backup); err != nil {
+			return err
+		}
+		username, _, found := strings.Cut(key, "/")
+		if !found {
+			return fmt.Errorf("неверный ключ резервной копии %q", key)
+		}
+		// Ключи с версией фиксированной ширины идут по возрастанию
+		um.backups[username] = append(um.backups[username], backup)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = um.store.ForEach(bucketAttachments, func(id string, value []byte) error {
+		var rec attachmentRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return err
+		}
+		um.attachments[id] = &rec
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = um.store.ForEach(bucketUploads, func(id string, value []byte) error {
+		var upload uploadRecord
+		if err := json.Unmarshal(value, &upload); err != nil {
+			return err
+		}
+		um.uploads[id] = &upload
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Входящие упоминания хранятся так же, как почтовые ящики
+	err = um.store.ForEach(bucketMentions, func(key string, value []byte) error {
+		var entry mentionEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return err
+		}
+		entry.storeKey = key
+
+		username, seqPart, found := strings.Cut(key, "/")
+		seq, err := strconv.ParseUint(seqPart, 10, 64)
+		if found && err == nil && seq > um.mentionSeq {
+			um.mentionSeq = seq
+		}
+		um.mentions[username] = append(um.mentions[username], entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// История комнат, удаленных до того, как удаление стало стирать ее
+	for conversation := range um.conversations {
+		name, isRoom := strings.CutPrefix(conversation, "room:")
+		if _, exists := um.rooms[name]; isRoom && !exists {
+			um.destroyRoom(&Room{Name: name})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeKeys возвращает ключи бакета
+func storeKeys(t *testing.T, store Store, bucket string) []string {
+	t.Helper()
+	var keys []string
+	err := store.ForEach(bucket, func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestSessionsStoredByTokenHash(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(bucketUsers, "alice", []byte(`{"username":"alice"}`))
+	// Запись в старом формате: ключ - открытый токен
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	store.Put(bucketSessions, "legacy-token", []byte(`{"username":"alice","expires":"`+expires+`"}`))
+	store.Put(bucketSessions, "expired-token", []byte(`{"username":"alice","expires":"2000-01-01T00:00:00Z"}`))
+
+	um, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username, ok := um.ValidateSession("legacy-token"); !ok || username != "alice" {
+		t.Fatalf("старая сессия не перенесена: %q, %v", username, ok)
+	}
+	token := um.CreateSession("alice")
+	if token == "" {
+		t.Fatal("сессия не создана")
+	}
+
+	keys := storeKeys(t, store, bucketSessions)
+	if len(keys) != 2 {
+		t.Fatalf("ключи сессий: %v", keys)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, sessionKeyPrefix) || strings.Contains(key, token) || strings.Contains(key, "token") {
+			t.Fatalf("токен на диске: %q", key)
+		}
+	}
+
+	restarted, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range []string{"legacy-token", token} {
+		if _, ok := restarted.ValidateSession(tok); !ok {
+			t.Fatalf("сессия %q потеряна после перезапуска", tok)
+		}
+	}
+	restarted.Logout(token)
+	if _, ok := restarted.ValidateSession(token); ok {
+		t.Fatal("сессия действует после выхода")
+	}
+	if keys := storeKeys(t, store, bucketSessions); len(keys) != 1 {
+		t.Fatalf("после выхода ключи сессий: %v", keys)
+	}
+}
+
+// Отметки о проверке ключей, которые раньше хранил сервер, стираются
+func TestLoadDropsLegacyVerifications(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(bucketUsers, "alice", []byte(`{"username":"alice"}`))
+	store.Put(bucketLegacyVerified, "alice/bob", []byte(`{"public_key":"k"}`))
+	store.Put(bucketLegacyVerified, "bob/alice", []byte(`{"public_key":"k"}`))
+
+	if _, err := NewUserManagerWithStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storeKeys(t, store, bucketLegacyVerified); len(keys) != 0 {
+		t.Fatalf("остались отметки: %v", keys)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+const (
+	// PrekeyLowWaterMark порог, ниже которого владелец получает уведомление о пополнении
+	PrekeyLowWaterMark = 10
+	// maxOneTimePrekeys максимальный размер пула одноразовых предключей
+	maxOneTimePrekeys = 100
+
+	// DefaultPrekeyFetchLimit и DefaultPrekeyFetchWindow ограничивают,
+	// сколько наборов предключей одного пользователя выдается одному
+	// запрашивающему: каждый набор расходует одноразовый предключ
+	DefaultPrekeyFetchLimit  = 10
+	DefaultPrekeyFetchWindow = time.Hour
+)
+
+var ErrPrekeyRateLimited = errors.New("слишком много запросов предключей")
+
+// PrekeyRateLimitError отказ в выдаче набора предключей; RetryAfter -
+// через сколько освободится следующая попытка
+type PrekeyRateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *PrekeyRateLimitError) Error() string {
+	return ErrPrekeyRateLimited.Error()
+}
+
+func (e *PrekeyRateLimitError) Is(target error) bool {
+	return target == ErrPrekeyRateLimited
+}
+
+// prekeyFetchKey запрашивающий и пользователь, чьи предключи он получает
+type prekeyFetchKey struct {
+	requester string
+	target    string
+}
+
+// SetPrekeyFetchLimit задает, сколько наборов предключей одного
+// пользователя можно получить за окно window. Счетчики держатся в памяти.
+func (um *UserManager) SetPrekeyFetchLimit(limit int, window time.Duration) error {
+	if limit <= 0 || window <= 0 {
+		return errors.New("лимит выдачи предключей должен быть положительным")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.prekeyFetchLimit = limit
+	um.prekeyFetchWindow = window
+	return nil
+}
+
+// prekeyRecord ключи пользователя в каталоге предключей
+type prekeyRecord struct {
+	IdentityKey    string              `json:"identity_key"`
+	SigningKey     string              `json:"signing_key"`
+	SignedPrekey   common.SignedPrekey `json:"signed_prekey"`
+	OneTimePrekeys []common.Prekey     `json:"one_time_prekeys"`
+}
+
+// UploadPrekeys публикует ключи пользователя. Подписанный предключ заменяет
+// предыдущий, одноразовые предключи добавляются в пул.
+// Возвращает текущий размер пула и признак смены ключа идентичности или
+// ключа подписи.
+func (um *UserManager) UploadPrekeys(username string, upload common.PrekeyUpload) (int, bool, error) {
+	if upload.IdentityKey != "" {
+		if _, err := common.ParsePublicKey(upload.IdentityKey); err != nil {
+			return 0, false, err
+		}
+	}
+	if upload.SigningKey != "" {
+		if _, err := common.ParseSigningKey(upload.SigningKey); err != nil {
+			return 0, false, err
+		}
+	}
+	for _, pk := range upload.OneTimePrekeys {
+		if pk.KeyID == 0 {
+			return 0, false, errors.New("идентификатор предключа должен быть ненулевым")
+		}
+		if _, err := common.ParsePublicKey(pk.PublicKey); err != nil {
+			return 0, false, err
+		}
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	user, exists := um.users[username]
+	if !exists {
+		return 0, false, errors.New("пользователь не найден")
+	}
+
+	record, exists := um.prekeys[username]
+	if !exists {
+		record = &prekeyRecord{}
+	}
+	next := *record
+
+	if upload.IdentityKey != "" && upload.IdentityKey != next.IdentityKey {
+		// Новый ключ идентичности делает старые предключи бесполезными
+		next.IdentityKey = upload.IdentityKey
+		next.OneTimePrekeys = nil
+	}
+	if upload.SigningKey != "" && upload.SigningKey != next.SigningKey {
+		if upload.SignedPrekey == nil {
+			return 0, false, errors.New("смена ключа подписи требует нового подписанного предключа")
+		}
+		next.SigningKey = upload.SigningKey
+	}
+	if upload.SignedPrekey != nil {
+		if upload.SignedPrekey.KeyID == 0 {
+			return 0, false, errors.New("идентификатор предключа должен быть ненулевым")
+		}
+		if err := common.VerifySignedPrekey(next.SigningKey, *upload.SignedPrekey); err != nil {
+			return 0, false, err
+		}
+		next.SignedPrekey = *upload.SignedPrekey
+	}
+	if next.IdentityKey == "" || next.SigningKey == "" || next.SignedPrekey.PublicKey == "" {
+		return 0, false, errors.New("требуются ключ идентичности, ключ подписи и подписанный предключ")
+	}
+
+	known := make(map[uint32]bool, len(next.OneTimePrekeys))
+	pool := make([]common.Prekey, 0, len(next.OneTimePrekeys)+len(upload.OneTimePrekeys))
+	for _, pk := range next.OneTimePrekeys {
+		known[pk.KeyID] = true
+		pool = append(pool, pk)
+	}
+	for _, pk := range upload.OneTimePrekeys {
+		if known[pk.KeyID] {
+			continue
+		}
+		if len(pool) >= maxOneTimePrekeys {
+			break
+		}
+		known[pk.KeyID] = true
+		pool = append(pool, pk)
+	}
+	next.OneTimePrekeys = pool
+
+	um.prekeys[username] = &next
+	um.persist(bucketPrekeys, username, &next)
+	changed := um.setPublicKey(user, next.IdentityKey)
+	// Ключом подписи предключей подписываются и сообщения
+	if um.setSigningKey(user, next.SigningKey) {
+		changed = true
+	}
+
+	return len(pool), changed, nil
+}
+
+// TakePrekeyBundle выдает requester набор предключей пользователя, атомарно
+// извлекая один одноразовый предключ из пула. Возвращает также оставшийся
+// размер пула. Выдача одному запрашивающему ограничена, при превышении
+// возвращается *PrekeyRateLimitError.
+func (um *UserManager) TakePrekeyBundle(requester, username string) (common.PrekeyBundle, int, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	record, exists := um.prekeys[username]
+	if !exists {
+		return common.PrekeyBundle{}, 0, errors.New("пользователь не опубликовал предключи")
+	}
+
+	key := prekeyFetchKey{requester: requester, target: username}
+	fetches, retryAfter := takeSlot(um.prekeyFetches[key], time.Now(), um.prekeyFetchLimit, um.prekeyFetchWindow)
+	um.prekeyFetches[key] = fetches
+	if retryAfter > 0 {
+		return common.PrekeyBundle{}, len(record.OneTimePrekeys), &PrekeyRateLimitError{RetryAfter: retryAfter}
+	}
+
+	bundle := common.PrekeyBundle{
+		Username:     username,
+		IdentityKey:  record.IdentityKey,
+		SigningKey:   record.SigningKey,
+		SignedPrekey: record.SignedPrekey,
+	}
+	if len(record.OneTimePrekeys) > 0 {
+		pk := record.OneTimePrekeys[0]
+		bundle.OneTimePrekey = &pk
+		record.OneTimePrekeys = record.OneTimePrekeys[1:]
+		// Предключ должен быть израсходован и на диске, иначе после
+		// перезапуска его выдадут повторно
+		um.persist(bucketPrekeys, username, record)
+	}
+
+	return bundle, len(record.OneTimePrekeys), nil
+}
+
+// PrekeyCount возвращает размер пула одноразовых предключей пользователя
+// и признак того, что пользователь вообще публиковал предключи
+func (um *UserManager) PrekeyCount(username string) (int, bool) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	record, exists := um.prekeys[username]
+	if !exists {
+		return 0, false
+	}
+	return len(record.OneTimePrekeys), true
+}
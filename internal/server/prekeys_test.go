@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+// prekeyUpload создает новые ключи пользователя с count одноразовыми
+// предключами
+func prekeyUpload(t *testing.T, count int) common.PrekeyUpload {
+	t.Helper()
+	newKey := func() *ecdh.PrivateKey {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	signingPublic, signingPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := common.SignPrekey(signingPrivate, 1, newKey().PublicKey())
+	upload := common.PrekeyUpload{
+		IdentityKey:  base64.StdEncoding.EncodeToString(newKey().PublicKey().Bytes()),
+		SigningKey:   base64.StdEncoding.EncodeToString(signingPublic),
+		SignedPrekey: &signed,
+	}
+	for i := 1; i <= count; i++ {
+		upload.OneTimePrekeys = append(upload.OneTimePrekeys, common.Prekey{
+			KeyID:     uint32(i),
+			PublicKey: base64.StdEncoding.EncodeToString(newKey().PublicKey().Bytes()),
+		})
+	}
+	return upload
+}
+
+// publishPrekeys публикует ключи пользователя с count одноразовыми
+// предключами
+func publishPrekeys(t *testing.T, um *UserManager, username string, count int) {
+	t.Helper()
+	if _, _, err := um.UploadPrekeys(username, prekeyUpload(t, count)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrekeyBundleFetchLimit(t *testing.T) {
+	um := newTestUserManager(t, "alice", "bob", "carol")
+	publishPrekeys(t, um, "bob", 20)
+	publishPrekeys(t, um, "carol", 20)
+	if err := um.SetPrekeyFetchLimit(3, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		bundle, _, err := um.TakePrekeyBundle("alice", "bob")
+		if err != nil || bundle.OneTimePrekey == nil {
+			t.Fatalf("запрос %d: %v", i, err)
+		}
+	}
+	_, remaining, err := um.TakePrekeyBundle("alice", "bob")
+	var limited *PrekeyRateLimitError
+	if !errors.As(err, &limited) || !errors.Is(err, ErrPrekeyRateLimited) || limited.RetryAfter <= 0 {
+		t.Fatalf("четвертый запрос: %v", err)
+	}
+	// Отказ не расходует предключи
+	if remaining != 17 {
+		t.Fatalf("в пуле %d предключей, want 17", remaining)
+	}
+
+	// Лимит считается отдельно для каждого запрашивающего и адресата
+	if _, _, err := um.TakePrekeyBundle("carol", "bob"); err != nil {
+		t.Fatalf("другой запрашивающий: %v", err)
+	}
+	if _, _, err := um.TakePrekeyBundle("alice", "carol"); err != nil {
+		t.Fatalf("другой адресат: %v", err)
+	}
+}
+
+func TestTakeSlotSlidingWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var times []time.Time
+	var retry time.Duration
+	for i := 0; i < 2; i++ {
+		times, retry = takeSlot(times, start.Add(time.Duration(i)*time.Minute), 2, 10*time.Minute)
+		if retry != 0 {
+			t.Fatalf("запрос %d отклонен", i)
+		}
+	}
+	times, retry = takeSlot(times, start.Add(5*time.Minute), 2, 10*time.Minute)
+	if retry != 5*time.Minute {
+		t.Fatalf("RetryAfter = %v, want 5m", retry)
+	}
+	// Первая отметка выходит из окна
+	if _, retry = takeSlot(times, start.Add(10*time.Minute), 2, 10*time.Minute); retry != 0 {
+		t.Fatalf("запрос после окна отклонен: %v", retry)
+	}
+}
+
+func TestPruneFetchLimits(t *testing.T) {
+	um := newTestUserManager(t, "alice", "bob", "carol")
+	publishPrekeys(t, um, "bob", 5)
+	publishPrekeys(t, um, "carol", 5)
+	if err := um.SetPrekeyFetchLimit(3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"bob", "carol"} {
+		if _, _, err := um.TakePrekeyBundle("alice", target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	um.backupFetches["alice"] = []time.Time{time.Now()}
+
+	um.mu.Lock()
+	um.pruneFetchLimits(time.Now())
+	kept := len(um.prekeyFetches) + len(um.backupFetches)
+	um.pruneFetchLimits(time.Now().Add(DefaultBackupFetchWindow))
+	left := len(um.prekeyFetches) + len(um.backupFetches)
+	um.mu.Unlock()
+
+	if kept != 3 {
+		t.Fatalf("до конца окна осталось счетчиков: %d, want 3", kept)
+	}
+	if left != 0 {
+		t.Fatalf("после окна осталось счетчиков: %d", left)
+	}
+}
+
+// Публикация по HTTP идет через PublishPrekeys: собеседники узнают о смене
+// ключа так же, как при публикации по WebSocket
+func TestPublishPrekeysNotifiesKeyChange(t *testing.T) {
+	s := NewWebSocketServer(newTestUserManager(t, "alice", "bob"))
+	alice := newClient(nil, "alice", "token-alice", systemClock{}, time.Hour, 2*time.Hour)
+	s.clients["alice"] = map[*Client]bool{alice: true}
+	received := func() map[string]common.Message {
+		got := make(map[string]common.Message)
+		for len(alice.send) > 0 {
+			var msg common.Message
+			if err := json.Unmarshal(<-alice.send, &msg); err != nil {
+				t.Fatal(err)
+			}
+			got[msg.Type] = msg
+		}
+		return got
+	}
+
+	if _, err := s.PublishPrekeys("bob", prekeyUpload(t, 3)); err != nil {
+		t.Fatal(err)
+	}
+	// Первая публикация ничего не меняет, но ключи нужны в списке
+	if got := received(); got[common.MsgUsersList].Type == "" || got[common.MsgKeyChange].Type != "" {
+		t.Fatalf("первая публикация: %v", got)
+	}
+
+	if _, err := s.userManager.AddMessage(common.Message{Type: common.MsgPrivate, Sender: "alice", Recipient: "bob", Content: "привет"}); err != nil {
+		t.Fatal(err)
+	}
+	upload := prekeyUpload(t, 3)
+	if _, err := s.PublishPrekeys("bob", upload); err != nil {
+		t.Fatal(err)
+	}
+	got := received()
+	change := got[common.MsgKeyChange]
+	if change.Username != "bob" || change.PublicKey != upload.IdentityKey || change.SigningKey != upload.SigningKey {
+		t.Fatalf("уведомление о смене ключа: %+v", change)
+	}
+	if got[common.MsgUsersList].Type == "" {
+		t.Fatal("список пользователей не разослан")
+	}
+}
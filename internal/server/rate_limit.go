@@ -0,0 +1,45 @@
+package server
+
+import "time"
+
+// takeSlot учитывает запрос в скользящем окне: отбрасывает отметки старше
+// window и, если их меньше limit, добавляет now. Возвращает обновленные
+// отметки и 0 или, при превышении, через сколько освободится место.
+func takeSlot(times []time.Time, now time.Time, limit int, window time.Duration) ([]time.Time, time.Duration) {
+	for len(times) > 0 && now.Sub(times[0]) >= window {
+		times = times[1:]
+	}
+	if len(times) >= limit {
+		return times, times[0].Add(window).Sub(now)
+	}
+	return append(times, now), 0
+}
+
+// slotsExpired сообщает, что все отметки вышли из окна
+func slotsExpired(times []time.Time, now time.Time, window time.Duration) bool {
+	return len(times) == 0 || now.Sub(times[len(times)-1]) >= window
+}
+
+// CleanupFetchLimits забывает счетчики выдачи предключей и скачиваний
+// резервных копий, все отметки которых вышли из окна: иначе записи
+// копятся для каждой пары запрашивающего и адресата
+func (um *UserManager) CleanupFetchLimits() {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.pruneFetchLimits(time.Now())
+}
+
+// pruneFetchLimits вызывается под um.mu
+func (um *UserManager) pruneFetchLimits(now time.Time) {
+	for key, times := range um.prekeyFetches {
+		if slotsExpired(times, now, um.prekeyFetchWindow) {
+			delete(um.prekeyFetches, key)
+		}
+	}
+	for username, times := range um.backupFetches {
+		if slotsExpired(times, now, um.backupFetchWindow) {
+			delete(um.backupFetches, username)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"sort"
+
+	"secure-messenger/internal/common"
+)
+
+// MaxReactionsPerMessage ограничивает число различных реакций на сообщение
+const MaxReactionsPerMessage = 20
+
+var ErrTooManyReactions = errors.New("слишком много разных реакций на сообщение")
+
+// React добавляет или снимает реакцию пользователя на сообщение. Как и
+// правка, изменение записывается в диалог событием reaction со своим
+// порядковым номером и итоговыми реакциями сообщения, чтобы его получили
+// и синхронизирующиеся позже клиенты. Если реакция уже в нужном состоянии,
+// событие не создается: возвращается само сообщение и changed == false.
+func (um *UserManager) React(username, targetID, emoji string, remove bool) (event MessageHistory, changed bool, err error) {
+	if !common.ValidateReaction(emoji) {
+		return MessageHistory{}, false, errors.New("недопустимая реакция")
+	}
+	id, err := common.GenerateMessageID()
+	if err != nil {
+		return MessageHistory{}, false, errors.New("ошибка генерации ID сообщения")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	target, exists := um.messageIndex[targetID]
+	if !exists || target.Deleted || target.Target != "" || !um.canSee(target.Conversation, username) {
+		return MessageHistory{}, false, ErrMessageNotFound
+	}
+
+	users := target.Reactions[emoji]
+	i := sort.SearchStrings(users, username)
+	reacted := i < len(users) && users[i] == username
+	if reacted != remove {
+		// Реакция уже в нужном состоянии
+		return *target, false, nil
+	}
+	if !remove && len(users) == 0 && len(target.Reactions) >= MaxReactionsPerMessage {
+		return MessageHistory{}, false, ErrTooManyReactions
+	}
+
+	// Копия при записи, как и для квитанций
+	reactions := make(map[string][]string, len(target.Reactions)+1)
+	for e, u := range target.Reactions {
+		reactions[e] = u
+	}
+	updated := make([]string, 0, len(users)+1)
+	if remove {
+		updated = append(append(updated, users[:i]...), users[i+1:]...)
+	} else {
+		updated = append(append(append(updated, users[:i]...), username), users[i:]...)
+	}
+	if len(updated) == 0 {
+		delete(reactions, emoji)
+	} else {
+		reactions[emoji] = updated
+	}
+	if len(reactions) == 0 {
+		reactions = nil
+	}
+
+	target.Reactions = reactions
+	um.persist(bucketMessages, target.storeKey, target)
+
+	stored := um.appendMessage(id, target.Conversation, common.Message{
+		Type:      common.MsgReaction,
+		Sender:    username,
+		Recipient: target.Recipient,
+		Room:      target.Room,
+		Target:    target.ID,
+	})
+	// Итог реакций задает сервер, поэтому appendMessage его не копирует
+	stored.Reactions = reactions
+	um.persist(bucketMessages, stored.storeKey, stored)
+	return *stored, true, nil
+}
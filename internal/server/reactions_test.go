@@ -0,0 +1,65 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+func TestReactionEventsResync(t *testing.T) {
+	um := newTestUserManager(t, "alice", "bob")
+	msg, err := um.AddMessage(common.Message{Type: common.MsgPrivate, Sender: "alice", Recipient: "bob", Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursors := map[string]uint64{msg.Conversation: msg.Seq}
+
+	event, changed, err := um.React("bob", msg.ID, "👍", false)
+	if err != nil || !changed {
+		t.Fatalf("React: %v, changed=%v", err, changed)
+	}
+	if event.Type != common.MsgReaction || event.Target != msg.ID || event.Seq != msg.Seq+1 || event.Sender != "bob" {
+		t.Fatalf("событие %+v", event)
+	}
+
+	// Повтор не создает события
+	if _, changed, err := um.React("bob", msg.ID, "👍", false); err != nil || changed {
+		t.Fatalf("повтор: %v, changed=%v", err, changed)
+	}
+	if _, _, err := um.React("bob", event.ID, "👍", false); err != ErrMessageNotFound {
+		t.Fatalf("реакция на событие: %v", err)
+	}
+	if _, changed, _ := um.React("alice", msg.ID, "🔥", false); !changed {
+		t.Fatal("реакция alice не записана")
+	}
+	if _, changed, _ := um.React("bob", msg.ID, "👍", true); !changed {
+		t.Fatal("снятие реакции не записано")
+	}
+
+	// Клиент с курсором после сообщения получает только события реакций,
+	// последнее несет итоговое состояние
+	check := func(um *UserManager) {
+		t.Helper()
+		since := um.GetUserHistorySince("alice", cursors)
+		if len(since) != 3 {
+			t.Fatalf("после курсора %d записей, want 3", len(since))
+		}
+		for i, e := range since {
+			if e.Type != common.MsgReaction || e.Target != msg.ID || e.Seq != msg.Seq+uint64(i)+1 {
+				t.Fatalf("запись %d: %+v", i, e)
+			}
+		}
+		want := map[string][]string{"🔥": {"alice"}}
+		if got := since[2].Message().Reactions; !reflect.DeepEqual(got, want) {
+			t.Fatalf("итог реакций %v, want %v", got, want)
+		}
+	}
+	check(um)
+
+	restarted, err := NewUserManagerWithStore(um.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(restarted)
+}
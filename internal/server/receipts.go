@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+// RecordReceipt фиксирует квитанцию получателя о личном сообщении.
+// Любая квитанция подтверждает доставку и убирает сообщение из почтового
+// ящика; прочтение учитывается, только если пользователь не отключил
+// уведомления о прочтении. Возвращает отправителя и примененный тип
+// квитанции; ok=false, если пересылать отправителю нечего.
+func (um *UserManager) RecordReceipt(username, id, kind string) (sender, applied string, ok bool) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	applied = kind
+	if kind == common.MsgRead {
+		if user, exists := um.users[username]; exists && user.HideReadReceipts {
+			applied = common.MsgDelivered
+		}
+	}
+
+	entry, queued := um.takeFromMailbox(username, id)
+	if queued {
+		sender, ok = entry.Message.Sender, true
+	}
+
+	now := time.Now()
+	if msg, exists := um.messageIndex[id]; exists && msg.Type == common.MsgPrivate && msg.Recipient == username {
+		sender = msg.Sender
+
+		receipt := msg.Receipts[username]
+		changed := false
+		if receipt.DeliveredAt.IsZero() {
+			receipt.DeliveredAt = now
+			changed = true
+		}
+		if applied == common.MsgRead && receipt.ReadAt.IsZero() {
+			receipt.ReadAt = now
+			changed = true
+		}
+		if changed {
+			// Копия при записи: выданные ранее копии записей разделяют старую карту
+			receipts := make(map[string]common.Receipt, len(msg.Receipts)+1)
+			for name, r := range msg.Receipts {
+				receipts[name] = r
+			}
+			receipts[username] = receipt
+			msg.Receipts = receipts
+			um.persist(bucketMessages, msg.storeKey, *msg)
+			ok = true
+		}
+	}
+
+	return sender, applied, ok
+}
+
+// GetPrivacySettings возвращает настройки приватности пользователя
+func (um *UserManager) GetPrivacySettings(username string) (common.PrivacySettings, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	user, exists := um.users[username]
+	if !exists {
+		return common.PrivacySettings{}, errors.New("пользователь не найден")
+	}
+	return common.PrivacySettings{ReadReceipts: !user.HideReadReceipts}, nil
+}
+
+// SetPrivacySettings сохраняет настройки приватности пользователя
+func (um *UserManager) SetPrivacySettings(username string, settings common.PrivacySettings) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	user, exists := um.users[username]
+	if !exists {
+		return errors.New("пользователь не найден")
+	}
+	user.HideReadReceipts = !settings.ReadReceipts
+	um.saveUser(user)
+	return nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"testing"
+
+	"secure-messenger/internal/common"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendPrivate отправляет личное сообщение, дожидается его у адресата
+// и возвращает ID из подтверждения
+func sendPrivate(t *testing.T, from, to *websocket.Conn, recipient, content string) string {
+	t.Helper()
+	if err := from.WriteJSON(common.Message{Type: common.MsgPrivate, Recipient: recipient, Content: content}); err != nil {
+		t.Fatal(err)
+	}
+	ack, _ := readUntil(t, from, common.MsgAck)
+	received, _ := readUntil(t, to, common.MsgPrivate)
+	if received.ID != ack.ID {
+		t.Fatalf("получено %s, подтверждено %s", received.ID, ack.ID)
+	}
+	return ack.ID
+}
+
+func TestReceiptsReachSender(t *testing.T) {
+	s, ts := newTestServer(t, "alice", "bob", "carol")
+	alice := dialUser(t, s, ts, "alice")
+	readUntil(t, alice, common.MsgSyncDone)
+	bob := dialUser(t, s, ts, "bob")
+	readUntil(t, bob, common.MsgSyncDone)
+	carol := dialUser(t, s, ts, "carol")
+	readUntil(t, carol, common.MsgSyncDone)
+
+	id := sendPrivate(t, alice, bob, "bob", "привет")
+
+	// Квитанция постороннего не применяется и не пересылается
+	if err := carol.WriteJSON(common.Message{Type: common.MsgRead, ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := carol.WriteJSON(common.Message{Type: common.MsgPing}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, carol, common.MsgPong)
+
+	for _, kind := range []string{common.MsgDelivered, common.MsgRead} {
+		if err := bob.WriteJSON(common.Message{Type: kind, ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		receipt, skipped := readUntil(t, alice, kind)
+		if receipt.ID != id || receipt.Sender != "bob" || receipt.Recipient != "alice" {
+			t.Fatalf("квитанция %s: %+v", kind, receipt)
+		}
+		for _, msg := range skipped {
+			if msg.Type == common.MsgDelivered || msg.Type == common.MsgRead {
+				t.Fatalf("лишняя квитанция: %+v", msg)
+			}
+		}
+	}
+
+	s.userManager.mu.RLock()
+	receipts := s.userManager.messageIndex[id].Receipts
+	s.userManager.mu.RUnlock()
+	if len(receipts) != 1 || receipts["bob"].DeliveredAt.IsZero() || receipts["bob"].ReadAt.IsZero() {
+		t.Fatalf("квитанции сообщения: %+v", receipts)
+	}
+}
+
+func TestHiddenReadReceipts(t *testing.T) {
+	s, ts := newTestServer(t, "alice", "bob")
+	if err := s.userManager.SetPrivacySettings("bob", common.PrivacySettings{ReadReceipts: false}); err != nil {
+		t.Fatal(err)
+	}
+	alice := dialUser(t, s, ts, "alice")
+	readUntil(t, alice, common.MsgSyncDone)
+	bob := dialUser(t, s, ts, "bob")
+	readUntil(t, bob, common.MsgSyncDone)
+
+	id := sendPrivate(t, alice, bob, "bob", "привет")
+
+	// Прочтение засчитывается только как доставка
+	if err := bob.WriteJSON(common.Message{Type: common.MsgRead, ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	receipt, _ := readUntil(t, alice, common.MsgDelivered)
+	if receipt.ID != id || receipt.Sender != "bob" {
+		t.Fatalf("квитанция: %+v", receipt)
+	}
+	// Повторное прочтение ничего не меняет и не пересылается
+	if err := bob.WriteJSON(common.Message{Type: common.MsgRead, ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.WriteJSON(common.Message{Type: common.MsgPing}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, bob, common.MsgPong)
+	if err := alice.WriteJSON(common.Message{Type: common.MsgPing}); err != nil {
+		t.Fatal(err)
+	}
+	_, skipped := readUntil(t, alice, common.MsgPong)
+	for _, msg := range skipped {
+		if msg.Type == common.MsgRead || msg.Type == common.MsgDelivered {
+			t.Fatalf("квитанция при скрытом прочтении: %+v", msg)
+		}
+	}
+
+	s.userManager.mu.RLock()
+	stored := s.userManager.messageIndex[id].Receipts["bob"]
+	s.userManager.mu.RUnlock()
+	if stored.DeliveredAt.IsZero() || !stored.ReadAt.IsZero() {
+		t.Fatalf("квитанция сообщения: %+v", stored)
+	}
+	if settings, _ := s.userManager.GetPrivacySettings("bob"); settings.ReadReceipts {
+		t.Fatal("настройка приватности не сохранилась")
+	}
+}
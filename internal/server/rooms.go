@@ -0,0 +1,350 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+var (
+	ErrRoomNotFound  = errors.New("комната не найдена")
+	ErrRoomExists    = errors.New("комната уже существует")
+	ErrNotRoomMember = errors.New("вы не участник комнаты")
+	ErrRoomForbidden = errors.New("недостаточно прав")
+)
+
+// roleRank упорядочивает роли по убыванию прав
+var roleRank = map[string]int{
+	common.RoleOwner:  3,
+	common.RoleAdmin:  2,
+	common.RoleMember: 1,
+}
+
+// Room групповой чат
+type Room struct {
+	Name      string                        `json:"name"`
+	Owner     string                        `json:"owner"`
+	Private   bool                          `json:"private"`
+	CreatedAt time.Time                     `json:"created_at"`
+	Members   map[string]*common.RoomMember `json:"members"`
+	Invited   map[string]bool               `json:"invited,omitempty"`
+}
+
+// Info возвращает публичное описание комнаты
+func (r *Room) Info() common.RoomInfo {
+	members := make([]common.RoomMember, 0, len(r.Members))
+	for _, m := range r.Members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if roleRank[members[i].Role] != roleRank[members[j].Role] {
+			return roleRank[members[i].Role] > roleRank[members[j].Role]
+		}
+		return members[i].Username < members[j].Username
+	})
+
+	return common.RoomInfo{
+		Name:      r.Name,
+		Owner:     r.Owner,
+		Private:   r.Private,
+		CreatedAt: r.CreatedAt,
+		Members:   members,
+	}
+}
+
+func (r *Room) role(username string) string {
+	if m, ok := r.Members[username]; ok {
+		return m.Role
+	}
+	return ""
+}
+
+// conversation возвращает ID диалога комнаты
+func (r *Room) conversation() string {
+	return common.ConversationID(common.MsgRoomMessage, "", "", r.Name)
+}
+
+// CreateRoom создает комнату, создатель становится владельцем
+func (um *UserManager) CreateRoom(name, owner string, private bool) (common.RoomInfo, error) {
+	if !common.ValidateRoomName(name) {
+		return common.RoomInfo{}, errors.New("недопустимое имя комнаты")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if _, exists := um.rooms[name]; exists {
+		return common.RoomInfo{}, ErrRoomExists
+	}
+
+	now := time.Now()
+	room := &Room{
+		Name:      name,
+		Owner:     owner,
+		Private:   private,
+		CreatedAt: now,
+		Members: map[string]*common.RoomMember{
+			owner: {Username: owner, Role: common.RoleOwner, JoinedAt: now},
+		},
+		Invited: make(map[string]bool),
+	}
+	um.rooms[name] = room
+	um.saveRoom(room)
+
+	return room.Info(), nil
+}
+
+// JoinRoom добавляет пользователя в открытую комнату или в приватную по приглашению
+func (um *UserManager) JoinRoom(name, username string) (common.RoomInfo, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	room, exists := um.rooms[name]
+	if !exists {
+		return common.RoomInfo{}, ErrRoomNotFound
+	}
+	if _, member := room.Members[username]; member {
+		return room.Info(), nil
+	}
+	if room.Private && !room.Invited[username] {
+		return common.RoomInfo{}, ErrRoomForbidden
+	}
+
+	delete(room.Invited, username)
+	room.Members[username] = &common.RoomMember{
+		Username: username,
+		Role:     common.RoleMember,
+		JoinedAt: time.Now(),
+	}
+	um.saveRoom(room)
+	um.rotateGroup(room.conversation())
+
+	return room.Info(), nil
+}
+
+// LeaveRoom удаляет пользователя из комнаты. Если уходит владелец, права
+// переходят к старейшему администратору, иначе к старейшему участнику;
+// опустевшая комната удаляется.
+func (um *UserManager) LeaveRoom(name, username string) (common.RoomInfo, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	room, exists := um.rooms[name]
+	if !exists {
+		return common.RoomInfo{}, ErrRoomNotFound
+	}
+	if _, member := room.Members[username]; !member {
+		return common.RoomInfo{}, ErrNotRoomMember
+	}
+
+	delete(room.Members, username)
+	um.rotateGroup(room.conversation())
+	if len(room.Members) == 0 {
+		um.destroyRoom(room)
+		return room.Info(), nil
+	}
+
+	if room.Owner == username {
+		var heir *common.RoomMember
+		for _, m := range room.Members {
+			if heir == nil || roleRank[m.Role] > roleRank[heir.Role] ||
+				(m.Role == heir.Role && m.JoinedAt.Before(heir.JoinedAt)) {
+				heir = m
+			}
+		}
+		heir.Role = common.RoleOwner
+		room.Owner = heir.Username
+	}
+	um.saveRoom(room)
+
+	return room.Info(), nil
+}
+
+// InviteToRoom приглашает пользователя. В приватных комнатах приглашать
+// могут администраторы и владелец, в открытых - любой участник.
+func (um *UserManager) InviteToRoom(name, inviter, invitee string) (common.RoomInfo, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	room, exists := um.rooms[name]
+	if !exists {
+		return common.RoomInfo{}, ErrRoomNotFound
+	}
+	if _, exists := um.users[invitee]; !exists {
+		return common.RoomInfo{}, errors.New("пользователь не найден")
+	}
+
+	role := room.role(inviter)
+	if role == "" {
+		return common.RoomInfo{}, ErrNotRoomMember
+	}
+	if room.Private && roleRank[role] < roleRank[common.RoleAdmin] {
+		return common.RoomInfo{}, ErrRoomForbidden
+	}
+	if _, member := room.Members[invitee]; member {
+		return common.RoomInfo{}, errors.New("пользователь уже в комнате")
+	}
+
+	room.Invited[invitee] = true
+	um.saveRoom(room)
+
+	return room.Info(), nil
+}
+
+// KickFromRoom исключает участника. Исключать можно только участников
+// с меньшими правами; владельца исключить нельзя.
+func (um *UserManager) KickFromRoom(name, actor, target string) (common.RoomInfo, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	room, exists := um.rooms[name]
+	if !exists {
+		return common.RoomInfo{}, ErrRoomNotFound
+	}
+
+	actorRole, targetRole := room.role(actor), room.role(target)
+	if actorRole == "" {
+		return common.RoomInfo{}, ErrNotRoomMember
+	}
+	if targetRole == "" {
+		return common.RoomInfo{}, errors.New("пользователь не в комнате")
+	}
+	if roleRank[actorRole] < roleRank[common.RoleAdmin] || roleRank[actorRole] <= roleRank[targetRole] {
+		return common.RoomInfo{}, ErrRoomForbidden
+	}
+
+	delete(room.Members, target)
+	delete(room.Invited, target)
+	um.saveRoom(room)
+	um.rotateGroup(room.conversation())
+
+	return room.Info(), nil
+}
+
+// SetRoomRole назначает участнику роль администратора или участника;
+// менять роли может только владелец
+func (um *UserManager) SetRoomRole(name, actor, target, role string) (common.RoomInfo, error) {
+	if role != common.RoleAdmin && role != common.RoleMember {
+		return common.RoomInfo{}, errors.New("недопустимая роль")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	room, exists := um.rooms[name]
+	if !exists {
+		return common.RoomInfo{}, ErrRoomNotFound
+	}
+	if room.role(actor) != common.RoleOwner {
+		return common.RoomInfo{}, ErrRoomForbidden
+	}
+	member, ok := room.Members[target]
+	if !ok || target == actor {
+		return common.RoomInfo{}, errors.New("пользователь не в комнате")
+	}
+
+	member.Role = role
+	um.saveRoom(room)
+
+	return room.Info(), nil
+}
+
+// IsRoomMember проверяет членство пользователя в комнате
+func (um *UserManager) IsRoomMember(name, username string) bool {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	room, exists := um.rooms[name]
+	return exists && room.role(username) != ""
+}
+
+// GetRoomMembers возвращает имена участников комнаты
+func (um *UserManager) GetRoomMembers(name string) []string {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	room, exists := um.rooms[name]
+	if !exists {
+		return nil
+	}
+
+	members := make([]string, 0, len(room.Members))
+	for username := range room.Members {
+		members = append(members, username)
+	}
+	return members
+}
+
+// GetRooms возвращает комнаты, видимые пользователю: все открытые,
+// приватные, где он участник или приглашен
+func (um *UserManager) GetRooms(username string) []common.RoomInfo {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	rooms := make([]common.RoomInfo, 0, len(um.rooms))
+	for _, room := range um.rooms {
+		if room.Private && room.role(username) == "" && !room.Invited[username] {
+			continue
+		}
+		rooms = append(rooms, room.Info())
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// GetRoomHistory возвращает историю сообщений комнаты
+func (um *UserManager) GetRoomHistory(name string) []MessageHistory {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	return sortedHistory(um.conversations[common.ConversationID(common.MsgRoomMessage, "", "", name)])
+}
+
+// destroyRoom удаляет опустевшую комнату вместе с историей, упоминаниями,
+// ключами отправителей в почтовых ящиках и таймером исчезающих сообщений:
+// комната, созданная потом с тем же именем, не должна открыть чужую
+// переписку. Порядковый номер и эпоха диалога не сбрасываются, чтобы
+// курсоры и ключи отправителей прежней комнаты не совпали с новыми.
+// Вызывается под um.mu.
+func (um *UserManager) destroyRoom(room *Room) {
+	conversation := room.conversation()
+	delete(um.rooms, room.Name)
+	um.removeFromStore(bucketRooms, room.Name)
+
+	msgs := append([]*MessageHistory(nil), um.conversations[conversation]...)
+	for _, msg := range msgs {
+		um.removeMessage(msg)
+		um.removeFromStore(bucketMessages, msg.storeKey)
+		um.dropMentions(msg)
+	}
+	for _, msg := range msgs {
+		um.releaseAttachments(msg)
+	}
+
+	for username, queue := range um.mailboxes {
+		kept := queue[:0]
+		for _, entry := range queue {
+			if entry.Message.Conversation == conversation {
+				um.removeFromStore(bucketMailbox, entry.storeKey)
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		if len(kept) == 0 {
+			delete(um.mailboxes, username)
+		} else {
+			um.mailboxes[username] = kept
+		}
+	}
+
+	if _, exists := um.expiry[conversation]; exists {
+		delete(um.expiry, conversation)
+		um.removeFromStore(bucketExpiry, conversation)
+	}
+}
+
+func (um *UserManager) saveRoom(room *Room) {
+	um.persist(bucketRooms, room.Name, room)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+func roomRoles(info common.RoomInfo) map[string]string {
+	roles := make(map[string]string, len(info.Members))
+	for _, m := range info.Members {
+		roles[m.Username] = m.Role
+	}
+	return roles
+}
+
+func TestRoomMembershipAndRoles(t *testing.T) {
+	um := newTestUserManager(t, "alice", "bob", "carol", "dave")
+
+	if _, err := um.CreateRoom("x", "alice", false); err == nil {
+		t.Fatal("короткое имя комнаты принято")
+	}
+	if _, err := um.CreateRoom("team", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.CreateRoom("team", "bob", false); !errors.Is(err, ErrRoomExists) {
+		t.Fatalf("повторное создание: %v", err)
+	}
+	for _, username := range []string{"bob", "carol"} {
+		if _, err := um.JoinRoom("team", username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	epoch := um.GroupEpoch("room:team")
+
+	// Роли назначает только владелец
+	if _, err := um.SetRoomRole("team", "bob", "carol", common.RoleAdmin); !errors.Is(err, ErrRoomForbidden) {
+		t.Fatalf("назначение роли участником: %v", err)
+	}
+	info, err := um.SetRoomRole("team", "alice", "bob", common.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roles := roomRoles(info); roles["alice"] != common.RoleOwner || roles["bob"] != common.RoleAdmin || roles["carol"] != common.RoleMember {
+		t.Fatalf("роли: %v", roles)
+	}
+
+	// Исключать можно только участников с меньшими правами
+	if _, err := um.KickFromRoom("team", "carol", "bob"); !errors.Is(err, ErrRoomForbidden) {
+		t.Fatalf("участник исключил администратора: %v", err)
+	}
+	if _, err := um.KickFromRoom("team", "bob", "alice"); !errors.Is(err, ErrRoomForbidden) {
+		t.Fatalf("администратор исключил владельца: %v", err)
+	}
+	if _, err := um.KickFromRoom("team", "bob", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if um.IsRoomMember("team", "carol") {
+		t.Fatal("исключенный остался в комнате")
+	}
+	if um.GroupEpoch("room:team") == epoch {
+		t.Fatal("эпоха не сменилась после исключения")
+	}
+
+	// Уход владельца передает права администратору
+	info, err = um.LeaveRoom("team", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Owner != "bob" || roomRoles(info)["bob"] != common.RoleOwner {
+		t.Fatalf("владелец после ухода: %+v", info)
+	}
+	if _, err := um.LeaveRoom("team", "alice"); !errors.Is(err, ErrNotRoomMember) {
+		t.Fatalf("повторный уход: %v", err)
+	}
+}
+
+func TestPrivateRoomRequiresInvite(t *testing.T) {
+	um := newTestUserManager(t, "alice", "bob", "carol")
+	if _, err := um.CreateRoom("secret", "alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.JoinRoom("secret", "bob"); !errors.Is(err, ErrRoomForbidden) {
+		t.Fatalf("вход без приглашения: %v", err)
+	}
+	if rooms := um.GetRooms("bob"); len(rooms) != 0 {
+		t.Fatalf("приватная комната видна: %v", rooms)
+	}
+	if _, err := um.InviteToRoom("secret", "alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.JoinRoom("secret", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	// Приглашают в приватную комнату только администраторы
+	if _, err := um.InviteToRoom("secret", "bob", "carol"); !errors.Is(err, ErrRoomForbidden) {
+		t.Fatalf("приглашение участником: %v", err)
+	}
+}
+
+// Комната, созданная заново с тем же именем, не открывает историю прежней
+func TestRecreatedRoomDoesNotInheritHistory(t *testing.T) {
+	store := NewMemoryStore()
+	for _, username := range []string{"alice", "mallory"} {
+		store.Put(bucketUsers, username, []byte(`{"username":"`+username+`"}`))
+	}
+	um, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := um.CreateRoom("secret", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.SetExpiry("alice", "", "secret", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	old, err := um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: "alice", Room: "secret", Content: "тайна @mallory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.LeaveRoom("secret", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := um.CreateRoom("secret", "mallory", false); err != nil {
+		t.Fatal(err)
+	}
+	page, err := um.QueryHistory("mallory", common.HistoryQuery{Room: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != 0 {
+		t.Fatalf("новой комнате видно сообщений прежней: %d", len(page.Messages))
+	}
+	if _, err := um.QueryHistory("mallory", common.HistoryQuery{Room: "secret", Before: old.ID}); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("курсор на сообщение прежней комнаты: %v", err)
+	}
+	if timers := um.ExpiryTimers("mallory"); len(timers) != 0 {
+		t.Fatalf("таймер прежней комнаты: %v", timers)
+	}
+
+	// Порядковые номера продолжаются, чтобы старые курсоры не пропустили
+	// новые сообщения
+	msg, err := um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: "mallory", Room: "secret", Content: "новое"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Seq <= old.Seq {
+		t.Fatalf("номер %d после %d", msg.Seq, old.Seq)
+	}
+
+	if keys := storeKeys(t, store, bucketMessages); len(keys) != 1 {
+		t.Fatalf("сообщений в хранилище: %d", len(keys))
+	}
+	if keys := storeKeys(t, store, bucketExpiry); len(keys) != 0 {
+		t.Fatalf("таймеры в хранилище: %v", keys)
+	}
+}
+
+// История комнаты, удаленной без очистки, стирается при загрузке
+func TestLoadDropsOrphanRoomHistory(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(bucketUsers, "alice", []byte(`{"username":"alice"}`))
+	um, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.CreateRoom("secret", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: "alice", Room: "secret", Content: "тайна"}); err != nil {
+		t.Fatal(err)
+	}
+	// Так комнату удаляли раньше: только запись о ней
+	store.Delete(bucketRooms, "secret")
+
+	restarted, err := NewUserManagerWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.CreateRoom("secret", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if history := restarted.GetRoomHistory("secret"); len(history) != 0 {
+		t.Fatalf("осталась история удаленной комнаты: %d", len(history))
+	}
+	if keys := storeKeys(t, store, bucketMessages); len(keys) != 0 {
+		t.Fatalf("сообщений в хранилище: %d", len(keys))
+	}
+}
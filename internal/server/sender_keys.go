@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"secure-messenger/internal/common"
+)
+
+var (
+	ErrStaleSenderKey = errors.New("ключ отправителя выдан для прежнего состава группы")
+	ErrSenderKeyPlain = errors.New("ключ отправителя передается только зашифрованным")
+)
+
+// QueueSenderKey ставит в почтовый ящик получателя ключ цепочки отправителя
+// для общего чата или комнаты msg.Room. Ключ зашифрован личной сессией
+// отправителя и получателя, сервер лишь проверяет, что оба состоят в группе.
+// В историю такие сообщения не попадают и удаляются из ящика после
+// подтверждения доставки.
+func (um *UserManager) QueueSenderKey(msg common.Message) (common.Message, error) {
+	if msg.IV == "" && msg.AuthTag == "" && msg.RatchetKey == "" {
+		return common.Message{}, ErrSenderKeyPlain
+	}
+	id, err := common.GenerateMessageID()
+	if err != nil {
+		return common.Message{}, errors.New("ошибка генерации ID сообщения")
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if _, exists := um.users[msg.Recipient]; !exists || msg.Recipient == msg.Sender {
+		return common.Message{}, errors.New("пользователь не найден")
+	}
+	groupType := common.MsgGeneral
+	if msg.Room != "" {
+		if _, exists := um.rooms[msg.Room]; !exists {
+			return common.Message{}, ErrRoomNotFound
+		}
+		groupType = common.MsgRoomMessage
+	}
+	conversation := common.ConversationID(groupType, "", "", msg.Room)
+	if !um.canSee(conversation, msg.Sender) {
+		return common.Message{}, ErrNotRoomMember
+	}
+	if !um.canSee(conversation, msg.Recipient) {
+		return common.Message{}, errors.New("пользователь не в комнате")
+	}
+
+	msg.Type = common.MsgSenderKey
+	msg.ID = id
+	msg.Conversation = conversation
+	msg.Timestamp = time.Now()
+	um.enqueue(msg)
+	return msg, nil
+}
+
+// GroupEpochs возвращает текущие эпохи состава групп пользователя: общего
+// чата и комнат, в которых он состоит
+func (um *UserManager) GroupEpochs(username string) map[string]uint64 {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	general := common.ConversationID(common.MsgGeneral, "", "", "")
+	epochs := map[string]uint64{general: um.epochs[general]}
+	for _, room := range um.rooms {
+		if room.role(username) != "" {
+			epochs[room.conversation()] = um.epochs[room.conversation()]
+		}
+	}
+	return epochs
+}
+
+// GroupEpoch возвращает текущую эпоху состава группового диалога
+func (um *UserManager) GroupEpoch(conversation string) uint64 {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	return um.epochs[conversation]
+}
+
+// rotateGroup начинает новую эпоху состава группы: ключи отправителей,
+// выданные прежнему составу, больше не принимаются; вызывается под um.mu
+func (um *UserManager) rotateGroup(conversation string) {
+	um.epochs[conversation]++
+	um.persist(bucketEpochs, conversation, um.epochs[conversation])
+}
+
+// checkSenderKey отклоняет групповое сообщение, зашифрованное ключом
+// отправителя прежней эпохи: его могли бы прочитать ушедшие участники
+// или не смогли бы новые; вызывается под um.mu
+func (um *UserManager) checkSenderKey(msg common.Message, conversation string) error {
+	if msg.KeyID == "" || strings.HasPrefix(conversation, "dm:") {
+		return nil
+	}
+	if msg.Epoch != um.epochs[conversation] {
+		return ErrStaleSenderKey
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+
+	"secure-messenger/internal/common"
+)
+
+// UpdateSigningKey публикует ключ Ed25519, которым пользователь подписывает
+// сообщения. Возвращает признак замены ранее опубликованного ключа.
+func (um *UserManager) UpdateSigningKey(username, signingKey string) (bool, error) {
+	if _, err := common.ParseSigningKey(signingKey); err != nil {
+		return false, err
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	user, exists := um.users[username]
+	if !exists {
+		return false, errors.New("пользователь не найден")
+	}
+	return um.setSigningKey(user, signingKey), nil
+}
+
+// IdentityKeys возвращает текущие ключи пользователя: X25519 и Ed25519
+func (um *UserManager) IdentityKeys(username string) (publicKey, signingKey string) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	if user, exists := um.users[username]; exists {
+		return user.PublicKey, user.SigningKey
+	}
+	return "", ""
+}
+
+// setSigningKey меняет ключ подписи пользователя и сообщает, был ли заменен
+// ранее опубликованный ключ; вызывается под um.mu
+func (um *UserManager) setSigningKey(user *User, signingKey string) bool {
+	previous := user.SigningKey
+	user.SigningKey = signingKey
+	um.saveUser(user)
+	return previous != "" && previous != signingKey
+}
+
+// checkSignature отклоняет сообщение с подписью, которая не сходится
+// с опубликованным ключом отправителя. Это лишь защита от ошибок клиентов:
+// получатели проверяют подпись сами и серверу не доверяют. Неподписанные
+// сообщения принимаются ради старых клиентов; вызывается под um.mu
+func (um *UserManager) checkSignature(msg common.Message) error {
+	if msg.Signature == "" {
+		return nil
+	}
+	user, exists := um.users[msg.Sender]
+	if !exists || user.SigningKey == "" {
+		return errors.New("отправитель не опубликовал ключ подписи")
+	}
+	return common.VerifyMessage(user.SigningKey, msg)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// Разделы хранилища
+const (
+	bucketUsers    = "users"
+	bucketSessions = "sessions"
+	bucketMessages = "messages"
+	bucketPrekeys  = "prekeys"
+	bucketRooms    = "rooms"
+	bucketMailbox  = "mailbox"
+	bucketMentions = "mentions"
+	// Метаданные вложений и незавершенных загрузок; содержимое хранит BlobStore
+	bucketAttachments = "attachments"
+	bucketUploads     = "uploads"
+	// bucketExpiry таймеры исчезающих сообщений по диалогам
+	bucketExpiry = "expiry"
+	// bucketLegacyVerified отметки о проверенных ключах, которые раньше
+	// хранил сервер; теперь они есть только у клиента, а записи стираются
+	// при загрузке
+	bucketLegacyVerified = "verified"
+	// bucketEpochs эпохи состава групповых диалогов для ключей отправителей
+	bucketEpochs = "epochs"
+	// bucketBackups версии резервных копий ключей: "<пользователь>/<версия>"
+	bucketBackups = "backups"
+	// bucketSequences хранит счетчики диалогов отдельно от сообщений,
+	// чтобы номера не повторялись после вытеснения старой истории
+	bucketSequences = "sequences"
+)
+
+// storeBuckets все разделы хранилища, например для перешифрования
+var storeBuckets = []string{
+	bucketUsers, bucketSessions, bucketMessages, bucketPrekeys, bucketRooms,
+	bucketMailbox, bucketMentions, bucketAttachments, bucketUploads,
+	bucketExpiry, bucketLegacyVerified, bucketEpochs, bucketBackups, bucketSequences,
+}
+
+// Store хранилище данных UserManager: набор разделов с записями ключ-значение.
+// UserManager держит рабочую копию в памяти и синхронно записывает в Store
+// каждое изменение, а при запуске восстанавливает из него состояние.
+type Store interface {
+	// Put сохраняет значение по ключу в разделе
+	Put(bucket, key string, value []byte) error
+	// Delete удаляет ключ из раздела; отсутствие ключа не является ошибкой
+	Delete(bucket, key string) error
+	// ForEach обходит записи раздела в порядке возрастания ключей
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	// Close освобождает ресурсы хранилища
+	Close() error
+}
+
+// MemoryStore хранилище в памяти, данные теряются при перезапуске
+type MemoryStore struct {
+	buckets map[string]map[string][]byte
+	mu      sync.RWMutex
+}
+
+// NewMemoryStore создает хранилище в памяти
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (ms *MemoryStore) Put(bucket, key string, value []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	b, exists := ms.buckets[bucket]
+	if !exists {
+		b = make(map[string][]byte)
+		ms.buckets[bucket] = b
+	}
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (ms *MemoryStore) Delete(bucket, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.buckets[bucket], key)
+	return nil
+}
+
+func (ms *MemoryStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	ms.mu.RLock()
+	b := ms.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	values := make(map[string][]byte, len(b))
+	for _, key := range keys {
+		values[key] = b[key]
+	}
+	ms.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"sort"
+
+	"secure-messenger/internal/common"
+)
+
+var ErrInvalidParent = errors.New("на это сообщение нельзя ответить")
+
+// threadRoot находит корень ветки для ответа в диалоге conversation.
+// Ответ на ответ попадает в ветку его корня; вызывается под um.mu.
+func (um *UserManager) threadRoot(parentID, conversation string) (*MessageHistory, error) {
+	parent, exists := um.messageIndex[parentID]
+	if !exists {
+		return nil, ErrMessageNotFound
+	}
+	if parent.ParentID != "" {
+		if parent, exists = um.messageIndex[parent.ParentID]; !exists {
+			return nil, ErrMessageNotFound
+		}
+	}
+	if parent.Deleted || parent.Target != "" || parent.Conversation != conversation {
+		return nil, ErrInvalidParent
+	}
+	return parent, nil
+}
+
+// addReply учитывает новый ответ в корне ветки; вызывается под um.mu
+func (um *UserManager) addReply(root, reply *MessageHistory) {
+	root.ReplyCount++
+	root.LastReplyAt = reply.Timestamp
+
+	// Участники: автор корня и все ответившие, по возрастанию
+	participants := root.ThreadParticipants
+	if len(participants) == 0 {
+		participants = []string{root.Sender}
+	}
+	i := sort.SearchStrings(participants, reply.Sender)
+	if i == len(participants) || participants[i] != reply.Sender {
+		// Копия при записи: срез мог попасть в выданные наружу копии
+		updated := make([]string, 0, len(participants)+1)
+		participants = append(append(append(updated, participants[:i]...), reply.Sender), participants[i:]...)
+	}
+	root.ThreadParticipants = participants
+
+	um.persist(bucketMessages, root.storeKey, root)
+}
+
+// ThreadParticipants возвращает участников ветки, которые по-прежнему
+// видят ее диалог, и число ответов в ветке
+func (um *UserManager) ThreadParticipants(rootID string) ([]string, int) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	root, exists := um.messageIndex[rootID]
+	if !exists {
+		return nil, 0
+	}
+
+	var participants []string
+	for _, username := range root.ThreadParticipants {
+		if um.canSee(root.Conversation, username) {
+			participants = append(participants, username)
+		}
+	}
+	return participants, root.ReplyCount
+}
+
+// QueryThread возвращает страницу ответов ветки вместе с ее корнем.
+// Before/After и интервал времени работают так же, как в QueryHistory;
+// Peer и Room игнорируются.
+func (um *UserManager) QueryThread(username, rootID string, q common.HistoryQuery) (common.HistoryPage, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	root, exists := um.messageIndex[rootID]
+	if !exists || root.ParentID != "" || !um.canSee(root.Conversation, username) {
+		return common.HistoryPage{}, ErrMessageNotFound
+	}
+
+	page, err := um.historyPage(username, [][]*MessageHistory{um.threads[rootID]}, q)
+	if err != nil {
+		return common.HistoryPage{}, err
+	}
+	rootMsg := root.Message()
+	page.Root = &rootMsg
+	return page, nil
+}
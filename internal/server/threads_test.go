@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+// threadRoom создает комнату team с участниками и корнем ветки от bob
+func threadRoom(t *testing.T, members ...string) (*UserManager, MessageHistory) {
+	t.Helper()
+	um := newTestUserManager(t, append([]string{"mallory"}, members...)...)
+	if _, err := um.CreateRoom("team", members[0], false); err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range members[1:] {
+		if _, err := um.JoinRoom("team", username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: "bob", Room: "team", Content: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return um, root
+}
+
+func reply(um *UserManager, sender, parentID, content string) (MessageHistory, error) {
+	return um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: sender, Room: "team", ParentID: parentID, Content: content})
+}
+
+func TestReplyToReplyJoinsRootThread(t *testing.T) {
+	um, root := threadRoom(t, "alice", "bob", "carol")
+
+	first, err := reply(um, "carol", root.ID, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := reply(um, "alice", first.ID, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ParentID != root.ID || second.ParentID != root.ID {
+		t.Fatalf("родители ответов: %s, %s; корень %s", first.ParentID, second.ParentID, root.ID)
+	}
+
+	participants, count := um.ThreadParticipants(root.ID)
+	if count != 2 || !reflect.DeepEqual(participants, []string{"alice", "bob", "carol"}) {
+		t.Fatalf("участники ветки: %v, ответов %d", participants, count)
+	}
+	// Повторный ответ не добавляет участника
+	if _, err := reply(um, "carol", root.ID, "3"); err != nil {
+		t.Fatal(err)
+	}
+	if participants, count = um.ThreadParticipants(root.ID); count != 3 || len(participants) != 3 {
+		t.Fatalf("участники ветки: %v, ответов %d", participants, count)
+	}
+
+	// Покинувший комнату не получает уведомлений ветки
+	if _, err := um.LeaveRoom("team", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if participants, _ = um.ThreadParticipants(root.ID); !reflect.DeepEqual(participants, []string{"alice", "bob"}) {
+		t.Fatalf("участники после ухода: %v", participants)
+	}
+	if participants, count = um.ThreadParticipants("нет такого"); participants != nil || count != 0 {
+		t.Fatalf("неизвестная ветка: %v, %d", participants, count)
+	}
+}
+
+func TestReplyRejectsInvalidParent(t *testing.T) {
+	um, root := threadRoom(t, "alice", "bob")
+
+	// Ответ уходит только в диалог корня
+	for _, msg := range []common.Message{
+		{Type: common.MsgGeneral, Sender: "alice", Recipient: "all", ParentID: root.ID},
+		{Type: common.MsgPrivate, Sender: "alice", Recipient: "bob", ParentID: root.ID},
+	} {
+		if _, err := um.AddMessage(msg); !errors.Is(err, ErrInvalidParent) {
+			t.Fatalf("ответ из %s: %v", msg.Type, err)
+		}
+	}
+	if _, err := reply(um, "alice", "нет такого", "x"); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("ответ на неизвестное сообщение: %v", err)
+	}
+
+	// На события и удаленные сообщения не отвечают
+	edit, err := um.EditMessage("bob", common.Message{Type: common.MsgEdit, Target: root.ID, Content: "root v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reply(um, "alice", edit.ID, "x"); !errors.Is(err, ErrInvalidParent) {
+		t.Fatalf("ответ на событие правки: %v", err)
+	}
+	first, err := reply(um, "alice", root.ID, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.DeleteMessage("bob", root.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, parent := range []string{root.ID, first.ID} {
+		if _, err := reply(um, "alice", parent, "x"); !errors.Is(err, ErrInvalidParent) {
+			t.Fatalf("ответ в удаленную ветку: %v", err)
+		}
+	}
+	if _, count := um.ThreadParticipants(root.ID); count != 1 {
+		t.Fatalf("отклоненные ответы учтены: %d", count)
+	}
+}
+
+func TestQueryThread(t *testing.T) {
+	um, root := threadRoom(t, "alice", "bob")
+	ids := make([]string, 8)
+	for i := range ids {
+		msg, err := reply(um, "alice", root.ID, strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = msg.ID
+	}
+	// Сообщения вне ветки в страницу не попадают
+	if _, err := um.AddMessage(common.Message{Type: common.MsgRoomMessage, Sender: "bob", Room: "team", Content: "вне ветки"}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := um.QueryThread("bob", root.ID, common.HistoryQuery{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Root == nil || page.Root.ID != root.ID || page.Root.ReplyCount != 8 {
+		t.Fatalf("корень ветки: %+v", page.Root)
+	}
+	pageRange(t, page, 5, 7, true)
+
+	page, err = um.QueryThread("bob", root.ID, common.HistoryQuery{Limit: 3, Before: page.Messages[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 2, 4, true)
+	page, err = um.QueryThread("bob", root.ID, common.HistoryQuery{Limit: 3, Before: page.Messages[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 0, 1, false)
+	page, err = um.QueryThread("bob", root.ID, common.HistoryQuery{After: ids[5]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageRange(t, page, 6, 7, false)
+
+	// Ветка ответа и ветка чужого диалога не выдаются
+	if _, err := um.QueryThread("bob", ids[0], common.HistoryQuery{}); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("ответ как корень: %v", err)
+	}
+	if _, err := um.QueryThread("mallory", root.ID, common.HistoryQuery{}); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("ветка комнаты без членства: %v", err)
+	}
+}
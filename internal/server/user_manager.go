@@ -2,23 +2,39 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"secure-messenger/internal/common"
+	"sort"
 	"sync"
 	"time"
 )
 
+const (
+	sessionTTL         = 24 * time.Hour
+	maxSessionsPerUser = 10
+)
+
 // User представляет пользователя системы
 type User struct {
-	Username       string
-	PasswordHash   string
-	Salt           string
-	IsOnline       bool
-	LastSeen       time.Time
-	JoinedAt       time.Time
-	SessionToken   string
-	SessionExpires time.Time
-	PublicKey      string
-	ConnectionID   string
+	Username     string
+	PasswordHash string
+	Salt         string // только для устаревших хэшей SHA-256
+	IsOnline     bool
+	LastSeen     time.Time
+	JoinedAt     time.Time
+	PublicKey    string
+	// SigningKey публичный ключ Ed25519 для подписей сообщений
+	SigningKey string
+	// HideReadReceipts запрещает сообщать отправителям о прочтении
+	HideReadReceipts bool
+}
+
+// Session сессия одного устройства пользователя. Сам токен не хранится:
+// сессии ищутся по его SHA-256, чтобы токены не лежали на диске открыто.
+type Session struct {
+	TokenHash string
+	Username  string
+	Expires   time.Time
 }
 
 // MessageHistory история сообщений
@@ -29,85 +45,248 @@ type MessageHistory struct {
 	Recipient string    `json:"recipient"`
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
+	Room      string    `json:"room,omitempty"`
 	IV        string    `json:"iv,omitempty"`
 	AuthTag   string    `json:"auth_tag,omitempty"`
 	Encrypted bool      `json:"encrypted"`
+	// Conversation и Seq задают порядок сообщений внутри диалога
+	Conversation string `json:"conversation"`
+	Seq          uint64 `json:"seq"`
+	// Target ID сообщения, к которому относится событие (правка, удаление)
+	Target string `json:"target,omitempty"`
+	// Заголовок Double Ratchet, нужен получателю для расшифровки
+	RatchetKey  string `json:"ratchet_key,omitempty"`
+	PrevCounter uint32 `json:"prev_counter,omitempty"`
+	Counter     uint32 `json:"counter,omitempty"`
+	// Параметры X3DH первого сообщения сессии
+	X3DH *common.X3DHHeader `json:"x3dh,omitempty"`
+	// Заголовок ключа отправителя группового сообщения: ID цепочки
+	// (номер сообщения в Counter) и эпоха состава группы
+	KeyID string `json:"key_id,omitempty"`
+	Epoch uint64 `json:"epoch,omitempty"`
+	// Подпись отправителя и время подписи по его часам
+	Signature string    `json:"signature,omitempty"`
+	SignedAt  time.Time `json:"signed_at,omitempty"`
+	// Квитанции получателей; карта заменяется целиком при каждом изменении
+	Receipts map[string]common.Receipt `json:"receipts,omitempty"`
+	// Предыдущие версии отредактированного сообщения; удаленное сообщение
+	// остается в истории пустым с пометкой Deleted
+	EditedAt time.Time            `json:"edited_at"`
+	Edits    []common.MessageEdit `json:"edits,omitempty"`
+	Deleted  bool                 `json:"deleted,omitempty"`
+	// Реакции: эмодзи -> пользователи; как и Receipts, заменяется целиком
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	// ParentID корень ветки, к которой относится ответ. У корня хранятся
+	// число ответов, время последнего и участники ветки.
+	ParentID           string    `json:"parent_id,omitempty"`
+	ReplyCount         int       `json:"reply_count,omitempty"`
+	LastReplyAt        time.Time `json:"last_reply_at,omitempty"`
+	ThreadParticipants []string  `json:"thread_participants,omitempty"`
+	// Mentions упомянутые в сообщении пользователи
+	Mentions    []string            `json:"mentions,omitempty"`
+	Attachments []common.Attachment `json:"attachments,omitempty"`
+	// ExpiresAt момент исчезновения сообщения, если в диалоге включен таймер
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	storeKey string
+	order    uint64 // глобальный порядок добавления
 }
 
 // UserManager управляет пользователями и их данными
 type UserManager struct {
-	users        map[string]*User
-	messages     []MessageHistory
-	sessions     map[string]*User // token -> user
-	onlineUsers  map[string]bool  // username -> online status
-	mu           sync.RWMutex
-	messageLimit int
+	users         map[string]*User
+	messages      []*MessageHistory            // общее кольцо истории в порядке добавления
+	conversations map[string][]*MessageHistory // диалог -> сообщения по возрастанию Seq
+	messageIndex  map[string]*MessageHistory   // ID -> сообщение
+	threads       map[string][]*MessageHistory // корень ветки -> ответы в порядке добавления
+	sessions      map[string]*Session          // SHA-256 токена -> session
+	onlineUsers   map[string]bool              // username -> online status
+	prekeys       map[string]*prekeyRecord
+	rooms         map[string]*Room
+	mailboxes     map[string][]mailboxEntry // получатель -> неподтвержденные сообщения
+	mentions      map[string][]mentionEntry // пользователь -> входящие упоминания
+	attachments   map[string]*attachmentRecord
+	uploads       map[string]*uploadRecord
+	expiry        map[string]time.Duration       // диалог -> срок жизни сообщений
+	epochs        map[string]uint64              // групповой диалог -> эпоха состава
+	backups       map[string][]common.KeyBackup  // пользователь -> версии по возрастанию
+	backupFetches map[string][]time.Time         // пользователь -> время скачиваний в окне
+	prekeyFetches map[prekeyFetchKey][]time.Time // запрашивающий и адресат -> время выдачи в окне
+	blobs         *BlobStore
+	hasher        *common.PasswordHasher
+	store         Store
+	messageSeq    uint64
+	sequences     map[string]uint64 // диалог -> последний порядковый номер
+	mailboxSeq    uint64
+	mentionSeq    uint64
+	mu            sync.RWMutex
+	messageLimit  int
+	editWindow    time.Duration
+	// Ограничения вложений в байтах: размер файла и квота пользователя
+	maxAttachmentSize int64
+	attachmentQuota   int64
+	// Не более backupFetchLimit скачиваний резервной копии за backupFetchWindow
+	backupFetchLimit  int
+	backupFetchWindow time.Duration
+	// Не более prekeyFetchLimit наборов предключей одного пользователя
+	// одному запрашивающему за prekeyFetchWindow
+	prekeyFetchLimit  int
+	prekeyFetchWindow time.Duration
 }
 
 // NewUserManager создает новый менеджер пользователей
 func NewUserManager() *UserManager {
+	hasher, _ := common.NewPasswordHasher(common.DefaultPasswordParams)
+
 	return &UserManager{
-		users:        make(map[string]*User),
-		messages:     make([]MessageHistory, 0),
-		sessions:     make(map[string]*User),
-		onlineUsers:  make(map[string]bool),
-		messageLimit: 1000,
+		users:         make(map[string]*User),
+		messages:      make([]*MessageHistory, 0),
+		conversations: make(map[string][]*MessageHistory),
+		messageIndex:  make(map[string]*MessageHistory),
+		threads:       make(map[string][]*MessageHistory),
+		sessions:      make(map[string]*Session),
+		onlineUsers:   make(map[string]bool),
+		prekeys:       make(map[string]*prekeyRecord),
+		rooms:         make(map[string]*Room),
+		mailboxes:     make(map[string][]mailboxEntry),
+		mentions:      make(map[string][]mentionEntry),
+		attachments:   make(map[string]*attachmentRecord),
+		uploads:       make(map[string]*uploadRecord),
+		expiry:        make(map[string]time.Duration),
+		epochs:        make(map[string]uint64),
+		backups:       make(map[string][]common.KeyBackup),
+		backupFetches: make(map[string][]time.Time),
+		prekeyFetches: make(map[prekeyFetchKey][]time.Time),
+		sequences:     make(map[string]uint64),
+		hasher:        hasher,
+		store:         NewMemoryStore(),
+		messageLimit:  1000,
+		editWindow:    DefaultEditWindow,
+
+		maxAttachmentSize: DefaultMaxAttachmentSize,
+		attachmentQuota:   DefaultAttachmentQuota,
+		backupFetchLimit:  DefaultBackupFetchLimit,
+		backupFetchWindow: DefaultBackupFetchWindow,
+		prekeyFetchLimit:  DefaultPrekeyFetchLimit,
+		prekeyFetchWindow: DefaultPrekeyFetchWindow,
 	}
 }
 
-// RegisterUser регистрирует нового пользователя
-func (um *UserManager) RegisterUser(username, password string) error {
+// NewUserManagerWithStore создает менеджер пользователей поверх хранилища
+// и восстанавливает из него пользователей, сессии, историю, предключи,
+// комнаты, почтовые ящики, входящие упоминания, метаданные вложений,
+// таймеры исчезающих сообщений, проверенные ключи собеседников и эпохи
+// состава групп
+func NewUserManagerWithStore(store Store) (*UserManager, error) {
+	um := NewUserManager()
+	um.store = store
+
+	if err := um.load(); err != nil {
+		return nil, err
+	}
+	return um, nil
+}
+
+// SetPasswordHasher задает хэшер паролей. Хэши с другими параметрами
+// будут пересчитаны при следующем успешном входе.
+func (um *UserManager) SetPasswordHasher(hasher *common.PasswordHasher) {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	// Проверка существования пользователя
-	if _, exists := um.users[username]; exists {
-		return errors.New("пользователь уже существует")
-	}
+	um.hasher = hasher
+}
 
+// RegisterUser регистрирует нового пользователя. Пароль хэшируется без
+// блокировки: Argon2id занимает заметное время и не должен задерживать
+// остальные запросы.
+func (um *UserManager) RegisterUser(username, password string) error {
 	// Валидация имени пользователя
 	if !common.ValidateUsername(username) {
 		return errors.New("недопустимое имя пользователя")
 	}
 
-	// Генерация соли и хэширование пароля
-	salt, err := common.GenerateSalt()
+	um.mu.RLock()
+	_, exists := um.users[username]
+	hasher := um.hasher
+	um.mu.RUnlock()
+	if exists {
+		return errors.New("пользователь уже существует")
+	}
+
+	// Хэширование пароля (соль хранится внутри хэша)
+	passwordHash, err := hasher.Hash(password)
 	if err != nil {
-		return errors.New("ошибка генерации соли")
+		return errors.New("ошибка хэширования пароля")
 	}
 
-	passwordHash := common.HashPassword(password, salt)
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	// Имя могли занять, пока мы считали хэш
+	if _, exists := um.users[username]; exists {
+		return errors.New("пользователь уже существует")
+	}
 
 	// Создание пользователя
 	um.users[username] = &User{
 		Username:     username,
 		PasswordHash: passwordHash,
-		Salt:         salt,
 		IsOnline:     false,
 		LastSeen:     time.Now(),
 		JoinedAt:     time.Now(),
 		PublicKey:    "",
 	}
+	um.saveUser(um.users[username])
+	// Новый участник общего чата не должен читать сообщения, зашифрованные
+	// до его прихода, поэтому ключи отправителей меняются
+	um.rotateGroup(common.ConversationID(common.MsgGeneral, "", "", ""))
 
 	return nil
 }
 
-// ValidateCredentials проверяет учетные данные
+// ValidateCredentials проверяет учетные данные. Устаревшие хэши и хэши
+// с прежними параметрами прозрачно пересчитываются после успешного входа.
 func (um *UserManager) ValidateCredentials(username, password string) (bool, error) {
 	um.mu.RLock()
 	user, exists := um.users[username]
+	hasher := um.hasher
+	var storedHash, salt string
+	if exists {
+		storedHash, salt = user.PasswordHash, user.Salt
+	}
 	um.mu.RUnlock()
 
 	if !exists {
+		// Выравниваем время ответа, чтобы не раскрывать существование пользователя
+		hasher.Hash(password)
 		return false, errors.New("пользователь не найден")
 	}
 
 	// Проверка пароля
-	passwordHash := common.HashPassword(password, user.Salt)
-	return passwordHash == user.PasswordHash, nil
+	ok, needsRehash, err := hasher.Verify(password, storedHash, salt)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if needsRehash {
+		if newHash, err := hasher.Hash(password); err == nil {
+			um.mu.Lock()
+			// Пароль мог смениться, пока мы считали хэш
+			if user.PasswordHash == storedHash {
+				user.PasswordHash = newHash
+				user.Salt = ""
+				um.saveUser(user)
+			}
+			um.mu.Unlock()
+		}
+	}
+
+	return true, nil
 }
 
-// CreateSession создает сессию для пользователя
+// CreateSession создает новую сессию для пользователя. У пользователя может
+// быть несколько сессий (по одной на устройство); при превышении
+// maxSessionsPerUser вытесняется самая старая.
 func (um *UserManager) CreateSession(username string) string {
 	um.mu.Lock()
 	defer um.mu.Unlock()
@@ -123,19 +302,30 @@ func (um *UserManager) CreateSession(username string) string {
 		return ""
 	}
 
-	// Удаление старой сессии, если существует
-	if user.SessionToken != "" {
-		delete(um.sessions, user.SessionToken)
+	// Вытеснение самых старых сессий сверх лимита
+	var own []*Session
+	for _, session := range um.sessions {
+		if session.Username == username {
+			own = append(own, session)
+		}
+	}
+	sort.Slice(own, func(i, j int) bool { return own[i].Expires.Before(own[j].Expires) })
+	for len(own) >= maxSessionsPerUser {
+		delete(um.sessions, own[0].TokenHash)
+		um.deleteSession(own[0].TokenHash)
+		own = own[1:]
 	}
 
-	// Установка новой сессии
-	user.SessionToken = token
-	user.SessionExpires = time.Now().Add(24 * time.Hour)
-	user.IsOnline = true
+	session := &Session{
+		TokenHash: hashToken(token),
+		Username:  username,
+		Expires:   time.Now().Add(sessionTTL),
+	}
 	user.LastSeen = time.Now()
 
-	um.sessions[token] = user
-	um.onlineUsers[username] = true
+	um.sessions[session.TokenHash] = session
+	um.saveSession(session)
+	um.saveUser(user)
 
 	return token
 }
@@ -145,40 +335,46 @@ func (um *UserManager) ValidateSession(token string) (string, bool) {
 	um.mu.RLock()
 	defer um.mu.RUnlock()
 
-	user, exists := um.sessions[token]
+	session, exists := um.sessions[hashToken(token)]
 	if !exists {
 		return "", false
 	}
 
 	// Проверка срока действия сессии
-	if time.Now().After(user.SessionExpires) {
+	if time.Now().After(session.Expires) {
 		return "", false
 	}
 
-	return user.Username, true
+	return session.Username, true
 }
 
-// UpdateSession обновляет время сессии
-func (um *UserManager) UpdateSession(username string) {
+// UpdateSession продлевает сессию
+func (um *UserManager) UpdateSession(token string) {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	if user, exists := um.users[username]; exists {
-		user.SessionExpires = time.Now().Add(24 * time.Hour)
+	session, exists := um.sessions[hashToken(token)]
+	if !exists {
+		return
+	}
+	session.Expires = time.Now().Add(sessionTTL)
+	um.saveSession(session)
+
+	if user, exists := um.users[session.Username]; exists {
 		user.LastSeen = time.Now()
 	}
 }
 
-// Logout завершает сессию
+// Logout завершает одну сессию; остальные устройства пользователя
+// остаются в системе, а статус онлайн определяется их подключениями
 func (um *UserManager) Logout(token string) {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	if user, exists := um.sessions[token]; exists {
-		user.SessionToken = ""
-		user.IsOnline = false
-		delete(um.sessions, token)
-		delete(um.onlineUsers, user.Username)
+	id := hashToken(token)
+	if _, exists := um.sessions[id]; exists {
+		delete(um.sessions, id)
+		um.deleteSession(id)
 	}
 }
 
@@ -199,11 +395,12 @@ func (um *UserManager) GetAllUsers() []common.UserInfo {
 	users := make([]common.UserInfo, 0, len(um.users))
 	for _, user := range um.users {
 		users = append(users, common.UserInfo{
-			Username:  user.Username,
-			PublicKey: user.PublicKey,
-			IsOnline:  user.IsOnline,
-			LastSeen:  user.LastSeen,
-			JoinedAt:  user.JoinedAt,
+			Username:   user.Username,
+			PublicKey:  user.PublicKey,
+			SigningKey: user.SigningKey,
+			IsOnline:   user.IsOnline,
+			LastSeen:   user.LastSeen,
+			JoinedAt:   user.JoinedAt,
 		})
 	}
 
@@ -235,60 +432,142 @@ func (um *UserManager) SetOnline(username string, online bool) {
 			um.onlineUsers[username] = true
 		} else {
 			delete(um.onlineUsers, username)
+			um.saveUser(user)
 		}
 	}
 }
 
-// UpdatePublicKey обновляет публичный ключ
-func (um *UserManager) UpdatePublicKey(username, publicKey string) {
+// UpdatePublicKey обновляет публичный ключ X25519 пользователя и сообщает,
+// сменился ли ранее опубликованный ключ
+func (um *UserManager) UpdatePublicKey(username, publicKey string) (bool, error) {
+	if _, err := common.ParsePublicKey(publicKey); err != nil {
+		return false, err
+	}
+
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	if user, exists := um.users[username]; exists {
-		user.PublicKey = publicKey
+	user, exists := um.users[username]
+	if !exists {
+		return false, errors.New("пользователь не найден")
 	}
+	return um.setPublicKey(user, publicKey), nil
 }
 
-// AddMessage добавляет сообщение в историю
-func (um *UserManager) AddMessage(msg common.Message) {
+// AddMessage добавляет сообщение в историю, назначая ему уникальный ID
+// и следующий порядковый номер в диалоге, и возвращает сохраненную запись
+func (um *UserManager) AddMessage(msg common.Message) (MessageHistory, error) {
+	id, err := common.GenerateMessageID()
+	if err != nil {
+		return MessageHistory{}, errors.New("ошибка генерации ID сообщения")
+	}
+
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	historyMsg := MessageHistory{
-		ID:        msg.ID,
+	conversation := common.ConversationID(msg.Type, msg.Sender, msg.Recipient, msg.Room)
+	var root *MessageHistory
+	if msg.ParentID != "" {
+		if root, err = um.threadRoot(msg.ParentID, conversation); err != nil {
+			return MessageHistory{}, err
+		}
+		msg.ParentID = root.ID
+	}
+	if err := um.checkSenderKey(msg, conversation); err != nil {
+		return MessageHistory{}, err
+	}
+	if err := um.checkSignature(msg); err != nil {
+		return MessageHistory{}, err
+	}
+	msg.Mentions = um.resolveMentions(msg, conversation)
+	if msg.Attachments, err = um.bindAttachments(msg, conversation); err != nil {
+		return MessageHistory{}, err
+	}
+
+	stored := um.appendMessage(id, conversation, msg)
+	if root != nil {
+		um.addReply(root, stored)
+	}
+	um.recordMentions(stored)
+	return *stored, nil
+}
+
+// appendMessage записывает сообщение в диалог под следующим порядковым
+// номером и вытесняет самое старое сверх лимита; вызывается под um.mu
+func (um *UserManager) appendMessage(id, conversation string, msg common.Message) *MessageHistory {
+	um.sequences[conversation]++
+	um.persist(bucketSequences, conversation, um.sequences[conversation])
+
+	historyMsg := &MessageHistory{
+		ID:           id,
+		Conversation: conversation,
+		Seq:          um.sequences[conversation],
+
 		Type:      msg.Type,
 		Sender:    msg.Sender,
 		Recipient: msg.Recipient,
 		Content:   msg.Content,
-		Timestamp: msg.Timestamp,
+		// Время назначается под блокировкой, чтобы в каждом диалоге оно
+		// не убывало и по нему работал двоичный поиск
+		Timestamp: time.Now(),
+		Room:      msg.Room,
+		Target:    msg.Target,
 		IV:        msg.IV,
 		AuthTag:   msg.AuthTag,
-		Encrypted: msg.IV != "" || msg.AuthTag != "",
+		Encrypted: msg.IV != "" || msg.AuthTag != "" || msg.RatchetKey != "",
+
+		RatchetKey:  msg.RatchetKey,
+		PrevCounter: msg.PrevCounter,
+		Counter:     msg.Counter,
+		X3DH:        msg.X3DH,
+		KeyID:       msg.KeyID,
+		Epoch:       msg.Epoch,
+		Signature:   msg.Signature,
+		SignedAt:    msg.SignedAt,
+
+		ParentID:    msg.ParentID,
+		Mentions:    msg.Mentions,
+		Attachments: msg.Attachments,
+	}
+	if ttl := um.expiry[conversation]; ttl > 0 {
+		historyMsg.ExpiresAt = historyMsg.Timestamp.Add(ttl)
 	}
 
-	um.messages = append(um.messages, historyMsg)
+	um.messageSeq++
+	historyMsg.order = um.messageSeq
+	historyMsg.storeKey = fmt.Sprintf("%020d", um.messageSeq)
+	um.indexMessage(historyMsg)
+	um.persist(bucketMessages, historyMsg.storeKey, historyMsg)
 
 	// Ограничение истории сообщений
 	if len(um.messages) > um.messageLimit {
-		um.messages = um.messages[1:]
+		um.removeFromStore(bucketMessages, um.messages[0].storeKey)
+		um.evictOldestMessage()
 	}
+
+	return historyMsg
 }
 
 // GetUserHistory возвращает историю сообщений пользователя
 func (um *UserManager) GetUserHistory(username string) []MessageHistory {
+	return um.GetUserHistorySince(username, nil)
+}
+
+// GetUserHistorySince возвращает сообщения пользователя, порядковый номер
+// которых больше курсора их диалога; диалоги без курсора выдаются целиком
+func (um *UserManager) GetUserHistorySince(username string, cursors map[string]uint64) []MessageHistory {
 	um.mu.RLock()
 	defer um.mu.RUnlock()
 
-	var history []MessageHistory
-	for _, msg := range um.messages {
-		if msg.Recipient == "all" ||
-			msg.Recipient == username ||
-			msg.Sender == username {
-			history = append(history, msg)
-		}
+	var collected []*MessageHistory
+	for _, conversation := range um.visibleConversations(username) {
+		msgs := um.conversations[conversation]
+		cursor := cursors[conversation]
+		from := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq > cursor })
+		collected = append(collected, msgs[from:]...)
 	}
 
-	return history
+	return sortedHistory(collected)
 }
 
 // GetConversationHistory возвращает историю диалога между двумя пользователями
@@ -296,15 +575,7 @@ func (um *UserManager) GetConversationHistory(user1, user2 string) []MessageHist
 	um.mu.RLock()
 	defer um.mu.RUnlock()
 
-	var history []MessageHistory
-	for _, msg := range um.messages {
-		if (msg.Sender == user1 && msg.Recipient == user2) ||
-			(msg.Sender == user2 && msg.Recipient == user1) {
-			history = append(history, msg)
-		}
-	}
-
-	return history
+	return sortedHistory(um.conversations[common.ConversationID(common.MsgPrivate, user1, user2, "")])
 }
 
 // GetOnlineCount возвращает количество онлайн пользователей
@@ -321,12 +592,10 @@ func (um *UserManager) CleanupSessions() {
 	defer um.mu.Unlock()
 
 	now := time.Now()
-	for token, user := range um.sessions {
-		if now.After(user.SessionExpires) {
-			user.SessionToken = ""
-			user.IsOnline = false
-			delete(um.sessions, token)
-			delete(um.onlineUsers, user.Username)
+	for id, session := range um.sessions {
+		if now.After(session.Expires) {
+			delete(um.sessions, id)
+			um.deleteSession(id)
 		}
 	}
 }
@@ -337,9 +606,16 @@ func (um *UserManager) GetStatistics() map[string]interface{} {
 	defer um.mu.RUnlock()
 
 	return map[string]interface{}{
-		"total_users":    len(um.users),
-		"online_users":   len(um.onlineUsers),
-		"total_messages": len(um.messages),
-		"message_limit":  um.messageLimit,
+		"total_users":     len(um.users),
+		"online_users":    len(um.onlineUsers),
+		"total_messages":  len(um.messages),
+		"message_limit":   um.messageLimit,
+		"queued_messages": um.mailboxDepth(),
+		"mailboxes":       len(um.mailboxes),
+		"mentions":        um.mentionCount(),
+		"attachments":     len(um.attachments),
+		"uploads":         len(um.uploads),
+		"expiry_timers":   len(um.expiry),
+		"group_epochs":    len(um.epochs),
 	}
 }
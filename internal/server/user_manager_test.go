@@ -0,0 +1,76 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"secure-messenger/internal/common"
+)
+
+func newHashingUserManager(t *testing.T) *UserManager {
+	t.Helper()
+	um := newTestUserManager(t)
+	hasher, err := common.NewPasswordHasher(common.PasswordParams{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.SetPasswordHasher(hasher)
+	return um
+}
+
+// Хэш считается без блокировки, поэтому одно имя может регистрироваться
+// одновременно; занять его должен ровно один запрос
+func TestRegisterUserConcurrentSameName(t *testing.T) {
+	um := newHashingUserManager(t)
+
+	const attempts = 8
+	errs := make([]error, attempts)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = um.RegisterUser("alice", "password-"+strings.Repeat("x", i))
+		}(i)
+	}
+	wg.Wait()
+
+	registered := -1
+	for i, err := range errs {
+		if err == nil {
+			if registered >= 0 {
+				t.Fatal("имя зарегистрировано дважды")
+			}
+			registered = i
+		}
+	}
+	if registered < 0 {
+		t.Fatal("ни одна регистрация не прошла")
+	}
+	if ok, err := um.ValidateCredentials("alice", "password-"+strings.Repeat("x", registered)); !ok || err != nil {
+		t.Fatalf("вход с паролем победившей регистрации: %v, %v", ok, err)
+	}
+	if err := um.RegisterUser("bad name", "password"); err == nil {
+		t.Fatal("принято недопустимое имя")
+	}
+}
+
+func TestValidateCredentialsRehashesLegacyHash(t *testing.T) {
+	um := newHashingUserManager(t)
+	um.users["alice"] = &User{Username: "alice", PasswordHash: common.HashPassword("secret", "salt"), Salt: "salt"}
+
+	if ok, err := um.ValidateCredentials("alice", "secret"); !ok || err != nil {
+		t.Fatalf("вход по устаревшему хэшу: %v, %v", ok, err)
+	}
+	user := um.users["alice"]
+	if !strings.HasPrefix(user.PasswordHash, "$argon2id$") || user.Salt != "" {
+		t.Fatalf("хэш не пересчитан: %q, соль %q", user.PasswordHash, user.Salt)
+	}
+	if ok, _ := um.ValidateCredentials("alice", "wrong"); ok {
+		t.Fatal("принят неверный пароль")
+	}
+	if ok, err := um.ValidateCredentials("alice", "secret"); !ok || err != nil {
+		t.Fatalf("вход после пересчета: %v, %v", ok, err)
+	}
+}
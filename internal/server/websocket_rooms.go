@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+
+	"secure-messenger/internal/common"
+)
+
+// handleRoomCommand обрабатывает операции с комнатами и уведомляет участников
+func (s *WebSocketServer) handleRoomCommand(client *Client, msg common.Message) {
+	var (
+		info common.RoomInfo
+		err  error
+		// affected получает обновление, даже если больше не участник комнаты
+		affected string
+	)
+
+	switch msg.Type {
+	case common.MsgRoomCreate:
+		info, err = s.userManager.CreateRoom(msg.Room, msg.Sender, msg.Private)
+	case common.MsgRoomJoin:
+		info, err = s.userManager.JoinRoom(msg.Room, msg.Sender)
+	case common.MsgRoomLeave:
+		info, err = s.userManager.LeaveRoom(msg.Room, msg.Sender)
+		affected = msg.Sender
+	case common.MsgRoomInvite:
+		info, err = s.userManager.InviteToRoom(msg.Room, msg.Sender, msg.Username)
+	case common.MsgRoomKick:
+		info, err = s.userManager.KickFromRoom(msg.Room, msg.Sender, msg.Username)
+		affected = msg.Username
+	case common.MsgRoomRole:
+		info, err = s.userManager.SetRoomRole(msg.Room, msg.Sender, msg.Username, msg.Role)
+	}
+
+	if err != nil {
+		client.SendError(err.Error())
+		return
+	}
+
+	update := common.Message{
+		Type:      common.MsgRoomUpdate,
+		Sender:    msg.Sender,
+		Username:  msg.Username,
+		Room:      info.Name,
+		Content:   msg.Type,
+		RoomInfo:  &info,
+		Timestamp: s.clock.Now(),
+	}
+	s.sendToRoom(info.Name, update, "")
+	if affected != "" {
+		s.sendToUser(affected, update)
+	}
+	switch msg.Type {
+	case common.MsgRoomJoin, common.MsgRoomLeave, common.MsgRoomKick:
+		s.NotifySenderKeyRotation(info.Name)
+	}
+
+	// Приглашенный получает отдельное уведомление
+	if msg.Type == common.MsgRoomInvite {
+		s.sendToUser(msg.Username, common.Message{
+			Type:      common.MsgRoomInvite,
+			Sender:    msg.Sender,
+			Recipient: msg.Username,
+			Room:      info.Name,
+			RoomInfo:  &info,
+			Timestamp: s.clock.Now(),
+		})
+	}
+}
+
+func (s *WebSocketServer) handleRoomMessage(origin *Client, msg common.Message) {
+	if !s.userManager.IsRoomMember(msg.Room, msg.Sender) {
+		origin.SendError(ErrNotRoomMember.Error())
+		return
+	}
+
+	msg.Recipient = ""
+	if !s.storeMessage(origin, &msg) {
+		return
+	}
+	s.sendToRoomExcept(msg.Room, msg, origin)
+	s.notifyThread(msg)
+	s.notifyMentions(msg)
+}
+
+// sendToRoom отправляет сообщение на все устройства участников комнаты,
+// кроме устройств пользователя except
+func (s *WebSocketServer) sendToRoom(room string, msg common.Message, except string) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("JSON marshal error:", err)
+		return
+	}
+
+	for _, member := range s.userManager.GetRoomMembers(room) {
+		if member == except {
+			continue
+		}
+		for _, client := range s.snapshotClients(member) {
+			client.Send(data)
+		}
+	}
+}
+
+// sendToRoomExcept отправляет сообщение участникам комнаты, включая другие
+// устройства отправителя, кроме устройства-источника
+func (s *WebSocketServer) sendToRoomExcept(room string, msg common.Message, origin *Client) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("JSON marshal error:", err)
+		return
+	}
+
+	for _, member := range s.userManager.GetRoomMembers(room) {
+		for _, client := range s.snapshotClients(member) {
+			if client != origin {
+				client.Send(data)
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"sync"
@@ -20,19 +21,48 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+const (
+	// DefaultPingInterval период отправки ping клиенту
+	DefaultPingInterval = 30 * time.Second
+	// DefaultPongWait сколько ждать любого входящего кадра (pong, ping или
+	// сообщения), прежде чем считать соединение мертвым
+	DefaultPongWait = 60 * time.Second
+	// authWait сколько ждать сообщения аутентификации
+	authWait = 10 * time.Second
+)
+
 type WebSocketServer struct {
-	userManager *UserManager
-	clients     map[string]*websocket.Conn
-	mu          sync.RWMutex
+	userManager  *UserManager
+	clients      map[string]map[*Client]bool // username -> устройства
+	mu           sync.RWMutex
+	clock        clock
+	pingInterval time.Duration
+	pongWait     time.Duration
 }
 
 func NewWebSocketServer(userManager *UserManager) *WebSocketServer {
 	return &WebSocketServer{
-		userManager: userManager,
-		clients:     make(map[string]*websocket.Conn),
+		userManager:  userManager,
+		clients:      make(map[string]map[*Client]bool),
+		clock:        systemClock{},
+		pingInterval: DefaultPingInterval,
+		pongWait:     DefaultPongWait,
 	}
 }
 
+// SetHeartbeat задает интервал ping и тайм-аут чтения. pongWait должен
+// превышать pingInterval, иначе живые клиенты будут отключаться. Тайм-аут
+// проверяется на тиках ping, поэтому мертвое соединение закрывается
+// через pongWait..pongWait+pingInterval.
+func (s *WebSocketServer) SetHeartbeat(pingInterval, pongWait time.Duration) error {
+	if pingInterval <= 0 || pongWait <= pingInterval {
+		return errors.New("тайм-аут pong должен быть больше интервала ping")
+	}
+	s.pingInterval = pingInterval
+	s.pongWait = pongWait
+	return nil
+}
+
 func (s *WebSocketServer) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -49,7 +79,7 @@ func (s *WebSocketServer) handleConnection(conn *websocket.Conn) {
 	defer conn.Close()
 
 	// Устанавливаем таймаут для аутентификации
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	conn.SetReadDeadline(s.clock.Now().Add(authWait))
 
 	var authMsg common.Message
 	if err := conn.ReadJSON(&authMsg); err != nil {
@@ -57,9 +87,6 @@ func (s *WebSocketServer) handleConnection(conn *websocket.Conn) {
 		return
 	}
 
-	// Сбрасываем таймаут после успешной аутентификации
-	conn.SetReadDeadline(time.Time{})
-
 	// Проверяем аутентификацию
 	username, valid := s.authenticate(authMsg)
 	if !valid {
@@ -67,32 +94,57 @@ func (s *WebSocketServer) handleConnection(conn *websocket.Conn) {
 		return
 	}
 
-	// Регистрируем клиент
+	// Регистрируем клиент; с этого момента писать в conn может только writePump.
+	// Соединение живо, пока приходят кадры: каждый pong от браузера
+	// отмечается, а срок проверяет writePump по часам сервера.
+	client := newClient(conn, username, authMsg.SessionToken, s.clock, s.pingInterval, s.pongWait)
+	conn.SetReadDeadline(time.Time{})
+	conn.SetPongHandler(func(string) error {
+		client.touch()
+		return nil
+	})
+	go client.writePump()
+	defer client.Close()
+
+	// Пользователь может быть подключен с нескольких устройств одновременно
 	s.mu.Lock()
-	// Закрываем старое соединение, если пользователь уже подключен
-	if oldConn, exists := s.clients[username]; exists {
-		oldConn.Close()
-		delete(s.clients, username)
+	devices, exists := s.clients[username]
+	if !exists {
+		devices = make(map[*Client]bool)
+		s.clients[username] = devices
+	}
+	devices[client] = true
+	firstDevice := len(devices) == 1
+	if firstDevice {
+		s.userManager.SetOnline(username, true)
 	}
-	s.clients[username] = conn
 	s.mu.Unlock()
 
-	log.Printf("✅ User connected: %s", username)
+	log.Printf("✅ User connected: %s (devices: %d)", username, len(devices))
 
 	// Отправляем приветственное сообщение
-	s.sendWelcomeMessage(username, conn)
+	s.sendWelcomeMessage(client)
 
 	// Уведомляем всех о новом пользователе
-	s.broadcastUserJoined(username)
+	if firstDevice {
+		s.broadcastUserJoined(username)
+	}
 
 	// Обновляем список пользователей
 	s.sendUserListToAll()
 
-	// Отправляем историю
-	s.sendHistoryToUser(username, conn)
+	// Отправляем историю (только новую, если клиент прислал курсоры),
+	// затем неподтвержденные личные сообщения
+	s.sendHistoryToUser(client, authMsg.Cursors)
+	s.flushMailbox(client)
+
+	// Напоминаем о пополнении пула предключей
+	if count, published := s.userManager.PrekeyCount(username); published {
+		s.notifyPrekeysLow(username, count)
+	}
 
 	// Обработка сообщений
-	s.handleMessages(conn, username)
+	s.handleMessages(client)
 }
 
 func (s *WebSocketServer) authenticate(msg common.Message) (string, bool) {
@@ -106,19 +158,49 @@ func (s *WebSocketServer) authenticate(msg common.Message) (string, bool) {
 		return "", false
 	}
 
-	// Обновляем статус
-	s.userManager.SetOnline(username, true)
+	// Клиент публикует свои публичные ключи X25519 и Ed25519 при подключении
+	changed := false
+	if msg.PublicKey != "" {
+		updated, err := s.userManager.UpdatePublicKey(username, msg.PublicKey)
+		if err != nil {
+			log.Printf("Invalid public key from %s: %v", username, err)
+		}
+		changed = changed || updated
+	}
+	if msg.SigningKey != "" {
+		updated, err := s.userManager.UpdateSigningKey(username, msg.SigningKey)
+		if err != nil {
+			log.Printf("Invalid signing key from %s: %v", username, err)
+		}
+		changed = changed || updated
+	}
+	if changed {
+		s.notifyKeyChange(username)
+	}
+
 	return username, true
 }
 
-func (s *WebSocketServer) handleMessages(conn *websocket.Conn, username string) {
+func (s *WebSocketServer) handleMessages(client *Client) {
+	username := client.username
+
 	defer func() {
-		conn.Close()
+		client.Close()
 		s.mu.Lock()
-		delete(s.clients, username)
+		devices := s.clients[username]
+		delete(devices, client)
+		// Пользователь уходит в офлайн только с отключением последнего устройства
+		lastDevice := len(devices) == 0
+		if lastDevice {
+			delete(s.clients, username)
+			s.userManager.SetOnline(username, false)
+		}
 		s.mu.Unlock()
 
-		s.userManager.SetOnline(username, false)
+		if !lastDevice {
+			return
+		}
+
 		s.broadcastUserLeft(username)
 		s.sendUserListToAll()
 
@@ -127,57 +209,538 @@ func (s *WebSocketServer) handleMessages(conn *websocket.Conn, username string)
 
 	for {
 		var msg common.Message
-		err := conn.ReadJSON(&msg)
+		err := client.conn.ReadJSON(&msg)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket read error: %v", err)
 			}
 			break
 		}
+		client.touch()
 
 		msg.Sender = username
-		msg.Timestamp = time.Now()
+		msg.Timestamp = s.clock.Now()
 
 		switch msg.Type {
+		case common.MsgPing:
+			client.SendJSON(common.Message{Type: common.MsgPong, Timestamp: msg.Timestamp})
+		case common.MsgPong:
+			// Ответ на ping уже отмечен в touch
+		case common.MsgHistory:
+			s.handleHistoryRequest(client, msg)
+		case common.MsgThread:
+			s.handleThreadRequest(client, msg)
+		case common.MsgEdit, common.MsgDelete:
+			s.handleEdit(client, msg)
+		case common.MsgReaction:
+			s.handleReaction(client, msg)
+		case common.MsgExpiry:
+			s.handleExpiry(client, msg)
+		case common.MsgSync:
+			s.sendHistoryToUser(client, msg.Cursors)
+		case common.MsgDelivered, common.MsgRead:
+			s.handleReceipt(msg)
 		case common.MsgGeneral:
-			s.handleGeneralMessage(msg)
+			s.handleGeneralMessage(client, msg)
 		case common.MsgPrivate:
-			s.handlePrivateMessage(msg)
+			s.handlePrivateMessage(client, msg)
 		case common.MsgTyping:
 			s.handleTypingNotification(msg)
+		case common.MsgRoomCreate, common.MsgRoomJoin, common.MsgRoomLeave,
+			common.MsgRoomInvite, common.MsgRoomKick, common.MsgRoomRole:
+			s.handleRoomCommand(client, msg)
+		case common.MsgRoomMessage:
+			s.handleRoomMessage(client, msg)
+		case common.MsgKeyUpdate:
+			s.handleKeyUpdate(client, msg)
+		case common.MsgPrekeyUpload:
+			s.handlePrekeyUpload(client, msg)
+		case common.MsgPrekeyRequest:
+			s.handlePrekeyRequest(client, msg)
+		case common.MsgSenderKey:
+			s.handleSenderKey(client, msg)
 		}
 	}
 }
 
-func (s *WebSocketServer) handleGeneralMessage(msg common.Message) {
+func (s *WebSocketServer) handleGeneralMessage(origin *Client, msg common.Message) {
 	if msg.Recipient == "" {
 		msg.Recipient = "all"
 	}
+	msg.Room = ""
 
-	s.userManager.AddMessage(msg)
-	s.broadcastToAllExcept(msg, msg.Sender)
+	if !s.storeMessage(origin, &msg) {
+		return
+	}
+	// Остальные устройства отправителя тоже получают сообщение
+	s.broadcastToAllExcept(msg, origin)
+	s.notifyThread(msg)
+	s.notifyMentions(msg)
 }
 
-func (s *WebSocketServer) handlePrivateMessage(msg common.Message) {
+func (s *WebSocketServer) handlePrivateMessage(origin *Client, msg common.Message) {
 	if msg.Recipient != "" && msg.Recipient != "all" && msg.Recipient != msg.Sender {
-		s.userManager.AddMessage(msg)
+		msg.Room = ""
+		if _, exists := s.userManager.GetUser(msg.Recipient); !exists {
+			origin.SendError("Пользователь не найден")
+			return
+		}
+		if !s.storeMessage(origin, &msg) {
+			return
+		}
+
+		// Сообщение ждет в почтовом ящике, пока получатель не пришлет
+		// квитанцию; офлайн получатель заберет его при подключении
+		if err := s.userManager.EnqueueMessage(msg); err != nil {
+			log.Printf("Mailbox error for %s: %v", msg.Recipient, err)
+		}
 		s.sendToUser(msg.Recipient, msg)
+		// Синхронизация с другими устройствами отправителя
+		s.sendToUserExcept(msg.Sender, msg, origin)
+		s.notifyThread(msg)
+	}
+}
+
+// storeMessage сохраняет сообщение в истории, дополняет его назначенными
+// сервером ID и порядковым номером и подтверждает их устройству-источнику.
+// ClientID нужен только отправителю для сопоставления и дальше не уходит.
+func (s *WebSocketServer) storeMessage(origin *Client, msg *common.Message) bool {
+	stored, err := s.userManager.AddMessage(*msg)
+	if errors.Is(err, ErrStaleSenderKey) {
+		// Устройство получает текущую эпоху, меняет ключ и отправляет заново
+		conversation := common.ConversationID(msg.Type, msg.Sender, msg.Recipient, msg.Room)
+		origin.SendJSON(common.Message{
+			Type:         common.MsgSenderKeyRotate,
+			ClientID:     msg.ClientID,
+			Conversation: conversation,
+			Room:         msg.Room,
+			Epoch:        s.userManager.GroupEpoch(conversation),
+			Error:        err.Error(),
+			Timestamp:    s.clock.Now(),
+		})
+		return false
+	}
+	if err != nil {
+		origin.SendError(err.Error())
+		return false
+	}
+	s.ackStored(origin, msg.ClientID, stored)
+
+	msg.ID = stored.ID
+	msg.ClientID = ""
+	msg.ParentID = stored.ParentID
+	msg.Mentions = stored.Mentions
+	msg.Conversation = stored.Conversation
+	msg.Seq = stored.Seq
+	msg.Timestamp = stored.Timestamp
+	msg.ExpiresAt = stored.ExpiresAt
+	return true
+}
+
+func (s *WebSocketServer) ackStored(origin *Client, clientID string, stored MessageHistory) {
+	origin.SendJSON(common.Message{
+		Type:         common.MsgAck,
+		ID:           stored.ID,
+		ClientID:     clientID,
+		Conversation: stored.Conversation,
+		Seq:          stored.Seq,
+		Timestamp:    stored.Timestamp,
+		ExpiresAt:    stored.ExpiresAt,
+	})
+}
+
+// handleEdit применяет правку или удаление и рассылает событие всем
+// участникам диалога, включая другие устройства автора
+func (s *WebSocketServer) handleEdit(origin *Client, msg common.Message) {
+	var (
+		event MessageHistory
+		err   error
+	)
+	if msg.Type == common.MsgEdit {
+		event, err = s.userManager.EditMessage(msg.Sender, msg)
+	} else {
+		event, err = s.userManager.DeleteMessage(msg.Sender, msg.Target)
+	}
+	if err != nil {
+		origin.SendError(err.Error())
+		return
 	}
+	s.ackStored(origin, msg.ClientID, event)
+	s.sendToConversation(event, event.Message(), origin)
+}
+
+// handleReaction добавляет или снимает реакцию и рассылает итог по
+// сообщению всем участникам диалога, включая устройство-источник
+func (s *WebSocketServer) handleReaction(origin *Client, msg common.Message) {
+	event, changed, err := s.userManager.React(msg.Sender, msg.Target, msg.Emoji, msg.Remove)
+	if err != nil {
+		origin.SendError(err.Error())
+		return
+	}
+	if !changed {
+		// Реакция уже была в нужном состоянии: обновляем только отправителя
+		origin.SendJSON(common.Message{
+			Type:      common.MsgReaction,
+			Target:    event.ID,
+			Reactions: event.Reactions,
+			Timestamp: msg.Timestamp,
+		})
+		return
+	}
+
+	reaction := event.Message()
+	reaction.Emoji = msg.Emoji
+	reaction.Remove = msg.Remove
+	s.sendToConversation(event, reaction, nil)
+}
+
+// handleExpiry меняет таймер исчезающих сообщений и сообщает о нем всем
+// участникам диалога
+func (s *WebSocketServer) handleExpiry(origin *Client, msg common.Message) {
+	ttl := time.Duration(msg.ExpiresIn) * time.Second
+	conversation, err := s.userManager.SetExpiry(msg.Sender, msg.Recipient, msg.Room, ttl)
+	if err != nil {
+		origin.SendError(err.Error())
+		return
+	}
+
+	ref := MessageHistory{Sender: msg.Sender, Recipient: msg.Recipient, Room: msg.Room}
+	s.sendToConversation(ref, common.Message{
+		Type:         common.MsgExpiry,
+		Sender:       msg.Sender,
+		Recipient:    msg.Recipient,
+		Room:         msg.Room,
+		Conversation: conversation,
+		ExpiresIn:    msg.ExpiresIn,
+		Timestamp:    msg.Timestamp,
+	}, nil)
+}
+
+// ReapExpiredMessages удаляет истекшие исчезающие сообщения и сообщает
+// участникам их диалогов, чтобы клиенты удалили локальные копии.
+// Возвращает число удаленных записей.
+func (s *WebSocketServer) ReapExpiredMessages() int {
+	expired := s.userManager.ReapExpired(s.clock.Now())
+
+	var order []string
+	byConversation := make(map[string][]MessageHistory)
+	for _, msg := range expired {
+		if _, seen := byConversation[msg.Conversation]; !seen {
+			order = append(order, msg.Conversation)
+		}
+		byConversation[msg.Conversation] = append(byConversation[msg.Conversation], msg)
+	}
+
+	for _, conversation := range order {
+		msgs := byConversation[conversation]
+		ids := make([]string, 0, len(msgs))
+		for _, msg := range msgs {
+			ids = append(ids, msg.ID)
+		}
+		ref := msgs[0]
+		s.sendToConversation(ref, common.Message{
+			Type:         common.MsgExpired,
+			Recipient:    ref.Recipient,
+			Room:         ref.Room,
+			Conversation: conversation,
+			IDs:          ids,
+			Timestamp:    s.clock.Now(),
+		}, nil)
+	}
+	return len(expired)
+}
+
+// sendToConversation рассылает сообщение участникам диалога, к которому
+// относится запись истории ref (комнаты, личной переписки или общего
+// чата), кроме устройства except
+func (s *WebSocketServer) sendToConversation(ref MessageHistory, msg common.Message, except *Client) {
+	switch {
+	case ref.Room != "":
+		s.sendToRoomExcept(ref.Room, msg, except)
+	case ref.Recipient != "all":
+		s.sendToUserExcept(ref.Recipient, msg, except)
+		s.sendToUserExcept(ref.Sender, msg, except)
+	default:
+		s.broadcastToAllExcept(msg, except)
+	}
+}
+
+// handleHistoryRequest отвечает устройству страницей истории
+func (s *WebSocketServer) handleHistoryRequest(client *Client, msg common.Message) {
+	var query common.HistoryQuery
+	if msg.Query != nil {
+		query = *msg.Query
+	}
+
+	page, err := s.userManager.QueryHistory(msg.Sender, query)
+	if err != nil {
+		client.SendError(err.Error())
+		return
+	}
+
+	client.SendJSONWait(common.Message{
+		Type:      common.MsgHistory,
+		Query:     &query,
+		Page:      &page,
+		Timestamp: s.clock.Now(),
+	})
+}
+
+func (s *WebSocketServer) handleThreadRequest(client *Client, msg common.Message) {
+	var query common.HistoryQuery
+	if msg.Query != nil {
+		query = *msg.Query
+	}
+
+	page, err := s.userManager.QueryThread(msg.Sender, msg.Target, query)
+	if err != nil {
+		client.SendError(err.Error())
+		return
+	}
+
+	client.SendJSONWait(common.Message{
+		Type:      common.MsgThread,
+		Target:    msg.Target,
+		Query:     &query,
+		Page:      &page,
+		Timestamp: s.clock.Now(),
+	})
+}
+
+// notifyThread сообщает участникам ветки о новом ответе, даже если ответ
+// к ним не обращен; автор ответа уведомление не получает
+func (s *WebSocketServer) notifyThread(reply common.Message) {
+	if reply.ParentID == "" {
+		return
+	}
+
+	participants, count := s.userManager.ThreadParticipants(reply.ParentID)
+	for _, username := range participants {
+		if username == reply.Sender {
+			continue
+		}
+		s.sendToUser(username, common.Message{
+			Type:         common.MsgThreadReply,
+			ID:           reply.ID,
+			ParentID:     reply.ParentID,
+			Conversation: reply.Conversation,
+			Sender:       reply.Sender,
+			Count:        count,
+			Timestamp:    reply.Timestamp,
+		})
+	}
+}
+
+// notifyMentions отправляет упомянутым пользователям отдельное уведомление
+// с числом непрочитанных упоминаний
+func (s *WebSocketServer) notifyMentions(msg common.Message) {
+	for _, username := range msg.Mentions {
+		s.sendToUser(username, common.Message{
+			Type:         common.MsgMention,
+			ID:           msg.ID,
+			Conversation: msg.Conversation,
+			Sender:       msg.Sender,
+			Recipient:    username,
+			Room:         msg.Room,
+			ParentID:     msg.ParentID,
+			Count:        s.userManager.UnreadMentions(username),
+			Timestamp:    msg.Timestamp,
+		})
+	}
+}
+
+// handleReceipt учитывает квитанцию получателя и пересылает ее на все
+// устройства отправителя
+func (s *WebSocketServer) handleReceipt(msg common.Message) {
+	sender, kind, ok := s.userManager.RecordReceipt(msg.Sender, msg.ID, msg.Type)
+	if !ok {
+		return
+	}
+
+	s.sendToUser(sender, common.Message{
+		Type:      kind,
+		ID:        msg.ID,
+		Sender:    msg.Sender,
+		Recipient: sender,
+		Timestamp: msg.Timestamp,
+	})
 }
 
 func (s *WebSocketServer) handleTypingNotification(msg common.Message) {
 	msg.Type = common.MsgTyping
+	if msg.Room != "" {
+		if s.userManager.IsRoomMember(msg.Room, msg.Sender) {
+			msg.Recipient = ""
+			s.sendToRoom(msg.Room, msg, msg.Sender)
+		}
+		return
+	}
 	if msg.Recipient != "" && msg.Recipient != "all" {
 		s.sendToUser(msg.Recipient, msg)
 	}
 }
 
-func (s *WebSocketServer) sendWelcomeMessage(username string, conn *websocket.Conn) {
+func (s *WebSocketServer) handleKeyUpdate(client *Client, msg common.Message) {
+	if msg.PublicKey == "" && msg.SigningKey == "" {
+		client.SendError("Не указан ключ")
+		return
+	}
+	changed := false
+	if msg.PublicKey != "" {
+		updated, err := s.userManager.UpdatePublicKey(msg.Sender, msg.PublicKey)
+		if err != nil {
+			client.SendError(err.Error())
+			return
+		}
+		changed = updated
+	}
+	if msg.SigningKey != "" {
+		updated, err := s.userManager.UpdateSigningKey(msg.Sender, msg.SigningKey)
+		if err != nil {
+			client.SendError(err.Error())
+			return
+		}
+		changed = changed || updated
+	}
+	if changed {
+		s.notifyKeyChange(msg.Sender)
+	}
+	s.sendUserListToAll()
+}
+
+func (s *WebSocketServer) handlePrekeyUpload(client *Client, msg common.Message) {
+	if msg.Prekeys == nil {
+		client.SendError("Пустой набор предключей")
+		return
+	}
+
+	count, err := s.PublishPrekeys(msg.Sender, *msg.Prekeys)
+	if err != nil {
+		client.SendError(err.Error())
+		return
+	}
+
+	client.SendJSON(common.Message{
+		Type:      common.MsgSuccess,
+		Content:   "Предключи опубликованы",
+		Count:     count,
+		Timestamp: s.clock.Now(),
+	})
+}
+
+func (s *WebSocketServer) handlePrekeyRequest(client *Client, msg common.Message) {
+	bundle, err := s.FetchPrekeyBundle(client.username, msg.Username)
+	if err != nil {
+		client.SendError(err.Error())
+		return
+	}
+
+	client.SendJSON(common.Message{
+		Type:      common.MsgPrekeyBundle,
+		Username:  msg.Username,
+		Bundle:    &bundle,
+		Timestamp: s.clock.Now(),
+	})
+}
+
+// PublishPrekeys публикует ключи пользователя по WebSocket или HTTP и
+// рассылает список пользователей с его ключами; если сменился ключ
+// идентичности или подписи, предупреждает его собеседников
+func (s *WebSocketServer) PublishPrekeys(username string, upload common.PrekeyUpload) (int, error) {
+	count, changed, err := s.userManager.UploadPrekeys(username, upload)
+	if err != nil {
+		return count, err
+	}
+	if changed {
+		s.notifyKeyChange(username)
+	}
+	s.sendUserListToAll()
+	return count, nil
+}
+
+// handleSenderKey пересылает участнику группы ключ цепочки отправителя.
+// Как и личное сообщение, ключ ждет в почтовом ящике квитанции получателя.
+func (s *WebSocketServer) handleSenderKey(origin *Client, msg common.Message) {
+	msg.ClientID = ""
+	queued, err := s.userManager.QueueSenderKey(msg)
+	if err != nil {
+		origin.SendError(err.Error())
+		return
+	}
+	s.sendToUser(queued.Recipient, queued)
+}
+
+// NotifySenderKeyRotation сообщает участникам общего чата (room == "") или
+// комнаты о новой эпохе состава: прежние ключи отправителей больше не
+// принимаются, и перед следующим сообщением каждый раздает новый ключ
+func (s *WebSocketServer) NotifySenderKeyRotation(room string) {
+	groupType := common.MsgGeneral
+	if room != "" {
+		groupType = common.MsgRoomMessage
+	}
+	conversation := common.ConversationID(groupType, "", "", room)
+	msg := common.Message{
+		Type:         common.MsgSenderKeyRotate,
+		Conversation: conversation,
+		Room:         room,
+		Epoch:        s.userManager.GroupEpoch(conversation),
+		Timestamp:    s.clock.Now(),
+	}
+	if room == "" {
+		s.broadcastToAll(msg)
+		return
+	}
+	s.sendToRoom(room, msg, "")
+}
+
+// notifyKeyChange предупреждает тех, кто переписывался с пользователем,
+// что ключ сменился и номер безопасности нужно сверить заново
+func (s *WebSocketServer) notifyKeyChange(username string) {
+	publicKey, signingKey := s.userManager.IdentityKeys(username)
+	for _, watcher := range s.userManager.KeyChangeWatchers(username) {
+		s.sendToUser(watcher, common.Message{
+			Type:       common.MsgKeyChange,
+			Username:   username,
+			Recipient:  watcher,
+			PublicKey:  publicKey,
+			SigningKey: signingKey,
+			Content:    "Ключ шифрования собеседника изменился",
+			Timestamp:  s.clock.Now(),
+		})
+	}
+}
+
+// FetchPrekeyBundle выдает requester набор предключей пользователя и, если
+// пул одноразовых предключей истощается, уведомляет владельца
+func (s *WebSocketServer) FetchPrekeyBundle(requester, username string) (common.PrekeyBundle, error) {
+	bundle, remaining, err := s.userManager.TakePrekeyBundle(requester, username)
+	if err != nil {
+		return bundle, err
+	}
+	s.notifyPrekeysLow(username, remaining)
+	return bundle, nil
+}
+
+func (s *WebSocketServer) notifyPrekeysLow(username string, remaining int) {
+	if remaining >= PrekeyLowWaterMark {
+		return
+	}
+
+	s.sendToUser(username, common.Message{
+		Type:      common.MsgPrekeyLow,
+		Recipient: username,
+		Content:   "Пул одноразовых предключей заканчивается",
+		Count:     remaining,
+		Timestamp: s.clock.Now(),
+	})
+}
+
+func (s *WebSocketServer) sendWelcomeMessage(client *Client) {
 	welcomeMsg := common.Message{
 		Type:    common.MsgSuccess,
 		Content: "Добро пожаловать в Secure Messenger!",
 	}
-	conn.WriteJSON(welcomeMsg)
+	client.SendJSON(welcomeMsg)
 }
 
 func (s *WebSocketServer) broadcastUserJoined(username string) {
@@ -185,7 +748,7 @@ func (s *WebSocketServer) broadcastUserJoined(username string) {
 		Type:      common.MsgUserJoined,
 		Sender:    username,
 		Content:   "присоединился(ась) к чату",
-		Timestamp: time.Now(),
+		Timestamp: s.clock.Now(),
 	}
 
 	s.broadcastToAll(msg)
@@ -196,57 +759,61 @@ func (s *WebSocketServer) broadcastUserLeft(username string) {
 		Type:      common.MsgUserLeft,
 		Sender:    username,
 		Content:   "покинул(а) чат",
-		Timestamp: time.Now(),
+		Timestamp: s.clock.Now(),
 	}
 
 	s.broadcastToAll(msg)
 }
 
 func (s *WebSocketServer) broadcastToAll(msg common.Message) {
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Println("JSON marshal error:", err)
-		return
-	}
-
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	for _, conn := range s.clients {
-		conn.WriteMessage(websocket.TextMessage, data)
-	}
+	s.broadcastToAllExcept(msg, nil)
 }
 
-func (s *WebSocketServer) broadcastToAllExcept(msg common.Message, except string) {
+// broadcastToAllExcept рассылает сообщение всем устройствам, кроме except
+func (s *WebSocketServer) broadcastToAllExcept(msg common.Message, except *Client) {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		log.Println("JSON marshal error:", err)
 		return
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	for username, conn := range s.clients {
-		if username != except {
-			conn.WriteMessage(websocket.TextMessage, data)
+	for _, client := range s.snapshotAllClients() {
+		if client != except {
+			client.Send(data)
 		}
 	}
 }
 
+// sendToUser отправляет сообщение на все устройства пользователя
 func (s *WebSocketServer) sendToUser(recipient string, msg common.Message) {
+	s.sendToUserExcept(recipient, msg, nil)
+}
+
+func (s *WebSocketServer) sendToUserExcept(recipient string, msg common.Message, except *Client) {
+	clients := s.snapshotClients(recipient)
+	if len(clients) == 0 {
+		return
+	}
+
 	data, err := json.Marshal(msg)
 	if err != nil {
 		log.Println("JSON marshal error:", err)
 		return
 	}
 
-	s.mu.RLock()
-	conn, exists := s.clients[recipient]
-	s.mu.RUnlock()
+	for _, client := range clients {
+		if client != except {
+			client.Send(data)
+		}
+	}
+}
 
-	if exists && conn != nil {
-		conn.WriteMessage(websocket.TextMessage, data)
+// DisconnectSession закрывает все соединения, открытые с указанной сессией
+func (s *WebSocketServer) DisconnectSession(token string) {
+	for _, client := range s.snapshotAllClients() {
+		if client.sessionToken == token {
+			client.Close()
+		}
 	}
 }
 
@@ -258,32 +825,84 @@ func (s *WebSocketServer) sendUserListToAll() {
 		Users: users,
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Println("JSON marshal error:", err)
-		return
+	s.broadcastToAll(msg)
+}
+
+// snapshotClients копирует список устройств пользователя, чтобы не держать
+// блокировку во время постановки сообщений в очереди (Send может закрыть
+// клиента). Для пустого имени возвращает nil: рассылка всем идет только
+// через snapshotAllClients.
+func (s *WebSocketServer) snapshotClients(username string) []*Client {
+	if username == "" {
+		return nil
 	}
 
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for _, conn := range s.clients {
-		conn.WriteMessage(websocket.TextMessage, data)
+	clients := make([]*Client, 0, len(s.clients[username]))
+	for client := range s.clients[username] {
+		clients = append(clients, client)
 	}
+	return clients
 }
 
-func (s *WebSocketServer) sendHistoryToUser(username string, conn *websocket.Conn) {
-	history := s.userManager.GetUserHistory(username)
+// snapshotAllClients копирует список всех подключенных устройств
+func (s *WebSocketServer) snapshotAllClients() []*Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var clients []*Client
+	for _, devices := range s.clients {
+		for client := range devices {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// sendHistoryToUser отправляет устройству историю после курсоров (целиком,
+// если курсоров нет) и завершает ее сообщением sync_done с новыми курсорами
+func (s *WebSocketServer) sendHistoryToUser(client *Client, cursors map[string]uint64) {
+	history := s.userManager.GetUserHistorySince(client.username, cursors)
+
+	latest := make(map[string]uint64, len(cursors))
+	for conversation, seq := range cursors {
+		latest[conversation] = seq
+	}
 
 	for _, msg := range history {
-		historyMsg := common.Message{
-			Type:      common.MsgHistory,
-			Sender:    msg.Sender,
-			Recipient: msg.Recipient,
-			Content:   msg.Content,
-			Timestamp: msg.Timestamp,
+		historyMsg := msg.Message()
+		// События над сообщениями (правки, удаления) уходят под своим типом,
+		// чтобы клиент применил их к уже показанным сообщениям
+		if msg.Target == "" {
+			historyMsg.Type = common.MsgHistory
+		}
+		if !client.SendJSONWait(historyMsg) {
+			return
+		}
+		if msg.Seq > latest[msg.Conversation] {
+			latest[msg.Conversation] = msg.Seq
+		}
+	}
+
+	client.SendJSONWait(common.Message{
+		Type:      common.MsgSyncDone,
+		Count:     len(history),
+		Cursors:   latest,
+		Timers:    s.userManager.ExpiryTimers(client.username),
+		Epochs:    s.userManager.GroupEpochs(client.username),
+		Timestamp: s.clock.Now(),
+	})
+}
+
+// flushMailbox досылает устройству неподтвержденные личные сообщения
+// в порядке их поступления
+func (s *WebSocketServer) flushMailbox(client *Client) {
+	for _, msg := range s.userManager.PendingMessages(client.username) {
+		if !client.SendJSONWait(msg) {
+			return
 		}
-		conn.WriteJSON(historyMsg)
 	}
 }
 
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"secure-messenger/internal/common"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeClock управляемые часы: время идет только в Advance
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	clock  *fakeClock
+	ch     chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, ch: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance переводит часы и срабатывает наступившие тики; как и у
+// time.Ticker, пропущенные тики не копятся
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.next.After(c.now) {
+			select {
+			case t.ch <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+func (c *fakeClock) tickerCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tickers)
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+// heartbeatClient подключает alice к серверу с управляемыми часами и
+// возвращает соединение, канал входящих ping и закрывающийся при обрыве канал
+func heartbeatClient(t *testing.T, answerPings bool) (*WebSocketServer, *fakeClock, *websocket.Conn, chan struct{}, <-chan struct{}) {
+	t.Helper()
+	s, ts := newTestServer(t, "alice")
+	clk := newFakeClock()
+	s.clock = clk
+	if err := s.SetHeartbeat(30*time.Second, 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialUser(t, s, ts, "alice")
+	pings := make(chan struct{}, 16)
+	conn.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		if !answerPings {
+			return nil
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	closed := drain(conn)
+	waitFor(t, "запуск writePump", func() bool { return clk.tickerCount() == 1 })
+	return s, clk, conn, pings, closed
+}
+
+func expectPing(t *testing.T, pings <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Fatal("ping не пришел")
+	}
+}
+
+func expectNoPing(t *testing.T, pings <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-pings:
+		t.Fatal("лишний ping")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestHeartbeatPingsOnTick(t *testing.T) {
+	_, clk, _, pings, _ := heartbeatClient(t, true)
+
+	clk.Advance(29 * time.Second)
+	expectNoPing(t, pings)
+	clk.Advance(time.Second)
+	expectPing(t, pings)
+	clk.Advance(30 * time.Second)
+	expectPing(t, pings)
+}
+
+func TestHeartbeatKeepsAnsweringClient(t *testing.T) {
+	s, clk, _, pings, closed := heartbeatClient(t, true)
+	client := s.snapshotClients("alice")[0]
+
+	for i := 0; i < 6; i++ {
+		clk.Advance(30 * time.Second)
+		expectPing(t, pings)
+		// pong отмечается по часам сервера
+		waitFor(t, "обработка pong", func() bool { return client.idle() == 0 })
+	}
+	select {
+	case <-closed:
+		t.Fatal("отвечающий клиент отключен")
+	default:
+	}
+}
+
+func TestHeartbeatDropsSilentClient(t *testing.T) {
+	s, clk, _, pings, closed := heartbeatClient(t, false)
+
+	// Без pong: 30 и 60 секунд тишины еще допустимы
+	for i := 0; i < 2; i++ {
+		clk.Advance(30 * time.Second)
+		expectPing(t, pings)
+	}
+	select {
+	case <-closed:
+		t.Fatal("клиент отключен раньше pongWait")
+	default:
+	}
+
+	clk.Advance(30 * time.Second)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("молчащий клиент не отключен")
+	}
+	waitFor(t, "снятие регистрации", func() bool { return len(s.snapshotClients("alice")) == 0 })
+}
+
+func TestHeartbeatMessagesCountAsActivity(t *testing.T) {
+	s, clk, conn, pings, closed := heartbeatClient(t, false)
+	client := s.snapshotClients("alice")[0]
+
+	for i := 0; i < 4; i++ {
+		clk.Advance(30 * time.Second)
+		expectPing(t, pings)
+		// Любое сообщение клиента продлевает соединение, как и pong
+		if err := conn.WriteJSON(map[string]string{"type": "typing"}); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "обработка сообщения", func() bool { return client.idle() == 0 })
+	}
+	select {
+	case <-closed:
+		t.Fatal("активный клиент отключен")
+	default:
+	}
+}
+
+func TestSendToEmptyUsernameDoesNotBroadcast(t *testing.T) {
+	s := NewWebSocketServer(newTestUserManager(t, "alice", "bob"))
+	// Клиенты без соединения: Send только ставит сообщение в очередь
+	clients := map[string]*Client{}
+	for _, username := range []string{"alice", "bob"} {
+		client := newClient(nil, username, "token-"+username, systemClock{}, time.Hour, 2*time.Hour)
+		s.clients[username] = map[*Client]bool{client: true}
+		clients[username] = client
+	}
+	queued := func(username string) int { return len(clients[username].send) }
+
+	if got := s.snapshotClients(""); got != nil {
+		t.Fatalf("snapshotClients(\"\") = %d клиентов, ожидался nil", len(got))
+	}
+	s.sendToUser("", common.Message{Type: common.MsgTyping})
+	s.sendToUserExcept("", common.Message{Type: common.MsgTyping}, nil)
+	if queued("alice") != 0 || queued("bob") != 0 {
+		t.Fatalf("пустой получатель разослан всем: alice %d, bob %d", queued("alice"), queued("bob"))
+	}
+
+	s.sendToUser("alice", common.Message{Type: common.MsgTyping})
+	if queued("alice") != 1 || queued("bob") != 0 {
+		t.Fatalf("sendToUser(alice): alice %d, bob %d", queued("alice"), queued("bob"))
+	}
+
+	s.broadcastToAllExcept(common.Message{Type: common.MsgTyping}, clients["alice"])
+	if queued("alice") != 1 || queued("bob") != 1 {
+		t.Fatalf("broadcastToAllExcept: alice %d, bob %d", queued("alice"), queued("bob"))
+	}
+}
+
+// Номера растут в каждом диалоге отдельно; подтверждение возвращает
+// отправителю ID и номер, а синхронизация по курсорам - только новое
+func TestSequenceAckAndCursorSync(t *testing.T) {
+	s, ts := newTestServer(t, "alice", "bob", "carol")
+	alice := dialUser(t, s, ts, "alice")
+	readUntil(t, alice, common.MsgSyncDone)
+
+	dm := common.ConversationID(common.MsgPrivate, "alice", "bob", "")
+	send := []struct {
+		msg          common.Message
+		conversation string
+		seq          uint64
+	}{
+		{common.Message{Type: common.MsgPrivate, Recipient: "bob", ClientID: "c1"}, dm, 1},
+		{common.Message{Type: common.MsgPrivate, Recipient: "carol", ClientID: "c2"}, "dm:alice:carol", 1},
+		{common.Message{Type: common.MsgGeneral, ClientID: "c3"}, "general", 1},
+		{common.Message{Type: common.MsgPrivate, Recipient: "bob", ClientID: "c4"}, dm, 2},
+		{common.Message{Type: common.MsgPrivate, Recipient: "bob", ClientID: "c5"}, dm, 3},
+	}
+	ids := make(map[string]bool)
+	for _, tt := range send {
+		tt.msg.Content = tt.msg.ClientID
+		if err := alice.WriteJSON(tt.msg); err != nil {
+			t.Fatal(err)
+		}
+		ack, _ := readUntil(t, alice, common.MsgAck)
+		if ack.ClientID != tt.msg.ClientID || ack.Conversation != tt.conversation || ack.Seq != tt.seq || ack.ID == "" || ids[ack.ID] {
+			t.Fatalf("подтверждение %s: %+v", tt.msg.ClientID, ack)
+		}
+		ids[ack.ID] = true
+	}
+
+	// Диалог с курсором выдается после курсора, без курсора - целиком
+	if err := alice.WriteJSON(common.Message{Type: common.MsgSync, Cursors: map[string]uint64{dm: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	done, history := readUntil(t, alice, common.MsgSyncDone)
+	got := make(map[string]bool)
+	for _, msg := range history {
+		if msg.Type != common.MsgHistory {
+			continue
+		}
+		if msg.ClientID != "" {
+			t.Fatalf("ClientID ушел в историю: %+v", msg)
+		}
+		got[msg.Content] = true
+	}
+	if len(got) != 3 || !got["c2"] || !got["c3"] || !got["c5"] || done.Count != 3 {
+		t.Fatalf("синхронизация после курсора: %v, count %d", got, done.Count)
+	}
+	want := map[string]uint64{dm: 3, "dm:alice:carol": 1, "general": 1}
+	for conversation, seq := range want {
+		if done.Cursors[conversation] != seq {
+			t.Fatalf("курсоры: %v", done.Cursors)
+		}
+	}
+
+	// С новыми курсорами досылать нечего
+	if err := alice.WriteJSON(common.Message{Type: common.MsgSync, Cursors: done.Cursors}); err != nil {
+		t.Fatal(err)
+	}
+	if done, _ = readUntil(t, alice, common.MsgSyncDone); done.Count != 0 {
+		t.Fatalf("повторная синхронизация: %d сообщений", done.Count)
+	}
+
+	// Номера переживают перезапуск
+	restarted, err := NewUserManagerWithStore(s.userManager.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := restarted.AddMessage(common.Message{Type: common.MsgPrivate, Sender: "bob", Recipient: "alice", Content: "ответ"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Conversation != dm || msg.Seq != 4 {
+		t.Fatalf("после перезапуска: %s #%d", msg.Conversation, msg.Seq)
+	}
+}
@@ -0,0 +1,319 @@
+// Argon2id (RFC 9106, версия 0x13) для ключа резервной копии ключей.
+// WebCrypto не умеет Argon2, поэтому он реализован здесь. Файл запускается
+// как Web Worker, чтобы вычисление не блокировало интерфейс:
+//
+//   worker.postMessage({ password, salt, time, memory, threads, length })
+//   -> { key } или { error }
+//
+// password и salt - Uint8Array, memory - в КиБ. Результат совпадает
+// с argon2.IDKey из golang.org/x/crypto.
+
+const ARGON2_VERSION = 0x13;
+const ARGON2_ID = 2;
+const SYNC_POINTS = 4;
+// Блок 1 КиБ = 128 слов по 64 бита = 256 слов по 32 бита (младшее, старшее)
+const BLOCK_WORDS = 256;
+
+// BLAKE2b на BigInt: используется только для H0, H' и итогового хэша,
+// поэтому скорость здесь не важна
+const B2B_MASK = (1n << 64n) - 1n;
+const B2B_IV = [
+    0x6a09e667f3bcc908n, 0xbb67ae8584caa73bn, 0x3c6ef372fe94f82bn, 0xa54ff53a5f1d36f1n,
+    0x510e527fade682d1n, 0x9b05688c2b3e6c1fn, 0x1f83d9abfb41bd6bn, 0x5be0cd19137e2179n
+];
+const B2B_SIGMA = [
+    [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15],
+    [14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3],
+    [11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4],
+    [7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8],
+    [9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13],
+    [2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9],
+    [12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11],
+    [13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10],
+    [6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5],
+    [10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0],
+    [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15],
+    [14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3]
+];
+
+function b2bRotr(x, n) {
+    return ((x >> n) | (x << (64n - n))) & B2B_MASK;
+}
+
+function b2bCompress(h, block, t, last) {
+    const m = [];
+    for (let i = 0; i < 16; i++) {
+        let w = 0n;
+        for (let j = 7; j >= 0; j--) {
+            w = (w << 8n) | BigInt(block[i * 8 + j]);
+        }
+        m.push(w);
+    }
+    const v = h.concat(B2B_IV);
+    v[12] ^= t;
+    if (last) v[14] ^= B2B_MASK;
+
+    const g = (a, b, c, d, x, y) => {
+        v[a] = (v[a] + v[b] + x) & B2B_MASK;
+        v[d] = b2bRotr(v[d] ^ v[a], 32n);
+        v[c] = (v[c] + v[d]) & B2B_MASK;
+        v[b] = b2bRotr(v[b] ^ v[c], 24n);
+        v[a] = (v[a] + v[b] + y) & B2B_MASK;
+        v[d] = b2bRotr(v[d] ^ v[a], 16n);
+        v[c] = (v[c] + v[d]) & B2B_MASK;
+        v[b] = b2bRotr(v[b] ^ v[c], 63n);
+    };
+    for (const s of B2B_SIGMA) {
+        g(0, 4, 8, 12, m[s[0]], m[s[1]]);
+        g(1, 5, 9, 13, m[s[2]], m[s[3]]);
+        g(2, 6, 10, 14, m[s[4]], m[s[5]]);
+        g(3, 7, 11, 15, m[s[6]], m[s[7]]);
+        g(0, 5, 10, 15, m[s[8]], m[s[9]]);
+        g(1, 6, 11, 12, m[s[10]], m[s[11]]);
+        g(2, 7, 8, 13, m[s[12]], m[s[13]]);
+        g(3, 4, 9, 14, m[s[14]], m[s[15]]);
+    }
+    for (let i = 0; i < 8; i++) {
+        h[i] ^= v[i] ^ v[i + 8];
+    }
+}
+
+function blake2b(input, outLen) {
+    const h = B2B_IV.slice();
+    h[0] ^= 0x01010000n ^ BigInt(outLen);
+
+    const blocks = Math.max(1, Math.ceil(input.length / 128));
+    for (let i = 0; i < blocks; i++) {
+        const block = new Uint8Array(128);
+        const chunk = input.subarray(i * 128, (i + 1) * 128);
+        block.set(chunk);
+        b2bCompress(h, block, BigInt(i * 128 + chunk.length), i === blocks - 1);
+    }
+
+    const out = new Uint8Array(outLen);
+    for (let i = 0; i < outLen; i++) {
+        out[i] = Number((h[i >> 3] >> BigInt(8 * (i & 7))) & 0xffn);
+    }
+    return out;
+}
+
+function le32(n) {
+    const out = new Uint8Array(4);
+    new DataView(out.buffer).setUint32(0, n, true);
+    return out;
+}
+
+function concatBytes(...parts) {
+    const out = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+    let offset = 0;
+    for (const p of parts) {
+        out.set(p, offset);
+        offset += p.length;
+    }
+    return out;
+}
+
+// blake2bLong хэш переменной длины H' из спецификации Argon2
+function blake2bLong(input, outLen) {
+    const data = concatBytes(le32(outLen), input);
+    if (outLen <= 64) {
+        return blake2b(data, outLen);
+    }
+    const out = new Uint8Array(outLen);
+    let v = blake2b(data, 64);
+    out.set(v.subarray(0, 32));
+    let offset = 32;
+    while (outLen - offset > 64) {
+        v = blake2b(v, 64);
+        out.set(v.subarray(0, 32), offset);
+        offset += 32;
+    }
+    out.set(blake2b(v, outLen - offset), offset);
+    return out;
+}
+
+// mulHi32 старшие 32 бита произведения двух 32-битных чисел
+function mulHi32(a, b) {
+    const al = a & 0xffff, ah = a >>> 16, bl = b & 0xffff, bh = b >>> 16;
+    const mid = al * bh + ah * bl + ((al * bl) >>> 16);
+    return (ah * bh + (mid / 65536 | 0)) >>> 0;
+}
+
+// fBlaMka: v[a] = v[a] + v[b] + 2 * lo(v[a]) * lo(v[b]) по модулю 2^64.
+// Индексы указывают на младшие половины 64-битных слов.
+function fBlaMka(v, a, b) {
+    const x = v[a], y = v[b];
+    const pLo = Math.imul(x, y) >>> 0;
+    const pHi = mulHi32(x, y);
+    const lo = x + y + ((pLo << 1) >>> 0);
+    v[a] = lo;
+    v[a + 1] = v[a + 1] + v[b + 1] + ((pHi << 1) | (pLo >>> 31)) + (lo / 4294967296 | 0);
+}
+
+// G_INDEX четверки индексов (младших половин слов) для функции G: восемь
+// раундов BLAKE2 по строкам матрицы 8x8 блока, затем восемь по столбцам
+const G_INDEX = (() => {
+    const rounds = [];
+    for (let i = 0; i < 8; i++) {
+        rounds.push(Array.from({ length: 16 }, (_, j) => 16 * i + j));
+    }
+    for (let i = 0; i < 8; i++) {
+        rounds.push(Array.from({ length: 16 }, (_, j) => 2 * i + 16 * (j >> 1) + (j & 1)));
+    }
+    const order = [[0, 4, 8, 12], [1, 5, 9, 13], [2, 6, 10, 14], [3, 7, 11, 15],
+        [0, 5, 10, 15], [1, 6, 11, 12], [2, 7, 8, 13], [3, 4, 9, 14]];
+    const index = [];
+    for (const w of rounds) {
+        for (const g of order) {
+            for (const k of g) index.push(2 * w[k]);
+        }
+    }
+    return Int32Array.from(index);
+})();
+
+// compressBlock функция сжатия G: out = (или ^=) R ^ P(R), R = x ^ y.
+// Блоки задаются смещениями в общих массивах.
+function compressBlock(out, outOff, x, xOff, y, yOff, xor, r, v) {
+    for (let i = 0; i < BLOCK_WORDS; i++) {
+        r[i] = x[xOff + i] ^ y[yOff + i];
+    }
+    v.set(r);
+    for (let k = 0; k < G_INDEX.length; k += 4) {
+        const a = G_INDEX[k], b = G_INDEX[k + 1], c = G_INDEX[k + 2], d = G_INDEX[k + 3];
+        let lo, hi;
+        fBlaMka(v, a, b);
+        lo = v[d] ^ v[a]; hi = v[d + 1] ^ v[a + 1];
+        v[d] = hi; v[d + 1] = lo;
+        fBlaMka(v, c, d);
+        lo = v[b] ^ v[c]; hi = v[b + 1] ^ v[c + 1];
+        v[b] = (lo >>> 24) | (hi << 8); v[b + 1] = (hi >>> 24) | (lo << 8);
+        fBlaMka(v, a, b);
+        lo = v[d] ^ v[a]; hi = v[d + 1] ^ v[a + 1];
+        v[d] = (lo >>> 16) | (hi << 16); v[d + 1] = (hi >>> 16) | (lo << 16);
+        fBlaMka(v, c, d);
+        lo = v[b] ^ v[c]; hi = v[b + 1] ^ v[c + 1];
+        v[b] = (lo << 1) | (hi >>> 31); v[b + 1] = (hi << 1) | (lo >>> 31);
+    }
+    if (xor) {
+        for (let i = 0; i < BLOCK_WORDS; i++) out[outOff + i] ^= r[i] ^ v[i];
+    } else {
+        for (let i = 0; i < BLOCK_WORDS; i++) out[outOff + i] = r[i] ^ v[i];
+    }
+}
+
+function argon2id(password, salt, { time, memory, threads, length }) {
+    if (time < 1 || threads < 1) {
+        throw new Error('argon2: недопустимые параметры');
+    }
+    const h0 = blake2b(concatBytes(
+        le32(threads), le32(length), le32(memory), le32(time),
+        le32(ARGON2_VERSION), le32(ARGON2_ID),
+        le32(password.length), password, le32(salt.length), salt,
+        le32(0), le32(0)
+    ), 64);
+
+    memory = Math.floor(memory / (SYNC_POINTS * threads)) * (SYNC_POINTS * threads);
+    if (memory < 2 * SYNC_POINTS * threads) {
+        memory = 2 * SYNC_POINTS * threads;
+    }
+    const lanes = memory / threads;
+    const segments = lanes / SYNC_POINTS;
+    const B = new Uint32Array(memory * BLOCK_WORDS);
+
+    const loadBlock = (index, bytes) => {
+        const view = new DataView(bytes.buffer, bytes.byteOffset, bytes.byteLength);
+        for (let i = 0; i < BLOCK_WORDS; i++) {
+            B[index * BLOCK_WORDS + i] = view.getUint32(4 * i, true);
+        }
+    };
+    for (let lane = 0; lane < threads; lane++) {
+        loadBlock(lane * lanes, blake2bLong(concatBytes(h0, le32(0), le32(lane)), 1024));
+        loadBlock(lane * lanes + 1, blake2bLong(concatBytes(h0, le32(1), le32(lane)), 1024));
+    }
+
+    const r = new Uint32Array(BLOCK_WORDS);
+    const t = new Uint32Array(BLOCK_WORDS);
+    const zero = new Uint32Array(BLOCK_WORDS);
+    const input = new Uint32Array(BLOCK_WORDS);
+    const addresses = new Uint32Array(BLOCK_WORDS);
+
+    const nextAddresses = () => {
+        input[12]++;
+        compressBlock(addresses, 0, input, 0, zero, 0, false, r, t);
+        compressBlock(addresses, 0, addresses, 0, zero, 0, false, r, t);
+    };
+
+    // Потоки (lanes) обрабатываются по очереди: результат от этого не меняется
+    for (let n = 0; n < time; n++) {
+        for (let slice = 0; slice < SYNC_POINTS; slice++) {
+            for (let lane = 0; lane < threads; lane++) {
+                const independent = n === 0 && slice < SYNC_POINTS / 2;
+                input.fill(0);
+                if (independent) {
+                    input[0] = n; input[2] = lane; input[4] = slice;
+                    input[6] = memory; input[8] = time; input[10] = ARGON2_ID;
+                }
+                let index = 0;
+                if (n === 0 && slice === 0) {
+                    index = 2;
+                    if (independent) nextAddresses();
+                }
+
+                let offset = lane * lanes + slice * segments + index;
+                for (; index < segments; index++, offset++) {
+                    let prev = offset - 1;
+                    if (index === 0 && slice === 0) prev += lanes;
+
+                    let randLo, randHi;
+                    if (independent) {
+                        if (index % 128 === 0) nextAddresses();
+                        randLo = addresses[2 * (index % 128)];
+                        randHi = addresses[2 * (index % 128) + 1];
+                    } else {
+                        randLo = B[prev * BLOCK_WORDS];
+                        randHi = B[prev * BLOCK_WORDS + 1];
+                    }
+
+                    // indexAlpha: выбор опорного блока
+                    let refLane = randHi % threads;
+                    if (n === 0 && slice === 0) refLane = lane;
+                    let m = 3 * segments;
+                    let s = ((slice + 1) % SYNC_POINTS) * segments;
+                    if (lane === refLane) m += index;
+                    if (n === 0) {
+                        m = slice * segments;
+                        s = 0;
+                        if (slice === 0 || lane === refLane) m += index;
+                    }
+                    if (index === 0 || lane === refLane) m--;
+                    const p = mulHi32(mulHi32(randLo, randLo), m);
+                    const ref = refLane * lanes + (s + m - (p + 1)) % lanes;
+
+                    compressBlock(B, offset * BLOCK_WORDS, B, prev * BLOCK_WORDS,
+                        B, ref * BLOCK_WORDS, true, r, t);
+                }
+            }
+        }
+    }
+
+    const last = B.slice((memory - 1) * BLOCK_WORDS, memory * BLOCK_WORDS);
+    for (let lane = 0; lane < threads - 1; lane++) {
+        const off = (lane * lanes + lanes - 1) * BLOCK_WORDS;
+        for (let i = 0; i < BLOCK_WORDS; i++) last[i] ^= B[off + i];
+    }
+    const bytes = new Uint8Array(1024);
+    const view = new DataView(bytes.buffer);
+    for (let i = 0; i < BLOCK_WORDS; i++) view.setUint32(4 * i, last[i], true);
+    return blake2bLong(bytes, length);
+}
+
+if (typeof WorkerGlobalScope !== 'undefined' && self instanceof WorkerGlobalScope) {
+    self.onmessage = (event) => {
+        const { password, salt, time, memory, threads, length } = event.data;
+        try {
+            self.postMessage({ key: argon2id(password, salt, { time, memory, threads, length }) });
+        } catch (error) {
+            self.postMessage({ error: error.message });
+        }
+    };
+}
@@ -10,6 +10,63 @@ class SecureMessenger {
         this.typingTimeout = null;
         this.reconnectAttempts = 0;
         this.maxReconnectAttempts = 5;
+        this.heartbeatInterval = null;
+        this.lastPong = 0;
+        this.pingIntervalMs = 25000;
+        this.pongTimeoutMs = 60000;
+        this.keyPair = null;
+        this.publicKey = '';
+        this.signingKey = null;
+        this.signingPublicKey = '';
+        this.conversationKeys = new Map();
+        this.seenMessageIds = new Set();
+        this.readReceipts = true;
+        this.unreadMessages = new Map();
+        this.cursors = {};
+        this.historyPageSize = 100;
+        this.oldestMessageId = '';
+        this.reactions = new Map();
+        this.quickReactions = ['👍', '❤️', '😂', '😮', '😢', '🎉'];
+        this.openThreadRoot = null;
+        this.threadOldestId = '';
+        this.unreadMentionCount = 0;
+        this.attachmentKeys = new Map();
+        this.expiryTimers = {};
+        this.knownKeys = {};
+        this.verifiedKeys = {};
+        // Ключи отправителей групп: собственные цепочки по диалогам и
+        // начальные состояния чужих цепочек "<отправитель>|<key_id>"
+        this.senderKeys = { own: {}, chains: {} };
+        this.chainCache = new Map();
+        this.awaitingSenderKeys = new Map();
+        this.pendingGroupSends = new Map();
+        this.groupEpochs = {};
+        // Участники комнат, где состоит пользователь: ключ отправителя
+        // комнаты раздается только им
+        this.roomMembers = {};
+        this.senderKeyQueue = Promise.resolve();
+        this.maxSenderKeySkip = 2000;
+        // Каталог предключей X3DH: закрытые части подписанного и одноразовых
+        // предключей; сервер хранит только публичные
+        this.prekeys = null;
+        this.prekeyQueue = Promise.resolve();
+        this.prekeyPoolSize = 50;
+        this.maxStoredPrekeys = 100;
+        // Резервная копия ключей: записи localStorage "<имя>_<пользователь>"
+        // и параметры Argon2id для ключа из фразы восстановления
+        this.backupItems = ['e2e_private_key', 'e2e_public_key', 'e2e_signing_key',
+            'e2e_signing_public', 'sender_keys', 'known_keys', 'verified_keys', 'prekeys'];
+        this.backupKdf = { algorithm: 'argon2id', time: 3, memory: 64 * 1024, threads: 1 };
+        this.minPassphraseLength = 12;
+        this.backupMode = 'create';
+        this.expiryOptions = [
+            { seconds: 0, label: 'выключено' },
+            { seconds: 30, label: '30 секунд' },
+            { seconds: 300, label: '5 минут' },
+            { seconds: 3600, label: '1 час' },
+            { seconds: 86400, label: '1 день' },
+            { seconds: 604800, label: '1 неделя' }
+        ];
         
         this.init();
     }
@@ -23,9 +80,21 @@ class SecureMessenger {
         }
         
         this.loadUI();
+        await this.loadOrCreateKeys();
+        await this.loadOrCreateSigningKey();
+        this.loadSenderKeys();
+        this.loadPrekeys();
+        await this.loadUsers();
+        await this.loadRooms();
+        await this.loadSettings();
+        this.loadVerifications();
+        await this.loadMentions();
         await this.loadMessageHistory();
         this.connectWebSocket();
         this.setupEventListeners();
+        // Исчезающие сообщения удаляются и без уведомления сервера,
+        // например пока нет соединения
+        setInterval(() => this.removeExpiredMessages(), 1000);
     }
     
     async checkAuth() {
@@ -41,9 +110,164 @@ class SecureMessenger {
         return true;
     }
     
-    async loadMessageHistory() {
+    async loadUsers() {
         try {
-            const response = await fetch(`/api/history`, {
+            const response = await fetch('/api/users', {
+                headers: {
+                    'X-Session-Token': this.sessionToken
+                }
+            });
+            
+            if (response.ok) {
+                this.updateUserList(await response.json());
+            }
+        } catch (error) {
+            console.error('Ошибка загрузки пользователей:', error);
+        }
+    }
+    
+    async loadRooms() {
+        try {
+            const response = await fetch('/api/rooms', {
+                headers: {
+                    'X-Session-Token': this.sessionToken
+                }
+            });
+            
+            if (response.ok) {
+                (await response.json()).forEach(info => this.updateRoomMembers(info));
+            }
+        } catch (error) {
+            console.error('Ошибка загрузки комнат:', error);
+        }
+    }
+    
+    async loadSettings() {
+        try {
+            const response = await fetch('/api/settings', {
+                headers: {
+                    'X-Session-Token': this.sessionToken
+                }
+            });
+            
+            if (response.ok) {
+                const settings = await response.json();
+                this.readReceipts = settings.read_receipts;
+            }
+        } catch (error) {
+            console.error('Ошибка загрузки настроек:', error);
+        }
+    }
+    
+    async saveSettings() {
+        const readReceipts = document.getElementById('readReceiptsToggle').checked;
+        
+        try {
+            const response = await fetch('/api/settings', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-Session-Token': this.sessionToken
+                },
+                body: JSON.stringify({ read_receipts: readReceipts })
+            });
+            
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            this.readReceipts = (await response.json()).read_receipts;
+            this.showNotification('Настройки сохранены', 'success');
+        } catch (error) {
+            console.error('Ошибка сохранения настроек:', error);
+            this.showNotification('Ошибка сохранения настроек', 'error');
+        }
+    }
+    
+    // Загружает входящие упоминания; без markRead только обновляет счетчик
+    async loadMentions(markRead = false) {
+        try {
+            const response = await fetch('/api/mentions', {
+                method: markRead ? 'POST' : 'GET',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-Session-Token': this.sessionToken
+                },
+                body: markRead ? JSON.stringify({ ids: [] }) : undefined
+            });
+            
+            if (response.ok) {
+                const page = await response.json();
+                this.updateMentionBadge(page.unread);
+                return page;
+            }
+        } catch (error) {
+            console.error('Ошибка загрузки упоминаний:', error);
+        }
+        return null;
+    }
+    
+    updateMentionBadge(count) {
+        this.unreadMentionCount = count;
+        const badge = document.getElementById('mentionBadge');
+        if (badge) {
+            badge.textContent = count;
+            badge.style.display = count > 0 ? 'inline-block' : 'none';
+        }
+    }
+    
+    // Показывает входящие упоминания и отмечает их прочитанными
+    async showMentions() {
+        const modal = document.getElementById('mentionsModal');
+        const list = document.getElementById('mentionsList');
+        const page = await this.loadMentions(true);
+        if (!page) return;
+        
+        list.replaceChildren();
+        const mentions = (page.mentions || []).reverse();
+        if (mentions.length === 0) {
+            list.innerHTML = '<p style="color: #666; font-size: 14px;">Вас пока никто не упоминал</p>';
+        }
+        for (const mention of mentions) {
+            const msg = await this.decryptIncoming(mention.message);
+            const item = document.createElement('div');
+            item.className = `mention-item${mention.read ? '' : ' unread'}`;
+            
+            const header = document.createElement('div');
+            header.className = 'mention-header';
+            header.textContent = `${msg.sender} · ${new Date(msg.timestamp).toLocaleString()}`;
+            const content = document.createElement('div');
+            content.textContent = msg.deleted ? 'Сообщение удалено' : msg.content;
+            item.append(header, content);
+            item.onclick = () => this.showMentionedMessage(msg);
+            list.appendChild(item);
+        }
+        modal.style.display = 'flex';
+    }
+    
+    // Прокручивает ленту к упоминанию или открывает ветку, где оно было
+    showMentionedMessage(msg) {
+        this.hideModal('mentionsModal');
+        const element = document.querySelector(`#messagesContainer .message[data-id="${CSS.escape(msg.parent_id || msg.id)}"]`);
+        if (!element) {
+            this.showNotification('Сообщение не загружено в ленту', 'info');
+            return;
+        }
+        element.scrollIntoView({ behavior: 'smooth', block: 'center' });
+        if (msg.parent_id) {
+            this.openThread(element.querySelector('.message-bubble'));
+        }
+    }
+    
+    // Загружает страницу истории: самые новые сообщения или, если задан
+    // before, сообщения старше указанного
+    async loadMessageHistory(before = '') {
+        const params = new URLSearchParams({ limit: this.historyPageSize });
+        if (before) {
+            params.set('before', before);
+        }
+        
+        try {
+            const response = await fetch(`/api/history?${params}`, {
                 headers: {
                     'X-Session-Token': this.sessionToken
                 }
@@ -56,8 +280,13 @@ class SecureMessenger {
             }
             
             if (response.ok) {
-                const history = await response.json();
-                this.displayHistory(history);
+                const page = await response.json();
+                const messages = page.messages || [];
+                if (messages.length > 0) {
+                    this.oldestMessageId = messages[0].id;
+                }
+                await this.displayHistory(messages, Boolean(before));
+                this.updateLoadEarlierButton(page.has_more);
             }
         } catch (error) {
             console.error('Ошибка загрузки истории:', error);
@@ -65,7 +294,25 @@ class SecureMessenger {
         this.loadedHistory = true;
     }
     
-    displayHistory(history) {
+    updateLoadEarlierButton(hasMore) {
+        const container = document.getElementById('messagesContainer');
+        let button = document.getElementById('loadEarlierButton');
+        
+        if (!hasMore) {
+            if (button) button.remove();
+            return;
+        }
+        if (!button) {
+            button = document.createElement('button');
+            button.id = 'loadEarlierButton';
+            button.className = 'btn btn-secondary load-earlier';
+            button.innerHTML = '<i class="fas fa-history"></i> Загрузить ранние сообщения';
+            button.onclick = () => this.loadMessageHistory(this.oldestMessageId);
+            container.prepend(button);
+        }
+    }
+    
+    async displayHistory(history, prepend = false) {
         const container = document.getElementById('messagesContainer');
         const loading = document.getElementById('loadingMessages');
         
@@ -75,12 +322,42 @@ class SecureMessenger {
         
         history.sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp));
         
+        history.forEach(msg => this.trackCursor(msg));
+        history = history.filter(msg => this.markSeen(msg));
+        // Ответы показываются только в своей ветке; у корня есть счетчик
+        history = history.filter(msg => !msg.parent_id);
+        // Правки, удаления и реакции применяются к сообщениям после их отображения
+        const events = history.filter(msg => this.isMessageEvent(msg));
+        history = history.filter(msg => !this.isMessageEvent(msg));
         history.forEach(msg => {
+            const receipt = (msg.receipts || {})[this.username];
+            if (msg.type === 'private' && msg.recipient === this.username && !this.isSet(receipt?.read_at)) {
+                this.trackUnread(msg);
+            }
+        });
+        const decrypted = await Promise.all(history.map(msg => this.decryptIncoming(msg)));
+        
+        if (prepend) {
+            // Ранние сообщения вставляются перед первым показанным
+            const anchor = container.querySelector('.message');
+            decrypted.forEach(msg => {
+                container.insertBefore(this.createMessageElement({
+                    ...msg,
+                    isOwn: msg.sender === this.username
+                }), anchor);
+            });
+            return;
+        }
+        
+        decrypted.forEach(msg => {
             this.createAndAppendMessage({
                 ...msg,
                 isOwn: msg.sender === this.username
             }, false);
         });
+        for (const event of events) {
+            await this.applyEvent(event);
+        }
         
         if (history.length > 0) {
             container.scrollTop = container.scrollHeight;
@@ -127,6 +404,10 @@ class SecureMessenger {
                     </div>
                     
                     <div style="padding: 20px; margin-top: auto;">
+                        <button class="btn btn-block btn-secondary" onclick="messenger.showMentions()" style="margin: 10px 0;">
+                            <i class="fas fa-at"></i> Упоминания
+                            <span id="mentionBadge" class="mention-badge" style="display: none;">0</span>
+                        </button>
                         <button class="btn btn-block btn-accent" onclick="messenger.showSettings()" style="margin: 10px 0;">
                             <i class="fas fa-cog"></i> Настройки
                         </button>
@@ -149,14 +430,24 @@ class SecureMessenger {
                                     <span class="encryption-badge">
                                         <i class="fas fa-lock"></i> Зашифровано
                                     </span>
+                                    <span id="verifiedBadge" class="encryption-badge verified-badge" style="display: none;">
+                                        <i class="fas fa-check-circle"></i> Ключ проверен
+                                    </span>
                                 </div>
                             </div>
                         </div>
                         
                         <div class="chat-actions">
+                            <button class="action-btn" id="expiryButton" onclick="messenger.setExpiry()" title="Исчезающие сообщения">
+                                <i class="fas fa-hourglass-half"></i>
+                                <span id="expiryLabel" class="expiry-label"></span>
+                            </button>
                             <button class="action-btn" onclick="messenger.showUserList()" title="Пользователи">
                                 <i class="fas fa-user-friends"></i>
                             </button>
+                            <button class="action-btn" onclick="messenger.showSafetyNumber()" title="Номер безопасности">
+                                <i class="fas fa-user-shield"></i>
+                            </button>
                             <button class="action-btn" onclick="messenger.showEncryptionInfo()" title="Шифрование">
                                 <i class="fas fa-shield-alt"></i>
                             </button>
@@ -187,6 +478,10 @@ class SecureMessenger {
                     
                     <div class="message-input-area">
                         <div class="input-wrapper">
+                            <button class="attach-button" onclick="document.getElementById('fileInput').click()" title="Прикрепить файл">
+                                <i class="fas fa-paperclip"></i>
+                            </button>
+                            <input type="file" id="fileInput" style="display: none;" onchange="messenger.sendFile(this)">
                             <textarea class="message-input" id="messageInput" placeholder="Введите сообщение..." rows="1" disabled></textarea>
                             <button class="send-button" id="sendButton" onclick="messenger.sendMessage()" disabled>
                                 <i class="fas fa-paper-plane"></i>
@@ -208,6 +503,64 @@ class SecureMessenger {
                 </div>
             </div>
             
+            <div id="mentionsModal" class="modal" style="display: none;">
+                <div class="modal-content">
+                    <h3><i class="fas fa-at"></i> Упоминания</h3>
+                    <div id="mentionsList" class="mentions-list"></div>
+                    <div style="text-align: center;">
+                        <button class="btn btn-secondary" onclick="messenger.hideModal('mentionsModal')" style="margin: 5px;">
+                            Закрыть
+                        </button>
+                    </div>
+                </div>
+            </div>
+            
+            <div id="threadModal" class="modal" style="display: none;">
+                <div class="modal-content thread-modal">
+                    <h3><i class="fas fa-comments"></i> Ветка</h3>
+                    <div id="threadRoot" class="thread-root"></div>
+                    <button id="threadLoadEarlier" class="btn btn-secondary load-earlier" style="display: none;"
+                            onclick="messenger.loadThread(messenger.threadOldestId)">
+                        <i class="fas fa-history"></i> Ранние ответы
+                    </button>
+                    <div id="threadMessages" class="thread-messages"></div>
+                    <div class="input-wrapper">
+                        <textarea class="message-input" id="threadInput" placeholder="Ответить в ветке..." rows="1"></textarea>
+                        <button class="send-button" onclick="messenger.sendThreadReply()">
+                            <i class="fas fa-paper-plane"></i>
+                        </button>
+                    </div>
+                    <div style="text-align: center;">
+                        <button class="btn btn-secondary" onclick="messenger.closeThread()" style="margin: 5px;">
+                            Закрыть
+                        </button>
+                    </div>
+                </div>
+            </div>
+            
+            <div id="safetyModal" class="modal" style="display: none;">
+                <div class="modal-content">
+                    <h3><i class="fas fa-user-shield"></i> Номер безопасности</h3>
+                    <p style="color: #666; margin: 10px 0; font-size: 14px;">
+                        Сверьте номер с собеседником лично или по другому каналу.
+                        Если номера совпадают, сервер не подменял ключи.
+                    </p>
+                    <div id="safetyNumber" class="safety-number"></div>
+                    <div id="safetyStatus" class="safety-status"></div>
+                    <div style="text-align: center;">
+                        <button id="verifyButton" class="btn btn-accent" onclick="messenger.verifyContact()" style="margin: 5px;">
+                            <i class="fas fa-check"></i> Отметить как проверенный
+                        </button>
+                        <button id="unverifyButton" class="btn btn-secondary" onclick="messenger.unverifyContact()" style="margin: 5px;">
+                            Снять отметку
+                        </button>
+                        <button class="btn btn-secondary" onclick="messenger.hideModal('safetyModal')" style="margin: 5px;">
+                            Закрыть
+                        </button>
+                    </div>
+                </div>
+            </div>
+            
             <div id="settingsModal" class="modal" style="display: none;">
                 <div class="modal-content">
                     <h3><i class="fas fa-cog"></i> Настройки</h3>
@@ -216,6 +569,13 @@ class SecureMessenger {
                             <label><i class="fas fa-user"></i> Имя пользователя</label>
                             <input type="text" class="form-control" value="${this.username}" readonly>
                         </div>
+                        <div style="margin: 20px 0;">
+                            <h4><i class="fas fa-eye"></i> Приватность</h4>
+                            <label style="display: flex; align-items: center; gap: 8px; margin: 10px 0; font-size: 14px;">
+                                <input type="checkbox" id="readReceiptsToggle" onchange="messenger.saveSettings()">
+                                Сообщать отправителям о прочтении
+                            </label>
+                        </div>
                         <div style="margin: 20px 0;">
                             <h4><i class="fas fa-key"></i> Ключи шифрования</h4>
                             <p style="color: #666; margin: 10px 0; font-size: 14px;">
@@ -224,6 +584,16 @@ class SecureMessenger {
                             <button class="btn btn-block btn-secondary" onclick="messenger.regenerateKeys()">
                                 <i class="fas fa-redo"></i> Сгенерировать новые ключи
                             </button>
+                            <p style="color: #666; margin: 10px 0; font-size: 14px;">
+                                Резервная копия шифруется фразой восстановления в браузере,
+                                сервер не может ее прочитать.
+                            </p>
+                            <button class="btn btn-block btn-secondary" onclick="messenger.showKeyBackup('create')">
+                                <i class="fas fa-cloud-upload-alt"></i> Создать резервную копию
+                            </button>
+                            <button class="btn btn-block btn-secondary" onclick="messenger.showKeyBackup('restore')">
+                                <i class="fas fa-cloud-download-alt"></i> Восстановить из копии
+                            </button>
                         </div>
                     </div>
                     <div style="text-align: center;">
@@ -233,6 +603,33 @@ class SecureMessenger {
                     </div>
                 </div>
             </div>
+            
+            <div id="backupModal" class="modal" style="display: none;">
+                <div class="modal-content">
+                    <h3><i class="fas fa-life-ring"></i> <span id="backupTitle">Резервная копия ключей</span></h3>
+                    <p id="backupHint" style="color: #666; margin: 10px 0; font-size: 14px;"></p>
+                    <div class="form-group" id="backupVersionGroup">
+                        <label><i class="fas fa-history"></i> Версия</label>
+                        <select id="backupVersion" class="form-control"></select>
+                    </div>
+                    <div class="form-group">
+                        <label><i class="fas fa-lock"></i> Фраза восстановления</label>
+                        <input type="password" id="backupPassphrase" class="form-control" autocomplete="off">
+                    </div>
+                    <div class="form-group" id="backupConfirmGroup">
+                        <label><i class="fas fa-lock"></i> Повторите фразу</label>
+                        <input type="password" id="backupPassphraseConfirm" class="form-control" autocomplete="off">
+                    </div>
+                    <div style="text-align: center;">
+                        <button id="backupSubmit" class="btn btn-accent" onclick="messenger.submitKeyBackup()" style="margin: 5px;">
+                            Продолжить
+                        </button>
+                        <button class="btn btn-secondary" onclick="messenger.hideModal('backupModal')" style="margin: 5px;">
+                            Отмена
+                        </button>
+                    </div>
+                </div>
+            </div>
         `;
     }
     
@@ -258,174 +655,1812 @@ class SecureMessenger {
             if (messageInput) messageInput.disabled = false;
             if (sendButton) sendButton.disabled = false;
             
-            // Отправляем сообщение аутентификации
-            const authMsg = {
-                type: 'auth',
-                session_token: this.sessionToken,
-                username: this.username
-            };
+            // Отправляем сообщение аутентификации
+            const authMsg = {
+                type: 'auth',
+                session_token: this.sessionToken,
+                username: this.username,
+                public_key: this.publicKey,
+                signing_key: this.signingPublicKey
+            };
+            // После загрузки истории достаточно догнать пропущенные сообщения
+            if (this.loadedHistory) {
+                authMsg.cursors = this.cursors;
+            }
+            
+            this.socket.send(JSON.stringify(authMsg));
+            this.startHeartbeat();
+        };
+        
+        this.socket.onmessage = (event) => {
+            try {
+                const data = JSON.parse(event.data);
+                this.handleMessage(data);
+            } catch (error) {
+                console.error('Ошибка парсинга:', error);
+            }
+        };
+        
+        this.socket.onclose = (event) => {
+            console.log('❌ WebSocket отключен:', event.code, event.reason);
+            this.stopHeartbeat();
+            this.isConnected = false;
+            this.updateConnectionStatus(false);
+            
+            // ✅ Блокируем поле ввода
+            const messageInput = document.getElementById('messageInput');
+            const sendButton = document.getElementById('sendButton');
+            if (messageInput) messageInput.disabled = true;
+            if (sendButton) sendButton.disabled = true;
+            
+            // ✅ Пробуем переподключиться
+            if (this.reconnectAttempts < this.maxReconnectAttempts) {
+                this.reconnectAttempts++;
+                const delay = Math.min(3000 * this.reconnectAttempts, 15000); // Экспоненциальная задержка
+                
+                console.log(`🔄 Попытка переподключения ${this.reconnectAttempts}/${this.maxReconnectAttempts} через ${delay}мс`);
+                
+                setTimeout(() => {
+                    if (!this.isConnected) {
+                        this.connectWebSocket();
+                    }
+                }, delay);
+            } else {
+                console.error('❌ Максимальное количество попыток переподключения достигнуто');
+                this.showNotification('Не удалось подключиться к серверу', 'error');
+            }
+        };
+        
+        this.socket.onerror = (error) => {
+            console.error('WebSocket ошибка:', error);
+            this.showNotification('Ошибка соединения', 'error');
+        };
+    }
+    
+    // Прикладной heartbeat: сервер отвечает pong на каждый ping.
+    // Если ответов нет дольше pongTimeoutMs, соединение считается мертвым.
+    startHeartbeat() {
+        this.stopHeartbeat();
+        this.lastPong = Date.now();
+        
+        this.heartbeatInterval = setInterval(() => {
+            if (!this.socket || this.socket.readyState !== WebSocket.OPEN) {
+                return;
+            }
+            
+            if (Date.now() - this.lastPong > this.pongTimeoutMs) {
+                console.warn('💔 Нет ответа от сервера, переподключаемся');
+                this.socket.close();
+                return;
+            }
+            
+            this.socket.send(JSON.stringify({ type: 'ping' }));
+        }, this.pingIntervalMs);
+    }
+    
+    stopHeartbeat() {
+        if (this.heartbeatInterval) {
+            clearInterval(this.heartbeatInterval);
+            this.heartbeatInterval = null;
+        }
+    }
+    
+    async handleMessage(data) {
+        this.lastPong = Date.now();
+        
+        console.log('📨 Получено сообщение:', data.type);
+        
+        switch (data.type) {
+            case 'general':
+            case 'private':
+                this.acknowledge(data);
+                this.trackCursor(data);
+                // Недоставленные сообщения могли уже прийти с историей
+                if (!this.markSeen(data)) break;
+                // Собственные сообщения приходят только с других устройств
+                if (data.parent_id) {
+                    this.addThreadReply(await this.decryptIncoming(data));
+                    break;
+                }
+                this.createAndAppendMessage(await this.decryptIncoming(data));
+                break;
+                
+            case 'delivered':
+            case 'read':
+                this.updateMessageStatus(data.id, data.type);
+                break;
+                
+            case 'history':
+                if (data.page) {
+                    await this.displayHistory(data.page.messages || [], Boolean(data.query?.before));
+                    break;
+                }
+                this.trackCursor(data);
+                if (!this.markSeen(data)) return;
+                if (data.parent_id) {
+                    this.addThreadReply(await this.decryptIncoming(data));
+                    break;
+                }
+                this.createAndAppendMessage(await this.decryptIncoming(data), false);
+                break;
+                
+            case 'sync_done':
+                Object.entries(data.cursors || {}).forEach(([conversation, seq]) => {
+                    this.trackCursor({ conversation, seq });
+                });
+                this.expiryTimers = data.timers || {};
+                this.updateExpiryLabel();
+                this.groupEpochs = data.epochs || {};
+                await this.publishPrekeys();
+                break;
+                
+            case 'prekey_low':
+                await this.replenishPrekeys(data.count || 0);
+                break;
+                
+            case 'sender_key':
+                this.socket.send(JSON.stringify({ type: 'delivered', id: data.id }));
+                await this.acceptSenderKey(data);
+                break;
+                
+            case 'sender_key_rotate':
+                await this.rotateSenderKey(data);
+                break;
+                
+            case 'expiry':
+                this.expiryTimers[data.conversation] = data.expires_in || 0;
+                this.updateExpiryLabel();
+                this.showSystemMessage(data.expires_in ?
+                    `${this.escapeHtml(data.sender)} включил(а) исчезающие сообщения: ${this.expiryLabel(data.expires_in)}` :
+                    `${this.escapeHtml(data.sender)} выключил(а) исчезающие сообщения`);
+                break;
+                
+            case 'expired':
+                (data.ids || []).forEach(id => this.removeMessage(id));
+                break;
+                
+            case 'key_change':
+                // Новый ключ подписи нужен для проверки следующих сообщений
+                this.users.filter(u => u.username === data.username).forEach(u => {
+                    u.signing_key = data.signing_key;
+                });
+                this.warnKeyChange(data.username, data.public_key);
+                break;
+                
+            case 'ack':
+                this.confirmSent(data);
+                break;
+                
+            case 'mention':
+                this.updateMentionBadge(data.count);
+                this.showNotification(`${data.sender} упомянул(а) вас`, 'info');
+                break;
+                
+            case 'thread_reply':
+                this.setThreadCount(data.parent_id, data.count);
+                if (this.openThreadRoot?.id !== data.parent_id) {
+                    this.showNotification(`${data.sender} ответил(а) в ветке`, 'info');
+                }
+                break;
+                
+            case 'reaction':
+                this.trackCursor(data);
+                if (!this.markSeen(data)) break;
+                this.updateReactions(data.target, data.reactions || {});
+                break;
+                
+            case 'edit':
+            case 'delete':
+                this.trackCursor(data);
+                if (!this.markSeen(data)) break;
+                await this.applyEdit(data);
+                break;
+                
+            case 'users_list':
+                this.updateUserList(data.users || []);
+                break;
+                
+            case 'room_update':
+            case 'room_invite':
+                if (data.room_info) {
+                    this.updateRoomMembers(data.room_info);
+                }
+                break;
+                
+            case 'user_joined':
+                this.showSystemMessage(`${data.sender} ${data.content}`);
+                break;
+                
+            case 'user_left':
+                this.showSystemMessage(`${data.sender} ${data.content}`);
+                break;
+                
+            case 'typing':
+                this.showTypingIndicator(data.sender);
+                break;
+                
+            case 'ping':
+                this.socket.send(JSON.stringify({ type: 'pong' }));
+                break;
+                
+            case 'pong':
+                break;
+                
+            case 'success':
+                this.showNotification(data.content || 'Успешно', 'success');
+                break;
+                
+            case 'error':
+                if (data.content === 'Authentication failed') {
+                    this.logout();
+                } else {
+                    this.showNotification(data.content || 'Ошибка', 'error');
+                }
+                break;
+        }
+    }
+    
+    // Подтверждаем доставку личного сообщения, чтобы сервер убрал его из очереди
+    // и сообщил отправителю
+    acknowledge(data) {
+        if (data.type === 'private' && data.id && data.recipient === this.username) {
+            this.socket.send(JSON.stringify({ type: 'delivered', id: data.id }));
+            this.trackUnread(data);
+            if (this.currentChat === data.sender && !document.hidden) {
+                this.markChatRead(data.sender);
+            }
+        }
+    }
+    
+    trackUnread(data) {
+        const ids = this.unreadMessages.get(data.sender) || [];
+        if (!ids.includes(data.id)) ids.push(data.id);
+        this.unreadMessages.set(data.sender, ids);
+    }
+    
+    // Квитанции о прочтении не отправляются, если пользователь отключил их в настройках
+    markChatRead(peer) {
+        const ids = this.unreadMessages.get(peer);
+        if (!ids) return;
+        this.unreadMessages.delete(peer);
+        
+        if (!this.readReceipts || !this.isConnected) return;
+        ids.forEach(id => this.socket.send(JSON.stringify({ type: 'read', id })));
+    }
+    
+    updateMessageStatus(id, status) {
+        const element = document.querySelector(`.message-status[data-id="${CSS.escape(id || '')}"]`);
+        if (!element) return;
+        if (status === 'delivered' && element.dataset.status === 'read') return;
+        
+        element.dataset.status = status;
+        element.innerHTML = this.statusIcon(status);
+    }
+    
+    statusIcon(status) {
+        if (status === 'read') {
+            return '<i class="fas fa-check-double" title="Прочитано"></i>';
+        }
+        if (status === 'delivered') {
+            return '<i class="fas fa-check" title="Доставлено"></i>';
+        }
+        return '';
+    }
+    
+    isSet(time) {
+        return Boolean(time) && !time.startsWith('0001-');
+    }
+    
+    isEditEvent(data) {
+        return data.type === 'edit' || data.type === 'delete';
+    }
+    
+    // События над сообщениями, которые хранятся в диалоге со своим seq
+    isMessageEvent(data) {
+        return this.isEditEvent(data) || data.type === 'reaction';
+    }
+    
+    async applyEvent(event) {
+        if (event.type === 'reaction') {
+            this.updateReactions(event.target, event.reactions || {});
+            return;
+        }
+        await this.applyEdit(event);
+    }
+    
+    // Применяет правку или удаление к показанному сообщению
+    async applyEdit(event) {
+        const element = document.querySelector(`.message[data-id="${CSS.escape(event.target || '')}"]`);
+        if (!element) return;
+        
+        if (event.type === 'delete') {
+            this.renderMessageContent(element, '', { deleted: true });
+            return;
+        }
+        const decrypted = await this.decryptIncoming(event);
+        this.renderMessageContent(element, decrypted.content, { edited: true });
+        if (decrypted.signature === 'invalid') {
+            this.showNotification(`Подпись правки от ${event.sender} не сходится`, 'error');
+        }
+    }
+    
+    renderMessageContent(element, content, { edited = false, deleted = false } = {}) {
+        const contentElement = element.querySelector('.message-content');
+        if (!contentElement) return;
+        
+        if (deleted) {
+            element.classList.add('deleted');
+            contentElement.innerHTML = '<i class="fas fa-ban"></i> Сообщение удалено';
+            element.querySelector('.message-actions')?.remove();
+            element.querySelector('.edited-mark')?.remove();
+            return;
+        }
+        contentElement.textContent = content;
+        if (edited && !element.querySelector('.edited-mark')) {
+            element.querySelector('.message-time')?.insertAdjacentHTML('afterbegin', '<span class="edited-mark">изменено</span> ');
+        }
+    }
+    
+    updateReactions(id, reactions) {
+        this.reactions.set(id, reactions);
+        const element = document.querySelector(`.message[data-id="${CSS.escape(id || '')}"]`);
+        if (element) {
+            this.renderReactions(element, id);
+        }
+    }
+    
+    renderReactions(element, id) {
+        const container = element.querySelector('.message-reactions');
+        container.replaceChildren();
+        
+        Object.entries(this.reactions.get(id) || {}).forEach(([emoji, users]) => {
+            const chip = document.createElement('button');
+            chip.className = 'reaction-chip';
+            chip.classList.toggle('mine', users.includes(this.username));
+            chip.title = users.join(', ');
+            chip.textContent = `${emoji} ${users.length}`;
+            chip.onclick = () => this.toggleReaction(chip, emoji);
+            container.appendChild(chip);
+        });
+    }
+    
+    toggleReaction(button, emoji) {
+        const element = button.closest('.message');
+        const id = element.dataset.id;
+        if (!id || !this.isConnected) return;
+        
+        const users = (this.reactions.get(id) || {})[emoji] || [];
+        this.socket.send(JSON.stringify({
+            type: 'reaction',
+            target: id,
+            emoji,
+            remove: users.includes(this.username)
+        }));
+        element.querySelector('.reaction-picker')?.remove();
+    }
+    
+    showReactionPicker(button) {
+        const element = button.closest('.message');
+        const existing = element.querySelector('.reaction-picker');
+        if (existing) {
+            existing.remove();
+            return;
+        }
+        
+        const picker = document.createElement('div');
+        picker.className = 'reaction-picker';
+        this.quickReactions.forEach(emoji => {
+            const option = document.createElement('button');
+            option.textContent = emoji;
+            option.onclick = () => this.toggleReaction(option, emoji);
+            picker.appendChild(option);
+        });
+        element.querySelector('.message-reactions').before(picker);
+    }
+    
+    async editMessage(button) {
+        const element = button.closest('.message');
+        if (!element.dataset.id) {
+            this.showNotification('Сообщение еще не доставлено на сервер', 'error');
+            return;
+        }
+        
+        const current = element.querySelector('.message-content').textContent;
+        const content = prompt('Изменить сообщение:', current)?.trim();
+        if (!content || content === current) return;
+        
+        try {
+            const recipient = element.dataset.recipient || 'all';
+            const encrypted = await this.encryptMessage(content, recipient);
+            const edit = {
+                type: 'edit',
+                target: element.dataset.id,
+                content: encrypted.content,
+                iv: encrypted.iv,
+                auth_tag: encrypted.tag,
+                key_id: encrypted.key_id,
+                counter: encrypted.counter,
+                epoch: encrypted.epoch
+            };
+            // Правка подписывается как новая версия сообщения вместе с его
+            // вложениями; сервер подставляет их из исходного сообщения
+            if (element.dataset.attachments) {
+                edit.attachments = JSON.parse(element.dataset.attachments);
+            }
+            await this.signMessage(edit, recipient);
+            this.socket.send(JSON.stringify(edit));
+            this.renderMessageContent(element, content, { edited: true });
+        } catch (error) {
+            console.error('Ошибка изменения сообщения:', error);
+            this.showNotification('Ошибка изменения сообщения', 'error');
+        }
+    }
+    
+    deleteMessage(button) {
+        const element = button.closest('.message');
+        if (!element.dataset.id) {
+            this.showNotification('Сообщение еще не доставлено на сервер', 'error');
+            return;
+        }
+        if (!confirm('Удалить сообщение у всех участников?')) return;
+        
+        this.socket.send(JSON.stringify({ type: 'delete', target: element.dataset.id }));
+        this.renderMessageContent(element, '', { deleted: true });
+    }
+    
+    trackCursor(data) {
+        if (!data.conversation || !data.seq) return;
+        if (data.seq > (this.cursors[data.conversation] || 0)) {
+            this.cursors[data.conversation] = data.seq;
+        }
+    }
+    
+    // Сервер подтвердил отправку: привязываем назначенный ID к локальному сообщению
+    confirmSent(data) {
+        this.pendingGroupSends.delete(data.client_id);
+        this.markSeen(data);
+        this.trackCursor(data);
+        
+        const element = document.querySelector(`.message[data-client-id="${CSS.escape(data.client_id || '')}"]`);
+        if (!element) return;
+        element.dataset.id = data.id;
+        if (this.isSet(data.expires_at)) {
+            this.markExpiring(element, data.expires_at);
+        }
+        const status = element.querySelector('.message-status');
+        if (status) {
+            status.dataset.id = data.id;
+        }
+    }
+    
+    markSeen(data) {
+        if (!data.id) return true;
+        if (this.seenMessageIds.has(data.id)) return false;
+        this.seenMessageIds.add(data.id);
+        return true;
+    }
+    
+    async sendMessage() {
+        const input = document.getElementById('messageInput');
+        const content = input.value.trim();
+        
+        if (!content || !this.isConnected) {
+            this.showNotification('Нет соединения с сервером', 'error');
+            return;
+        }
+        
+        const recipient = this.currentChat === 'general' ? 'all' : this.currentChat;
+        
+        try {
+            // Показываем сообщение локально
+            this.createAndAppendMessage(await this.postMessage(content, recipient));
+            
+            input.value = '';
+            this.adjustTextareaHeight(input);
+        } catch (error) {
+            console.error('Ошибка отправки сообщения:', error);
+            this.showNotification('Ошибка отправки сообщения', 'error');
+        }
+    }
+    
+    // Шифрует и отправляет сообщение; возвращает его локальную копию для показа
+    async postMessage(content, recipient, { parentId = '', attachments = [] } = {}) {
+        const messageType = recipient === 'all' ? 'general' : 'private';
+        const clientId = crypto.randomUUID();
+        const message = await this.sealMessage(clientId, content, recipient, { parentId, attachments });
+        // Групповое сообщение может быть отклонено из-за смены состава чата;
+        // тогда оно шифруется новым ключом и отправляется повторно
+        if (messageType === 'general') {
+            this.pendingGroupSends.set(clientId, { content, recipient, parentId, attachments });
+        }
+        
+        this.socket.send(JSON.stringify(message));
+        
+        return {
+            type: messageType,
+            sender: this.username,
+            content: content,
+            recipient: recipient,
+            parent_id: parentId,
+            attachments: (message.attachments || []).map((sealed, i) => ({ ...attachments[i], ...sealed })),
+            timestamp: new Date().toISOString(),
+            encrypted: true,
+            client_id: clientId,
+            isOwn: true
+        };
+    }
+    
+    // Шифрует сообщение и ключи его вложений. В зашифрованном тексте сервер
+    // не видит упоминаний, поэтому для общего чата они передаются списком.
+    async sealMessage(clientId, content, recipient, { parentId = '', attachments = [] } = {}) {
+        const encrypted = await this.encryptMessage(content, recipient);
+        const message = {
+            type: recipient === 'all' ? 'general' : 'private',
+            client_id: clientId,
+            content: encrypted.content,
+            recipient: recipient,
+            iv: encrypted.iv,
+            auth_tag: encrypted.tag
+        };
+        if (encrypted.key_id) {
+            message.key_id = encrypted.key_id;
+            message.counter = encrypted.counter;
+            message.epoch = encrypted.epoch;
+            message.mentions = this.parseMentions(content);
+        }
+        if (parentId) {
+            message.parent_id = parentId;
+        }
+        if (attachments.length > 0) {
+            message.attachments = [];
+            for (const { id, hash } of attachments) {
+                const info = this.attachmentKeys.get(id);
+                const key = JSON.stringify(await this.encryptMessage(JSON.stringify(info), recipient));
+                message.attachments.push({ id, hash, key });
+            }
+        }
+        // Подпись покрывает и вложения, поэтому ставится последней
+        await this.signMessage(message, recipient);
+        return message;
+    }
+    
+    // Упоминания @username, как их находит сервер в открытом тексте
+    parseMentions(text) {
+        const mentions = [];
+        for (const match of text.matchAll(/(^|[^A-Za-z0-9_])@([A-Za-z0-9_]+)/g)) {
+            if (!mentions.includes(match[2])) mentions.push(match[2]);
+        }
+        return mentions;
+    }
+    
+    // Вложения шифруются на клиенте случайным ключом AES-256-GCM (IV в первых
+    // 12 байтах), сервер получает только шифротекст. Ключ, имя и тип файла
+    // передаются в сообщении зашифрованными ключом диалога.
+    async sendFile(input) {
+        const file = input.files[0];
+        input.value = '';
+        if (!file) return;
+        if (!this.isConnected) {
+            this.showNotification('Нет соединения с сервером', 'error');
+            return;
+        }
+        
+        const recipient = this.currentChat === 'general' ? 'all' : this.currentChat;
+        try {
+            this.showNotification(`Загрузка ${file.name}...`, 'info');
+            const key = await crypto.subtle.generateKey({ name: 'AES-GCM', length: 256 }, true, ['encrypt', 'decrypt']);
+            const iv = crypto.getRandomValues(new Uint8Array(12));
+            const sealed = new Uint8Array(await crypto.subtle.encrypt({ name: 'AES-GCM', iv }, key, await file.arrayBuffer()));
+            const blob = new Uint8Array(iv.length + sealed.length);
+            blob.set(iv);
+            blob.set(sealed, iv.length);
+            
+            const attachment = await this.uploadBlob(blob, file.type);
+            const info = {
+                key: this.bytesToBase64(await crypto.subtle.exportKey('raw', key)),
+                name: file.name,
+                type: file.type
+            };
+            this.attachmentKeys.set(attachment.id, info);
+            
+            this.createAndAppendMessage(await this.postMessage('', recipient, { attachments: [attachment] }));
+        } catch (error) {
+            console.error('Ошибка отправки файла:', error);
+            this.showNotification(`Ошибка отправки файла: ${error.message}`, 'error');
+        }
+    }
+    
+    // Загружает зашифрованный файл частями; после сбоя загрузка
+    // продолжается с принятого сервером смещения
+    async uploadBlob(blob, mimeType) {
+        const headers = { 'X-Session-Token': this.sessionToken };
+        const digest = new Uint8Array(await crypto.subtle.digest('SHA-256', blob));
+        const hash = Array.from(digest, b => b.toString(16).padStart(2, '0')).join('');
+        
+        let response = await fetch('/api/uploads', {
+            method: 'POST',
+            headers: { ...headers, 'Content-Type': 'application/json' },
+            body: JSON.stringify({ size: blob.length, mime_type: mimeType || 'application/octet-stream', hash })
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        let status = await response.json();
+        
+        let retries = 0;
+        while (!status.attachment) {
+            const chunk = blob.subarray(status.offset, status.offset + status.chunk_size);
+            try {
+                response = await fetch(`/api/uploads?id=${encodeURIComponent(status.id)}&offset=${status.offset}`, {
+                    method: 'PUT',
+                    headers,
+                    body: chunk
+                });
+            } catch (error) {
+                response = null;
+            }
+            
+            // Обрыв соединения или конфликт смещения: ждем и узнаем у сервера,
+            // сколько он успел принять
+            if (!response || response.status === 409 || response.status >= 500) {
+                if (++retries > 5) {
+                    throw new Error('загрузка прервана');
+                }
+                await new Promise(resolve => setTimeout(resolve, 1000 * retries));
+                const check = await fetch(`/api/uploads?id=${encodeURIComponent(status.id)}`, { headers }).catch(() => null);
+                if (check?.ok) {
+                    status = await check.json();
+                }
+                continue;
+            }
+            
+            const body = await response.json().catch(() => ({}));
+            if (!response.ok) {
+                throw new Error(body.error || response.statusText);
+            }
+            status = body;
+            retries = 0;
+        }
+        return status.attachment;
+    }
+    
+    // Расшифровывает ключи вложений сообщения ключом диалога
+    async openAttachmentKeys(data) {
+        for (const attachment of data.attachments || []) {
+            if (this.attachmentKeys.has(attachment.id) || !attachment.key) continue;
+            try {
+                const sealed = JSON.parse(attachment.key);
+                const opened = await this.decryptIncoming({
+                    sender: data.sender,
+                    recipient: data.recipient,
+                    content: sealed.content,
+                    iv: sealed.iv,
+                    auth_tag: sealed.tag,
+                    key_id: sealed.key_id,
+                    counter: sealed.counter
+                });
+                this.attachmentKeys.set(attachment.id, JSON.parse(opened.content));
+            } catch (error) {
+                console.error('Ошибка расшифровки ключа вложения:', error);
+            }
+        }
+    }
+    
+    renderAttachments(element, attachments) {
+        const list = document.createElement('div');
+        list.className = 'message-attachments';
+        attachments.forEach(attachment => {
+            const info = this.attachmentKeys.get(attachment.id);
+            const button = document.createElement('button');
+            button.className = 'attachment-chip';
+            button.textContent = `📎 ${info?.name || 'Файл'} (${this.formatSize(attachment.size)})`;
+            button.onclick = () => this.openAttachment(attachment, button);
+            list.appendChild(button);
+        });
+        element.querySelector('.message-bubble').appendChild(list);
+    }
+    
+    // Скачивает и расшифровывает вложение: картинки показываются в
+    // сообщении, остальные файлы сохраняются
+    async openAttachment(attachment, button) {
+        const info = this.attachmentKeys.get(attachment.id);
+        if (!info) {
+            this.showNotification('Нет ключа для расшифровки файла', 'error');
+            return;
+        }
+        
+        try {
+            const response = await fetch(`/api/attachments?id=${encodeURIComponent(attachment.id)}`, {
+                headers: {
+                    'X-Session-Token': this.sessionToken
+                }
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const data = new Uint8Array(await response.arrayBuffer());
+            const key = await crypto.subtle.importKey('raw', this.base64ToBytes(info.key), 'AES-GCM', false, ['decrypt']);
+            const plaintext = await crypto.subtle.decrypt({ name: 'AES-GCM', iv: data.slice(0, 12) }, key, data.slice(12));
+            const url = URL.createObjectURL(new Blob([plaintext], { type: info.type || 'application/octet-stream' }));
+            
+            if ((info.type || '').startsWith('image/')) {
+                const image = document.createElement('img');
+                image.className = 'attachment-image';
+                image.src = url;
+                image.alt = info.name;
+                button.replaceWith(image);
+                return;
+            }
+            const link = document.createElement('a');
+            link.href = url;
+            link.download = info.name || 'file';
+            link.click();
+            setTimeout(() => URL.revokeObjectURL(url), 60000);
+        } catch (error) {
+            console.error('Ошибка загрузки файла:', error);
+            this.showNotification('Не удалось открыть файл', 'error');
+        }
+    }
+    
+    // Таймер исчезающих сообщений открытого диалога; в общем чате недоступен
+    setExpiry() {
+        const conversation = this.currentConversation();
+        if (!conversation) {
+            this.showNotification('В общем чате исчезающие сообщения недоступны', 'error');
+            return;
+        }
+        if (!this.isConnected) {
+            this.showNotification('Нет соединения с сервером', 'error');
+            return;
+        }
+        
+        const current = this.expiryTimers[conversation] || 0;
+        const choices = this.expiryOptions.map((option, i) =>
+            `${i}. ${option.label}${option.seconds === current ? ' (сейчас)' : ''}`).join('\n');
+        const answer = prompt(`Срок жизни новых сообщений:\n${choices}`, '');
+        if (answer === null || answer.trim() === '') return;
+        
+        const option = this.expiryOptions[Number(answer)];
+        if (!option) {
+            this.showNotification('Неверный выбор', 'error');
+            return;
+        }
+        this.socket.send(JSON.stringify({
+            type: 'expiry',
+            recipient: this.currentChat,
+            expires_in: option.seconds
+        }));
+    }
+    
+    // ID диалога открытого чата в формате сервера; пусто для общего чата
+    currentConversation() {
+        if (this.currentChat === 'general') return '';
+        return 'dm:' + [this.username, this.currentChat].sort().join(':');
+    }
+    
+    updateExpiryLabel() {
+        const label = document.getElementById('expiryLabel');
+        if (!label) return;
+        const seconds = this.expiryTimers[this.currentConversation()] || 0;
+        label.textContent = seconds ? this.expiryLabel(seconds) : '';
+        document.getElementById('expiryButton')?.classList.toggle('active', Boolean(seconds));
+    }
+    
+    expiryLabel(seconds) {
+        const option = this.expiryOptions.find(option => option.seconds === seconds);
+        if (option) return option.label;
+        if (seconds < 60) return `${seconds} с`;
+        if (seconds < 3600) return `${Math.round(seconds / 60)} мин`;
+        if (seconds < 86400) return `${Math.round(seconds / 3600)} ч`;
+        return `${Math.round(seconds / 86400)} дн`;
+    }
+    
+    markExpiring(element, expiresAt) {
+        element.dataset.expiresAt = expiresAt;
+        const time = element.querySelector('.message-time');
+        if (time && !time.querySelector('.expiry-mark')) {
+            time.insertAdjacentHTML('afterbegin', '<i class="fas fa-hourglass-half expiry-mark" title="Исчезающее сообщение"></i> ');
+        }
+    }
+    
+    removeExpiredMessages() {
+        const now = Date.now();
+        document.querySelectorAll('.message[data-expires-at]').forEach(element => {
+            if (Date.parse(element.dataset.expiresAt) <= now) {
+                this.removeMessage(element.dataset.id);
+            }
+        });
+    }
+    
+    // Удаляет локальные копии сообщения: в ленте, в открытой ветке и реакции
+    removeMessage(id) {
+        if (!id) return;
+        document.querySelectorAll(`.message[data-id="${CSS.escape(id)}"]`).forEach(element => element.remove());
+        this.reactions.delete(id);
+        if (this.openThreadRoot?.id === id) {
+            this.closeThread();
+        }
+    }
+    
+    formatSize(bytes) {
+        if (bytes < 1024) return `${bytes} Б`;
+        if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)} КБ`;
+        return `${(bytes / 1024 / 1024).toFixed(1)} МБ`;
+    }
+    
+    // Открывает ветку ответов на сообщение
+    async openThread(button) {
+        const element = button.closest('.message');
+        if (!element.dataset.id) {
+            this.showNotification('Сообщение еще не доставлено на сервер', 'error');
+            return;
+        }
+        
+        this.openThreadRoot = { id: element.dataset.id };
+        this.threadOldestId = '';
+        document.getElementById('threadRoot').replaceChildren();
+        document.getElementById('threadMessages').replaceChildren();
+        document.getElementById('threadModal').style.display = 'flex';
+        await this.loadThread();
+    }
+    
+    async loadThread(before = '') {
+        const root = this.openThreadRoot;
+        if (!root) return;
+        
+        const params = new URLSearchParams({ id: root.id, limit: this.historyPageSize });
+        if (before) {
+            params.set('before', before);
+        }
+        
+        try {
+            const response = await fetch(`/api/thread?${params}`, {
+                headers: {
+                    'X-Session-Token': this.sessionToken
+                }
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            
+            const page = await response.json();
+            if (this.openThreadRoot !== root) return;
+            
+            if (!before) {
+                // Корень показывается без действий и без data-id, чтобы не
+                // путать его с сообщением в основной ленте
+                const rootMsg = await this.decryptIncoming(page.root);
+                root.peer = rootMsg.type === 'private' ?
+                    (rootMsg.sender === this.username ? rootMsg.recipient : rootMsg.sender) : 'all';
+                const rootElement = this.createMessageElement(rootMsg);
+                delete rootElement.dataset.id;
+                rootElement.querySelector('.message-actions')?.remove();
+                rootElement.querySelector('.thread-link')?.remove();
+                document.getElementById('threadRoot').replaceChildren(rootElement);
+            }
+            
+            const messages = await Promise.all((page.messages || []).map(msg => this.decryptIncoming(msg)));
+            if (messages.length > 0) {
+                this.threadOldestId = messages[0].id;
+            }
+            const container = document.getElementById('threadMessages');
+            const anchor = container.querySelector('.message');
+            messages.forEach(msg => {
+                const element = this.createMessageElement(msg);
+                if (before) {
+                    container.insertBefore(element, anchor);
+                } else {
+                    container.appendChild(element);
+                }
+            });
+            
+            const button = document.getElementById('threadLoadEarlier');
+            button.style.display = page.has_more ? 'inline-block' : 'none';
+            if (!before) {
+                container.scrollTop = container.scrollHeight;
+            }
+        } catch (error) {
+            console.error('Ошибка загрузки ветки:', error);
+            this.showNotification('Ошибка загрузки ветки', 'error');
+        }
+    }
+    
+    async sendThreadReply() {
+        const input = document.getElementById('threadInput');
+        const content = input.value.trim();
+        const root = this.openThreadRoot;
+        
+        if (!content || !root?.peer) return;
+        if (!this.isConnected) {
+            this.showNotification('Нет соединения с сервером', 'error');
+            return;
+        }
+        
+        try {
+            const reply = await this.postMessage(content, root.peer, { parentId: root.id });
+            this.appendThreadMessage(reply);
+            this.setThreadCount(root.id, this.threadCount(root.id) + 1);
+            input.value = '';
+        } catch (error) {
+            console.error('Ошибка отправки ответа:', error);
+            this.showNotification('Ошибка отправки ответа', 'error');
+        }
+    }
+    
+    closeThread() {
+        this.openThreadRoot = null;
+        this.hideModal('threadModal');
+    }
+    
+    // Новый ответ увеличивает счетчик у корня и попадает в открытую ветку
+    addThreadReply(data) {
+        this.setThreadCount(data.parent_id, this.threadCount(data.parent_id) + 1);
+        if (this.openThreadRoot?.id === data.parent_id) {
+            this.appendThreadMessage(data);
+        }
+    }
+    
+    appendThreadMessage(data) {
+        const container = document.getElementById('threadMessages');
+        container.appendChild(this.createMessageElement(data));
+        container.scrollTop = container.scrollHeight;
+    }
+    
+    threadCount(rootId) {
+        const element = document.querySelector(`#messagesContainer .message[data-id="${CSS.escape(rootId || '')}"]`);
+        return Number(element?.querySelector('.thread-link')?.dataset.count || 0);
+    }
+    
+    setThreadCount(rootId, count) {
+        const element = document.querySelector(`#messagesContainer .message[data-id="${CSS.escape(rootId || '')}"]`);
+        if (!element || !count) return;
+        
+        let link = element.querySelector('.thread-link');
+        if (!link) {
+            link = document.createElement('button');
+            link.className = 'thread-link';
+            link.onclick = () => this.openThread(link);
+            element.querySelector('.message-reactions').after(link);
+        }
+        link.dataset.count = count;
+        link.innerHTML = `<i class="fas fa-comments"></i> ${this.repliesLabel(count)}`;
+    }
+    
+    repliesLabel(count) {
+        const mod10 = count % 10;
+        const mod100 = count % 100;
+        if (mod10 === 1 && mod100 !== 11) return `${count} ответ`;
+        if (mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14)) return `${count} ответа`;
+        return `${count} ответов`;
+    }
+    
+    // Проверенные ключи и ключи, которые уже видел этот браузер, хранятся
+    // только локально (и в резервной копии ключей): сервер не знает,
+    // кого проверил пользователь
+    loadVerifications() {
+        this.knownKeys = JSON.parse(localStorage.getItem(`known_keys_${this.username}`) || '{}');
+        this.verifiedKeys = JSON.parse(localStorage.getItem(`verified_keys_${this.username}`) || '{}');
+    }
+    
+    // Проверенным считается только собеседник, чьи текущие ключи совпадают
+    // с проверенными
+    isVerified(peer) {
+        const verified = this.verifiedKeys[peer];
+        const user = this.users.find(u => u.username === peer);
+        return Boolean(verified && user?.public_key && verified.public_key === user.public_key &&
+            (verified.signing_key || '') === (user.signing_key || ''));
+    }
+    
+    // Проверялся ли собеседник, даже если его ключи с тех пор сменились
+    wasVerified(peer) {
+        return Boolean(this.verifiedKeys[peer]);
+    }
+    
+    saveVerifiedKeys() {
+        localStorage.setItem(`verified_keys_${this.username}`, JSON.stringify(this.verifiedKeys));
+    }
+    
+    rememberKey(peer, publicKey) {
+        this.knownKeys[peer] = publicKey;
+        localStorage.setItem(`known_keys_${this.username}`, JSON.stringify(this.knownKeys));
+    }
+    
+    // Смену ключа замечаем и сами: сервер мог бы не прислать key_change
+    checkKeyChanges(users) {
+        users.forEach(user => {
+            const known = this.knownKeys[user.username];
+            if (known && user.public_key && known !== user.public_key) {
+                this.warnKeyChange(user.username, user.public_key);
+            }
+        });
+    }
+    
+    // Предупреждает о смене ключа собеседника один раз на каждый новый ключ
+    warnKeyChange(peer, publicKey) {
+        if (!peer || peer === this.username || !publicKey || this.knownKeys[peer] === publicKey) return;
+        const wasVerified = this.wasVerified(peer);
+        this.rememberKey(peer, publicKey);
+        this.conversationKeys.delete(peer);
+        this.forgetSharedSenderKeys(peer);
+        this.updateVerifiedBadge();
+        
+        const text = `Ключ шифрования ${this.escapeHtml(peer)} изменился. Сверьте номер безопасности заново.`;
+        this.showSystemMessage(`<i class="fas fa-exclamation-triangle"></i> ${text}`);
+        this.showNotification(wasVerified ? `Проверенный ключ ${peer} изменился!` : `Ключ ${peer} изменился`, 'error');
+    }
+    
+    updateVerifiedBadge() {
+        const badge = document.getElementById('verifiedBadge');
+        if (!badge) return;
+        badge.style.display = this.currentChat !== 'general' && this.isVerified(this.currentChat) ? '' : 'none';
+    }
+    
+    // Отпечаток ключей X25519 и Ed25519: те же параметры, что в
+    // internal/common/safety.go (общие векторы - в его тестах)
+    async fingerprint(username, publicKey, signingKey = '') {
+        const identity = this.base64ToBytes(publicKey);
+        const signing = signingKey ? this.base64ToBytes(signingKey) : new Uint8Array(0);
+        const key = new Uint8Array(identity.length + signing.length);
+        key.set(identity);
+        key.set(signing, identity.length);
+        const id = new TextEncoder().encode(username);
+        let digest = new Uint8Array(2 + key.length + id.length);
+        new DataView(digest.buffer).setUint16(0, 1);
+        digest.set(key, 2);
+        digest.set(id, 2 + key.length);
+        
+        for (let i = 0; i < 5200; i++) {
+            const input = new Uint8Array(digest.length + key.length);
+            input.set(digest);
+            input.set(key, digest.length);
+            digest = new Uint8Array(await crypto.subtle.digest('SHA-512', input));
+        }
+        
+        let result = '';
+        for (let i = 0; i < 6; i++) {
+            let chunk = 0;
+            for (let j = 0; j < 5; j++) {
+                chunk = chunk * 256 + digest[i * 5 + j];
+            }
+            result += String(chunk % 100000).padStart(5, '0');
+        }
+        return result;
+    }
+    
+    async safetyNumber(peer, peerKey, peerSigningKey = '') {
+        const fingerprints = [
+            await this.fingerprint(this.username, this.publicKey, this.signingPublicKey),
+            await this.fingerprint(peer, peerKey, peerSigningKey)
+        ].sort();
+        return fingerprints.join('');
+    }
+    
+    async showSafetyNumber() {
+        if (this.currentChat === 'general') {
+            this.showNotification('Выберите личный чат', 'error');
+            return;
+        }
+        const peer = this.currentChat;
+        const user = this.users.find(u => u.username === peer);
+        if (!user?.public_key) {
+            this.showNotification(`Нет публичного ключа для ${peer}`, 'error');
+            return;
+        }
+        
+        const number = await this.safetyNumber(peer, user.public_key, user.signing_key);
+        const groups = number.match(/\d{5}/g);
+        const container = document.getElementById('safetyNumber');
+        container.dataset.peer = peer;
+        container.dataset.number = number;
+        container.dataset.publicKey = user.public_key;
+        container.dataset.signingKey = user.signing_key || '';
+        container.replaceChildren(...[0, 4, 8].map(start => {
+            const row = document.createElement('div');
+            row.textContent = groups.slice(start, start + 4).join(' ');
+            return row;
+        }));
+        this.renderSafetyStatus(peer);
+        document.getElementById('safetyModal').style.display = 'flex';
+    }
+    
+    renderSafetyStatus(peer) {
+        const status = document.getElementById('safetyStatus');
+        const verified = this.isVerified(peer);
+        const changed = this.wasVerified(peer) && !verified;
+        
+        status.className = `safety-status ${verified ? 'verified' : changed ? 'changed' : ''}`;
+        status.innerHTML = verified ?
+            `<i class="fas fa-check-circle"></i> ${this.escapeHtml(peer)} проверен(а)` :
+            changed ? `<i class="fas fa-exclamation-triangle"></i> Ключ ${this.escapeHtml(peer)} изменился после проверки` :
+            `<i class="fas fa-question-circle"></i> ${this.escapeHtml(peer)} не проверен(а)`;
+        document.getElementById('verifyButton').style.display = verified ? 'none' : '';
+        document.getElementById('unverifyButton').style.display = this.wasVerified(peer) ? '' : 'none';
+    }
+    
+    // Номер безопасности сверяется вне мессенджера; отметка запоминает
+    // ключи, по которым он посчитан
+    verifyContact() {
+        const container = document.getElementById('safetyNumber');
+        const peer = container.dataset.peer;
+        this.verifiedKeys[peer] = {
+            public_key: container.dataset.publicKey,
+            signing_key: container.dataset.signingKey
+        };
+        this.saveVerifiedKeys();
+        this.rememberKey(peer, container.dataset.publicKey);
+        this.renderSafetyStatus(peer);
+        this.updateVerifiedBadge();
+        this.showNotification(`${peer} отмечен(а) как проверенный`, 'success');
+    }
+    
+    unverifyContact() {
+        const peer = document.getElementById('safetyNumber').dataset.peer;
+        delete this.verifiedKeys[peer];
+        this.saveVerifiedKeys();
+        this.renderSafetyStatus(peer);
+        this.updateVerifiedBadge();
+    }
+    
+    // Сквозное шифрование: X25519 -> HKDF-SHA256 -> AES-256-GCM.
+    // Параметры должны совпадать с internal/common/e2e.go. Храповик
+    // (internal/common/ratchet) здесь не используется: ключ диалога
+    // статический, чтобы историю могли расшифровать все устройства.
+    async loadOrCreateKeys() {
+        const storageKey = `e2e_private_key_${this.username}`;
+        const stored = localStorage.getItem(storageKey);
+        
+        if (stored) {
+            try {
+                const privateKey = await crypto.subtle.importKey(
+                    'pkcs8', this.base64ToBytes(stored), { name: 'X25519' }, true, ['deriveBits']
+                );
+                const publicRaw = this.base64ToBytes(localStorage.getItem(`e2e_public_key_${this.username}`) || '');
+                const publicKey = await crypto.subtle.importKey('raw', publicRaw, { name: 'X25519' }, true, []);
+                this.keyPair = { privateKey, publicKey };
+                this.publicKey = this.bytesToBase64(publicRaw);
+                return;
+            } catch (error) {
+                console.error('Ошибка загрузки ключей, генерируем новые:', error);
+            }
+        }
+        
+        await this.generateKeys();
+    }
+    
+    async generateKeys() {
+        this.keyPair = await crypto.subtle.generateKey({ name: 'X25519' }, true, ['deriveBits']);
+        const pkcs8 = await crypto.subtle.exportKey('pkcs8', this.keyPair.privateKey);
+        const publicRaw = await crypto.subtle.exportKey('raw', this.keyPair.publicKey);
+        
+        this.publicKey = this.bytesToBase64(publicRaw);
+        this.conversationKeys.clear();
+        localStorage.setItem(`e2e_private_key_${this.username}`, this.bytesToBase64(pkcs8));
+        localStorage.setItem(`e2e_public_key_${this.username}`, this.publicKey);
+    }
+    
+    async getConversationKey(peer) {
+        const user = this.users.find(u => u.username === peer);
+        if (!user || !user.public_key) {
+            throw new Error(`Нет публичного ключа для ${peer}`);
+        }
+        
+        const cached = this.conversationKeys.get(peer);
+        if (cached && cached.publicKey === user.public_key) {
+            return cached.key;
+        }
+        
+        const peerKey = await crypto.subtle.importKey(
+            'raw', this.base64ToBytes(user.public_key), { name: 'X25519' }, false, []
+        );
+        const shared = await crypto.subtle.deriveBits(
+            { name: 'X25519', public: peerKey }, this.keyPair.privateKey, 256
+        );
+        const hkdfKey = await crypto.subtle.importKey('raw', shared, 'HKDF', false, ['deriveKey']);
+        const [first, second] = [this.username, peer].sort();
+        const key = await crypto.subtle.deriveKey(
+            {
+                name: 'HKDF',
+                hash: 'SHA-256',
+                salt: new Uint8Array(0),
+                info: new TextEncoder().encode(`secure-messenger/e2e/v1|${first}|${second}`)
+            },
+            hkdfKey,
+            { name: 'AES-GCM', length: 256 },
+            false,
+            ['encrypt', 'decrypt']
+        );
+        
+        this.conversationKeys.set(peer, { publicKey: user.public_key, key });
+        if (!this.knownKeys[peer]) {
+            this.rememberKey(peer, user.public_key);
+        }
+        return key;
+    }
+    
+    async encryptMessage(content, recipient) {
+        // Общий чат шифруется один раз ключом отправителя
+        if (recipient === 'all') {
+            return this.encryptGroup('general', content);
+        }
+        
+        const key = await this.getConversationKey(recipient);
+        const iv = crypto.getRandomValues(new Uint8Array(12));
+        const sealed = new Uint8Array(await crypto.subtle.encrypt(
+            {
+                name: 'AES-GCM',
+                iv,
+                additionalData: new TextEncoder().encode(`${this.username}->${recipient}`),
+                tagLength: 128
+            },
+            key,
+            new TextEncoder().encode(content)
+        ));
+        
+        return {
+            content: this.bytesToBase64(sealed.slice(0, sealed.length - 16)),
+            iv: this.bytesToBase64(iv),
+            tag: this.bytesToBase64(sealed.slice(sealed.length - 16))
+        };
+    }
+    
+    async decryptIncoming(data) {
+        const signature = await this.verifySignature(data);
+        return { ...(await this.openMessage(data)), signature };
+    }
+    
+    async openMessage(data) {
+        if (data.attachments?.length) {
+            await this.openAttachmentKeys(data);
+        }
+        if (data.key_id) {
+            return this.decryptGroup(data);
+        }
+        if (!data.iv || !data.auth_tag) {
+            return data;
+        }
+        
+        const peer = data.sender === this.username ? data.recipient : data.sender;
+        try {
+            const key = await this.getConversationKey(peer);
+            const ciphertext = this.base64ToBytes(data.content);
+            const tag = this.base64ToBytes(data.auth_tag);
+            const sealed = new Uint8Array(ciphertext.length + tag.length);
+            sealed.set(ciphertext);
+            sealed.set(tag, ciphertext.length);
+            
+            const plaintext = await crypto.subtle.decrypt(
+                {
+                    name: 'AES-GCM',
+                    iv: this.base64ToBytes(data.iv),
+                    additionalData: new TextEncoder().encode(`${data.sender}->${data.recipient}`),
+                    tagLength: 128
+                },
+                key,
+                sealed
+            );
+            
+            return { ...data, content: new TextDecoder().decode(plaintext), encrypted: true };
+        } catch (error) {
+            console.error('Ошибка расшифровки:', error);
+            return { ...data, content: '🔒 Не удалось расшифровать сообщение', encrypted: true };
+        }
+    }
+    
+    // Подписи сообщений: Ed25519 над конвертом из отправителя, получателя,
+    // комнаты, времени подписи и SHA-256 шифротекста с заголовками - как
+    // common.MessageEnvelope. Каждое поле предваряется длиной (4 байта
+    // big-endian). Сервер перезаписывает отправителя, но подделать подпись
+    // не может.
+    async loadOrCreateSigningKey() {
+        const stored = localStorage.getItem(`e2e_signing_key_${this.username}`);
+        if (stored) {
+            try {
+                this.signingKey = await crypto.subtle.importKey(
+                    'pkcs8', this.base64ToBytes(stored), { name: 'Ed25519' }, false, ['sign']
+                );
+                this.signingPublicKey = localStorage.getItem(`e2e_signing_public_${this.username}`) || '';
+                if (this.signingPublicKey) return;
+            } catch (error) {
+                console.error('Ошибка загрузки ключа подписи, генерируем новый:', error);
+            }
+        }
+        
+        await this.generateSigningKey();
+    }
+    
+    async generateSigningKey() {
+        const pair = await crypto.subtle.generateKey({ name: 'Ed25519' }, true, ['sign', 'verify']);
+        this.signingKey = pair.privateKey;
+        this.signingPublicKey = this.bytesToBase64(await crypto.subtle.exportKey('raw', pair.publicKey));
+        localStorage.setItem(`e2e_signing_key_${this.username}`,
+            this.bytesToBase64(await crypto.subtle.exportKey('pkcs8', pair.privateKey)));
+        localStorage.setItem(`e2e_signing_public_${this.username}`, this.signingPublicKey);
+    }
+    
+    async signMessage(message, recipient, room = '') {
+        message.signed_at = new Date().toISOString();
+        const envelope = await this.messageEnvelope({ ...message, sender: this.username, recipient, room });
+        const signature = await crypto.subtle.sign({ name: 'Ed25519' }, this.signingKey, envelope);
+        message.signature = this.bytesToBase64(signature);
+    }
+    
+    // Возвращает 'valid', 'invalid', 'unsigned' или 'unknown' (ключ подписи
+    // отправителя неизвестен)
+    async verifySignature(data) {
+        if (!data.signature || !data.signed_at) return 'unsigned';
+        const signingKey = this.users.find(u => u.username === data.sender)?.signing_key ||
+            (data.sender === this.username ? this.signingPublicKey : '');
+        if (!signingKey) return 'unknown';
+        
+        try {
+            const key = await crypto.subtle.importKey('raw', this.base64ToBytes(signingKey), { name: 'Ed25519' }, false, ['verify']);
+            const valid = await crypto.subtle.verify(
+                { name: 'Ed25519' }, key, this.base64ToBytes(data.signature), await this.messageEnvelope(data)
+            );
+            return valid ? 'valid' : 'invalid';
+        } catch (error) {
+            console.error('Ошибка проверки подписи:', error);
+            return 'invalid';
+        }
+    }
+    
+    // Подписываемое представление сообщения, как common.MessageEnvelope;
+    // векторы - в internal/common/signature_test.go
+    async messageEnvelope(data) {
+        const encoder = new TextEncoder();
+        const prefixed = fields => {
+            const parts = fields.map(field => typeof field === 'string' ? encoder.encode(field) : field);
+            const out = new Uint8Array(parts.reduce((total, part) => total + 4 + part.length, 0));
+            const view = new DataView(out.buffer);
+            let offset = 0;
+            parts.forEach(part => {
+                view.setUint32(offset, part.length);
+                out.set(part, offset + 4);
+                offset += 4 + part.length;
+            });
+            return out;
+        };
+        
+        const fields = [
+            data.content || '',
+            data.iv || '',
+            data.auth_tag || '',
+            data.ratchet_key || '',
+            String(data.prev_counter || 0),
+            String(data.counter || 0),
+            data.key_id || '',
+            String(data.epoch || 0)
+        ];
+        if (data.attachments?.length) {
+            fields.push(String(data.attachments.length));
+            data.attachments.forEach(a => fields.push(a.id || '', a.hash || '', a.key || ''));
+        }
+        const hash = new Uint8Array(await crypto.subtle.digest('SHA-256', prefixed(fields)));
+        return prefixed([
+            'secure-messenger/signature/v1',
+            data.sender || '',
+            data.recipient || '',
+            data.room || '',
+            String(Date.parse(data.signed_at)),
+            hash
+        ]);
+    }
+    
+    // Предключи для асинхронной установки сессий (X3DH, internal/common/x3dh.go):
+    // подписанный предключ X25519 с подписью Ed25519 над его 32 байтами и пул
+    // одноразовых предключей. Ключ идентичности - ключ X25519 пользователя.
+    loadPrekeys() {
+        try {
+            this.prekeys = JSON.parse(localStorage.getItem(`prekeys_${this.username}`) || 'null');
+        } catch (error) {
+            console.error('Ошибка загрузки предключей:', error);
+        }
+    }
+    
+    savePrekeys() {
+        localStorage.setItem(`prekeys_${this.username}`, JSON.stringify(this.prekeys));
+    }
+    
+    // Публикации идут по очереди: номера предключей не должны повториться
+    withPrekeys(task) {
+        const result = this.prekeyQueue.then(task);
+        this.prekeyQueue = result.catch(error => console.error('Ошибка публикации предключей:', error));
+        return this.prekeyQueue;
+    }
+    
+    // Публикует ключи, если каталог не знает текущих ключей идентичности
+    // и подписи, и пополняет истощившийся пул; дальше сервер сам напоминает
+    // о пополнении (prekey_low)
+    publishPrekeys() {
+        return this.withPrekeys(async () => {
+            const status = await this.prekeyRequest('GET');
+            if (!status.published || !this.prekeysCurrent()) {
+                await this.republishPrekeys();
+            } else if (status.count < status.low_water_mark) {
+                await this.uploadPrekeys(this.prekeyPoolSize - status.count);
+            }
+        });
+    }
+    
+    replenishPrekeys(count) {
+        return this.withPrekeys(async () => {
+            if (!this.prekeysCurrent()) {
+                await this.republishPrekeys();
+                return;
+            }
+            await this.uploadPrekeys(Math.max(this.prekeyPoolSize - count, 0));
+        });
+    }
+    
+    prekeysCurrent() {
+        return Boolean(this.prekeys && this.prekeys.identity_key === this.publicKey &&
+            this.prekeys.signing_key === this.signingPublicKey);
+    }
+    
+    // Новый подписанный предключ и полный пул; состояние сохраняется только
+    // после того, как сервер принял ключи
+    async republishPrekeys() {
+        const nextId = this.prekeys?.next_id || 1;
+        const signed = await this.generatePrekey((this.prekeys?.signed?.key_id || 0) + 1);
+        signed.signature = this.bytesToBase64(await crypto.subtle.sign(
+            { name: 'Ed25519' }, this.signingKey, this.base64ToBytes(signed.public_key)
+        ));
+        const next = {
+            identity_key: this.publicKey,
+            signing_key: this.signingPublicKey,
+            signed,
+            one_time: {},
+            next_id: nextId
+        };
+        const oneTime = await this.generateOneTimePrekeys(next, this.prekeyPoolSize);
+        await this.prekeyRequest('POST', {
+            identity_key: next.identity_key,
+            signing_key: next.signing_key,
+            signed_prekey: { key_id: signed.key_id, public_key: signed.public_key, signature: signed.signature },
+            one_time_prekeys: oneTime
+        });
+        this.prekeys = next;
+        this.savePrekeys();
+    }
+    
+    async uploadPrekeys(count) {
+        if (count <= 0) return;
+        const oneTime = await this.generateOneTimePrekeys(this.prekeys, count);
+        // Закрытые ключи сохраняются до отправки: сервер может принять
+        // ключи, даже если ответ не дойдет
+        this.savePrekeys();
+        await this.prekeyRequest('POST', {
+            identity_key: this.prekeys.identity_key,
+            signing_key: this.prekeys.signing_key,
+            one_time_prekeys: oneTime
+        });
+    }
+    
+    async generateOneTimePrekeys(state, count) {
+        const oneTime = [];
+        for (let i = 0; i < count; i++) {
+            const prekey = await this.generatePrekey(state.next_id++);
+            state.one_time[prekey.key_id] = prekey.private_key;
+            oneTime.push({ key_id: prekey.key_id, public_key: prekey.public_key });
+        }
+        // Сервер держит не больше maxStoredPrekeys и выдает старые первыми,
+        // поэтому более старые закрытые ключи уже не понадобятся
+        const ids = Object.keys(state.one_time).map(Number).sort((a, b) => a - b);
+        ids.slice(0, Math.max(ids.length - this.maxStoredPrekeys, 0)).forEach(id => {
+            delete state.one_time[id];
+        });
+        return oneTime;
+    }
+    
+    async generatePrekey(keyId) {
+        const pair = await crypto.subtle.generateKey({ name: 'X25519' }, true, ['deriveBits']);
+        return {
+            key_id: keyId,
+            public_key: this.bytesToBase64(await crypto.subtle.exportKey('raw', pair.publicKey)),
+            private_key: this.bytesToBase64(await crypto.subtle.exportKey('pkcs8', pair.privateKey))
+        };
+    }
+    
+    async prekeyRequest(method, upload) {
+        const response = await fetch('/api/prekeys', {
+            method,
+            headers: {
+                'Content-Type': 'application/json',
+                'X-Session-Token': this.sessionToken
+            },
+            body: upload ? JSON.stringify(upload) : undefined
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        return response.json();
+    }
+    
+    // Ключи отправителей групп: цепочка HMAC-SHA256 (0x01 - ключ сообщения,
+    // 0x02 - следующий ключ цепочки), ключ сообщения через HKDF-SHA256 дает
+    // ключ AES-256-GCM и nonce. Associated data - "<отправитель>-><диалог>"
+    // и заголовок (key_id и номер, по 4 байта big-endian), как в пакете
+    // internal/common/senderkey (общие векторы - в его тестах). Начальное
+    // состояние цепочки раздается участникам личными зашифрованными
+    // сообщениями sender_key.
+    loadSenderKeys() {
+        try {
+            const stored = JSON.parse(localStorage.getItem(`sender_keys_${this.username}`) || 'null');
+            if (stored?.own && stored?.chains) {
+                this.senderKeys = stored;
+            }
+        } catch (error) {
+            console.error('Ошибка загрузки ключей отправителей:', error);
+        }
+    }
+    
+    saveSenderKeys() {
+        localStorage.setItem(`sender_keys_${this.username}`, JSON.stringify(this.senderKeys));
+    }
+    
+    // Операции с цепочками выполняются по очереди: номер сообщения не должен
+    // повториться, а кэш цепочки - продлеваться параллельно
+    withSenderKeys(task) {
+        const result = this.senderKeyQueue.then(task);
+        this.senderKeyQueue = result.catch(() => {});
+        return result;
+    }
+    
+    encryptGroup(conversation, content) {
+        return this.withSenderKeys(async () => {
+            const own = await this.ensureSenderKey(conversation);
+            const n = own.iteration;
+            const chainKey = this.base64ToBytes(own.chain_key);
+            // Цепочка продвигается до шифрования, чтобы ключ не использовался дважды
+            own.chain_key = this.bytesToBase64(await this.chainStep(chainKey, 0x02));
+            own.iteration++;
+            this.saveSenderKeys();
+            
+            const { key, iv } = await this.groupCipher(await this.chainStep(chainKey, 0x01));
+            const sealed = new Uint8Array(await crypto.subtle.encrypt(
+                { name: 'AES-GCM', iv, additionalData: this.groupAD(this.username, conversation, own.key_id, n), tagLength: 128 },
+                key,
+                new TextEncoder().encode(content)
+            ));
             
-            this.socket.send(JSON.stringify(authMsg));
-        };
+            return {
+                content: this.bytesToBase64(sealed.slice(0, sealed.length - 16)),
+                iv: '',
+                tag: this.bytesToBase64(sealed.slice(sealed.length - 16)),
+                key_id: String(own.key_id),
+                counter: n,
+                epoch: own.epoch
+            };
+        });
+    }
+    
+    // Создает ключ отправителя для текущей эпохи состава группы и раздает
+    // его участникам, которые его еще не получили
+    async ensureSenderKey(conversation) {
+        const epoch = this.groupEpochs[conversation] || 0;
+        let own = this.senderKeys.own[conversation];
+        if (!own || own.epoch !== epoch) {
+            const chainKey = this.bytesToBase64(crypto.getRandomValues(new Uint8Array(32)));
+            own = {
+                key_id: crypto.getRandomValues(new Uint32Array(1))[0],
+                chain_key: chainKey,
+                iteration: 0,
+                epoch,
+                shared_with: []
+            };
+            this.senderKeys.own[conversation] = own;
+            // Своя цепочка нужна для расшифровки собственных сообщений из истории
+            this.senderKeys.chains[`${this.username}|${own.key_id}`] = { iteration: 0, chain_key: chainKey };
+            this.saveSenderKeys();
+        }
         
-        this.socket.onmessage = (event) => {
+        const members = new Set(this.groupMembers(conversation));
+        for (const user of this.users) {
+            if (user.username === this.username || !members.has(user.username) ||
+                !user.public_key || own.shared_with.includes(user.username)) continue;
             try {
-                const data = JSON.parse(event.data);
-                this.handleMessage(data);
+                await this.shareSenderKey(conversation, own, user.username);
+                own.shared_with.push(user.username);
             } catch (error) {
-                console.error('Ошибка парсинга:', error);
-            }
-        };
-        
-        this.socket.onclose = (event) => {
-            console.log('❌ WebSocket отключен:', event.code, event.reason);
-            this.isConnected = false;
-            this.updateConnectionStatus(false);
-            
-            // ✅ Блокируем поле ввода
-            const messageInput = document.getElementById('messageInput');
-            const sendButton = document.getElementById('sendButton');
-            if (messageInput) messageInput.disabled = true;
-            if (sendButton) sendButton.disabled = true;
-            
-            // ✅ Пробуем переподключиться
-            if (this.reconnectAttempts < this.maxReconnectAttempts) {
-                this.reconnectAttempts++;
-                const delay = Math.min(3000 * this.reconnectAttempts, 15000); // Экспоненциальная задержка
-                
-                console.log(`🔄 Попытка переподключения ${this.reconnectAttempts}/${this.maxReconnectAttempts} через ${delay}мс`);
-                
-                setTimeout(() => {
-                    if (!this.isConnected) {
-                        this.connectWebSocket();
-                    }
-                }, delay);
-            } else {
-                console.error('❌ Максимальное количество попыток переподключения достигнуто');
-                this.showNotification('Не удалось подключиться к серверу', 'error');
+                console.error(`Ошибка отправки ключа отправителя ${user.username}:`, error);
             }
+        }
+        this.saveSenderKeys();
+        return own;
+    }
+    
+    // Участники группового диалога: общего чата - все пользователи,
+    // комнаты - ее текущий состав
+    groupMembers(conversation) {
+        if (!conversation.startsWith('room:')) {
+            return this.users.map(user => user.username);
+        }
+        return this.roomMembers[conversation.slice(5)] || [];
+    }
+    
+    updateRoomMembers(info) {
+        const members = (info.members || []).map(member => member.username);
+        if (members.includes(this.username)) {
+            this.roomMembers[info.name] = members;
+        } else {
+            delete this.roomMembers[info.name];
+        }
+    }
+    
+    async shareSenderKey(conversation, own, peer) {
+        if (!this.isConnected) {
+            throw new Error('нет соединения с сервером');
+        }
+        const distribution = {
+            conversation,
+            epoch: own.epoch,
+            key_id: own.key_id,
+            iteration: own.iteration,
+            chain_key: own.chain_key
         };
-        
-        this.socket.onerror = (error) => {
-            console.error('WebSocket ошибка:', error);
-            this.showNotification('Ошибка соединения', 'error');
+        const encrypted = await this.encryptMessage(JSON.stringify(distribution), peer);
+        const room = conversation.startsWith('room:') ? conversation.slice(5) : '';
+        const message = {
+            type: 'sender_key',
+            recipient: peer,
+            room,
+            content: encrypted.content,
+            iv: encrypted.iv,
+            auth_tag: encrypted.tag
         };
+        await this.signMessage(message, peer, room);
+        this.socket.send(JSON.stringify(message));
     }
     
-    handleMessage(data) {
-        console.log('📨 Получено сообщение:', data.type);
-        
-        switch (data.type) {
-            case 'general':
-            case 'private':
-                if (data.sender === this.username) return;
-                this.createAndAppendMessage(data);
-                break;
-                
-            case 'history':
-                if (this.loadedHistory) return;
-                this.createAndAppendMessage(data, false);
-                break;
-                
-            case 'users_list':
-                this.updateUserList(data.users || []);
-                break;
-                
-            case 'user_joined':
-                this.showSystemMessage(`${data.sender} ${data.content}`);
-                break;
-                
-            case 'user_left':
-                this.showSystemMessage(`${data.sender} ${data.content}`);
-                break;
-                
-            case 'typing':
-                this.showTypingIndicator(data.sender);
-                break;
-                
-            case 'success':
-                this.showNotification(data.content || 'Успешно', 'success');
-                break;
-                
-            case 'error':
-                if (data.content === 'Authentication failed') {
-                    this.logout();
-                } else {
-                    this.showNotification(data.content || 'Ошибка', 'error');
+    // После смены ключа собеседника ему нужно заново раздать ключи отправителя
+    forgetSharedSenderKeys(peer) {
+        Object.values(this.senderKeys.own).forEach(own => {
+            own.shared_with = own.shared_with.filter(name => name !== peer);
+        });
+        this.saveSenderKeys();
+    }
+    
+    async acceptSenderKey(data) {
+        try {
+            const opened = await this.decryptIncoming(data);
+            // Подделанный ключ позволил бы выдавать чужие сообщения за отправителя
+            if (opened.signature === 'invalid') {
+                throw new Error('недействительная подпись ключа отправителя');
+            }
+            const distribution = JSON.parse(opened.content);
+            const ref = `${data.sender}|${distribution.key_id}`;
+            if (!this.senderKeys.chains[ref]) {
+                this.senderKeys.chains[ref] = {
+                    iteration: distribution.iteration || 0,
+                    chain_key: distribution.chain_key
+                };
+                this.saveSenderKeys();
+            }
+            
+            // Сообщения, пришедшие раньше ключа, расшифровываются заново
+            const waiting = this.awaitingSenderKeys.get(ref) || [];
+            this.awaitingSenderKeys.delete(ref);
+            for (const message of waiting) {
+                const decrypted = await this.decryptGroup(message);
+                const id = this.isEditEvent(message) ? message.target : message.id;
+                const element = document.querySelector(`.message[data-id="${CSS.escape(id || '')}"]`);
+                if (element) {
+                    this.renderMessageContent(element, decrypted.content, { edited: Boolean(message.edited) || this.isEditEvent(message) });
                 }
-                break;
+            }
+        } catch (error) {
+            console.error('Ошибка получения ключа отправителя:', error);
         }
     }
     
-    async sendMessage() {
-        const input = document.getElementById('messageInput');
-        const content = input.value.trim();
+    // Состав группы изменился: следующее сообщение уйдет под новым ключом.
+    // Если сервер отклонил отправленное сообщение, оно шифруется заново.
+    async rotateSenderKey(data) {
+        const conversation = data.conversation || 'general';
+        this.groupEpochs[conversation] = data.epoch || 0;
+        if (!data.client_id) return;
         
-        if (!content || !this.isConnected) {
-            this.showNotification('Нет соединения с сервером', 'error');
+        const pending = this.pendingGroupSends.get(data.client_id);
+        this.pendingGroupSends.delete(data.client_id);
+        if (!pending) {
+            this.showNotification('Сообщение не отправлено: состав чата изменился', 'error');
             return;
         }
-        
-        const recipient = this.currentChat === 'general' ? 'all' : this.currentChat;
-        const messageType = recipient === 'all' ? 'general' : 'private';
-        
         try {
-            // Шифруем сообщение
-            const encrypted = await this.encryptMessage(content, recipient);
-            
-            const message = {
-                type: messageType,
-                content: encrypted.content,
-                recipient: recipient,
-                iv: encrypted.iv,
-                auth_tag: encrypted.tag
-            };
-            
+            const message = await this.sealMessage(data.client_id, pending.content, pending.recipient, pending);
             this.socket.send(JSON.stringify(message));
-            
-            // Показываем сообщение локально
-            this.createAndAppendMessage({
-                type: messageType,
-                sender: this.username,
-                content: content,
-                recipient: recipient,
-                timestamp: new Date().toISOString(),
-                isOwn: true
-            });
-            
-            input.value = '';
-            this.adjustTextareaHeight(input);
         } catch (error) {
-            console.error('Ошибка отправки сообщения:', error);
+            console.error('Ошибка повторной отправки:', error);
             this.showNotification('Ошибка отправки сообщения', 'error');
         }
     }
     
-    async encryptMessage(content, recipient) {
+    async decryptGroup(data) {
+        const ref = `${data.sender}|${data.key_id}`;
+        const conversation = data.room ? `room:${data.room}` : 'general';
+        if (!this.senderKeys.chains[ref]) {
+            const waiting = this.awaitingSenderKeys.get(ref) || [];
+            waiting.push(data);
+            this.awaitingSenderKeys.set(ref, waiting);
+            return { ...data, content: '🔒 Ожидается ключ отправителя', encrypted: true };
+        }
+        
         try {
-            // В реальном приложении здесь должно быть настоящее шифрование
-            const encoded = btoa(unescape(encodeURIComponent(content)));
-            const iv = this.generateRandomBytes(12);
+            const n = data.counter || 0;
+            const { key, iv } = await this.withSenderKeys(() => this.groupMessageKey(ref, n));
+            const ciphertext = this.base64ToBytes(data.content);
+            const tag = this.base64ToBytes(data.auth_tag);
+            const sealed = new Uint8Array(ciphertext.length + tag.length);
+            sealed.set(ciphertext);
+            sealed.set(tag, ciphertext.length);
             
-            return {
-                content: `🔐 ${encoded} [для: ${recipient}]`,
-                iv: btoa(iv),
-                tag: 'demo_tag'
-            };
+            const plaintext = await crypto.subtle.decrypt(
+                { name: 'AES-GCM', iv, additionalData: this.groupAD(data.sender, conversation, Number(data.key_id), n), tagLength: 128 },
+                key,
+                sealed
+            );
+            return { ...data, content: new TextDecoder().decode(plaintext), encrypted: true };
         } catch (error) {
-            console.error('Ошибка шифрования:', error);
-            return {
-                content: content,
-                iv: '',
-                tag: ''
-            };
+            console.error('Ошибка расшифровки группового сообщения:', error);
+            return { ...data, content: '🔒 Не удалось расшифровать сообщение', encrypted: true };
+        }
+    }
+    
+    // Ключ сообщения n выводится от начального состояния цепочки, поэтому
+    // история расшифровывается и повторно; пройденные ключи цепочки кэшируются
+    async groupMessageKey(ref, n) {
+        const start = this.senderKeys.chains[ref];
+        if (n < start.iteration || n - start.iteration > this.maxSenderKeySkip) {
+            throw new Error('номер сообщения вне цепочки');
+        }
+        let chain = this.chainCache.get(ref);
+        if (!chain) {
+            chain = [this.base64ToBytes(start.chain_key)];
+            this.chainCache.set(ref, chain);
+        }
+        while (chain.length <= n - start.iteration) {
+            chain.push(await this.chainStep(chain[chain.length - 1], 0x02));
         }
+        return this.groupCipher(await this.chainStep(chain[n - start.iteration], 0x01));
+    }
+    
+    async chainStep(chainKey, constant) {
+        const key = await crypto.subtle.importKey('raw', chainKey, { name: 'HMAC', hash: 'SHA-256' }, false, ['sign']);
+        return new Uint8Array(await crypto.subtle.sign('HMAC', key, new Uint8Array([constant])));
+    }
+    
+    async groupCipher(messageKey) {
+        const base = await crypto.subtle.importKey('raw', messageKey, 'HKDF', false, ['deriveBits']);
+        const bits = new Uint8Array(await crypto.subtle.deriveBits(
+            {
+                name: 'HKDF',
+                hash: 'SHA-256',
+                salt: new Uint8Array(0),
+                info: new TextEncoder().encode('secure-messenger/senderkey/v1/message')
+            },
+            base,
+            (32 + 12) * 8
+        ));
+        const key = await crypto.subtle.importKey('raw', bits.slice(0, 32), 'AES-GCM', false, ['encrypt', 'decrypt']);
+        return { key, iv: bits.slice(32) };
     }
     
-    generateRandomBytes(length) {
-        const array = new Uint8Array(length);
-        crypto.getRandomValues(array);
-        return String.fromCharCode.apply(null, array);
+    groupAD(sender, conversation, keyId, n) {
+        const prefix = new TextEncoder().encode(`${sender}->${conversation}`);
+        const ad = new Uint8Array(prefix.length + 8);
+        ad.set(prefix);
+        const header = new DataView(ad.buffer, prefix.length);
+        header.setUint32(0, keyId);
+        header.setUint32(4, n);
+        return ad;
+    }
+    
+    bytesToBase64(bytes) {
+        return btoa(String.fromCharCode(...new Uint8Array(bytes)));
+    }
+    
+    base64ToBytes(text) {
+        return Uint8Array.from(atob(text), ch => ch.charCodeAt(0));
     }
     
     createAndAppendMessage(data, scroll = true) {
@@ -454,19 +2489,14 @@ class SecureMessenger {
         
         const div = document.createElement('div');
         div.className = `message ${isOwn ? 'sent' : isSystem ? 'system' : 'received'}`;
+        if (data.id) div.dataset.id = data.id;
+        if (data.client_id) div.dataset.clientId = data.client_id;
+        if (data.recipient) div.dataset.recipient = data.recipient;
+        if (data.deleted) div.classList.add('deleted');
+        if ((data.mentions || []).includes(this.username)) div.classList.add('mentioned');
         
         let content = data.content || '';
-        let encrypted = false;
-        
-        if (content.startsWith('🔐 ')) {
-            encrypted = true;
-            const encoded = content.replace('🔐 ', '').split(' [для: ')[0];
-            try {
-                content = decodeURIComponent(escape(atob(encoded)));
-            } catch {
-                content = content.replace('🔐 ', '');
-            }
-        }
+        const encrypted = Boolean(data.encrypted);
         
         let senderName = data.sender;
         if (isSystem && data.type === 'user_joined') {
@@ -479,21 +2509,74 @@ class SecureMessenger {
         
         const encryptionBadge = encrypted ?
             '<span class="encryption-badge" title="Зашифровано"><i class="fas fa-lock"></i></span>' : '';
+        const signatureBadge = data.signature === 'valid' ?
+            '<span class="encryption-badge signature-badge" title="Подпись отправителя проверена"><i class="fas fa-signature"></i></span>' :
+            data.signature === 'invalid' ?
+            '<span class="encryption-badge signature-invalid" title="Подпись не сходится: сообщение могло быть подделано или изменено"><i class="fas fa-exclamation-triangle"></i></span>' : '';
+        
+        // Статус доставки собственных личных сообщений
+        let statusBadge = '';
+        if (isOwn && data.type === 'private') {
+            const receipt = (data.receipts || {})[data.recipient];
+            const status = this.isSet(receipt?.read_at) ? 'read' :
+                this.isSet(receipt?.delivered_at) ? 'delivered' : 'sent';
+            statusBadge = `<span class="message-status" data-id="${this.escapeHtml(data.id || '')}" data-status="${status}">${this.statusIcon(status)}</span>`;
+        }
+        
+        const contentHtml = data.deleted ?
+            '<i class="fas fa-ban"></i> Сообщение удалено' : this.escapeHtml(content);
+        const editedMark = data.edited && !data.deleted ? '<span class="edited-mark">изменено</span> ' : '';
+        
+        // Свои сообщения можно изменить или удалить, пока не истекло окно редактирования
+        const ownActions = isOwn ? `
+                <button title="Изменить" onclick="messenger.editMessage(this)"><i class="fas fa-pen"></i></button>
+                <button title="Удалить" onclick="messenger.deleteMessage(this)"><i class="fas fa-trash"></i></button>` : '';
+        // Ответить можно только в ветку корневого сообщения
+        const replyAction = !data.parent_id ? `
+                <button title="Ответить в ветке" onclick="messenger.openThread(this)"><i class="fas fa-reply"></i></button>` : '';
+        const actions = !isSystem && !data.deleted ? `
+            <span class="message-actions">
+                <button title="Реакция" onclick="messenger.showReactionPicker(this)"><i class="far fa-smile"></i></button>${replyAction}${ownActions}
+            </span>` : '';
+        if (data.id && data.reactions) {
+            this.reactions.set(data.id, data.reactions);
+        }
         
         div.innerHTML = `
             ${!isSystem && !isOwn && senderName ? `<div class="message-sender">${senderName}</div>` : ''}
             <div class="message-bubble">
-                <div class="message-content">${this.escapeHtml(content)}</div>
-                ${encryptionBadge}
+                <div class="message-content">${contentHtml}</div>
+                ${encryptionBadge}${signatureBadge}
             </div>
-            <div class="message-time">${time}</div>
+            <div class="message-reactions"></div>
+            <div class="message-time">${editedMark}${time} ${statusBadge}${actions}</div>
         `;
         
+        if (data.id) {
+            this.renderReactions(div, data.id);
+        }
+        if (this.isSet(data.expires_at)) {
+            this.markExpiring(div, data.expires_at);
+        }
+        if (data.attachments?.length && !data.deleted) {
+            div.dataset.attachments = JSON.stringify(data.attachments.map(({ id, hash, key }) => ({ id, hash, key })));
+            this.renderAttachments(div, data.attachments);
+        }
+        if (data.reply_count && !data.parent_id) {
+            const link = document.createElement('button');
+            link.className = 'thread-link';
+            link.dataset.count = data.reply_count;
+            link.innerHTML = `<i class="fas fa-comments"></i> ${this.repliesLabel(data.reply_count)}`;
+            link.onclick = () => this.openThread(link);
+            div.querySelector('.message-reactions').after(link);
+        }
+        
         return div;
     }
     
     updateUserList(users) {
         this.users = users;
+        this.checkKeyChanges(users);
         
         const participantCount = document.getElementById('participantCount');
         if (participantCount) {
@@ -627,6 +2710,7 @@ class SecureMessenger {
     selectChat(chatId) {
         this.currentChat = chatId;
         this.updateChatInterface();
+        this.markChatRead(chatId);
         this.hideModal('userListModal');
     }
     
@@ -660,24 +2744,242 @@ class SecureMessenger {
             );
             if (privateChat) privateChat.classList.add('active');
         }
+        this.updateExpiryLabel();
+        this.updateVerifiedBadge();
     }
     
     showEncryptionInfo() {
-        alert('🔐 Шифрование сообщений:\n\n• Сообщения шифруются с помощью AES-GCM\n• Только получатель может расшифровать сообщение\n• Сервер не видит содержимое сообщений\n• Используются уникальные ключи для каждой сессии');
+        alert('🔐 Шифрование сообщений:\n\n• Личные сообщения шифруются AES-256-GCM\n• Ключ диалога выводится из X25519 через HKDF-SHA256\n• Только получатель может расшифровать сообщение\n• Общий чат шифруется ключами отправителей, которые меняются при смене состава\n• Сервер видит лишь шифротекст и публичные ключи');
     }
     
     showSettings() {
         const modal = document.getElementById('settingsModal');
+        const toggle = document.getElementById('readReceiptsToggle');
+        if (toggle) {
+            toggle.checked = this.readReceipts;
+        }
         if (modal) {
             modal.style.display = 'flex';
         }
     }
     
-    regenerateKeys() {
+    async regenerateKeys() {
         if (confirm('Вы уверены, что хотите сгенерировать новые ключи шифрования?\nВсе предыдущие сообщения не смогут быть прочитаны.')) {
-            // Здесь должна быть реализация генерации новых ключей
-            this.showNotification('Новые ключи сгенерированы', 'success');
+            try {
+                await this.generateKeys();
+                await this.generateSigningKey();
+                // Прежние ключи отправителей раздавались под старым ключом
+                this.senderKeys.own = {};
+                this.saveSenderKeys();
+                if (this.isConnected) {
+                    this.socket.send(JSON.stringify({
+                        type: 'key_update',
+                        public_key: this.publicKey,
+                        signing_key: this.signingPublicKey
+                    }));
+                }
+                this.showNotification('Новые ключи сгенерированы', 'success');
+            } catch (error) {
+                console.error('Ошибка генерации ключей:', error);
+                this.showNotification('Ошибка генерации ключей', 'error');
+            }
+        }
+    }
+    
+    // Резервная копия ключей: записи localStorage шифруются AES-256-GCM
+    // ключом, выведенным из фразы восстановления Argon2id (в Web Worker,
+    // /static/argon2.js). Associated data привязывает копию к пользователю.
+    // Сервер хранит только шифротекст и параметры KDF.
+    async showKeyBackup(mode) {
+        this.backupMode = mode;
+        const restore = mode === 'restore';
+        const select = document.getElementById('backupVersion');
+        select.innerHTML = '';
+        
+        if (restore) {
+            try {
+                const response = await fetch('/api/key-backup', {
+                    headers: { 'X-Session-Token': this.sessionToken }
+                });
+                if (!response.ok) {
+                    throw new Error(await response.text());
+                }
+                const versions = await response.json();
+                if (versions.length === 0) {
+                    this.showNotification('Резервных копий нет', 'error');
+                    return;
+                }
+                for (const backup of versions) {
+                    const option = document.createElement('option');
+                    option.value = backup.version;
+                    option.textContent = `№${backup.version} от ${new Date(backup.created_at).toLocaleString()}`;
+                    select.appendChild(option);
+                }
+            } catch (error) {
+                console.error('Ошибка загрузки списка копий:', error);
+                this.showNotification('Ошибка загрузки списка копий', 'error');
+                return;
+            }
+        }
+        
+        document.getElementById('backupTitle').textContent = restore ? 'Восстановление ключей' : 'Резервная копия ключей';
+        document.getElementById('backupHint').textContent = restore
+            ? 'Ключи в этом браузере будут заменены ключами из копии. Число скачиваний копии ограничено.'
+            : `Придумайте фразу восстановления не короче ${this.minPassphraseLength} символов. Без нее копию не восстановить: сервер фразу не знает.`;
+        document.getElementById('backupVersionGroup').style.display = restore ? '' : 'none';
+        document.getElementById('backupConfirmGroup').style.display = restore ? 'none' : '';
+        document.getElementById('backupPassphrase').value = '';
+        document.getElementById('backupPassphraseConfirm').value = '';
+        this.hideModal('settingsModal');
+        document.getElementById('backupModal').style.display = 'flex';
+    }
+    
+    async submitKeyBackup() {
+        const passphrase = document.getElementById('backupPassphrase').value;
+        const button = document.getElementById('backupSubmit');
+        
+        if (this.backupMode === 'create') {
+            if (passphrase.length < this.minPassphraseLength) {
+                this.showNotification(`Фраза короче ${this.minPassphraseLength} символов`, 'error');
+                return;
+            }
+            if (passphrase !== document.getElementById('backupPassphraseConfirm').value) {
+                this.showNotification('Фразы не совпадают', 'error');
+                return;
+            }
+        }
+        
+        button.disabled = true;
+        try {
+            if (this.backupMode === 'create') {
+                await this.createKeyBackup(passphrase);
+            } else {
+                await this.restoreKeyBackup(passphrase, document.getElementById('backupVersion').value);
+            }
+        } finally {
+            button.disabled = false;
+        }
+    }
+    
+    async createKeyBackup(passphrase) {
+        try {
+            const items = {};
+            for (const name of this.backupItems) {
+                const value = localStorage.getItem(`${name}_${this.username}`);
+                if (value !== null) items[name] = value;
+            }
+            const plaintext = new TextEncoder().encode(JSON.stringify({ version: 1, items }));
+            
+            const kdf = { ...this.backupKdf, salt: this.bytesToBase64(crypto.getRandomValues(new Uint8Array(16))) };
+            const key = await this.deriveBackupKey(passphrase, kdf);
+            const nonce = crypto.getRandomValues(new Uint8Array(12));
+            const ciphertext = await crypto.subtle.encrypt(
+                { name: 'AES-GCM', iv: nonce, additionalData: this.backupAD() }, key, plaintext
+            );
+            
+            const response = await fetch('/api/key-backup', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-Session-Token': this.sessionToken
+                },
+                body: JSON.stringify({
+                    kdf,
+                    nonce: this.bytesToBase64(nonce),
+                    ciphertext: this.bytesToBase64(new Uint8Array(ciphertext))
+                })
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const stored = await response.json();
+            this.hideModal('backupModal');
+            this.showNotification(`Резервная копия №${stored.version} сохранена`, 'success');
+        } catch (error) {
+            console.error('Ошибка создания резервной копии:', error);
+            this.showNotification(`Ошибка создания резервной копии: ${error.message}`, 'error');
+        }
+    }
+    
+    async restoreKeyBackup(passphrase, version) {
+        let backup;
+        try {
+            const response = await fetch(`/api/key-backup/download?version=${encodeURIComponent(version)}`, {
+                headers: { 'X-Session-Token': this.sessionToken }
+            });
+            if (response.status === 429) {
+                const minutes = Math.ceil((parseInt(response.headers.get('Retry-After'), 10) || 60) / 60);
+                this.showNotification(`Слишком много попыток, повторите через ${minutes} мин.`, 'error');
+                return;
+            }
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            backup = await response.json();
+        } catch (error) {
+            console.error('Ошибка загрузки резервной копии:', error);
+            this.showNotification('Ошибка загрузки резервной копии', 'error');
+            return;
+        }
+        
+        let items;
+        try {
+            const key = await this.deriveBackupKey(passphrase, backup.kdf);
+            const plaintext = await crypto.subtle.decrypt(
+                { name: 'AES-GCM', iv: this.base64ToBytes(backup.nonce), additionalData: this.backupAD() },
+                key, this.base64ToBytes(backup.ciphertext)
+            );
+            items = JSON.parse(new TextDecoder().decode(plaintext)).items || {};
+        } catch (error) {
+            console.error('Ошибка расшифровки резервной копии:', error);
+            this.showNotification('Неверная фраза восстановления', 'error');
+            return;
         }
+        
+        if (!confirm('Заменить ключи в этом браузере ключами из резервной копии?')) return;
+        for (const name of this.backupItems) {
+            if (typeof items[name] === 'string') {
+                localStorage.setItem(`${name}_${this.username}`, items[name]);
+            } else {
+                localStorage.removeItem(`${name}_${this.username}`);
+            }
+        }
+        // Ключи загружаются при запуске и публикуются при подключении
+        location.reload();
+    }
+    
+    deriveBackupKey(passphrase, kdf) {
+        return new Promise((resolve, reject) => {
+            const worker = new Worker('/static/argon2.js');
+            worker.onmessage = async (event) => {
+                worker.terminate();
+                if (event.data.error) {
+                    reject(new Error(event.data.error));
+                    return;
+                }
+                try {
+                    resolve(await crypto.subtle.importKey('raw', event.data.key, 'AES-GCM', false, ['encrypt', 'decrypt']));
+                } catch (error) {
+                    reject(error);
+                }
+            };
+            worker.onerror = (event) => {
+                worker.terminate();
+                reject(new Error(event.message));
+            };
+            worker.postMessage({
+                password: new TextEncoder().encode(passphrase),
+                salt: this.base64ToBytes(kdf.salt),
+                time: kdf.time,
+                memory: kdf.memory,
+                threads: kdf.threads,
+                length: 32
+            });
+        });
+    }
+    
+    backupAD() {
+        return new TextEncoder().encode(`secure-messenger/key-backup/v1|${this.username}`);
     }
     
     hideModal(modalId) {
@@ -745,6 +3047,13 @@ class SecureMessenger {
     }
     
     setupEventListeners() {
+        // Сообщения открытого диалога считаются прочитанными, когда вкладка видима
+        document.addEventListener('visibilitychange', () => {
+            if (!document.hidden) {
+                this.markChatRead(this.currentChat);
+            }
+        });
+        
         const messageInput = document.getElementById('messageInput');
         if (messageInput) {
             messageInput.addEventListener('input', () => {
@@ -767,10 +3076,23 @@ class SecureMessenger {
             });
         }
         
+        const threadInput = document.getElementById('threadInput');
+        if (threadInput) {
+            threadInput.addEventListener('keydown', (e) => {
+                if (e.key === 'Enter' && !e.shiftKey) {
+                    e.preventDefault();
+                    this.sendThreadReply();
+                }
+            });
+        }
+        
         // Закрытие модальных окон при клике вне их
         document.addEventListener('click', (e) => {
             if (e.target.classList.contains('modal')) {
                 e.target.style.display = 'none';
+                if (e.target.id === 'threadModal') {
+                    this.openThreadRoot = null;
+                }
             }
         });
         